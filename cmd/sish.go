@@ -49,21 +49,34 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVarP(&configFile, "config", "c", "config.yml", "Config file")
 
-	rootCmd.PersistentFlags().StringP("ssh-address", "a", "localhost:2222", "The address to listen for SSH connections")
-	rootCmd.PersistentFlags().StringP("http-address", "i", "localhost:80", "The address to listen for HTTP connections")
-	rootCmd.PersistentFlags().StringP("https-address", "t", "localhost:443", "The address to listen for HTTPS connections")
+	rootCmd.PersistentFlags().StringP("ssh-address", "a", "localhost:2222", "The address to listen for SSH connections. Multiple addresses can be separated by commas")
+	rootCmd.PersistentFlags().StringP("http-address", "i", "localhost:80", "The address to listen for HTTP connections. Multiple addresses can be separated by commas")
+	rootCmd.PersistentFlags().StringP("https-address", "t", "localhost:443", "The address to listen for HTTPS connections. Multiple addresses can be separated by commas")
 	rootCmd.PersistentFlags().StringP("tcp-address", "", "", "The address to listen for TCP connections")
 	rootCmd.PersistentFlags().StringP("redirect-root-location", "r", "https://github.com/antoniomika/sish", "The location to redirect requests to the root domain\nto instead of responding with a 404")
 	rootCmd.PersistentFlags().StringP("https-certificate-directory", "s", "deploy/ssl/", "The directory containing HTTPS certificate files (name.crt and name.key). There can be many crt/key pairs")
+	rootCmd.PersistentFlags().StringP("tls-client-ca", "", "", "A PEM file of certificate authorities used to verify client certificates. When set, HTTPS and TLS alias connections must present a valid client certificate")
+	rootCmd.PersistentFlags().StringP("tls-min-version", "", "1.2", "The minimum TLS version (1.2 or 1.3) accepted for HTTPS and TLS alias connections")
+	rootCmd.PersistentFlags().StringP("tls-cipher-suites", "", "", "A comma separated list of TLS 1.2 cipher suites accepted for HTTPS and TLS alias connections, for example TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Uses the Go defaults if empty")
 	rootCmd.PersistentFlags().StringP("https-ondemand-certificate-email", "", "", "The email to use with Let's Encrypt for cert notifications. Can be left blank")
 	rootCmd.PersistentFlags().StringP("domain", "d", "ssi.sh", "The root domain for HTTP(S) multiplexing that will be appended to subdomains")
+	rootCmd.PersistentFlags().StringP("state-store", "", "memory", "Where reservations of reconnect tokens are persisted so sish instances can share them. One of memory or redis. redis requires building sish with -tags redis")
+	rootCmd.PersistentFlags().StringP("state-store-redis-url", "", "redis://localhost:6379/0", "The URL of the Redis server used by state-store=redis")
+	rootCmd.PersistentFlags().StringP("state-store-redis-prefix", "", "sish:", "The prefix of the keys stored by state-store=redis. Instances sharing reservations must use the same prefix")
+	rootCmd.PersistentFlags().StringP("client-env-allowlist", "", "", "A comma separated list of environment variable names clients can set with SetEnv or SendEnv, for example CI_BUILD_ID. Names ending with * match a prefix, like CI_*. No variables are accepted if empty")
 	rootCmd.PersistentFlags().StringP("banned-subdomains", "b", "localhost", "A comma separated list of banned subdomains that users are unable to bind")
 	rootCmd.PersistentFlags().StringP("banned-aliases", "", "", "A comma separated list of banned aliases that users are unable to bind")
 	rootCmd.PersistentFlags().StringP("banned-ips", "x", "", "A comma separated list of banned ips that are unable to access the service. Applies to HTTP, TCP, and SSH connections")
 	rootCmd.PersistentFlags().StringP("banned-countries", "o", "", "A comma separated list of banned countries. Applies to HTTP, TCP, and SSH connections")
 	rootCmd.PersistentFlags().StringP("whitelisted-ips", "w", "", "A comma separated list of whitelisted ips. Applies to HTTP, TCP, and SSH connections")
 	rootCmd.PersistentFlags().StringP("whitelisted-countries", "y", "", "A comma separated list of whitelisted countries. Applies to HTTP, TCP, and SSH connections")
+	rootCmd.PersistentFlags().StringP("banned-ja3-fingerprints", "", "", "A comma separated list of banned JA3 TLS fingerprints. Applies to TLS connections routed by SNI, TLS aliases and the HTTPS server")
+	rootCmd.PersistentFlags().StringP("whitelisted-ja3-fingerprints", "", "", "A comma separated list of whitelisted JA3 TLS fingerprints. Applies to TLS connections routed by SNI, TLS aliases and the HTTPS server")
+	rootCmd.PersistentFlags().StringP("allowed-countries", "", "", "A comma separated list of countries allowed to access forwards, resolved using --geoip-database. Applies to HTTP and TCP forwards")
+	rootCmd.PersistentFlags().StringP("blocked-countries", "", "", "A comma separated list of countries blocked from accessing forwards, resolved using --geoip-database. Applies to HTTP and TCP forwards")
+	rootCmd.PersistentFlags().StringP("geoip-database", "", "", "The path to a MaxMind country database (mmdb) used for --allowed-countries and --blocked-countries")
 	rootCmd.PersistentFlags().StringP("private-key-passphrase", "p", "S3Cr3tP4$$phrAsE", "Passphrase to use to encrypt the server private key")
+	rootCmd.PersistentFlags().StringP("bandwidth-quota-file", "", "", "The file used to persist the bandwidth used by each user across restarts. Usage is only kept in memory if empty")
 	rootCmd.PersistentFlags().StringP("private-keys-directory", "l", "deploy/keys", "The location of other SSH server private keys. sish will add these as valid auth methods for SSH. Note, these need to be unencrypted OR use the private-key-passphrase")
 	rootCmd.PersistentFlags().StringP("authentication-password", "u", "", "Password to use for SSH server password authentication")
 	rootCmd.PersistentFlags().StringP("authentication-keys-directory", "k", "deploy/pubkeys/", "Directory where public keys for public key authentication are stored.\nsish will watch this directory and automatically load new keys and remove keys\nfrom the authentication list")
@@ -71,13 +84,28 @@ func init() {
 	rootCmd.PersistentFlags().StringP("port-bind-range", "n", "0,1024-65535", "Ports or port ranges that sish will allow to be bound when a user attempts to use TCP forwarding")
 	rootCmd.PersistentFlags().StringP("proxy-protocol-version", "q", "1", "What version of the proxy protocol to use. Can either be 1, 2, or userdefined.\nIf userdefined, the user needs to add a command to SSH called proxyproto=version (ie proxyproto=1)")
 	rootCmd.PersistentFlags().StringP("proxy-protocol-policy", "", "use", "What to do with the proxy protocol header. Can be use, ignore, reject, or require")
+	rootCmd.PersistentFlags().StringP("http-auth-file", "", "", "A file of credentials required to access HTTP forwards. Each line contains a host and a username:secret or bearer:secret credential. Secrets can be plaintext, bcrypt hashes, or sha256:<hex> hashes")
+	rootCmd.PersistentFlags().StringP("admin-console-client-ca", "", "", "A PEM file of certificate authorities used to verify client certificates of admin console requests. Requests without a valid certificate are rejected with 403")
 	rootCmd.PersistentFlags().StringP("admin-console-token", "j", "", "The token to use for admin console access if it's enabled")
 	rootCmd.PersistentFlags().StringP("service-console-token", "m", "", "The token to use for service console access. Auto generated if empty for each connected tunnel")
 	rootCmd.PersistentFlags().StringP("append-user-to-subdomain-separator", "", "-", "The token to use for separating username and subdomain selection in a virtualhost")
 	rootCmd.PersistentFlags().StringP("time-format", "", "2006/01/02 - 15:04:05", "The time format to use for both HTTP and general log messages")
+	rootCmd.PersistentFlags().StringP("log-format", "", "text", "The format to write log output in. Can be one of (text, json)")
+	rootCmd.PersistentFlags().StringP("access-log-format", "", "common", "The format to write the HTTP access log in. Can be one of (common, json)")
 	rootCmd.PersistentFlags().StringP("log-to-file-path", "", "/tmp/sish.log", "The file to write log output to")
+	rootCmd.PersistentFlags().StringP("ip-anonymization", "", "none", "How client IPs are written to logs and access logs. Can be one of (none, truncate, hash). truncate keeps the /24 of IPv4 and the /48 of IPv6 addresses, hash writes a HMAC of the IP")
+	rootCmd.PersistentFlags().StringP("ip-anonymization-key", "", "", "The key used to hash client IPs with ip-anonymization set to hash. A random key is used for each run if empty")
+	rootCmd.PersistentFlags().StringP("ssh-connection-rate-limit-allowlist", "", "", "A comma separated list of IPs and CIDRs that are exempt from ssh-connection-rate-limit")
+	rootCmd.PersistentFlags().StringP("client-webhook-allowed-networks", "", "", "A comma separated list of IPs and CIDRs client webhooks can reach even though they are private or otherwise special purpose addresses")
 	rootCmd.PersistentFlags().StringP("bind-hosts", "", "", "A comma separated list of other hosts a user can bind. Requested hosts should be subdomains of a host in this list")
+	rootCmd.PersistentFlags().StringP("capture-directory", "", "deploy/captures", "The directory that captures of SSH connections started from the admin console are written to")
+	rootCmd.PersistentFlags().StringP("no-backend-page", "", "", "The path of an HTML page to serve for HTTP requests to hosts that have no available forward. sish's default error is returned if empty")
+	rootCmd.PersistentFlags().StringP("no-backend-pages-directory", "", "", "A directory of HTML pages named <host>.html to serve for HTTP requests to that host when it has no available forward, instead of no-backend-page")
+	rootCmd.PersistentFlags().StringP("no-backend-redirect", "", "", "A URL to redirect HTTP requests to hosts that have no available forward to, if there is no page to serve for the host")
 	rootCmd.PersistentFlags().StringP("load-templates-directory", "", "templates/*", "The directory and glob parameter for templates that should be loaded")
+	rootCmd.PersistentFlags().StringP("health-check-http-path", "", "", "The path to request when health checking HTTP forwards. If empty, a TCP connection is attempted instead")
+	rootCmd.PersistentFlags().StringP("shutdown-message", "", "This server is shutting down.", "The message sent to connected clients when sish is shutting down")
+	rootCmd.PersistentFlags().StringP("local-forward-unix-socket-directory", "", "", "The directory that local forwards to unix:/path/to/sock targets are allowed to connect to. Unix socket forwards are disabled if empty")
 	rootCmd.PersistentFlags().StringP("welcome-message", "", "Press Ctrl-C to close the session.", "Message displayed to users upon connection")
 
 	rootCmd.PersistentFlags().BoolP("force-requested-ports", "", false, "Force the ports used to be the one that is requested. Will fail the bind if it exists already")
@@ -95,22 +123,34 @@ func init() {
 	rootCmd.PersistentFlags().BoolP("debug", "", false, "Enable debugging information")
 	rootCmd.PersistentFlags().BoolP("ping-client", "", true, "Send ping requests to the underlying SSH client.\nThis is useful to ensure that SSH connections are kept open or close cleanly")
 	rootCmd.PersistentFlags().BoolP("geodb", "", false, "Use a geodb to verify country IP address association for IP filtering")
+	rootCmd.PersistentFlags().BoolP("geoip-fail-open", "", true, "Allow forwarded connections when the geoip database is unavailable or the address can not be resolved. If false, these connections are dropped")
 	rootCmd.PersistentFlags().BoolP("authentication", "", true, "Require authentication for the SSH service")
 	rootCmd.PersistentFlags().BoolP("proxy-protocol", "", false, "Use the proxy-protocol while proxying connections in order to pass-on IP address and port information")
+	rootCmd.PersistentFlags().BoolP("proxy-protocol-tlvs", "", false, "Include TLVs with the TLS server name, ALPN protocol, and TLS version in PROXY protocol v2 headers for SNI proxied connections")
 	rootCmd.PersistentFlags().BoolP("proxy-protocol-use-timeout", "", false, "Use a timeout for the proxy-protocol read")
 	rootCmd.PersistentFlags().BoolP("proxy-protocol-listener", "", false, "Use the proxy-protocol to resolve ip addresses from user connections")
+	rootCmd.PersistentFlags().StringP("proxy-protocol-listener-trusted-cidrs", "", "", "A comma separated list of upstream IPs and CIDRs to accept proxy-protocol headers from when proxy-protocol-listener is enabled. Connections from other upstreams that send headers are logged and rejected. All upstreams are trusted if empty")
+	rootCmd.PersistentFlags().StringP("proxy-protocol-listener-trusted-cidrs-file", "", "", "A file with upstream IPs and CIDRs to accept proxy-protocol headers from, one per line, in addition to proxy-protocol-listener-trusted-cidrs. Reloaded on SIGHUP")
+	rootCmd.PersistentFlags().BoolP("forwarded-headers", "", true, "Set the X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host, X-Forwarded-Port, X-Forwarded-Server and X-Real-IP headers on requests sent to HTTP forwards")
+	rootCmd.PersistentFlags().BoolP("forwarded-headers-trust", "", true, "Keep the forwarded headers sent by clients and append the client IP to their X-Forwarded-For. If false, they are overwritten using the client's connection")
 	rootCmd.PersistentFlags().BoolP("proxy-ssl-termination", "", false, "Whether sish is running behind an SSL-terminated reverse proxy\nIf true, the displayed HTTP URL will use `https://` despite running on port 80")
 	rootCmd.PersistentFlags().BoolP("https", "", false, "Listen for HTTPS connections. Requires a correct --https-certificate-directory")
 	rootCmd.PersistentFlags().BoolP("force-all-https", "", false, "Redirect all requests to the https server")
 	rootCmd.PersistentFlags().BoolP("force-https", "", false, "Allow indiviual binds to request for https to be enforced")
+	rootCmd.PersistentFlags().BoolP("force-https-hsts-include-subdomains", "", false, "Add includeSubDomains to the Strict-Transport-Security header sent for forwards that enforce https")
 	rootCmd.PersistentFlags().BoolP("redirect-root", "", true, "Redirect the root domain to the location defined in --redirect-root-location")
 	rootCmd.PersistentFlags().BoolP("admin-console", "", false, "Enable the admin console accessible at http(s)://domain/_sish/console?x-authorization=admin-console-token")
 	rootCmd.PersistentFlags().BoolP("service-console", "", false, "Enable the service console for each service and send the info to connected clients")
 	rootCmd.PersistentFlags().BoolP("tcp-aliases", "", false, "Enable the use of TCP aliasing")
+	rootCmd.PersistentFlags().BoolP("tcp-aliases-tls", "", false, "Allow TCP aliases to terminate TLS at sish using the HTTPS certificates. Requires --https")
+	rootCmd.PersistentFlags().StringP("tcp-aliases-mux-address", "", "", "The address to listen on for connections to TCP aliases that set tcp-alias-mux=true. Connections are routed by TLS server name or a routing hint. Disabled if empty")
 	rootCmd.PersistentFlags().BoolP("sni-proxy", "", false, "Enable the use of SNI proxying")
 	rootCmd.PersistentFlags().BoolP("sni-proxy-https", "", false, "Enable the use of SNI proxying on the HTTPS port")
+	rootCmd.PersistentFlags().BoolP("access-log", "", false, "Write a line to the log output for each HTTP request handled by sish, including the SSH connection that served it")
 	rootCmd.PersistentFlags().BoolP("log-to-client", "", false, "Enable logging HTTP and TCP requests to the client")
 	rootCmd.PersistentFlags().BoolP("idle-connection", "", true, "Enable connection idle timeouts for reads and writes")
+	rootCmd.PersistentFlags().BoolP("idle-websocket", "", false, "Enable WebSocket aware idle timeouts for HTTP forwards. Each WebSocket frame, including pings, resets the read and write timeouts")
+	rootCmd.PersistentFlags().BoolP("websocket-upgrade-validation", "", true, "Reject WebSocket upgrade requests to HTTP forwards with a 400 if they don't follow the WebSocket handshake. Disable for backends that use non-standard upgrades")
 	rootCmd.PersistentFlags().BoolP("http-load-balancer", "", false, "Enable the HTTP load balancer (multiple clients can bind the same domain)")
 	rootCmd.PersistentFlags().BoolP("tcp-load-balancer", "", false, "Enable the TCP load balancer (multiple clients can bind the same port)")
 	rootCmd.PersistentFlags().BoolP("sni-load-balancer", "", false, "Enable the SNI load balancer (multiple clients can bind the same SNI domain/port)")
@@ -119,6 +159,7 @@ func init() {
 	rootCmd.PersistentFlags().BoolP("log-to-stdout", "", true, "Enable writing log output to stdout")
 	rootCmd.PersistentFlags().BoolP("log-to-file", "", false, "Enable writing log output to file, specified by log-to-file-path")
 	rootCmd.PersistentFlags().BoolP("log-to-file-compress", "", false, "Enable compressing log output files")
+	rootCmd.PersistentFlags().BoolP("acme-enabled", "", false, "Answer ACME HTTP-01 challenges for hosts bound by clients with sish instead of forwarding them, and retrieve certificates for those hosts on demand via Let's Encrypt. Requires https")
 	rootCmd.PersistentFlags().BoolP("https-ondemand-certificate", "", false, "Enable retrieving certificates on demand via Let's Encrypt")
 	rootCmd.PersistentFlags().BoolP("https-ondemand-certificate-accept-terms", "", false, "Accept the Let's Encrypt terms")
 	rootCmd.PersistentFlags().BoolP("bind-http-auth", "", true, "Allow binding http auth on a forwarded host")
@@ -127,33 +168,117 @@ func init() {
 	rootCmd.PersistentFlags().BoolP("bind-any-host", "", false, "Allow binding any host when accepting an HTTP listener")
 	rootCmd.PersistentFlags().BoolP("bind-root-domain", "", false, "Allow binding the root domain when accepting an HTTP listener")
 	rootCmd.PersistentFlags().BoolP("bind-wildcards", "", false, "Allow binding wildcards when accepting an HTTP listener")
+	rootCmd.PersistentFlags().BoolP("bind-host-regexes", "", false, "Allow clients to route HTTP hosts matching a regex to their HTTP forwards with host-regex=<regex>. Exact and wildcard hosts take precedence")
 	rootCmd.PersistentFlags().BoolP("load-templates", "", true, "Load HTML templates. This is required for admin/service consoles")
-	rootCmd.PersistentFlags().BoolP("rewrite-host-header", "", true, "Force rewrite the host header if the user provides host-header=host.com")
+	rootCmd.PersistentFlags().BoolP("rewrite-host-header", "", true, "Force rewrite the host header if the user provides host-header=host.com or host-rewrite=regex:replacement")
+	rootCmd.PersistentFlags().BoolP("udp-forwards", "", false, "Allow users to forward UDP instead of TCP with udp=true. Datagrams are sent over the forward with a 2 byte length prefix")
+	rootCmd.PersistentFlags().BoolP("reconnect-tokens", "", false, "Allow clients to request a token with reconnect-token=true and reclaim the addresses of their forwards when reconnecting with reconnect-token=<token>")
+	rootCmd.PersistentFlags().BoolP("response-compression", "", false, "Allow users to gzip the HTTP responses of their forwards with compress=true when clients accept it")
+	rootCmd.PersistentFlags().BoolP("response-headers", "", false, "Allow users to add headers to the HTTP responses of their forwards with response-header=Name:Value")
+	rootCmd.PersistentFlags().BoolP("http-auth", "", false, "Allow users to require Basic or Bearer auth for their HTTP forwards with http-auth=username:secret or http-auth=bearer:secret. Secrets can be plaintext, bcrypt hashes, or sha256:<hex> hashes")
+	rootCmd.PersistentFlags().BoolP("http-auth-strip-header", "", false, "Remove the Authorization header from requests to HTTP forwards after their credentials are validated")
+	rootCmd.PersistentFlags().BoolP("http2-backends", "", false, "Send requests to HTTP forwards whose service supports HTTP/2 without TLS (h2c) as streams over a single forwarded connection. Other services use HTTP/1.1")
+	rootCmd.PersistentFlags().BoolP("sticky-sessions", "", false, "Use a cookie to send requests from the same browser to the same connection of a load balanced HTTP forward")
+	rootCmd.PersistentFlags().StringP("sticky-sessions-cookie-name", "", "sish_sticky", "The name of the cookie used for sticky sessions")
+	rootCmd.PersistentFlags().DurationP("sticky-sessions-cookie-ttl", "", 0, "How long sticky session cookies last. 0 uses a cookie that lasts until the browser is closed")
+	rootCmd.PersistentFlags().DurationP("force-https-hsts-max-age", "", 0, "The max-age of the Strict-Transport-Security header sent on https responses of forwards that enforce https. 0 doesn't send the header")
+	rootCmd.PersistentFlags().BoolP("metrics", "", false, "Serve Prometheus metrics on --metrics-address")
+	rootCmd.PersistentFlags().StringP("metrics-tls-certificate", "", "", "A PEM certificate file to serve metrics over HTTPS with. Requires --metrics-tls-key")
+	rootCmd.PersistentFlags().StringP("metrics-tls-key", "", "", "The PEM private key file of --metrics-tls-certificate")
+	rootCmd.PersistentFlags().StringP("metrics-client-ca", "", "", "A PEM file of certificate authorities used to verify client certificates of metrics requests. Requests without a valid certificate are rejected with 403. Requires --metrics-tls-certificate")
+	rootCmd.PersistentFlags().StringP("metrics-address", "", "localhost:9222", "The address to serve Prometheus metrics on at /metrics")
+	rootCmd.PersistentFlags().BoolP("health-check", "", false, "Enable active health checks of each forward. Unhealthy forwards are skipped by load balancers")
+	rootCmd.PersistentFlags().BoolP("capture", "", false, "Allow admins to capture the forwarded traffic of a single SSH connection to a pcap file with the admin console API")
+	rootCmd.PersistentFlags().BoolP("tcp-nodelay", "", true, "Disable Nagle's algorithm on the client connections of TCP forwards, the TCP alias multiplexer and TLS passthrough HTTPS forwards, which lowers latency for interactive traffic at the cost of sending more small packets. Connections can change it with tcp-nodelay=<true|false>")
+	rootCmd.PersistentFlags().BoolP("dscp-override", "", false, "Allow connections to set the DSCP value of their forwards with dscp=<value>")
+	rootCmd.PersistentFlags().BoolP("allow-client-webhooks", "", false, "Allow connections to post events for their forwarded connections to a URL with webhook=<url>")
+	rootCmd.PersistentFlags().BoolP("circuit-breaker", "", false, "Enable a circuit breaker for each SSH connection. Connections whose forwarded channels keep failing to open are skipped by load balancers for a cooldown")
 	rootCmd.PersistentFlags().BoolP("tcp-aliases-allowed-users", "", false, "Enable setting allowed users to access tcp aliases.\nCan provide tcp-aliases-allowed-users in the ssh command set to a comma separated list of ssh fingerprints that can access an alias.\nProvide `any` for all.")
 
+	rootCmd.PersistentFlags().IntP("copy-buffer-size", "", 32*1024, "The size in bytes of the buffer used in each direction when copying forwarded connections")
+	rootCmd.PersistentFlags().IntP("stall-sample-rate", "", 16, "Time one in every this many reads and writes of forwarded connections to estimate how long they are blocked on slow peers. 0 disables stall measurement")
 	rootCmd.PersistentFlags().IntP("http-port-override", "", 0, "The port to use for http command output. This does not affect ports used for connecting, it's for cosmetic use only")
 	rootCmd.PersistentFlags().IntP("https-port-override", "", 0, "The port to use for https command output. This does not affect ports used for connecting, it's for cosmetic use only")
 	rootCmd.PersistentFlags().IntP("http-request-port-override", "", 0, "The port to use for http requests. Will default to 80, then http-port-override. Otherwise will use this value")
 	rootCmd.PersistentFlags().IntP("https-request-port-override", "", 0, "The port to use for https requests. Will default to 443, then https-port-override. Otherwise will use this value")
+	rootCmd.PersistentFlags().IntP("force-https-redirect-status", "", 302, "The status code used to redirect http requests to the https server for forwards that enforce https. One of 301, 302, 307 or 308. Permanent redirects are cached by browsers")
 	rootCmd.PersistentFlags().IntP("bind-random-subdomains-length", "", 3, "The length of the random subdomain to generate if a subdomain is unavailable or if random subdomains are enforced")
 	rootCmd.PersistentFlags().IntP("bind-random-aliases-length", "", 3, "The length of the random alias to generate if a alias is unavailable or if random aliases are enforced")
 	rootCmd.PersistentFlags().IntP("log-to-file-max-size", "", 500, "The maximum size of outputed log files in megabytes")
 	rootCmd.PersistentFlags().IntP("log-to-file-max-backups", "", 3, "The maxium number of rotated logs files to keep")
 	rootCmd.PersistentFlags().IntP("log-to-file-max-age", "", 28, "The maxium number of days to store log output in a file")
 	rootCmd.PersistentFlags().IntP("service-console-max-content-length", "", -1, "The max content length before we stop reading the response body")
+	rootCmd.PersistentFlags().IntP("ssh-keepalive-max-failures", "", 3, "The number of consecutive failed SSH keepalive requests before a connection is closed")
+	rootCmd.PersistentFlags().IntP("health-check-unhealthy-threshold", "", 3, "The number of consecutive failed health checks before a forward is marked unhealthy")
+	rootCmd.PersistentFlags().IntP("health-check-healthy-threshold", "", 2, "The number of consecutive successful health checks before an unhealthy forward is marked healthy")
+	rootCmd.PersistentFlags().IntP("no-backend-status", "", 503, "The HTTP status code to serve no-backend-page and no-backend-pages-directory pages with")
+	rootCmd.PersistentFlags().IntP("dscp", "", 0, "The DSCP value (0-63) to mark the IP packets sent to clients of TCP forwards and TLS passthrough HTTPS forwards with. 0 leaves them unmarked")
+	rootCmd.PersistentFlags().IntP("circuit-breaker-threshold", "", 5, "The number of forwarded channels that fail to open within circuit-breaker-window before a connection's circuit opens")
+	rootCmd.PersistentFlags().IntP("tcp-aliases-pool-size", "", 0, "The number of forwarded channels to keep open ahead of time for each TCP alias forward, so connections to the alias don't wait for a channel to be opened. Disabled if 0")
+	rootCmd.PersistentFlags().IntP("message-retry-count", "", 5, "The number of times to retry sending a non-blocking console message before it is dropped. 0 tries sending it once")
+	rootCmd.PersistentFlags().IntP("max-connections-per-user", "", 0, "The maximum number of concurrent SSH connections per user (public key fingerprint or username). Users at the limit are rejected during authentication. 0 means unlimited")
+	rootCmd.PersistentFlags().IntP("max-host-regexes", "", 5, "The maximum number of host regexes a single SSH connection can add with host-regex=<regex>. 0 means unlimited")
+	rootCmd.PersistentFlags().IntP("max-listeners-per-connection", "", 0, "The maximum number of forwards a single SSH connection can have open. New forwards of the connection are rejected when it is reached. 0 means unlimited")
+	rootCmd.PersistentFlags().IntP("max-total-listeners", "", 0, "The maximum number of forwards that can be open across all SSH connections. New forwards are rejected when it is reached. 0 means unlimited")
+	rootCmd.PersistentFlags().IntP("max-concurrent-forwards", "", 0, "The maximum number of connections each forward handles at once. Excess connections wait for a free slot. 0 means unlimited")
+	rootCmd.PersistentFlags().IntP("max-retries", "", 0, "The number of times an idempotent HTTP request is retried on another healthy backend of the same host if its backend fails before sending a response. 0 means disabled")
+	rootCmd.PersistentFlags().Int64P("max-request-body-size", "", 0, "The maximum size in bytes of request bodies sent to HTTP forwards. Larger requests are rejected with 413. Connections can lower it with max-request-body-size=<bytes>. 0 means unlimited")
+	rootCmd.PersistentFlags().IntP("info-max-streams", "", 100, "The maximum number of forwarded connections to include in the reply to an info@sish request, ordered by most recent activity. 0 means unlimited")
+	rootCmd.PersistentFlags().IntP("max-bandwidth-per-connection", "", 0, "The maximum bandwidth in bytes per second for each direction of a forwarded connection. 0 means unlimited")
+	rootCmd.PersistentFlags().IntP("max-bandwidth-total", "", 0, "The maximum bandwidth in bytes per second for each direction shared by all forwarded connections. Connections of keys with a higher priority are served first. 0 means unlimited")
+	rootCmd.PersistentFlags().IntP("max-bandwidth-burst", "", 0, "The burst size in bytes allowed by the bandwidth limiter. Uses max-bandwidth-per-connection if 0")
+	rootCmd.PersistentFlags().IntP("ssh-connection-rate-limit", "", 0, "The number of SSH connections each source IP can open per ssh-connection-rate-limit-window before being authenticated. Excess connections are closed when accepted. 0 means unlimited")
+	rootCmd.PersistentFlags().IntP("multiprotocol-port", "", 0, "A port on tcp-address that accepts HTTP, TLS and raw TCP connections. HTTP and TLS connections are served like connections to http-address and https-address, others go to the TCP forward bound to this port. 0 means disabled")
+	rootCmd.PersistentFlags().Int64P("max-request-header-size", "", 1<<20, "The maximum size in bytes of request headers sent to HTTP forwards. Larger requests are rejected with 431. Connections can lower it with max-request-header-size=<bytes>. 0 means unlimited")
+	rootCmd.PersistentFlags().Int64P("http-request-rate-limit", "", 0, "The number of requests per second each HTTP forward can receive. Requests over the limit are rejected with 429. Connections can lower it with max-request-rate=<requests>. 0 means unlimited")
+	rootCmd.PersistentFlags().Int64P("http-request-rate-limit-burst", "", 0, "The number of requests a HTTP forward can receive at once before http-request-rate-limit applies. 0 uses the rate limit")
+	rootCmd.PersistentFlags().IntP("client-webhook-rate-limit", "", 10, "The number of opened events per second each connection can post to its webhook. Events over the limit are dropped. 0 means unlimited")
+	rootCmd.PersistentFlags().Int64P("capture-max-size", "", 10*1024*1024, "The maximum size in bytes of a capture file. Captures stop once they reach it")
+	rootCmd.PersistentFlags().Int64P("bandwidth-quota", "", 0, "The maximum number of bytes a user's connections can forward in each quota period. New forwards are rejected once it is used. 0 means unlimited")
 
 	rootCmd.PersistentFlags().DurationP("debug-interval", "", 2*time.Second, "Duration to wait between each debug loop output if debug is true")
 	rootCmd.PersistentFlags().DurationP("idle-connection-timeout", "", 5*time.Second, "Duration to wait for activity before closing a connection for all reads and writes")
+	rootCmd.PersistentFlags().DurationP("idle-connection-max-timeout", "", 0, "The longest idle timeout connections can request for their forwarded connections with idle-timeout=<duration>. Longer requests are capped. 0 means connections can't change their idle timeout")
+	rootCmd.PersistentFlags().DurationP("idle-read-timeout", "", 0, "Duration to wait for read activity before closing a connection. Uses idle-connection-timeout if 0")
+	rootCmd.PersistentFlags().DurationP("idle-write-timeout", "", 0, "Duration to wait for write activity before closing a connection. Uses idle-connection-timeout if 0")
 	rootCmd.PersistentFlags().DurationP("ping-client-interval", "", 5*time.Second, "Duration representing an interval to ping a client to ensure it is up")
 	rootCmd.PersistentFlags().DurationP("ping-client-timeout", "", 5*time.Second, "Duration to wait for activity before closing a connection after sending a ping to a client")
+	rootCmd.PersistentFlags().DurationP("ssh-keepalive-interval", "", 0, "Duration between SSH keepalive requests sent to each client. Disabled if 0")
+	rootCmd.PersistentFlags().DurationP("health-check-interval", "", 10*time.Second, "Duration between health checks of each forward")
+	rootCmd.PersistentFlags().DurationP("health-check-timeout", "", 2*time.Second, "Duration to wait for a response to an HTTP health check")
+	rootCmd.PersistentFlags().DurationP("capture-max-duration", "", 5*time.Minute, "The maximum duration a capture runs for. Captures stop once it passes")
+	rootCmd.PersistentFlags().DurationP("circuit-breaker-window", "", 30*time.Second, "Duration in which circuit-breaker-threshold failures open a connection's circuit")
+	rootCmd.PersistentFlags().DurationP("circuit-breaker-cooldown", "", 30*time.Second, "Duration a connection is skipped by load balancers after its circuit opens, before it half-opens to test recovery")
+	rootCmd.PersistentFlags().DurationP("tcp-aliases-pool-idle-timeout", "", 30*time.Second, "Duration a pooled TCP alias channel can stay unused before it is replaced with a new one. Never replaced if 0")
+	rootCmd.PersistentFlags().DurationP("close-linger", "", 0, "Duration to keep copying the other direction of a forwarded connection after one side finishes sending, instead of closing both sides at once. Disabled if 0")
+	rootCmd.PersistentFlags().DurationP("message-retry-interval", "", 100*time.Millisecond, "Duration to wait before the first retry of sending a non-blocking console message. The wait doubles with each retry and is jittered")
+	rootCmd.PersistentFlags().DurationP("message-retry-max-interval", "", 1*time.Second, "The maximum duration to wait between retries of sending a non-blocking console message")
+	rootCmd.PersistentFlags().DurationP("shutdown-timeout", "", 5*time.Second, "Duration to wait for connections to close when sish is shutting down")
+	rootCmd.PersistentFlags().DurationP("teardown-hook-timeout", "", 5*time.Second, "Duration to wait for teardown hooks to finish after a SSH connection is closed")
+	rootCmd.PersistentFlags().DurationP("max-concurrent-forwards-timeout", "", 10*time.Second, "Duration a connection waits for a free slot when --max-concurrent-forwards is reached before it is closed. 0 waits indefinitely")
 	rootCmd.PersistentFlags().DurationP("cleanup-unauthed-timeout", "", 5*time.Second, "Duration to wait before cleaning up an unauthed connection")
 	rootCmd.PersistentFlags().DurationP("cleanup-unbound-timeout", "", 5*time.Second, "Duration to wait before cleaning up an unbound (unforwarded) connection")
+	rootCmd.PersistentFlags().DurationP("max-connection-duration-hard", "", 0, "The maximum duration a forwarded connection can stay open, however active it is. It is set once when the connection starts and is independent of --max-connection-lifetime. 0 means unlimited")
+	rootCmd.PersistentFlags().DurationP("max-connection-lifetime", "", 0, "The maximum duration a SSH connection can stay open. Clients are warned when it is reached and disconnected after --max-connection-lifetime-grace. 0 means unlimited")
+	rootCmd.PersistentFlags().DurationP("max-connection-lifetime-grace", "", 30*time.Second, "Duration to wait after warning a client that its connection reached --max-connection-lifetime before closing it")
+	rootCmd.PersistentFlags().DurationP("reap-idle-after", "", 0, "Clean up SSH connections that have not forwarded any data for this duration, even if keepalives have not closed them. 0 means disabled")
+	rootCmd.PersistentFlags().DurationP("reap-interval", "", 1*time.Minute, "How often to check for SSH connections idle longer than --reap-idle-after")
+	rootCmd.PersistentFlags().DurationP("udp-session-timeout", "", 30*time.Second, "Duration without datagrams in either direction before the forwarded connection of a UDP client is closed")
+	rootCmd.PersistentFlags().DurationP("bandwidth-quota-reset-interval", "", 0, "Duration of each bandwidth quota period. 0 resets quotas at the start of every month in UTC")
+	rootCmd.PersistentFlags().DurationP("bandwidth-quota-save-interval", "", 1*time.Minute, "How often to add the bytes forwarded by active connections to their user's bandwidth quota and save it")
+	rootCmd.PersistentFlags().DurationP("reconnect-token-ttl", "", 5*time.Minute, "Duration the addresses of a closed SSH connection stay reserved for a client reconnecting with its reconnect token")
+	rootCmd.PersistentFlags().DurationP("state-store-sync-interval", "", 30*time.Second, "Duration between refreshing the reservations of connected clients in the state-store and loading the reservations of other instances. Should be shorter than reconnect-token-ttl")
+	rootCmd.PersistentFlags().DurationP("state-store-timeout", "", 5*time.Second, "Duration to wait for each request to the state-store")
+	rootCmd.PersistentFlags().DurationP("tls-peek-timeout", "", 10*time.Second, "The duration to wait for the TLS hello of connections routed by SNI. 0 waits indefinitely")
 	rootCmd.PersistentFlags().DurationP("proxy-protocol-timeout", "", 200*time.Millisecond, "The duration to wait for the proxy proto header")
 	rootCmd.PersistentFlags().DurationP("authentication-keys-directory-watch-interval", "", 200*time.Millisecond, "The interval to poll for filesystem changes for SSH keys")
 	rootCmd.PersistentFlags().DurationP("https-certificate-directory-watch-interval", "", 200*time.Millisecond, "The interval to poll for filesystem changes for HTTPS certificates")
 	rootCmd.PersistentFlags().DurationP("authentication-key-request-timeout", "", 5*time.Second, "Duration to wait for a response from the authentication key request")
 	rootCmd.PersistentFlags().StringP("authentication-password-request-url", "", "", "A url to validate passwords for password-based authentication.\nsish will make an HTTP POST request to this URL with a JSON body containing\nthe provided password, username, and ip address. E.g.:\n{\"password\": string, \"user\": string, \"remote_addr\": string}\nA response with status code 200 indicates approval of the password")
 	rootCmd.PersistentFlags().DurationP("authentication-password-request-timeout", "", 5*time.Second, "Duration to wait for a response from the authentication password request")
+	rootCmd.PersistentFlags().DurationP("ssh-connection-rate-limit-window", "", 1*time.Minute, "The window ssh-connection-rate-limit applies to. Each source IP regains its full limit after a window without connections")
+	rootCmd.PersistentFlags().DurationP("multiprotocol-sniff-timeout", "", 500*time.Millisecond, "The duration to wait for the first bytes of a connection to multiprotocol-port. Connections that send nothing in time go to the TCP forward. 0 waits indefinitely")
+	rootCmd.PersistentFlags().DurationP("client-webhook-timeout", "", 5*time.Second, "The duration to wait for a client webhook to respond to an event")
 }
 
 // initConfig initializes the configuration and loads needed
@@ -200,17 +325,26 @@ func initConfig() {
 		log.SetFlags(0)
 		log.SetOutput(utils.LogWriter{
 			TimeFmt:     viper.GetString("time-format"),
+			Format:      viper.GetString("log-format"),
 			MultiWriter: multiWriter,
 		})
 
 		if viper.GetBool("debug") {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
+
+		if viper.GetBool("proxy-protocol-listener") {
+			_, err := utils.ReloadProxyProtoTrustedCIDRs()
+			if err != nil {
+				log.Println("Error reloading proxy protocol trusted cidrs:", err)
+			}
+		}
 	})
 
 	log.SetFlags(0)
 	log.SetOutput(utils.LogWriter{
 		TimeFmt:     viper.GetString("time-format"),
+		Format:      viper.GetString("log-format"),
 		MultiWriter: multiWriter,
 	})
 
@@ -6,16 +6,20 @@ package httpmuxer
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/antoniomika/sish/utils"
@@ -29,6 +33,10 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
+// clientCertSubjectHeader is the header used to send the subject of a verified
+// client certificate to HTTP backends.
+const clientCertSubjectHeader = "X-Client-Cert-Subject"
+
 // Start initializes the HTTP service.
 func Start(state *utils.State) {
 	releaseMode := gin.ReleaseMode
@@ -39,6 +47,15 @@ func Start(state *utils.State) {
 	gin.DefaultWriter = state.LogWriter
 	gin.ForceConsoleColor()
 
+	if viper.GetBool("access-log") && state.AccessLogger == nil {
+		accessLogger, err := utils.NewAccessLogger(viper.GetString("access-log-format"), state.LogWriter)
+		if err != nil {
+			log.Fatalln("Error starting access log:", err)
+		}
+
+		state.AccessLogger = accessLogger
+	}
+
 	r := gin.New()
 
 	if viper.GetBool("load-templates") {
@@ -51,9 +68,9 @@ func Start(state *utils.State) {
 
 		// Here is where we check whether or not an IP is blocked.
 		clientIPAddr, _, err := net.SplitHostPort(c.Request.RemoteAddr)
-		clientIPAddrBlocked := state.IPFilter.Blocked(clientIPAddr)
+		clientIPAddrBlocked := state.IPFilter.Blocked(clientIPAddr) || state.GeoIPFilter.Blocked(clientIPAddr)
 		cClientIP := c.ClientIP()
-		cClientIPBlocked := state.IPFilter.Blocked(cClientIP)
+		cClientIPBlocked := state.IPFilter.Blocked(cClientIP) || state.GeoIPFilter.Blocked(cClientIP)
 
 		if clientIPAddrBlocked || cClientIPBlocked || err != nil {
 			status := http.StatusForbidden
@@ -61,10 +78,10 @@ func Start(state *utils.State) {
 			if viper.GetBool("debug") {
 				log.Println("Aborting with status", status)
 				if clientIPAddrBlocked {
-					log.Println("Blocked:", clientIPAddr)
+					log.Println("Blocked:", utils.LogIP(clientIPAddr))
 				}
 				if cClientIPBlocked {
-					log.Println("Blocked:", cClientIP)
+					log.Println("Blocked:", utils.LogIP(cClientIP))
 				}
 			}
 			return
@@ -84,22 +101,14 @@ func Start(state *utils.State) {
 			param.Latency = param.Latency - param.Latency%time.Second
 		}
 
-		originalURI := param.Keys["originalURI"].(string)
-
-		if viper.GetString("admin-console-token") != "" && strings.Contains(originalURI, viper.GetString("admin-console-token")) {
-			originalURI = strings.Replace(originalURI, viper.GetString("admin-console-token"), "[REDACTED]", 1)
-		}
-
-		if viper.GetString("service-console-token") != "" && strings.Contains(originalURI, viper.GetString("service-console-token")) {
-			originalURI = strings.Replace(originalURI, viper.GetString("service-console-token"), "[REDACTED]", 1)
-		}
+		originalURI := redactConsoleTokens(param.Keys["originalURI"].(string))
 
 		logLine := fmt.Sprintf("%v | %s |%s %3d %s| %13v | %15s |%s %-7s %s %s\n%s",
 			param.TimeStamp.Format(viper.GetString("time-format")),
 			param.Request.Host,
 			statusColor, param.StatusCode, resetColor,
 			param.Latency,
-			param.ClientIP,
+			utils.LogIP(param.ClientIP),
 			methodColor, param.Method, resetColor,
 			originalURI,
 			param.ErrorMessage,
@@ -146,7 +155,7 @@ func Start(state *utils.State) {
 		}
 
 		return logLine
-	}), gin.Recovery(), func(c *gin.Context) {
+	}), accessLog(state), gin.Recovery(), func(c *gin.Context) {
 		c.Set("originalURI", c.Request.RequestURI)
 		c.Set("originalPath", c.Request.URL.Path)
 		c.Set("originalRawPath", c.Request.URL.RawPath)
@@ -163,61 +172,17 @@ func Start(state *utils.State) {
 		hostIsRoot := hostname == viper.GetString("domain")
 
 		if viper.GetBool("admin-console") && hostIsRoot && strings.HasPrefix(c.Request.URL.Path, "/_sish/") {
+			if !state.AdminClientCerts.Verified(c.Request.TLS) {
+				c.AbortWithStatus(http.StatusForbidden)
+				return
+			}
+
 			state.Console.HandleRequest("", hostIsRoot, c)
 			return
 		}
 
-		var currentListener *utils.HTTPHolder
-
 		requestUsername, requestPassword, _ := c.Request.BasicAuth()
-		authNeeded := true
-
-		// Loop for checking if there's a listener with auth set (most specific)
-		state.HTTPListeners.Range(func(key string, locationListener *utils.HTTPHolder) bool {
-			parsedPassword, _ := locationListener.HTTPUrl.User.Password()
-
-			if hostname == locationListener.HTTPUrl.Host && strings.HasPrefix(c.Request.URL.Path, locationListener.HTTPUrl.Path) {
-				credsNeeded := locationListener.HTTPUrl.User.Username() != "" && parsedPassword != ""
-				credsMatch := requestUsername == locationListener.HTTPUrl.User.Username() && requestPassword == parsedPassword
-
-				if credsNeeded {
-					currentListener = locationListener
-
-					if credsMatch {
-						authNeeded = false
-						return false
-					}
-				}
-			}
-
-			return true
-		})
-
-		// Loop for checking if there's a listener with the exact host and path prefix set (next most specific)
-		if currentListener == nil {
-			state.HTTPListeners.Range(func(key string, locationListener *utils.HTTPHolder) bool {
-				if hostname == locationListener.HTTPUrl.Host && strings.HasPrefix(c.Request.URL.Path, locationListener.HTTPUrl.Path) {
-					currentListener = locationListener
-					authNeeded = false
-					return false
-				}
-
-				return true
-			})
-		}
-
-		// Loop for checking if there's a wildcard listener with the host and path prefix set (least most specific)
-		if currentListener == nil {
-			state.HTTPListeners.Range(func(key string, locationListener *utils.HTTPHolder) bool {
-				if utils.MatchesWildcardHost(hostname, locationListener.HTTPUrl.Host) && strings.HasPrefix(c.Request.URL.Path, locationListener.HTTPUrl.Path) {
-					currentListener = locationListener
-					authNeeded = false
-					return false
-				}
-
-				return true
-			})
-		}
+		currentListener, authNeeded := state.FindHTTPHolder(hostname, c.Request.URL.Path, requestUsername, requestPassword)
 
 		if currentListener == nil && hostIsRoot {
 			if viper.GetBool("redirect-root") && !strings.HasPrefix(c.Request.URL.Path, "/favicon.ico") {
@@ -234,6 +199,11 @@ func Start(state *utils.State) {
 		}
 
 		if currentListener == nil {
+			if utils.ServeNoBackend(c.Writer, c.Request, hostname) {
+				c.Abort()
+				return
+			}
+
 			err := c.AbortWithError(http.StatusNotFound, fmt.Errorf("cannot find connection for host: %s", hostname))
 			if err != nil {
 				log.Println("Aborting with error", err)
@@ -253,6 +223,8 @@ func Start(state *utils.State) {
 			return
 		}
 
+		utils.SetForwardedHeaders(c.Request)
+
 		stripPath := viper.GetBool("strip-http-path")
 		forceHTTPS := viper.GetBool("force-all-https")
 
@@ -265,7 +237,12 @@ func Start(state *utils.State) {
 			}
 
 			if newHost == "" {
-				return true
+				rewrittenHost, ok := utils.RewriteHost(hostname, sshConn.HostRewrites)
+				if !ok {
+					return true
+				}
+
+				newHost = rewrittenHost
 			}
 
 			if len(hostSplit) > 1 {
@@ -276,15 +253,16 @@ func Start(state *utils.State) {
 			return false
 		})
 
-		if forceHTTPS && c.Request.TLS == nil && viper.GetBool("https") {
-			c.Request.URL.Scheme = "https"
-			c.Request.URL.Host = hostname
-			if state.Ports.HTTPSPort != 443 {
-				c.Request.URL.Host = fmt.Sprintf("%s:%d", hostname, state.Ports.HTTPSPort)
+		if forceHTTPS && viper.GetBool("https") {
+			if redirectURL, ok := utils.HTTPSRedirectURL(c.Request, hostname, state.Ports.HTTPSPort); ok {
+				c.Redirect(utils.HTTPSRedirectStatus(), redirectURL)
+				c.Abort()
+				return
 			}
 
-			c.Redirect(http.StatusFound, c.Request.URL.String())
-			return
+			if c.Request.TLS != nil {
+				c.Set("hstsHeader", utils.HSTSHeader())
+			}
 		}
 
 		if viper.GetBool("strip-http-path") && stripPath {
@@ -310,11 +288,68 @@ func Start(state *utils.State) {
 			})
 		}
 
+		c.Request.Header.Del(clientCertSubjectHeader)
+		if c.Request.TLS != nil && len(c.Request.TLS.VerifiedChains) > 0 {
+			c.Request.Header.Set(clientCertSubjectHeader, c.Request.TLS.VerifiedChains[0][0].Subject.String())
+		}
+
 		if (viper.GetBool("admin-console") || viper.GetBool("service-console")) && strings.HasPrefix(c.Request.URL.Path, "/_sish/") {
 			state.Console.HandleRequest(currentListener.HTTPUrl.String(), hostIsRoot, c)
 			return
 		}
 
+		if auth := state.HTTPAuthFor(currentListener); auth != nil {
+			if !auth.Authorized(c.Request) {
+				for _, challenge := range auth.Challenges() {
+					c.Writer.Header().Add("WWW-Authenticate", challenge)
+				}
+
+				status := http.StatusUnauthorized
+				c.AbortWithStatus(status)
+				if viper.GetBool("debug") {
+					log.Println("Aborting with status", status)
+				}
+				return
+			}
+
+			if viper.GetBool("http-auth-strip-header") {
+				c.Request.Header.Del("Authorization")
+			}
+		}
+
+		if viper.GetBool("websocket-upgrade-validation") {
+			err := utils.ValidateWebSocketUpgrade(c.Request)
+			if err != nil {
+				status := http.StatusBadRequest
+				c.Header("Connection", "close")
+				c.String(status, "Invalid upgrade request: %s\n", err)
+				c.Abort()
+				if viper.GetBool("debug") {
+					log.Println("Aborting with status", status, "invalid upgrade request:", err)
+				}
+				return
+			}
+		}
+
+		if !utils.LimitRequestHeaders(c.Writer, c.Request, currentListener.RequestHeaderLimit()) {
+			c.Abort()
+			return
+		}
+
+		if allowed, wait := state.RequestRateLimiter.Allow(currentListener); !allowed {
+			status := http.StatusTooManyRequests
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			c.AbortWithStatus(status)
+			if viper.GetBool("debug") {
+				log.Println("Aborting with status", status, "request rate limit exceeded")
+			}
+			return
+		}
+
+		if !limitRequestBody(c, currentListener.RequestBodyLimit()) {
+			return
+		}
+
 		var err error
 		var reqBody []byte
 
@@ -328,6 +363,9 @@ func Start(state *utils.State) {
 
 		if reqBody != nil {
 			c.Request.Body = io.NopCloser(bytes.NewBuffer(reqBody))
+			c.Request.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(reqBody)), nil
+			}
 		} else {
 			reqBody = []byte("{\"_sish_status\": false, \"_sish_message\": \"request body size exceeds limit for service console\"}")
 		}
@@ -337,10 +375,18 @@ func Start(state *utils.State) {
 			log.Println("Unable to set response modifier:", err)
 		}
 
+		if !currentListener.HasBackend() && utils.ServeNoBackend(c.Writer, c.Request, hostname) {
+			c.Abort()
+			return
+		}
+
+		c.Request = c.Request.WithContext(utils.WithForwardedAddrs(c.Request))
+
 		gin.WrapH(currentListener.Balancer)(c)
 	})
 
 	var acmeIssuer *certmagic.ACMEIssuer = nil
+	var httpsSNIHolder *utils.TCPHolder
 
 	// If HTTPS is enabled, setup certmagic to allow us to provision HTTPS certs on the fly.
 	// You can use sish without a wildcard cert, but you really should. If you get a lot of clients
@@ -361,24 +407,11 @@ func Start(state *utils.State) {
 
 		certManager.OnDemand = &certmagic.OnDemandConfig{
 			DecisionFunc: func(ctx context.Context, name string) error {
-				if !viper.GetBool("https-ondemand-certificate") {
+				if !viper.GetBool("https-ondemand-certificate") && !viper.GetBool("acme-enabled") {
 					return fmt.Errorf("ondemand certificate retrieval is not enabled")
 				}
 
-				ok := name == viper.GetString("domain")
-
-				if !ok {
-					state.HTTPListeners.Range(func(key string, locationListener *utils.HTTPHolder) bool {
-						if name == locationListener.HTTPUrl.Host || utils.MatchesWildcardHost(name, locationListener.HTTPUrl.Host) {
-							ok = true
-							return false
-						}
-
-						return true
-					})
-				}
-
-				if !ok {
+				if !state.CertificateHostAllowed(name) {
 					return fmt.Errorf("cannot find connection for host: %s", name)
 				}
 
@@ -389,23 +422,93 @@ func Start(state *utils.State) {
 
 		utils.WatchCerts(certManager)
 
+		aliasTLSConfig := certManager.TLSConfig()
+
+		err := utils.ConfigureTLSBaseline(aliasTLSConfig)
+		if err != nil {
+			log.Fatal("Invalid TLS configuration:", err)
+		}
+
+		err = utils.ConfigureClientAuth(aliasTLSConfig)
+		if err != nil {
+			log.Fatal("Unable to load client certificate authorities:", err)
+		}
+
+		state.SetTLSConfig(aliasTLSConfig)
+
 		tlsConfig := certManager.TLSConfig()
 		tlsConfig.NextProtos = append([]string{"h2", "http/1.1"}, tlsConfig.NextProtos...)
 
+		err = utils.ConfigureTLSBaseline(tlsConfig)
+		if err != nil {
+			log.Fatal("Invalid TLS configuration:", err)
+		}
+
+		err = utils.ConfigureClientAuth(tlsConfig)
+		if err != nil {
+			log.Fatal("Unable to load client certificate authorities:", err)
+		}
+
+		// Ask clients of the root domain for a certificate so admin console
+		// requests can be verified. Other hosts are unaffected.
+		if state.AdminClientCerts != nil {
+			rootTLSConfig := utils.RootDomainTLSConfig(tlsConfig)
+
+			tlsConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				if strings.EqualFold(hello.ServerName, viper.GetString("domain")) {
+					return rootTLSConfig, nil
+				}
+
+				return nil, nil
+			}
+		}
+
 		httpsServer := &http.Server{
-			Addr:      viper.GetString("https-address"),
-			TLSConfig: tlsConfig,
-			Handler:   r,
+			Addr:           viper.GetString("https-address"),
+			TLSConfig:      tlsConfig,
+			Handler:        r,
+			MaxHeaderBytes: utils.MaxHeaderBytes(),
 		}
 
-		go func() {
-			// We'll replace this with a custom listener
-			// That listener will then check the hostname of the request and choose the connection to send it to
-			portListener, err := utils.Listen(httpsServer.Addr)
+		// We'll replace this with a custom listener
+		// That listener will then check the hostname of the request and choose the connection to send it to
+		portListeners, err := utils.ListenEach(httpsServer.Addr)
+		if err != nil {
+			log.Fatalf("couldn't listen to %q: %q\n", httpsServer.Addr, err.Error())
+		}
+
+		var tH *utils.TCPHolder
+
+		if viper.GetBool("sni-proxy-https") {
+			tH = &utils.TCPHolder{
+				TCPHost:        httpsServer.Addr,
+				SSHConnections: syncmap.New[string, *utils.SSHConnection](),
+				Balancers:      syncmap.New[string, *roundrobin.RoundRobin](),
+				SNIProxy:       true,
+				NoHandle:       true,
+			}
+
+			balancer, err := roundrobin.New(nil)
+			if err != nil {
+				log.Fatal("Error initializing tcp balancer:", err)
+			}
+
+			err = balancer.UpsertServer(&url.URL{
+				Host: base64.StdEncoding.EncodeToString([]byte("_sish_https_root")),
+			})
+
 			if err != nil {
-				log.Fatalf("couldn't listen to %q: %q\n", httpsServer.Addr, err.Error())
+				log.Fatal("Error upserting empty balancer:", err)
 			}
 
+			tH.Balancers.Store("", balancer)
+
+			httpsSNIHolder = tH
+		}
+
+		httpsListeners := []net.Listener{}
+
+		for _, portListener := range portListeners {
 			pListener := portListener
 
 			if viper.GetBool("proxy-protocol-listener") {
@@ -419,32 +522,7 @@ func Start(state *utils.State) {
 
 			httpsListener := pListener
 
-			var tH *utils.TCPHolder
-
-			if viper.GetBool("sni-proxy-https") {
-				tH = &utils.TCPHolder{
-					TCPHost:        httpsServer.Addr,
-					SSHConnections: syncmap.New[string, *utils.SSHConnection](),
-					Balancers:      syncmap.New[string, *roundrobin.RoundRobin](),
-					SNIProxy:       true,
-					NoHandle:       true,
-				}
-
-				balancer, err := roundrobin.New(nil)
-				if err != nil {
-					log.Fatal("Error initializing tcp balancer:", err)
-				}
-
-				err = balancer.UpsertServer(&url.URL{
-					Host: base64.StdEncoding.EncodeToString([]byte("_sish_https_root")),
-				})
-
-				if err != nil {
-					log.Fatal("Error upserting empty balancer:", err)
-				}
-
-				tH.Balancers.Store("", balancer)
-
+			if tH != nil || utils.JA3FilterEnabled() {
 				httpsListener = &proxyListener{
 					Listener: pListener,
 					Holder:   tH,
@@ -452,56 +530,193 @@ func Start(state *utils.State) {
 				}
 			}
 
-			if tH != nil {
+			// Forwards only need the port of the holder's listener,
+			// which is the same on every address.
+			if tH != nil && tH.Listener == nil {
 				tH.Listener = httpsListener
-
-				state.Listeners.Store(httpsServer.Addr, httpsListener)
-				state.TCPListeners.Store(httpsServer.Addr, tH)
 			}
 
-			defer func() {
-				err := httpsListener.Close()
-				if err != nil {
-					log.Println("Error closing https listener:", err)
+			state.Listeners.Store(portListener.Addr().String(), httpsListener)
+			httpsListeners = append(httpsListeners, httpsListener)
+		}
+
+		if state.MultiProtocol != nil && state.MultiProtocol.HTTPS != nil {
+			var multiProtocolListener net.Listener = state.MultiProtocol.HTTPS
+
+			if tH != nil || utils.JA3FilterEnabled() {
+				multiProtocolListener = &proxyListener{
+					Listener: multiProtocolListener,
+					Holder:   tH,
+					State:    state,
 				}
-			}()
+			}
 
-			log.Fatal(httpsServer.ServeTLS(httpsListener, "", ""))
-		}()
+			httpsListeners = append(httpsListeners, multiProtocolListener)
+		}
+
+		if tH != nil {
+			state.TCPListeners.Store(httpsServer.Addr, tH)
+		}
+
+		go serveListeners("https", httpsListeners, func(l net.Listener) error {
+			return httpsServer.ServeTLS(l, "", "")
+		})
 	}
 
 	httpServer := &http.Server{
-		Addr:    viper.GetString("http-address"),
-		Handler: r,
+		Addr:           viper.GetString("http-address"),
+		Handler:        r,
+		MaxHeaderBytes: utils.MaxHeaderBytes(),
 	}
 	if acmeIssuer != nil {
-		httpServer.Handler = acmeIssuer.HTTPChallengeHandler(r)
+		httpServer.Handler = acmeChallengeHandler(acmeIssuer, httpsSNIHolder, state, r)
 	}
 
-	var httpListener net.Listener
-
-	l, err := utils.Listen(httpServer.Addr)
+	portListeners, err := utils.ListenEach(httpServer.Addr)
 	if err != nil {
 		log.Fatalf("couldn't listen to %q: %q\n", httpServer.Addr, err.Error())
 	}
 
-	if viper.GetBool("proxy-protocol-listener") {
-		hListener := &proxyproto.Listener{
-			Listener: l,
+	httpListeners := []net.Listener{}
+
+	for _, l := range portListeners {
+		httpListener := l
+
+		if viper.GetBool("proxy-protocol-listener") {
+			hListener := &proxyproto.Listener{
+				Listener: l,
+			}
+
+			utils.LoadProxyProtoConfig(hListener)
+			httpListener = hListener
 		}
 
-		utils.LoadProxyProtoConfig(hListener)
-		httpListener = hListener
-	} else {
-		httpListener = l
+		state.Listeners.Store(l.Addr().String(), httpListener)
+		httpListeners = append(httpListeners, httpListener)
 	}
 
-	defer func() {
-		err := httpListener.Close()
-		if err != nil {
-			log.Println("Error closing http listener:", err)
+	if state.MultiProtocol != nil {
+		httpListeners = append(httpListeners, state.MultiProtocol.HTTP)
+	}
+
+	serveListeners("http", httpListeners, httpServer.Serve)
+}
+
+// serveListeners serves each listener with serve in its own goroutine. It
+// returns once every listener has been closed, and exits if any of them fail.
+func serveListeners(name string, listeners []net.Listener, serve func(net.Listener) error) {
+	var wg sync.WaitGroup
+
+	for _, l := range listeners {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			defer func() {
+				err := l.Close()
+				if err != nil && !utils.ListenerClosed(err) {
+					log.Printf("Error closing %s listener: %s", name, err)
+				}
+			}()
+
+			err := serve(l)
+			if err != nil && !utils.ListenerClosed(err) {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// acmeChallengeHandler answers ACME HTTP-01 challenges with issuer and hands
+// other requests to next. If acme-enabled is set, challenges for hosts sish
+// can issue certificates for are never forwarded, so clients can't answer
+// them for a domain that sish terminates TLS for. Hosts that are
+// SNI proxied on the https port terminate TLS themselves and keep receiving
+// their challenges.
+func acmeChallengeHandler(issuer *certmagic.ACMEIssuer, sniHolder *utils.TCPHolder, state *utils.State, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if issuer.HandleHTTPChallenge(w, r) {
+			return
+		}
+
+		if viper.GetBool("acme-enabled") && strings.HasPrefix(r.URL.Path, utils.ACMEChallengePath) {
+			host := strings.ToLower(strings.Split(r.Host, ":")[0])
+
+			sniProxied := false
+			if sniHolder != nil {
+				_, sniProxied = sniHolder.Balancers.Load(host)
+			}
+
+			if !sniProxied && state.CertificateHostAllowed(host) {
+				if viper.GetBool("debug") {
+					log.Println("Not forwarding ACME challenge for host:", host)
+				}
+
+				http.NotFound(w, r)
+				return
+			}
 		}
-	}()
 
-	log.Fatal(httpServer.Serve(httpListener))
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redactConsoleTokens replaces the console tokens in uri so they aren't
+// logged.
+func redactConsoleTokens(uri string) string {
+	if viper.GetString("admin-console-token") != "" && strings.Contains(uri, viper.GetString("admin-console-token")) {
+		uri = strings.Replace(uri, viper.GetString("admin-console-token"), "[REDACTED]", 1)
+	}
+
+	if viper.GetString("service-console-token") != "" && strings.Contains(uri, viper.GetString("service-console-token")) {
+		uri = strings.Replace(uri, viper.GetString("service-console-token"), "[REDACTED]", 1)
+	}
+
+	return uri
+}
+
+// accessLog returns a handler that calls the state's access logger after each
+// request completes.
+func accessLog(state *utils.State) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if state.AccessLogger == nil {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+
+		c.Next()
+
+		var connectionID string
+		var env map[string]string
+		if currentListener, ok := c.Keys["httpHolder"].(*utils.HTTPHolder); ok && currentListener != nil {
+			if sshConn, ok := currentListener.SSHConnections.Load(c.GetString("proxySocket")); ok {
+				connectionID = utils.LogAddr(sshConn.SSHConn.RemoteAddr())
+				env = sshConn.GetEnv()
+			}
+		}
+
+		bytes := c.Writer.Size()
+		if bytes < 0 {
+			bytes = 0
+		}
+
+		state.AccessLogger.LogAccess(utils.AccessLogEntry{
+			Time:         start,
+			ClientIP:     utils.LogIP(c.ClientIP()),
+			Method:       c.Request.Method,
+			Host:         c.Request.Host,
+			Path:         redactConsoleTokens(c.GetString("originalURI")),
+			Proto:        c.Request.Proto,
+			Status:       c.Writer.Status(),
+			Bytes:        bytes,
+			Duration:     time.Since(start),
+			ConnectionID: connectionID,
+			Env:          env,
+		})
+	}
 }
@@ -2,13 +2,14 @@ package httpmuxer
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"os"
 
 	"github.com/antoniomika/sish/utils"
 	"github.com/spf13/viper"
-	"github.com/vulcand/oxy/roundrobin"
 )
 
 type proxyListener struct {
@@ -25,21 +26,34 @@ func (pL *proxyListener) Accept() (net.Conn, error) {
 
 	clientRemote, _, err := net.SplitHostPort(cl.RemoteAddr().String())
 
-	if err != nil || pL.State.IPFilter.Blocked(clientRemote) {
+	if err != nil || pL.State.IPFilter.Blocked(clientRemote) || pL.State.GeoIPFilter.Blocked(clientRemote) {
 		err := cl.Close()
 		if err != nil {
 			log.Println("Error closing connection:", err)
 		}
 
 		if viper.GetBool("debug") {
-			log.Printf("Blocked connection from %s to %s", cl.RemoteAddr().String(), cl.LocalAddr().String())
+			log.Printf("Blocked connection from %s to %s", utils.LogAddr(cl.RemoteAddr()), cl.LocalAddr().String())
 		}
 
 		return pL.Accept()
 	}
 
-	tlsHello, teeConn, _ := utils.PeekTLSHello(cl)
-	if tlsHello == nil {
+	tlsHello, teeConn, err := utils.PeekTLSHello(cl)
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, utils.ErrJA3Blocked) {
+		if errors.Is(err, utils.ErrJA3Blocked) {
+			log.Printf("Rejected connection from %s: %s", utils.LogAddr(cl.RemoteAddr()), err)
+		}
+
+		err := cl.Close()
+		if err != nil {
+			log.Println("Error closing connection:", err)
+		}
+
+		return pL.Accept()
+	}
+
+	if tlsHello == nil || pL.Holder == nil {
 		return teeConn, nil
 	}
 
@@ -48,19 +62,9 @@ func (pL *proxyListener) Accept() (net.Conn, error) {
 		return teeConn, nil
 	}
 
-	balancer, ok := pL.Holder.Balancers.Load(balancerName)
+	balancer, ok := pL.Holder.SNIRoute(balancerName, tlsHello.SupportedProtos...)
 	if !ok {
-		pL.Holder.Balancers.Range(func(n string, b *roundrobin.RoundRobin) bool {
-			if utils.MatchesWildcardHost(balancerName, n) {
-				balancer = b
-				return false
-			}
-			return true
-		})
-
-		if balancer == nil {
-			return teeConn, nil
-		}
+		return teeConn, nil
 	}
 
 	connectionLocation, err := balancer.NextServer()
@@ -89,7 +93,18 @@ func (pL *proxyListener) Accept() (net.Conn, error) {
 
 	hostAddr := string(host)
 
-	logLine := fmt.Sprintf("Accepted connection from %s -> %s", teeConn.RemoteAddr().String(), teeConn.LocalAddr().String())
+	if !pL.Holder.ServerNameAllowed(hostAddr, balancerName) {
+		log.Printf("Rejected connection from %s: server name %s is not allowed for %s", utils.LogAddr(teeConn.RemoteAddr()), balancerName, hostAddr)
+
+		err := teeConn.Close()
+		if err != nil {
+			log.Println("Error closing teeConn:", err)
+		}
+
+		return pL.Accept()
+	}
+
+	logLine := fmt.Sprintf("Accepted connection from %s -> %s with ja3 %s", utils.LogAddr(teeConn.RemoteAddr()), teeConn.LocalAddr().String(), teeConn.JA3)
 	log.Println(logLine)
 
 	if viper.GetBool("log-to-client") {
@@ -108,6 +123,10 @@ func (pL *proxyListener) Accept() (net.Conn, error) {
 		})
 	}
 
+	forwardConn, _ := pL.Holder.SSHConnections.Load(hostAddr)
+	utils.MarkDSCP(teeConn, forwardConn)
+	utils.ApplyNoDelay(teeConn, forwardConn)
+
 	conn, err := net.Dial("unix", hostAddr)
 	if err != nil {
 		log.Println("Error connecting to tcp balancer:", err)
@@ -120,7 +139,19 @@ func (pL *proxyListener) Accept() (net.Conn, error) {
 		return pL.Accept()
 	}
 
-	go utils.CopyBoth(conn, teeConn)
+	err = utils.WriteForwardedHeader(conn, teeConn, utils.ProxyProtoTLVs(tlsHello))
+	if err != nil {
+		log.Println("Unable to write forwarded header:", err)
+
+		err := teeConn.Close()
+		if err != nil {
+			log.Println("Error closing teeConn:", err)
+		}
+
+		return pL.Accept()
+	}
+
+	go utils.CopyBoth(conn, teeConn.ReplayConn(), nil)
 
 	return pL.Accept()
 }
@@ -3,6 +3,7 @@ package httpmuxer
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"io"
@@ -10,8 +11,10 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/antoniomika/sish/utils"
+	"github.com/antoniomika/syncmap"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/viper"
 )
@@ -19,13 +22,28 @@ import (
 // RoundTripper returns the specific handler for unix connections. This
 // will allow us to use our created sockets cleanly.
 func RoundTripper() *http.Transport {
-	dialer := func(network, addr string) (net.Conn, error) {
+	dialer := func(ctx context.Context, network, addr string) (net.Conn, error) {
 		realAddr, err := base64.StdEncoding.DecodeString(strings.Split(addr, ":")[0])
 		if err != nil {
 			log.Println("Unable to parse socket:", err)
 		}
 
-		return net.Dial("unix", string(realAddr))
+		conn, err := net.Dial("unix", string(realAddr))
+		if err != nil {
+			return nil, err
+		}
+
+		// The addresses of the client are sent to the listener, so forwards
+		// with a PROXY protocol version can send them to their backend.
+		if source, dest, ok := utils.ForwardedAddrs(ctx); ok {
+			err = utils.WriteForwardedAddrs(conn, source, dest, nil)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+
+		return conn, nil
 	}
 
 	tlsConfig := &tls.Config{
@@ -33,16 +51,182 @@ func RoundTripper() *http.Transport {
 	}
 
 	return &http.Transport{
-		Dial:            dialer,
+		DialContext:     dialer,
 		TLSClientConfig: tlsConfig,
 	}
 }
 
+// http2ProbeTimeout is how long to wait for a backend to answer the HTTP/2
+// connection preface before falling back to HTTP/1.1.
+const http2ProbeTimeout = 5 * time.Second
+
+// http2ClientPreface is the HTTP/2 connection preface followed by an empty
+// SETTINGS frame.
+var http2ClientPreface = append([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"), 0, 0, 0, 0x4, 0, 0, 0, 0, 0)
+
+// http2Backends caches whether each backend, by the host of its balancer
+// server URL, supports h2c. Entries are removed with their listeners by
+// RemoveHTTP2Backend.
+var http2Backends = syncmap.New[string, bool]()
+
+// http2FallbackTransport sends requests to HTTP backends that support
+// HTTP/2 without TLS (h2c) as streams over a single forwarded connection.
+// Requests to other backends use the HTTP/1.1 transport.
+type http2FallbackTransport struct {
+	http1 *http.Transport
+	http2 *http.Transport
+}
+
+// HTTP2RoundTripper returns a round tripper that multiplexes requests to
+// backends speaking h2c over one forwarded connection per backend. Whether a
+// backend speaks h2c is probed once, and backends that don't use rT.
+func HTTP2RoundTripper(rT *http.Transport) http.RoundTripper {
+	protocols := &http.Protocols{}
+	protocols.SetUnencryptedHTTP2(true)
+
+	return &http2FallbackTransport{
+		http1: rT,
+		http2: &http.Transport{
+			DialContext: rT.DialContext,
+			Protocols:   protocols,
+		},
+	}
+}
+
+// RemoveHTTP2Backend forgets whether the backend at host supports h2c. It is
+// called when the backend's listener is removed, so a new listener reusing
+// its address is probed again.
+func RemoveHTTP2Backend(host string) {
+	http2Backends.Delete(host)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *http2FallbackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" && !req.Close && t.supportsHTTP2(req.URL.Host) {
+		return t.http2.RoundTrip(req)
+	}
+
+	return t.http1.RoundTrip(req)
+}
+
+// supportsHTTP2 returns whether the backend answers the HTTP/2 connection
+// preface with a SETTINGS frame. The result is cached per backend.
+func (t *http2FallbackTransport) supportsHTTP2(host string) bool {
+	supported, ok := http2Backends.Load(host)
+	if ok {
+		return supported
+	}
+
+	conn, err := t.http1.DialContext(context.Background(), "tcp", host)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+
+	err = conn.SetDeadline(time.Now().Add(http2ProbeTimeout))
+	if err != nil {
+		return false
+	}
+
+	_, err = conn.Write(http2ClientPreface)
+	if err != nil {
+		return false
+	}
+
+	frameHeader := make([]byte, 9)
+	_, err = io.ReadFull(conn, frameHeader)
+
+	supported = err == nil && frameHeader[3] == 0x4 && frameHeader[4]&0x1 == 0
+	http2Backends.Store(host, supported)
+
+	if viper.GetBool("debug") {
+		log.Printf("HTTP/2 support for backend %s: %t", host, supported)
+	}
+
+	return supported
+}
+
+// addResponseHeaders adds the response headers requested by the SSH connection
+// that served the response.
+func addResponseHeaders(response *http.Response, currentListener *utils.HTTPHolder) {
+	sshConn, ok := responseConnection(response, currentListener)
+	if !ok {
+		return
+	}
+
+	for name, values := range sshConn.ResponseHeaders {
+		response.Header[name] = append([]string{}, values...)
+	}
+}
+
+// responseConnection returns the SSH connection that served the response.
+func responseConnection(response *http.Response, currentListener *utils.HTTPHolder) (*utils.SSHConnection, bool) {
+	hostLocation, err := base64.StdEncoding.DecodeString(response.Request.URL.Host)
+	if err != nil {
+		log.Println("Error loading proxy info from request", err)
+		return nil, false
+	}
+
+	return currentListener.SSHConnections.Load(string(hostLocation))
+}
+
+// limitRequestBody aborts the request with 413 if its body is larger than
+// limit bytes. Requests without a content length are read up to the limit
+// before being forwarded, so chunked bodies are rejected before the forward
+// sees them. It returns whether or not the request can be forwarded.
+func limitRequestBody(c *gin.Context, limit int64) bool {
+	if limit <= 0 || c.Request.Body == nil || c.Request.Body == http.NoBody {
+		return true
+	}
+
+	tooLarge := c.Request.ContentLength > limit
+
+	if c.Request.ContentLength == -1 {
+		reqBody, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+		if err != nil {
+			log.Println("Error reading request body:", err)
+			c.AbortWithStatus(http.StatusBadRequest)
+			return false
+		}
+
+		tooLarge = int64(len(reqBody)) > limit
+		c.Request.Body = io.NopCloser(bytes.NewReader(reqBody))
+	}
+
+	if tooLarge {
+		c.Header("Connection", "close")
+		c.AbortWithStatus(http.StatusRequestEntityTooLarge)
+		if viper.GetBool("debug") {
+			log.Println("Aborting with status", http.StatusRequestEntityTooLarge)
+		}
+		return false
+	}
+
+	return true
+}
+
 // ResponseModifier implements a response modifier for the specified request.
 // We don't actually modify any requests, but we do want to record the request
 // so we can send it to the web console.
 func ResponseModifier(state *utils.State, hostname string, reqBody []byte, c *gin.Context, currentListener *utils.HTTPHolder) func(*http.Response) error {
 	return func(response *http.Response) error {
+		if viper.GetBool("response-headers") && response.Request != nil {
+			addResponseHeaders(response, currentListener)
+		}
+
+		if hsts := c.GetString("hstsHeader"); hsts != "" && response.Header.Get("Strict-Transport-Security") == "" {
+			response.Header.Set("Strict-Transport-Security", hsts)
+		}
+
+		if response.Request != nil {
+			hostLocation, err := base64.StdEncoding.DecodeString(response.Request.URL.Host)
+			if err != nil {
+				log.Println("Error loading proxy info from request", err)
+			}
+
+			c.Set("proxySocket", string(hostLocation))
+		}
+
 		if viper.GetBool("admin-console") || viper.GetBool("service-console") {
 			var err error
 			var resBody []byte
@@ -91,19 +275,17 @@ func ResponseModifier(state *utils.State, hostname string, reqBody []byte, c *gi
 				"responseBody":       base64.StdEncoding.EncodeToString(resBody),
 			}
 
-			if response.Request != nil {
-				hostLocation, err := base64.StdEncoding.DecodeString(response.Request.URL.Host)
-				if err != nil {
-					log.Println("Error loading proxy info from request", err)
-				}
-
-				c.Set("proxySocket", string(hostLocation))
-			}
-
 			c.Set("broadcastRoute", currentListener.HTTPUrl.String())
 			c.Set("broadcastData", data)
 		}
 
+		if viper.GetBool("response-compression") && response.Request != nil {
+			sshConn, ok := responseConnection(response, currentListener)
+			if ok && sshConn.CompressResponses {
+				utils.CompressResponse(response, c.Request.Header.Get("Accept-Encoding"))
+			}
+		}
+
 		return nil
 	}
 }
@@ -35,6 +35,8 @@ func handleAliasListener(check *channelForwardMsg, stringPort string, requestMes
 			AliasHost:      validAlias,
 			SSHConnections: syncmap.New[string, *utils.SSHConnection](),
 			Balancer:       lb,
+			TLS:            sshConn.TCPAliasTLS,
+			Mux:            sshConn.TCPAliasMux,
 		}
 
 		state.AliasListeners.Store(validAlias, aH)
@@ -46,13 +48,25 @@ func handleAliasListener(check *channelForwardMsg, stringPort string, requestMes
 		Host: base64.StdEncoding.EncodeToString([]byte(listenerHolder.Addr().String())),
 	}
 
-	err := aH.Balancer.UpsertServer(serverURL)
+	err := aH.Balancer.UpsertServer(serverURL, roundrobin.Weight(sshConn.BalancerWeight()))
 	if err != nil {
 		log.Println("Unable to add server to balancer")
 	}
 
-	requestMessages += fmt.Sprintf("%s: %s\r\n", aurora.BgBlue("TCP Alias"), validAlias)
-	log.Printf("%s forwarding started: %s -> %s for client: %s\n", aurora.BgBlue("TCP Alias"), validAlias, listenerHolder.Addr().String(), sshConn.SSHConn.RemoteAddr().String())
+	connType := "TCP Alias"
+	if aH.TLS {
+		connType = "TLS Alias"
+	}
+
+	requestMessages += fmt.Sprintf("%s: %s\r\n", aurora.BgBlue(connType), validAlias)
+
+	if aH.Mux {
+		requestMessages += fmt.Sprintf("%s: %s (%s)\r\n", aurora.BgBlue("Multiplexed"), viper.GetString("tcp-aliases-mux-address"), validAlias)
+	}
+	listenerHolder.AddAddress(fmt.Sprintf("alias://%s", validAlias))
+	log.Printf("%s forwarding started: %s -> %s for client: %s\n", aurora.BgBlue(connType), validAlias, listenerHolder.Addr().String(), utils.LogAddr(sshConn.SSHConn.RemoteAddr()))
+
+	state.AddReservedForward(sshConn, utils.ReservedAlias, fmt.Sprintf("%s:%s", strings.ToLower(check.Addr), stringPort), validAlias)
 
 	return aH, serverURL, validAlias, requestMessages, nil
 }
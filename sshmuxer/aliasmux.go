@@ -0,0 +1,216 @@
+package sshmuxer
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/antoniomika/sish/utils"
+	"github.com/pires/go-proxyproto"
+	"github.com/spf13/viper"
+)
+
+// aliasMuxRouteTimeout is how long a client of the TCP alias multiplexer has
+// to send its TLS hello or routing hint.
+const aliasMuxRouteTimeout = 10 * time.Second
+
+// startAliasMux listens on tcp-aliases-mux-address and sends each connection
+// to the TCP alias named by its TLS server name or routing hint.
+func startAliasMux(state *utils.State) {
+	listeners, err := utils.ListenEach(viper.GetString("tcp-aliases-mux-address"))
+	if err != nil {
+		log.Fatalln("Error starting TCP alias multiplexer:", err)
+	}
+
+	log.Println("Starting TCP alias multiplexer on address:", viper.GetString("tcp-aliases-mux-address"))
+
+	for _, lis := range listeners {
+		var l net.Listener = lis
+
+		if viper.GetBool("proxy-protocol-listener") {
+			ln := &proxyproto.Listener{
+				Listener: lis,
+			}
+
+			utils.LoadProxyProtoConfig(ln)
+			l = ln
+		}
+
+		state.Listeners.Store(lis.Addr().String(), l)
+
+		go func() {
+			for {
+				cl, err := l.Accept()
+				if err != nil {
+					if !utils.ListenerClosed(err) {
+						log.Println("Error accepting TCP alias multiplexer connection:", err)
+					}
+					break
+				}
+
+				go handleAliasMuxConn(cl, state)
+			}
+		}()
+	}
+}
+
+// handleAliasMuxConn routes a connection to the TCP alias multiplexer. TLS
+// connections are routed by server name and replayed to the alias. Other
+// connections must start with a routing hint, which is removed before the
+// connection is forwarded.
+func handleAliasMuxConn(cl net.Conn, state *utils.State) {
+	clientRemote, _, err := net.SplitHostPort(cl.RemoteAddr().String())
+	if err != nil || state.IPFilter.Blocked(clientRemote) || state.GeoIPFilter.Blocked(clientRemote) {
+		err := cl.Close()
+		if err != nil {
+			log.Printf("Unable to close connection: %s", err)
+		}
+
+		if viper.GetBool("debug") {
+			log.Printf("Blocked connection from %s to %s", utils.LogAddr(cl.RemoteAddr()), cl.LocalAddr().String())
+		}
+
+		return
+	}
+
+	// The route deadline is set before peeking so clients that send nothing
+	// are closed even if tls-peek-timeout is 0. Peeking clears its own
+	// deadline, so it is set again afterwards.
+	routeDeadline := time.Now().Add(aliasMuxRouteTimeout)
+
+	err = cl.SetReadDeadline(routeDeadline)
+	if err != nil {
+		log.Println("Unable to set read deadline:", err)
+	}
+
+	tlsHello, teeConn, err := utils.PeekTLSHello(cl)
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, utils.ErrJA3Blocked) {
+		rejectAliasMuxConn(cl, false, err)
+		return
+	}
+
+	err = cl.SetReadDeadline(routeDeadline)
+	if err != nil {
+		log.Println("Unable to set read deadline:", err)
+	}
+
+	var tlvs []proxyproto.TLV
+	var name string
+
+	if tlsHello != nil {
+		name = tlsHello.ServerName
+		tlvs = append(utils.ProxyProtoTLVs(tlsHello), utils.JA3TLVs(teeConn.JA3)...)
+	} else {
+		hint, ok, err := utils.ReadAliasMuxHint(teeConn.Buffer)
+		if !ok {
+			err = fmt.Errorf("connection is not a tls handshake and did not send a routing hint")
+		}
+
+		if err != nil {
+			rejectAliasMuxConn(cl, true, err)
+			return
+		}
+
+		name = strings.ToLower(hint)
+	}
+
+	aH, err := state.AliasMuxRoute(name)
+	if err != nil {
+		rejectAliasMuxConn(cl, tlsHello == nil, err)
+		return
+	}
+
+	if !aH.UserAllowed("") {
+		rejectAliasMuxConn(cl, tlsHello == nil, fmt.Errorf("alias %s is restricted to allowed users", aH.AliasHost))
+		return
+	}
+
+	var aliasConn net.Conn = teeConn
+
+	if aH.TLS {
+		aliasHost, _, _ := net.SplitHostPort(aH.AliasHost)
+
+		tlsConn, err := terminateAliasTLS(teeConn, aliasHost, state)
+		if err != nil {
+			rejectAliasMuxConn(cl, false, fmt.Errorf("unable to terminate tls for alias: %w", err))
+			return
+		}
+
+		aliasConn = tlsConn
+		tlvs = utils.TerminatedTLSTLVs(tlsConn.ConnectionState())
+	}
+
+	err = cl.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Println("Unable to clear read deadline:", err)
+	}
+
+	connectionLocation, err := aH.Balancer.NextServer()
+	if err != nil {
+		rejectAliasMuxConn(cl, false, fmt.Errorf("unable to load connection location: %w", err))
+		return
+	}
+
+	host, err := base64.StdEncoding.DecodeString(connectionLocation.Host)
+	if err != nil {
+		rejectAliasMuxConn(cl, false, fmt.Errorf("unable to decode connection location: %w", err))
+		return
+	}
+
+	forwardConn, _ := aH.SSHConnections.Load(string(host))
+	utils.ApplyNoDelay(cl, forwardConn)
+
+	if teeConn.JA3 != "" {
+		log.Printf("Accepted connection from %s -> %s with ja3 %s", utils.LogAddr(cl.RemoteAddr()), aH.AliasHost, teeConn.JA3)
+	} else {
+		log.Printf("Accepted connection from %s -> %s", utils.LogAddr(cl.RemoteAddr()), aH.AliasHost)
+	}
+
+	conn, err := net.Dial("unix", string(host))
+	if err != nil {
+		rejectAliasMuxConn(cl, false, fmt.Errorf("unable to connect to alias: %w", err))
+		return
+	}
+
+	err = utils.WriteForwardedHeader(conn, aliasConn, tlvs)
+	if err != nil {
+		log.Println("Unable to write forwarded header:", err)
+
+		err := conn.Close()
+		if err != nil {
+			log.Printf("Unable to close connection: %s", err)
+		}
+
+		rejectAliasMuxConn(cl, false, err)
+		return
+	}
+
+	utils.CopyBoth(conn, aliasConn, nil)
+}
+
+// rejectAliasMuxConn logs why a connection to the TCP alias multiplexer could
+// not be routed and closes it. If writeError is true, the error is also sent
+// to the client, which is only done for connections that are not using TLS.
+func rejectAliasMuxConn(cl net.Conn, writeError bool, err error) {
+	utils.LogEvent("alias_mux_rejected", utils.LogFields{
+		"remote_addr": utils.LogAddr(cl.RemoteAddr()),
+		"error":       err,
+	}, "Unable to route TCP alias multiplexer connection from", utils.LogAddr(cl.RemoteAddr()), "error:", err)
+
+	if writeError {
+		_, writeErr := fmt.Fprintf(cl, "sish: %s\n", err)
+		if writeErr != nil && viper.GetBool("debug") {
+			log.Println("Unable to write error to connection:", writeErr)
+		}
+	}
+
+	err = cl.Close()
+	if err != nil {
+		log.Printf("Unable to close connection: %s", err)
+	}
+}
@@ -1,11 +1,15 @@
 package sshmuxer
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"net/textproto"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
@@ -13,6 +17,7 @@ import (
 
 	"github.com/antoniomika/sish/utils"
 	"github.com/logrusorgru/aurora"
+	"github.com/pires/go-proxyproto"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/ssh"
 )
@@ -32,15 +37,48 @@ const (
 	// hostHeaderPrefix is the host-header for a specific session.
 	hostHeaderPrefix = "host-header"
 
+	// hostRewritePrefix is a regex:replacement rule used to rewrite the host header for a specific session.
+	hostRewritePrefix = "host-rewrite"
+
+	// hostRegexPrefix is a regex of HTTP hosts routed to the session's HTTP forwards when no exact or wildcard host matches.
+	hostRegexPrefix = "host-regex"
+
+	// labelPrefix is a key:value label used to find a specific session in the admin console.
+	labelPrefix = "label"
+
+	// reconnectTokenPrefix requests a reconnect token (true) or reclaims the addresses of an earlier connection (token).
+	reconnectTokenPrefix = "reconnect-token"
+
+	// responseHeaderPrefix is a Name:Value header added to HTTP responses for a specific session.
+	responseHeaderPrefix = "response-header"
+
+	// httpAuthPrefix is a username:secret or bearer:secret credential required to access the session's HTTP forwards.
+	httpAuthPrefix = "http-auth"
+
+	// compressPrefix defines whether or not to gzip HTTP responses (if enabled globally).
+	compressPrefix = "compress"
+
 	// stripPathPrefix defines whether or not to strip the path (if enabled globally).
 	stripPathPrefix = "strip-path"
 
 	// sniProxyPrefix defines whether or not to enable SNI Proxying (if enabled globally).
 	sniProxyPrefix = "sni-proxy"
 
+	// alpnPrefix defines the ALPN protocol to route SNI proxied connections by.
+	alpnPrefix = "alpn"
+
 	// tcpAliasPrefix defines whether or not to enable TCP Aliasing (if enabled globally).
 	tcpAliasPrefix = "tcp-alias"
 
+	// tcpAliasTLSPrefix defines whether or not TCP Aliases terminate TLS at sish (if enabled globally).
+	tcpAliasTLSPrefix = "tcp-alias-tls"
+
+	// tcpAliasMuxPrefix defines whether or not TCP Aliases can be reached through the alias multiplexer (if enabled globally).
+	tcpAliasMuxPrefix = "tcp-alias-mux"
+
+	// udpPrefix defines whether or not TCP forwards are UDP forwards instead (if enabled globally).
+	udpPrefix = "udp"
+
 	// localForwardPrefix defines whether or not a local forward is being used (allows for logging).
 	localForwardPrefix = "local-forward"
 
@@ -56,8 +94,41 @@ const (
 	// tcpAliasesAllowedUsersPrefix defines a comma separated list of allowed key fingerprints to access TCP aliases.
 	tcpAliasesAllowedUsersPrefix = "tcp-aliases-allowed-users"
 
+	// allowIPsPrefix defines a comma separated list of IPs and CIDRs that can access the connection's TCP and alias forwards.
+	allowIPsPrefix = "allow-ips"
+
+	// denyIPsPrefix defines a comma separated list of IPs and CIDRs that can't access the connection's TCP and alias forwards.
+	denyIPsPrefix = "deny-ips"
+
 	// deadlinePrefix defines a timestamp at which the connection will close automatically.
 	deadlinePrefix = "deadline"
+
+	// unixSocketPrefix defines a local forward target that is a unix socket on the sish host.
+	unixSocketPrefix = "unix:"
+
+	// maxRequestBodySizePrefix defines the maximum size in bytes of request bodies sent to the connection's HTTP forwards.
+	maxRequestBodySizePrefix = "max-request-body-size"
+
+	// maxRequestHeaderSizePrefix defines the maximum size in bytes of request headers sent to the connection's HTTP forwards.
+	maxRequestHeaderSizePrefix = "max-request-header-size"
+
+	// maxRequestRatePrefix defines the maximum number of requests per second sent to each of the connection's HTTP forwards.
+	maxRequestRatePrefix = "max-request-rate"
+
+	// weightPrefix defines the load balancer weight for the connection's forwards.
+	weightPrefix = "weight"
+
+	// idleTimeoutPrefix defines the idle timeout for the connection's forwarded connections (capped globally).
+	idleTimeoutPrefix = "idle-timeout"
+
+	// dscpPrefix defines the DSCP value to mark the connection's forwarded TCP connections with.
+	dscpPrefix = "dscp"
+
+	// tcpNoDelayPrefix defines whether or not Nagle's algorithm is disabled on the connection's forwarded TCP connections.
+	tcpNoDelayPrefix = "tcp-nodelay"
+
+	// webhookPrefix defines a URL that events for the connection's forwarded connections are posted to.
+	webhookPrefix = "webhook"
 )
 
 // handleSession handles the channel when a user requests a session.
@@ -65,7 +136,7 @@ const (
 func handleSession(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, state *utils.State) {
 	connection, requests, err := newChannel.Accept()
 	if err != nil {
-		sshConn.CleanUp(state)
+		sshConn.CleanUp(state, utils.CloseReasonError)
 		return
 	}
 
@@ -78,6 +149,10 @@ func handleSession(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, stat
 		writeToSession(connection, aurora.BgRed(welcomeMessage).String()+"\r\n")
 	}
 
+	for _, scope := range sshConn.KeyPermissions.WildcardScopes() {
+		writeToSession(connection, fmt.Sprintf("Subdomains matching %s are reserved for your key.\r\n", aurora.Green(scope)))
+	}
+
 	go func() {
 		for {
 			select {
@@ -89,6 +164,18 @@ func handleSession(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, stat
 		}
 	}()
 
+	if state.Draining() {
+		sshConn.SendMessage("This server is draining and is not accepting new connections. Please reconnect later.", true)
+		sshConn.CleanUp(state, utils.CloseReasonDraining)
+		return
+	}
+
+	if sshConn.ConnectionLimitReached {
+		sshConn.SendMessage(fmt.Sprintf("You have reached the maximum of %d connections for your user. Please close an existing connection and try again.", viper.GetInt("max-connections-per-user")), true)
+		sshConn.CleanUp(state, utils.CloseReasonConnectionLimit)
+		return
+	}
+
 	go func() {
 		for {
 			data := make([]byte, 4096)
@@ -100,14 +187,14 @@ func handleSession(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, stat
 				case <-sshConn.Close:
 					break
 				default:
-					sshConn.CleanUp(state)
+					sshConn.CleanUp(state, utils.CloseReasonClientDisconnect)
 				}
 				break
 			}
 
 			if dataRead != 0 {
 				if data[0] == 3 {
-					sshConn.CleanUp(state)
+					sshConn.CleanUp(state, utils.CloseReasonClientInterrupt)
 				}
 			}
 		}
@@ -145,7 +232,13 @@ func handleSession(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, stat
 						if !viper.GetBool("proxy-protocol") {
 							break
 						}
-						sshConn.ProxyProto = getProxyProtoVersion(param)
+						proxyProto, err := getProxyProtoVersion(param)
+						if err != nil {
+							sshConn.SendMessage(fmt.Sprintf("Unable to enable proxy protocol: %s", err), true)
+							break
+						}
+
+						sshConn.ProxyProto = proxyProto
 						if sshConn.ProxyProto != 0 {
 							sshConn.SendMessage(fmt.Sprintf("Proxy protocol enabled for TCP connections. Using protocol version %d", int(sshConn.ProxyProto)), true)
 						}
@@ -155,6 +248,127 @@ func handleSession(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, stat
 						}
 						sshConn.HostHeader = param
 						sshConn.SendMessage(fmt.Sprintf("Using host header %s for HTTP handlers", sshConn.HostHeader), true)
+					case hostRewritePrefix:
+						if !viper.GetBool("rewrite-host-header") {
+							break
+						}
+
+						hostRewrite, err := utils.ParseHostRewrite(strings.Join(commandFlagParts[1:], commandSplitter))
+						if err != nil {
+							sshConn.SendMessage(fmt.Sprintf("Unable to add host rewrite: %s", err), true)
+							break
+						}
+
+						sshConn.HostRewrites = append(sshConn.HostRewrites, hostRewrite)
+						sshConn.SendMessage(fmt.Sprintf("Rewriting hosts matching %s to %s for HTTP handlers", hostRewrite.Match, hostRewrite.Replacement), true)
+					case hostRegexPrefix:
+						if !viper.GetBool("bind-host-regexes") {
+							sshConn.SendMessage("Host regexes can't be used on this server.", true)
+							break
+						}
+
+						if sshConn.KeyPermissions != nil && len(sshConn.KeyPermissions.AllowedSubdomains) > 0 {
+							sshConn.SendMessage("Host regexes can't be used by keys with allowed subdomains.", true)
+							break
+						}
+
+						maxHostRegexes := viper.GetInt("max-host-regexes")
+						if maxHostRegexes > 0 && len(sshConn.HostRegexes) >= maxHostRegexes {
+							sshConn.SendMessage(fmt.Sprintf("Unable to add host regex: connections can have at most %d host regexes.", maxHostRegexes), true)
+							break
+						}
+
+						hostRegex, err := utils.ParseHostRegex(strings.Join(commandFlagParts[1:], commandSplitter))
+						if err != nil {
+							sshConn.SendMessage(fmt.Sprintf("Unable to add host regex: %s", err), true)
+							break
+						}
+
+						sshConn.HostRegexes = append(sshConn.HostRegexes, hostRegex)
+						sshConn.SendMessage(fmt.Sprintf("Routing hosts matching %s to HTTP handlers", hostRegex), true)
+					case reconnectTokenPrefix:
+						if !viper.GetBool("reconnect-tokens") {
+							break
+						}
+
+						if param == "true" {
+							sshConn.SendMessage(fmt.Sprintf("Reconnect token: %s", state.NewReservation(sshConn)), true)
+							break
+						}
+
+						err := state.ClaimReservation(param, sshConn)
+						if err != nil {
+							sshConn.SendMessage(fmt.Sprintf("Unable to use reconnect token: %s", err), true)
+							break
+						}
+
+						sshConn.SendMessage(fmt.Sprintf("Reconnect token: %s", param), true)
+					case responseHeaderPrefix:
+						if !viper.GetBool("response-headers") {
+							break
+						}
+
+						name, value, err := parseResponseHeader(strings.Join(commandFlagParts[1:], commandSplitter))
+						if err != nil {
+							sshConn.SendMessage(fmt.Sprintf("Unable to add response header: %s", err), true)
+							break
+						}
+
+						if sshConn.ResponseHeaders == nil {
+							sshConn.ResponseHeaders = http.Header{}
+						}
+
+						sshConn.ResponseHeaders.Add(name, value)
+						sshConn.SendMessage(fmt.Sprintf("Adding response header %s: %s for HTTP handlers", name, value), true)
+					case httpAuthPrefix:
+						if !viper.GetBool("http-auth") {
+							break
+						}
+
+						credential, err := utils.ParseHTTPCredential(strings.Join(commandFlagParts[1:], commandSplitter))
+						if err != nil {
+							sshConn.SendMessage(fmt.Sprintf("Unable to add HTTP auth credential: %s", err), true)
+							break
+						}
+
+						if sshConn.HTTPAuth == nil {
+							sshConn.HTTPAuth = &utils.HTTPAuth{}
+						}
+
+						sshConn.HTTPAuth.Add(credential)
+
+						scheme := "Basic"
+						if credential.Username == "" {
+							scheme = "Bearer"
+						}
+
+						sshConn.SendMessage(fmt.Sprintf("Requiring %s auth for HTTP handlers", scheme), true)
+					case compressPrefix:
+						if !viper.GetBool("response-compression") {
+							break
+						}
+
+						compress, err := strconv.ParseBool(param)
+
+						if err != nil {
+							log.Printf("Unable to detect compress setting. Using false as default: %s", err)
+						}
+
+						sshConn.CompressResponses = compress
+
+						sshConn.SendMessage(fmt.Sprintf("Response compression for HTTP handlers set to: %t", sshConn.CompressResponses), true)
+					case labelPrefix:
+						key, value, err := utils.ParseLabel(strings.Join(commandFlagParts[1:], commandSplitter))
+						if err == nil {
+							err = sshConn.SetLabel(key, value)
+						}
+
+						if err != nil {
+							sshConn.SendMessage(fmt.Sprintf("Unable to add label: %s", err), true)
+							break
+						}
+
+						sshConn.SendMessage(fmt.Sprintf("Added label %s: %s", key, value), true)
 					case stripPathPrefix:
 						if !sshConn.StripPath {
 							break
@@ -183,6 +397,14 @@ func handleSession(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, stat
 						sshConn.SNIProxy = sniProxy
 
 						sshConn.SendMessage(fmt.Sprintf("SNI proxy for TCP forwards set to: %t", sshConn.SNIProxy), true)
+					case alpnPrefix:
+						if !viper.GetBool("sni-proxy") {
+							break
+						}
+
+						sshConn.ALPN = param
+
+						sshConn.SendMessage(fmt.Sprintf("ALPN protocol for SNI proxied forwards set to: %s", sshConn.ALPN), true)
 					case tcpAddressPrefix:
 						if viper.GetBool("force-tcp-address") {
 							break
@@ -205,6 +427,62 @@ func handleSession(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, stat
 						sshConn.TCPAlias = tcpAlias
 
 						sshConn.SendMessage(fmt.Sprintf("TCP alias for TCP forwards set to: %t", sshConn.TCPAlias), true)
+					case tcpAliasTLSPrefix:
+						if !viper.GetBool("tcp-aliases-tls") {
+							break
+						}
+
+						tcpAliasTLS, err := strconv.ParseBool(param)
+
+						if err != nil {
+							log.Printf("Unable to detect tcp alias tls setting. Using false as default: %s", err)
+						}
+
+						sshConn.TCPAliasTLS = tcpAliasTLS
+
+						sshConn.SendMessage(fmt.Sprintf("TLS termination for TCP aliases set to: %t", sshConn.TCPAliasTLS), true)
+					case tcpAliasMuxPrefix:
+						if viper.GetString("tcp-aliases-mux-address") == "" {
+							break
+						}
+
+						tcpAliasMux, err := strconv.ParseBool(param)
+
+						if err != nil {
+							log.Printf("Unable to detect tcp alias mux setting. Using false as default: %s", err)
+						}
+
+						sshConn.TCPAliasMux = tcpAliasMux
+
+						sshConn.SendMessage(fmt.Sprintf("Multiplexing for TCP aliases set to: %t", sshConn.TCPAliasMux), true)
+					case allowIPsPrefix, denyIPsPrefix:
+						ipNets, err := utils.ParseIPNets(param)
+						if err != nil {
+							sshConn.SendMessage(fmt.Sprintf("Unable to parse %s: %s", command, err), true)
+							break
+						}
+
+						if command == allowIPsPrefix {
+							sshConn.AllowedIPs = append(sshConn.AllowedIPs, ipNets...)
+						} else {
+							sshConn.DeniedIPs = append(sshConn.DeniedIPs, ipNets...)
+						}
+
+						sshConn.SendMessage(fmt.Sprintf("Set %s for TCP and alias forwards to: %s", command, param), true)
+					case udpPrefix:
+						if !viper.GetBool("udp-forwards") {
+							break
+						}
+
+						udp, err := strconv.ParseBool(param)
+
+						if err != nil {
+							log.Printf("Unable to detect udp setting. Using false as default: %s", err)
+						}
+
+						sshConn.UDP = udp
+
+						sshConn.SendMessage(fmt.Sprintf("UDP forwarding for TCP forwards set to: %t", sshConn.UDP), true)
 					case autoClosePrefix:
 						autoClose, err := strconv.ParseBool(param)
 
@@ -272,10 +550,116 @@ func handleSession(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, stat
 
 						sshConn.Deadline = &deadline
 						sshConn.SendMessage(fmt.Sprintf("Deadline for connection set to: %s", sshConn.Deadline.UTC().Format("2006-01-02 15:04:05")), true)
+					case maxRequestBodySizePrefix:
+						maxRequestBodySize, err := strconv.ParseInt(param, 10, 64)
+						if err != nil || maxRequestBodySize < 1 {
+							sshConn.SendMessage(fmt.Sprintf("Invalid max request body size %q. Size must be a positive number of bytes.", param), true)
+							break
+						}
+
+						sshConn.MaxRequestBodySize = maxRequestBodySize
+						sshConn.SendMessage(fmt.Sprintf("Max request body size for HTTP forwards set to: %d bytes", sshConn.RequestBodyLimit()), true)
+					case maxRequestHeaderSizePrefix:
+						maxRequestHeaderSize, err := strconv.ParseInt(param, 10, 64)
+						if err != nil || maxRequestHeaderSize < 1 {
+							sshConn.SendMessage(fmt.Sprintf("Invalid max request header size %q. Size must be a positive number of bytes.", param), true)
+							break
+						}
+
+						sshConn.MaxRequestHeaderSize = maxRequestHeaderSize
+						sshConn.SendMessage(fmt.Sprintf("Max request header size for HTTP forwards set to: %d bytes", sshConn.RequestHeaderLimit()), true)
+					case maxRequestRatePrefix:
+						maxRequestRate, err := strconv.ParseInt(param, 10, 64)
+						if err != nil || maxRequestRate < 1 {
+							sshConn.SendMessage(fmt.Sprintf("Invalid max request rate %q. Rate must be a positive number of requests per second.", param), true)
+							break
+						}
+
+						sshConn.MaxRequestRate = maxRequestRate
+						sshConn.SendMessage(fmt.Sprintf("Max request rate for HTTP forwards set to: %d requests per second", sshConn.RequestRateLimit()), true)
+					case weightPrefix:
+						weight, err := strconv.Atoi(param)
+						if err != nil || weight < 1 {
+							sshConn.SendMessage(fmt.Sprintf("Invalid load balancer weight %q. Weight must be a positive integer.", param), true)
+							break
+						}
+
+						sshConn.Weight = weight
+						sshConn.SendMessage(fmt.Sprintf("Load balancer weight for connection set to: %d", sshConn.Weight), true)
+					case idleTimeoutPrefix:
+						if viper.GetDuration("idle-connection-max-timeout") <= 0 {
+							sshConn.SendMessage("Idle timeouts can't be changed on this server.", true)
+							break
+						}
+
+						idleTimeout, err := time.ParseDuration(param)
+						if err != nil || sshConn.SetIdleTimeout(idleTimeout) == 0 {
+							sshConn.SendMessage(fmt.Sprintf("Invalid idle timeout %q. Timeout must be a positive duration like 10m.", param), true)
+							break
+						}
+
+						sshConn.SendMessage(fmt.Sprintf("Idle timeout for forwarded connections set to: %s", sshConn.IdleTimeout), true)
+					case dscpPrefix:
+						if !viper.GetBool("dscp-override") {
+							sshConn.SendMessage("DSCP values can't be changed on this server.", true)
+							break
+						}
+
+						dscp, err := utils.ParseDSCP(param)
+						if err != nil {
+							sshConn.SendMessage(fmt.Sprintf("Invalid DSCP value: %s", err), true)
+							break
+						}
+
+						sshConn.DSCP = dscp
+						sshConn.SendMessage(fmt.Sprintf("DSCP value for forwarded TCP connections set to: %d", sshConn.DSCPValue()), true)
+					case tcpNoDelayPrefix:
+						noDelay, err := strconv.ParseBool(param)
+						if err != nil {
+							sshConn.SendMessage(fmt.Sprintf("Invalid tcp nodelay setting %q. Setting must be true or false.", param), true)
+							break
+						}
+
+						sshConn.NoDelay = &noDelay
+						sshConn.SendMessage(fmt.Sprintf("Nagle's algorithm disabled for forwarded TCP connections: %t", sshConn.TCPNoDelay()), true)
+					case webhookPrefix:
+						if !viper.GetBool("allow-client-webhooks") {
+							sshConn.SendMessage("Webhooks can't be used on this server.", true)
+							break
+						}
+
+						webhook, err := utils.NewClientWebhook(param)
+						if err != nil {
+							sshConn.SendMessage(fmt.Sprintf("Invalid webhook: %s", err), true)
+							break
+						}
+
+						sshConn.Webhook = webhook
+						sshConn.SendMessage(fmt.Sprintf("Posting forwarded connection events to: %s", webhook.URL.Redacted()), true)
 					}
 				}
 
 				close(sshConn.Exec)
+			case "env":
+				name, value, err := utils.ParseEnvRequest(req.Payload)
+				if err == nil && !utils.EnvAllowed(name) {
+					err = fmt.Errorf("environment variable %s is not allowed", name)
+				}
+
+				if err == nil {
+					err = sshConn.SetEnv(name, value)
+				}
+
+				if err != nil && viper.GetBool("debug") {
+					log.Println("Rejected environment variable:", err)
+				}
+
+				if req.WantReply {
+					err := req.Reply(err == nil, nil)
+					if err != nil {
+						log.Println("Error replying to socket request:", err)
+					}
+				}
 			default:
 				if viper.GetBool("debug") {
 					log.Println("Sub Channel Type", req.Type, req.WantReply, string(req.Payload))
@@ -289,7 +673,7 @@ func handleSession(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, stat
 func handleAlias(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, state *utils.State) {
 	connection, requests, err := newChannel.Accept()
 	if err != nil {
-		sshConn.CleanUp(state)
+		sshConn.CleanUp(state, utils.CloseReasonError)
 		return
 	}
 
@@ -309,7 +693,12 @@ func handleAlias(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, state
 	err = ssh.Unmarshal(newChannel.ExtraData(), check)
 	if err != nil {
 		log.Println("Error unmarshaling information:", err)
-		sshConn.CleanUp(state)
+		sshConn.CleanUp(state, utils.CloseReasonError)
+		return
+	}
+
+	if strings.HasPrefix(check.Addr, unixSocketPrefix) {
+		handleUnixSocketForward(check.Addr, connection, sshConn, state)
 		return
 	}
 
@@ -319,7 +708,7 @@ func handleAlias(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, state
 	loc, ok := state.AliasListeners.Load(tcpAliasToConnect)
 	if !ok {
 		log.Println("Unable to load tcp alias:", tcpAliasToConnect)
-		sshConn.CleanUp(state)
+		sshConn.CleanUp(state, utils.CloseReasonError)
 		return
 	}
 
@@ -333,37 +722,23 @@ func handleAlias(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, state
 		}
 	}
 
-	if viper.GetBool("tcp-aliases-allowed-users") {
-		connAllowed := false
-
-		aH.SSHConnections.Range(func(name string, conn *utils.SSHConnection) bool {
-			for _, fingerprint := range conn.TCPAliasesAllowedUsers {
-				if fingerprint == "any" || (fingerprint != "" && pubKeyFingerprint != "" && fingerprint == pubKeyFingerprint) {
-					connAllowed = true
-					return false
-				}
-			}
-			return true
-		})
-
-		if !connAllowed {
-			log.Println("Connection not allowed because fingerprint is not found in allowed list")
-			sshConn.CleanUp(state)
-			return
-		}
+	if !aH.UserAllowed(pubKeyFingerprint) {
+		log.Println("Connection not allowed because fingerprint is not found in allowed list")
+		sshConn.CleanUp(state, utils.CloseReasonError)
+		return
 	}
 
 	connectionLocation, err := aH.Balancer.NextServer()
 	if err != nil {
 		log.Println("Unable to load connection location:", err)
-		sshConn.CleanUp(state)
+		sshConn.CleanUp(state, utils.CloseReasonError)
 		return
 	}
 
 	host, err := base64.StdEncoding.DecodeString(connectionLocation.Host)
 	if err != nil {
 		log.Println("Unable to decode connection location:", err)
-		sshConn.CleanUp(state)
+		sshConn.CleanUp(state, utils.CloseReasonError)
 		return
 	}
 
@@ -397,14 +772,65 @@ func handleAlias(newChannel ssh.NewChannel, sshConn *utils.SSHConnection, state
 		}
 	}
 
+	var aliasConn net.Conn = utils.NewChannelConn(connection, sshConn.SSHConn)
+	var tlvs []proxyproto.TLV
+
+	if aH.TLS {
+		tlsConn, err := terminateAliasTLS(aliasConn, check.Addr, state)
+		if err != nil {
+			log.Println("Unable to terminate tls for alias:", err)
+			sshConn.CleanUp(state, utils.CloseReasonError)
+			return
+		}
+
+		aliasConn = tlsConn
+		tlvs = utils.TerminatedTLSTLVs(tlsConn.ConnectionState())
+	}
+
 	conn, err := net.Dial("unix", aliasAddr)
 	if err != nil {
 		log.Println("Error connecting to alias:", err)
-		sshConn.CleanUp(state)
+		sshConn.CleanUp(state, utils.CloseReasonError)
 		return
 	}
 
-	utils.CopyBoth(conn, connection)
+	err = utils.WriteForwardedHeader(conn, aliasConn, tlvs)
+	if err != nil {
+		log.Println("Unable to write forwarded header:", err)
+		sshConn.CleanUp(state, utils.CloseReasonError)
+		return
+	}
+
+	utils.CopyBoth(conn, aliasConn, sshConn)
+}
+
+// terminateAliasTLS completes the TLS handshake of a TCP alias connection using
+// the certificate for the server name the client requested. The server name must
+// match the alias being connected to. If tls-client-ca is set, the client must
+// present a certificate signed by it.
+func terminateAliasTLS(connection net.Conn, aliasHost string, state *utils.State) (*tls.Conn, error) {
+	tlsConfig := state.TLSConfig()
+	if tlsConfig == nil {
+		return nil, fmt.Errorf("https is not enabled")
+	}
+
+	tlsHello, teeConn, err := utils.PeekTLSHello(connection)
+	if tlsHello == nil {
+		return nil, err
+	}
+
+	if tlsHello.ServerName != aliasHost {
+		return nil, fmt.Errorf("server name %q does not match alias %s", tlsHello.ServerName, aliasHost)
+	}
+
+	tlsConn := tls.Server(teeConn, tlsConfig)
+
+	err = tlsConn.Handshake()
+	if err != nil {
+		return nil, err
+	}
+
+	return tlsConn, nil
 }
 
 // writeToSession is where we write to the underlying session channel.
@@ -416,19 +842,27 @@ func writeToSession(connection ssh.Channel, c string) {
 }
 
 // getProxyProtoVersion returns the proxy proto version selected by the client.
-func getProxyProtoVersion(proxyProtoUserVersion string) byte {
+// An error is returned if the requested version is not supported.
+func getProxyProtoVersion(proxyProtoUserVersion string) (byte, error) {
 	if viper.GetString("proxy-protocol-version") != "userdefined" {
 		proxyProtoUserVersion = viper.GetString("proxy-protocol-version")
 	}
 
-	switch proxyProtoUserVersion {
-	case "1":
-		return 1
-	case "2":
-		return 2
-	default:
-		return 0
+	return utils.ParseProxyProtoVersion(proxyProtoUserVersion)
+}
+
+// parseResponseHeader parses a Name:Value response header provided by the client.
+func parseResponseHeader(param string) (string, string, error) {
+	name, value, ok := strings.Cut(param, ":")
+	if !ok || name == "" || value == "" {
+		return "", "", fmt.Errorf("header %q is not in the form Name:Value", param)
+	}
+
+	if strings.ContainsAny(name, " \t\r\n()<>@,;\\\"/[]?={}") {
+		return "", "", fmt.Errorf("invalid header name %q", name)
 	}
+
+	return textproto.CanonicalMIMEHeaderKey(name), value, nil
 }
 
 // parseDeadline parses the deadline string provided by the client to a time object.
@@ -458,3 +892,62 @@ func parseDeadline(param string) (time.Time, error) {
 
 	return time.Time{}, fmt.Errorf("invalid deadline format")
 }
+
+// parseUnixSocketTarget returns the socket path of a unix:/path/to/sock local
+// forward target. The path must resolve to a location inside of
+// local-forward-unix-socket-directory.
+func parseUnixSocketTarget(target string) (string, error) {
+	allowedDirectory := viper.GetString("local-forward-unix-socket-directory")
+	if allowedDirectory == "" {
+		return "", fmt.Errorf("unix socket forwards are not enabled")
+	}
+
+	socketPath := filepath.Clean(strings.TrimPrefix(target, unixSocketPrefix))
+	if !filepath.IsAbs(socketPath) {
+		return "", fmt.Errorf("unix socket path %s is not absolute", socketPath)
+	}
+
+	resolvedDirectory, err := filepath.EvalSymlinks(allowedDirectory)
+	if err != nil {
+		return "", err
+	}
+
+	resolvedPath, err := filepath.EvalSymlinks(socketPath)
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(resolvedDirectory, resolvedPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("unix socket path %s is outside of the allowed directory", socketPath)
+	}
+
+	return resolvedPath, nil
+}
+
+// handleUnixSocketForward connects a local forward to a unix socket on the sish host.
+// Idle timeouts are not applied since the socket is a trusted local service.
+func handleUnixSocketForward(target string, connection ssh.Channel, sshConn *utils.SSHConnection, state *utils.State) {
+	socketPath, err := parseUnixSocketTarget(target)
+	if err != nil {
+		log.Println("Unable to forward to unix socket:", err)
+		sshConn.CleanUp(state, utils.CloseReasonError)
+		return
+	}
+
+	logLine := fmt.Sprintf("Accepted connection from %s -> %s", utils.LogAddr(sshConn.SSHConn.RemoteAddr()), target)
+	log.Println(logLine)
+
+	if viper.GetBool("log-to-client") && sshConn.LocalForward {
+		sshConn.SendMessage(logLine, true)
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		log.Println("Error connecting to unix socket:", err)
+		sshConn.CleanUp(state, utils.CloseReasonError)
+		return
+	}
+
+	utils.CopyBoth(utils.NoIdleTimeoutConn{Conn: conn}, connection, sshConn)
+}
@@ -1,6 +1,7 @@
 package sshmuxer
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"time"
@@ -28,6 +29,8 @@ func handleRequest(newRequest *ssh.Request, sshConn *utils.SSHConnection, state
 		handleRemoteForward(newRequest, sshConn, state)
 	case "cancel-tcpip-forward":
 		handleCancelRemoteForward(newRequest, sshConn, state)
+	case "info@sish":
+		handleInfoRequest(newRequest, sshConn, state)
 	case "keepalive@openssh.com":
 		err := newRequest.Reply(true, nil)
 		if err != nil {
@@ -41,6 +44,29 @@ func handleRequest(newRequest *ssh.Request, sshConn *utils.SSHConnection, state
 	}
 }
 
+// handleInfoRequest replies to an info request with the JSON encoded
+// information of the requesting connection.
+func handleInfoRequest(newRequest *ssh.Request, sshConn *utils.SSHConnection, state *utils.State) {
+	info := sshConn.Info()
+	info.Quota = state.QuotaInfo(sshConn)
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		log.Println("Error marshaling connection info:", err)
+
+		err := newRequest.Reply(false, nil)
+		if err != nil {
+			log.Println("Error replying to socket request:", err)
+		}
+		return
+	}
+
+	err = newRequest.Reply(true, data)
+	if err != nil {
+		log.Println("Error replying to socket request:", err)
+	}
+}
+
 // checkSession will check a session to see that it has a session.
 func checkSession(_ *ssh.Request, sshConn *utils.SSHConnection, state *utils.State) {
 	sshConn.SetupLock.Lock()
@@ -68,7 +94,7 @@ func checkSession(_ *ssh.Request, sshConn *utils.SSHConnection, state *utils.Sta
 		if err != nil {
 			log.Println("Waited for ssh conn without session:", err)
 		}
-		sshConn.CleanUp(state)
+		sshConn.CleanUp(state, utils.CloseReasonClientDisconnect)
 		return
 	}
 }
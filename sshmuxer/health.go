@@ -0,0 +1,59 @@
+package sshmuxer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/antoniomika/sish/utils"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// healthProbe returns the probe used to health check a forwarded listener.
+// HTTP listeners are checked with a request to health-check-http-path if it is
+// set. Otherwise, a forwarded channel is opened to verify the client's local
+// service accepts connections.
+func healthProbe(sshConn *utils.SSHConnection, listenerHolder *utils.ListenerHolder, payload *forwardedTCPPayload, httpHost string) func() error {
+	httpPath := viper.GetString("health-check-http-path")
+
+	if listenerHolder.Type == utils.HTTPListener && httpPath != "" {
+		client := &http.Client{
+			Timeout: viper.GetDuration("health-check-timeout"),
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", listenerHolder.ListenAddr)
+				},
+			},
+		}
+
+		return func() error {
+			res, err := client.Get(fmt.Sprintf("http://%s%s", httpHost, httpPath))
+			if err != nil {
+				return err
+			}
+
+			err = res.Body.Close()
+			if err != nil {
+				return err
+			}
+
+			if res.StatusCode >= http.StatusInternalServerError {
+				return fmt.Errorf("health check returned status %d", res.StatusCode)
+			}
+
+			return nil
+		}
+	}
+
+	return func() error {
+		newChan, newReqs, err := sshConn.SSHConn.OpenChannel("forwarded-tcpip", ssh.Marshal(payload))
+		if err != nil {
+			return err
+		}
+
+		go ssh.DiscardRequests(newReqs)
+
+		return newChan.Close()
+	}
+}
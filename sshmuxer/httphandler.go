@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"strings"
 
@@ -21,17 +22,32 @@ import (
 func handleHTTPListener(check *channelForwardMsg, _ string, requestMessages string, listenerHolder *utils.ListenerHolder, state *utils.State, sshConn *utils.SSHConnection, scheme string) (*utils.HTTPHolder, *url.URL, string, error) {
 	hostUrl, pH := utils.GetOpenHost(check.Addr, state, sshConn)
 
-	if (hostUrl == nil || !strings.HasPrefix(hostUrl.Host, check.Addr)) && viper.GetBool("force-requested-subdomains") {
+	if hostUrl == nil || (!strings.HasPrefix(hostUrl.Host, check.Addr) && viper.GetBool("force-requested-subdomains")) {
 		return nil, nil, "", fmt.Errorf("error assigning requested subdomain to tunnel")
 	}
 
+	if hostUrl != nil && !sshConn.KeyPermissions.SubdomainAllowed(hostUrl.Host) {
+		sshConn.SendMessage(fmt.Sprintf("The subdomain %s is not allowed for your key.", hostUrl.Host), true)
+		return nil, nil, "", fmt.Errorf("subdomain not allowed for key")
+	}
+
 	if pH == nil {
 		rT := httpmuxer.RoundTripper()
 
+		var fwdRT http.RoundTripper = rT
+		if viper.GetBool("http2-backends") {
+			fwdRT = httpmuxer.HTTP2RoundTripper(rT)
+		}
+
+		retryRT := &utils.RetryTransport{
+			Transport: fwdRT,
+		}
+
 		fwd, err := forward.New(
 			forward.Stream(true),
 			forward.PassHostHeader(true),
-			forward.RoundTripper(rT),
+			forward.Rewriter(utils.ForwardedHeaderRewriter{}),
+			forward.RoundTripper(retryRT),
 			forward.WebsocketRoundTripper(rT),
 		)
 
@@ -40,13 +56,27 @@ func handleHTTPListener(check *channelForwardMsg, _ string, requestMessages stri
 			return nil, nil, "", err
 		}
 
-		lb, err := roundrobin.New(fwd)
+		var lbOptions []roundrobin.LBOption
+		var stickyCookieValue *utils.HealthyCookieValue
+
+		if viper.GetBool("sticky-sessions") {
+			var stickySession *roundrobin.StickySession
+			stickySession, stickyCookieValue = utils.NewStickySession()
+
+			lbOptions = append(lbOptions, roundrobin.EnableStickySession(stickySession))
+		}
+
+		lb, err := roundrobin.New(utils.ForwardedHeadersHandler(fwd), lbOptions...)
 
 		if err != nil {
 			log.Println("Error initializing HTTP balancer:", err)
 			return nil, nil, "", err
 		}
 
+		if stickyCookieValue != nil {
+			stickyCookieValue.Balancer = lb
+		}
+
 		hostUrl.Scheme = scheme
 
 		pH = &utils.HTTPHolder{
@@ -56,7 +86,17 @@ func handleHTTPListener(check *channelForwardMsg, _ string, requestMessages stri
 			Balancer:       lb,
 		}
 
-		state.HTTPListeners.Store(pH.HTTPUrl.String(), pH)
+		retryRT.Holder = pH
+
+		current, added := state.AddHTTPHolder(pH)
+		if !added {
+			if !viper.GetBool("http-load-balancer") {
+				sshConn.SendMessage(fmt.Sprintf("The subdomain %s was bound by another forward.", hostUrl.Host), true)
+				return nil, nil, "", fmt.Errorf("error assigning requested subdomain to tunnel")
+			}
+
+			pH = current
+		}
 	}
 
 	pH.SSHConnections.Store(listenerHolder.Addr().String(), sshConn)
@@ -66,7 +106,7 @@ func handleHTTPListener(check *channelForwardMsg, _ string, requestMessages stri
 		Scheme: pH.HTTPUrl.Scheme,
 	}
 
-	err := pH.Balancer.UpsertServer(serverURL)
+	err := pH.Balancer.UpsertServer(serverURL, roundrobin.Weight(sshConn.BalancerWeight()))
 	if err != nil {
 		log.Println("Unable to add server to balancer")
 	}
@@ -128,7 +168,8 @@ func handleHTTPListener(check *channelForwardMsg, _ string, requestMessages stri
 		}
 
 		requestMessages += fmt.Sprintf("%s: http://%s%s%s%s\r\n", aurora.BgBlue("HTTP"), userPass, pH.HTTPUrl.Host, httpPortString, pH.HTTPUrl.Path)
-		log.Printf("%s forwarding started: http://%s%s%s%s -> %s for client: %s\n", aurora.BgBlue("HTTP"), userPass, pH.HTTPUrl.Host, httpPortString, pH.HTTPUrl.Path, listenerHolder.Addr().String(), sshConn.SSHConn.RemoteAddr().String())
+		listenerHolder.AddAddress(fmt.Sprintf("http://%s%s%s", pH.HTTPUrl.Host, httpPortString, pH.HTTPUrl.Path))
+		log.Printf("%s forwarding started: http://%s%s%s%s -> %s for client: %s\n", aurora.BgBlue("HTTP"), userPass, pH.HTTPUrl.Host, httpPortString, pH.HTTPUrl.Path, listenerHolder.Addr().String(), utils.LogAddr(sshConn.SSHConn.RemoteAddr()))
 	}
 
 	if viper.GetBool("https") || viper.GetBool("proxy-ssl-termination") {
@@ -138,8 +179,11 @@ func handleHTTPListener(check *channelForwardMsg, _ string, requestMessages stri
 		}
 
 		requestMessages += fmt.Sprintf("%s: https://%s%s%s%s\r\n", aurora.BgBlue("HTTPS"), userPass, pH.HTTPUrl.Host, httpsPortString, pH.HTTPUrl.Path)
-		log.Printf("%s forwarding started: https://%s%s%s%s -> %s for client: %s\n", aurora.BgBlue("HTTPS"), userPass, pH.HTTPUrl.Host, httpsPortString, pH.HTTPUrl.Path, listenerHolder.Addr().String(), sshConn.SSHConn.RemoteAddr().String())
+		listenerHolder.AddAddress(fmt.Sprintf("https://%s%s%s", pH.HTTPUrl.Host, httpsPortString, pH.HTTPUrl.Path))
+		log.Printf("%s forwarding started: https://%s%s%s%s -> %s for client: %s\n", aurora.BgBlue("HTTPS"), userPass, pH.HTTPUrl.Host, httpsPortString, pH.HTTPUrl.Path, listenerHolder.Addr().String(), utils.LogAddr(sshConn.SSHConn.RemoteAddr()))
 	}
 
+	state.AddReservedForward(sshConn, utils.ReservedHTTP, check.Addr, pH.HTTPUrl.Host)
+
 	return pH, serverURL, requestMessages, nil
 }
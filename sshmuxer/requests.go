@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -11,6 +12,7 @@ import (
 	"time"
 
 	"github.com/antoniomika/multilistener"
+	"github.com/antoniomika/sish/httpmuxer"
 	"github.com/antoniomika/sish/utils"
 	"github.com/logrusorgru/aurora"
 	"github.com/pires/go-proxyproto"
@@ -104,6 +106,26 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 		break
 	}
 
+	if state.Draining() {
+		sshConn.SendMessage("This server is draining and is not accepting new forwards.", true)
+
+		err := newRequest.Reply(false, nil)
+		if err != nil {
+			log.Println("Error replying to socket request:", err)
+		}
+		return
+	}
+
+	if sshConn.ConnectionLimitReached {
+		sshConn.SendMessage("Connection limit reached for your user. Forwards will be rejected.", false)
+
+		err := newRequest.Reply(false, nil)
+		if err != nil {
+			log.Println("Error replying to socket request:", err)
+		}
+		return
+	}
+
 	cleanupOnce := &sync.Once{}
 	check := &channelForwardMsg{}
 
@@ -124,7 +146,19 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 	}
 
 	originalAddress := check.Addr
-	check.Addr = strings.ToLower(check.Addr)
+
+	forwardAddr, proxyProto, err := parseForwardProxyProto(check.Addr, sshConn.ProxyProto)
+	if err != nil {
+		sshConn.SendMessage(fmt.Sprintf("Unable to set proxy protocol for forward: %s", err), true)
+
+		err = newRequest.Reply(false, nil)
+		if err != nil {
+			log.Println("Error replying to socket request:", err)
+		}
+		return
+	}
+
+	check.Addr = strings.ToLower(forwardAddr)
 
 	bindPort := check.Rport
 	stringPort := strconv.FormatUint(uint64(bindPort), 10)
@@ -169,9 +203,53 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 		}
 	}
 
-	tmpfile, err := os.CreateTemp("", strings.ReplaceAll(sshConn.SSHConn.RemoteAddr().String()+":"+stringPort, ":", "_"))
+	if listenerType == utils.TCPListener && !sniProxyForced && viper.GetBool("udp-forwards") && sshConn.UDP {
+		listenerType = utils.UDPListener
+	}
+
+	// HTTP forwards only send a PROXY header when it is requested with the
+	// ?proxy-protocol=version suffix, as proxy-protocol=version applies to TCP
+	// connections.
+	if listenerType == utils.HTTPListener && forwardAddr == originalAddress {
+		proxyProto = 0
+	}
+
+	if quota := state.QuotaInfo(sshConn); quota != nil && quota.Remaining == 0 {
+		sshConn.SendMessage(fmt.Sprintf("You have used your bandwidth quota of %d bytes. It resets at %s UTC.", quota.Limit, quota.ResetsAt.Format("2006-01-02 15:04:05")), true)
+
+		err = newRequest.Reply(false, nil)
+		if err != nil {
+			log.Println("Error replying to socket request:", err)
+		}
+		return
+	}
+
+	if !sshConn.ReserveListener() {
+		sshConn.SendMessage(fmt.Sprintf("This connection has reached its maximum number of forwards (%d). Close a forward before opening another.", viper.GetInt64("max-listeners-per-connection")), true)
+
+		err = newRequest.Reply(false, nil)
+		if err != nil {
+			log.Println("Error replying to socket request:", err)
+		}
+		return
+	}
+
+	if !state.ReserveListener() {
+		sshConn.ReleaseListener()
+		sshConn.SendMessage("This server has reached its maximum number of forwards. Please try again later.", true)
+
+		err = newRequest.Reply(false, nil)
+		if err != nil {
+			log.Println("Error replying to socket request:", err)
+		}
+		return
+	}
+
+	tmpfile, err := os.CreateTemp("", strings.ReplaceAll(utils.LogAddr(sshConn.SSHConn.RemoteAddr())+":"+stringPort, ":", "_"))
 	if err != nil {
 		log.Println("Error creating temporary file:", err)
+		state.ReleaseListener()
+		sshConn.ReleaseListener()
 
 		err = newRequest.Reply(false, nil)
 		if err != nil {
@@ -195,6 +273,8 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 	chanListener, err := net.Listen("unix", listenAddr)
 	if err != nil {
 		log.Println("Error listening on unix socket:", err)
+		state.ReleaseListener()
+		sshConn.ReleaseListener()
 
 		err = newRequest.Reply(false, nil)
 		if err != nil {
@@ -203,19 +283,36 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 		return
 	}
 
+	var forwardListener net.Listener = chanListener
+
+	// Connections to TCP, alias and HTTP listeners are prefixed with a PROXY
+	// header describing the original client connection. See
+	// utils.WriteForwardedHeader.
+	if listenerType == utils.TCPListener || listenerType == utils.AliasListener || listenerType == utils.HTTPListener {
+		forwardListener = &proxyproto.Listener{
+			Listener: chanListener,
+		}
+	}
+
 	listenerHolder := &utils.ListenerHolder{
 		ListenAddr:   listenAddr,
-		Listener:     chanListener,
+		Listener:     forwardListener,
 		Type:         listenerType,
 		SSHConn:      sshConn,
 		OriginalAddr: originalCheck.Addr,
 		OriginalPort: originalCheck.Rport,
+		Limiter:      utils.NewForwardLimiter(viper.GetInt("max-concurrent-forwards")),
+		ProxyProto:   proxyProto,
 	}
 
 	state.Listeners.Store(listenAddr, listenerHolder)
 	sshConn.Listeners.Store(listenAddr, listenerHolder)
 
 	deferHandler := func() {}
+	stopHealthCheck := func() {}
+	stopBreakerWatch := func() {}
+
+	var channelPool *utils.ChannelPool
 
 	cleanupChanListener := func() {
 		err := listenerHolder.Close()
@@ -225,12 +322,17 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 
 		state.Listeners.Delete(listenAddr)
 		sshConn.Listeners.Delete(listenAddr)
+		state.ReleaseListener()
+		sshConn.ReleaseListener()
 
 		err = os.Remove(listenAddr)
 		if err != nil {
 			log.Println("Error removing unix socket:", err)
 		}
 
+		stopHealthCheck()
+		stopBreakerWatch()
+		channelPool.Stop()
 		deferHandler()
 	}
 
@@ -242,6 +344,8 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 	connType := "tcp"
 	if sniProxyForced {
 		connType = "tls"
+	} else if listenerType == utils.UDPListener {
+		connType = "udp"
 	} else if !tcpAliasForced && stringPort == strconv.FormatUint(uint64(comparePortHTTP), 10) {
 		connType = "http"
 	} else if !tcpAliasForced && stringPort == strconv.FormatUint(uint64(comparePortHTTPS), 10) {
@@ -250,6 +354,10 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 
 	portChannelForwardReplyPayload := channelForwardReply{bindPort}
 
+	var lbBalancer *roundrobin.RoundRobin
+	var lbServerURL *url.URL
+	healthHTTPHost := ""
+
 	mainRequestMessages := fmt.Sprintf("Starting SSH Forwarding service for %s. Forwarded connections can be accessed via the following methods:\r\n", aurora.Sprintf(aurora.Green("%s:%s"), connType, stringPort))
 
 	switch listenerType {
@@ -257,6 +365,7 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 		pH, serverURL, requestMessages, err := handleHTTPListener(check, stringPort, mainRequestMessages, listenerHolder, state, sshConn, connType)
 		if err != nil {
 			log.Println("Error setting up HTTPListener:", err)
+			state.Metrics.ForwardError(listenerType)
 
 			err = newRequest.Reply(false, nil)
 			if err != nil {
@@ -269,6 +378,7 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 		}
 
 		mainRequestMessages = requestMessages
+		lbBalancer, lbServerURL, healthHTTPHost = pH.Balancer, serverURL, pH.HTTPUrl.Host
 
 		deferHandler = func() {
 			err := pH.Balancer.RemoveServer(serverURL)
@@ -277,19 +387,15 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 			}
 
 			pH.SSHConnections.Delete(listenerHolder.Addr().String())
+			httpmuxer.RemoveHTTP2Backend(serverURL.Host)
 
-			if len(pH.Balancer.Servers()) == 0 {
-				state.HTTPListeners.Delete(pH.HTTPUrl.String())
-
-				if viper.GetBool("admin-console") || viper.GetBool("service-console") {
-					state.Console.RemoveRoute(pH.HTTPUrl.String())
-				}
-			}
+			state.RemoveHTTPHolder(pH)
 		}
 	case utils.AliasListener:
 		aH, serverURL, validAlias, requestMessages, err := handleAliasListener(check, stringPort, mainRequestMessages, listenerHolder, state, sshConn)
 		if err != nil {
 			log.Println("Error setting up AliasListener:", err)
+			state.Metrics.ForwardError(listenerType)
 
 			err = newRequest.Reply(false, nil)
 			if err != nil {
@@ -302,6 +408,7 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 		}
 
 		mainRequestMessages = requestMessages
+		lbBalancer, lbServerURL = aH.Balancer, serverURL
 
 		deferHandler = func() {
 			err := aH.Balancer.RemoveServer(serverURL)
@@ -319,6 +426,7 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 		tH, balancer, balancerName, serverURL, tcpAddr, requestMessages, err := handleTCPListener(check, bindPort, mainRequestMessages, listenerHolder, state, sshConn, sniProxyForced)
 		if err != nil {
 			log.Println("Error setting up TCPListener:", err)
+			state.Metrics.ForwardError(listenerType)
 
 			err = newRequest.Reply(false, nil)
 			if err != nil {
@@ -333,6 +441,7 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 		portChannelForwardReplyPayload.Rport = uint32(tH.Listener.Addr().(*multilistener.MultiListener).Addresses()[0].(*net.TCPAddr).Port)
 
 		mainRequestMessages = requestMessages
+		lbBalancer, lbServerURL = balancer, serverURL
 
 		if !tH.NoHandle {
 			go tH.Handle(state)
@@ -366,6 +475,44 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 				}
 			}
 		}
+	case utils.UDPListener:
+		uH, serverURL, requestMessages, err := handleUDPListener(check, bindPort, mainRequestMessages, listenerHolder, state, sshConn)
+		if err != nil {
+			log.Println("Error setting up UDPListener:", err)
+			state.Metrics.ForwardError(listenerType)
+
+			err = newRequest.Reply(false, nil)
+			if err != nil {
+				log.Println("Error replying to socket request:", err)
+			}
+
+			cleanupOnce.Do(cleanupChanListener)
+
+			return
+		}
+
+		portChannelForwardReplyPayload.Rport = uint32(uH.Conn.LocalAddr().(*net.UDPAddr).Port)
+
+		mainRequestMessages = requestMessages
+		lbBalancer, lbServerURL = uH.Balancer, serverURL
+
+		deferHandler = func() {
+			err := uH.Balancer.RemoveServer(serverURL)
+			if err != nil {
+				log.Println("Unable to remove server from balancer:", err)
+			}
+
+			uH.SSHConnections.Delete(listenerHolder.Addr().String())
+
+			if len(uH.Balancer.Servers()) == 0 {
+				err := uH.Close()
+				if err != nil {
+					log.Println("Error closing UDPListener:", err)
+				}
+
+				state.UDPListeners.Delete(uH.UDPHost)
+			}
+		}
 	}
 
 	if check.Rport != 0 {
@@ -381,6 +528,47 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 
 	sshConn.SendMessage(mainRequestMessages, true)
 
+	utils.LogEvent("forward_created", utils.LogFields{
+		"remote_addr": utils.LogAddr(sshConn.SSHConn.RemoteAddr()),
+		"user":        sshConn.SSHConn.User(),
+		"type":        connType,
+		"port":        stringPort,
+	}, "Created forward for:", utils.LogAddr(sshConn.SSHConn.RemoteAddr()), "user:", sshConn.SSHConn.User(), "type:", fmt.Sprintf("%s:%s", connType, stringPort))
+
+	state.Metrics.ForwardCreated(listenerType)
+
+	if viper.GetBool("health-check") && lbBalancer != nil {
+		probePayload := &forwardedTCPPayload{
+			Addr:       originalAddress,
+			Port:       portChannelForwardReplyPayload.Rport,
+			OriginAddr: originalAddress,
+			OriginPort: portChannelForwardReplyPayload.Rport,
+		}
+
+		healthCheck := utils.NewHealthCheck(listenerHolder, lbBalancer, lbServerURL, healthProbe(sshConn, listenerHolder, probePayload, healthHTTPHost))
+		stopHealthCheck = healthCheck.Stop
+
+		go healthCheck.Run()
+	}
+
+	stopBreakerWatch = sshConn.Breaker.Watch(lbBalancer, lbServerURL, listenerHolder)
+
+	openChannel := func() (ssh.Channel, <-chan *ssh.Request, error) {
+		resp := &forwardedTCPPayload{
+			Addr:       originalAddress,
+			Port:       portChannelForwardReplyPayload.Rport,
+			OriginAddr: originalAddress,
+			OriginPort: portChannelForwardReplyPayload.Rport,
+		}
+
+		return sshConn.SSHConn.OpenChannel("forwarded-tcpip", ssh.Marshal(resp))
+	}
+
+	if listenerType == utils.AliasListener && viper.GetInt("tcp-aliases-pool-size") > 0 {
+		channelPool = utils.NewChannelPool(openChannel)
+		go channelPool.Run()
+	}
+
 	go func() {
 		defer cleanupOnce.Do(cleanupChanListener)
 		for {
@@ -389,16 +577,55 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 				break
 			}
 
+			// The slot is taken before the connection gets a goroutine, so
+			// waiting connections stay in the listener's backlog.
+			if !listenerHolder.Limiter.Acquire(viper.GetDuration("max-concurrent-forwards-timeout"), sshConn.Close) {
+				utils.LogEvent("forward_rejected", utils.LogFields{
+					"remote_addr": utils.LogAddr(sshConn.SSHConn.RemoteAddr()),
+					"user":        sshConn.SSHConn.User(),
+					"listener":    listenerHolder.Addr().String(),
+				}, "Rejected connection to", listenerHolder.Addr().String(), "for client:", utils.LogAddr(sshConn.SSHConn.RemoteAddr()), "no forward slot became available")
+
+				err := cl.Close()
+				if err != nil {
+					log.Println("Error closing client connection:", err)
+				}
+				continue
+			}
+
 			go func() {
-				resp := &forwardedTCPPayload{
-					Addr:       originalAddress,
-					Port:       portChannelForwardReplyPayload.Rport,
-					OriginAddr: originalAddress,
-					OriginPort: portChannelForwardReplyPayload.Rport,
+				defer listenerHolder.Limiter.Release()
+
+				if listenerType == utils.TCPListener || listenerType == utils.AliasListener {
+					clientRemote, _, err := net.SplitHostPort(cl.RemoteAddr().String())
+					if err != nil || sshConn.ForwardBlocked(clientRemote) {
+						if viper.GetBool("debug") {
+							log.Printf("Blocked connection from %s to %s for client: %s", utils.LogAddr(cl.RemoteAddr()), listenerHolder.Addr().String(), utils.LogAddr(sshConn.SSHConn.RemoteAddr()))
+						}
+
+						err := cl.Close()
+						if err != nil {
+							log.Println("Error closing client connection:", err)
+						}
+						return
+					}
+				}
+
+				var newChan ssh.Channel
+
+				if channelPool != nil {
+					newChan, err = channelPool.Get()
+				} else {
+					var newReqs <-chan *ssh.Request
+
+					newChan, newReqs, err = openChannel()
+					if err == nil {
+						go ssh.DiscardRequests(newReqs)
+					}
 				}
 
-				newChan, newReqs, err := sshConn.SSHConn.OpenChannel("forwarded-tcpip", ssh.Marshal(resp))
 				if err != nil {
+					sshConn.Breaker.Failure()
 					sshConn.SendMessage(err.Error(), true)
 
 					err := cl.Close()
@@ -408,34 +635,70 @@ func handleRemoteForward(newRequest *ssh.Request, sshConn *utils.SSHConnection,
 					return
 				}
 
-				if sshConn.ProxyProto != 0 && listenerType == utils.TCPListener {
-					var sourceInfo *net.TCPAddr
-					var destInfo *net.TCPAddr
-					if _, ok := cl.RemoteAddr().(*net.TCPAddr); !ok {
-						sourceInfo = sshConn.SSHConn.RemoteAddr().(*net.TCPAddr)
-						destInfo = sshConn.SSHConn.LocalAddr().(*net.TCPAddr)
-					} else {
-						sourceInfo = cl.RemoteAddr().(*net.TCPAddr)
-						destInfo = cl.LocalAddr().(*net.TCPAddr)
-					}
+				sshConn.Breaker.Success()
 
-					proxyProtoHeader := proxyproto.Header{
-						Version:           sshConn.ProxyProto,
-						Command:           proxyproto.ProtocolVersionAndCommand(proxyproto.PROXY),
-						TransportProtocol: proxyproto.AddressFamilyAndProtocol(proxyproto.TCPv4),
-						SourceAddr:        sourceInfo,
-						DestinationAddr:   destInfo,
+				if listenerHolder.ProxyProto != 0 && (listenerType == utils.TCPListener || listenerType == utils.HTTPListener || (listenerType == utils.AliasListener && (sshConn.TCPAliasTLS || sshConn.TCPAliasMux))) {
+					sourceInfo, destInfo := utils.ProxyProtoAddrs(cl, sshConn.SSHConn)
+
+					var tlvs []proxyproto.TLV
+					if viper.GetBool("proxy-protocol-tlvs") {
+						tlvs = utils.ForwardedTLVs(cl)
 					}
 
-					_, err := proxyProtoHeader.WriteTo(newChan)
+					err := utils.WriteProxyProtoHeader(newChan, listenerHolder.ProxyProto, sourceInfo, destInfo, tlvs...)
 					if err != nil && viper.GetBool("debug") {
 						log.Println("Error writing to channel:", err)
 					}
 				}
 
-				go ssh.DiscardRequests(newReqs)
-				utils.CopyBoth(cl, newChan)
+				var clientConn net.Conn = cl
+				if listenerType == utils.HTTPListener && viper.GetBool("idle-connection") && viper.GetBool("idle-websocket") {
+					clientConn = utils.NewWebSocketIdleTimeoutConn(cl, sshConn)
+				} else if listenerType == utils.UDPListener {
+					// UDP flows are closed by the UDPHolder after udp-session-timeout.
+					clientConn = utils.NoIdleTimeoutConn{Conn: cl}
+				}
+
+				utils.CopyBoth(clientConn, newChan, sshConn)
 			}()
 		}
 	}()
 }
+
+// parseForwardProxyProto removes the ?proxy-protocol=version suffix from a
+// remote forward address and returns the address and the PROXY protocol
+// version to use for the forward. The version is "1", "2" or "none". If the
+// suffix is not provided, defaultVersion is returned.
+func parseForwardProxyProto(addr string, defaultVersion byte) (string, byte, error) {
+	forwardAddr, rawOptions, ok := strings.Cut(addr, "?")
+	if !ok {
+		return addr, defaultVersion, nil
+	}
+
+	options, err := url.ParseQuery(rawOptions)
+	if err != nil {
+		return "", 0, fmt.Errorf("unable to parse forward options %q: %w", rawOptions, err)
+	}
+
+	for option := range options {
+		if option != proxyProtocolPrefix {
+			return "", 0, fmt.Errorf("unknown forward option %q", option)
+		}
+	}
+
+	if !viper.GetBool("proxy-protocol") {
+		return "", 0, fmt.Errorf("proxy protocol is not enabled on this server")
+	}
+
+	version := options.Get(proxyProtocolPrefix)
+	if version == "none" {
+		return forwardAddr, 0, nil
+	}
+
+	proxyProto, err := getProxyProtoVersion(version)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return forwardAddr, proxyProto, nil
+}
@@ -3,13 +3,17 @@
 package sshmuxer
 
 import (
+	"crypto/tls"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"runtime"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/antoniomika/sish/httpmuxer"
@@ -21,8 +25,10 @@ import (
 )
 
 // Start initializes the ssh muxer service. It will start necessary components
-// and begin listening for SSH connections.
-func Start() {
+// and begin listening for SSH connections. Each configure function is called
+// with the state before any service starts, so programs embedding sish can set
+// extension points like the state's HostAllocator or AccessLogger.
+func Start(configure ...func(state *utils.State)) {
 	var (
 		httpPort  int
 		httpsPort int
@@ -59,6 +65,20 @@ func Start() {
 		log.Fatalln("Error parsing address:", err)
 	}
 
+	if proxyProtoVersion := viper.GetString("proxy-protocol-version"); proxyProtoVersion != "userdefined" {
+		_, err := utils.ParseProxyProtoVersion(proxyProtoVersion)
+		if err != nil {
+			log.Fatalln("Error parsing proxy protocol version:", err)
+		}
+	}
+
+	if viper.GetString("proxy-protocol-listener-trusted-cidrs") != "" || viper.GetString("proxy-protocol-listener-trusted-cidrs-file") != "" {
+		_, err := utils.ReloadProxyProtoTrustedCIDRs()
+		if err != nil {
+			log.Fatalln("Error parsing proxy protocol trusted cidrs:", err)
+		}
+	}
+
 	if viper.GetInt("http-port-override") != 0 {
 		httpPort = viper.GetInt("http-port-override")
 	}
@@ -76,8 +96,168 @@ func Start() {
 
 	state.Console.State = state
 
+	state.AdminClientCerts, err = utils.NewClientCertVerifier(viper.GetString("admin-console-client-ca"))
+	if err != nil {
+		log.Fatalln("Error loading admin console client certificate authorities:", err)
+	}
+
+	if viper.GetString("http-auth-file") != "" {
+		state.HTTPAuth, err = utils.LoadHTTPAuthFile(viper.GetString("http-auth-file"))
+		if err != nil {
+			log.Fatalln("Error loading HTTP auth file:", err)
+		}
+	}
+
+	if viper.GetString("state-store") == "redis" {
+		state.StateStore, err = utils.NewRedisStateStore(viper.GetString("state-store-redis-url"), viper.GetString("state-store-redis-prefix"))
+		if err != nil {
+			log.Fatalln("Error starting state store:", err)
+		}
+	} else if viper.GetString("state-store") != "memory" {
+		log.Fatalln("Error starting state store: unknown state-store", viper.GetString("state-store"))
+	}
+
+	for _, configureState := range configure {
+		configureState(state)
+	}
+
+	if _, ok := state.StateStore.(*utils.MemoryStateStore); !ok {
+		state.StartStateStore()
+	}
+
+	if port := viper.GetInt("multiprotocol-port"); port > 0 {
+		state.MultiProtocol, err = utils.NewMultiProtocolMux(viper.GetString("tcp-address"), uint32(port), viper.GetBool("https"))
+		if err != nil {
+			log.Fatalln("Error starting multiprotocol listener:", err)
+		}
+
+		state.Listeners.Store(state.MultiProtocol.Listener.Addr().String(), state.MultiProtocol.Listener)
+
+		log.Println("Starting multiprotocol listener on port:", port)
+
+		go state.MultiProtocol.Serve(state)
+	}
+
 	go httpmuxer.Start(state)
 
+	if viper.GetBool("tcp-aliases") && viper.GetString("tcp-aliases-mux-address") != "" {
+		go startAliasMux(state)
+	}
+
+	if viper.GetBool("metrics") {
+		metricsCerts, err := utils.NewClientCertVerifier(viper.GetString("metrics-client-ca"))
+		if err != nil {
+			log.Fatalln("Error loading metrics client certificate authorities:", err)
+		}
+
+		metricsCertificate := viper.GetString("metrics-tls-certificate")
+		if metricsCerts != nil && metricsCertificate == "" {
+			log.Fatalln("Error starting metrics service: metrics-client-ca requires metrics-tls-certificate and metrics-tls-key")
+		}
+
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", state.MetricsHandler())
+
+			metricsServer := &http.Server{
+				Addr:    viper.GetString("metrics-address"),
+				Handler: metricsCerts.Handler(mux),
+			}
+
+			log.Println("Starting metrics service on address:", viper.GetString("metrics-address"))
+
+			var err error
+
+			if metricsCertificate != "" {
+				metricsServer.TLSConfig = &tls.Config{}
+
+				if metricsCerts != nil {
+					metricsServer.TLSConfig.ClientAuth = tls.RequestClientCert
+				}
+
+				err = utils.ConfigureTLSBaseline(metricsServer.TLSConfig)
+				if err == nil {
+					err = metricsServer.ListenAndServeTLS(metricsCertificate, viper.GetString("metrics-tls-key"))
+				}
+			} else {
+				err = metricsServer.ListenAndServe()
+			}
+
+			if err != nil {
+				log.Fatalln("Error starting metrics service:", err)
+			}
+		}()
+	}
+
+	if viper.GetInt64("bandwidth-quota") > 0 {
+		var store utils.QuotaStore
+		if quotaFile := viper.GetString("bandwidth-quota-file"); quotaFile != "" {
+			store = &utils.FileQuotaStore{Path: quotaFile}
+		}
+
+		state.Quotas, err = utils.NewQuotas(store)
+		if err != nil {
+			log.Fatalln("Error loading bandwidth quotas:", err)
+		}
+
+		if viper.GetDuration("bandwidth-quota-save-interval") <= 0 {
+			log.Fatalln("Error starting bandwidth quotas: bandwidth-quota-save-interval must be greater than 0")
+		}
+
+		go func() {
+			ticker := time.NewTicker(viper.GetDuration("bandwidth-quota-save-interval"))
+			defer ticker.Stop()
+
+			for range ticker.C {
+				err := state.AccountQuotas()
+				if err != nil {
+					log.Println("Error saving bandwidth quotas:", err)
+				}
+			}
+		}()
+	}
+
+	if limit := viper.GetInt("ssh-connection-rate-limit"); limit > 0 {
+		window := viper.GetDuration("ssh-connection-rate-limit-window")
+		if window <= 0 {
+			log.Fatalln("Error starting connection rate limiting: ssh-connection-rate-limit-window must be greater than 0")
+		}
+
+		var allowed []*net.IPNet
+		if allowlist := viper.GetString("ssh-connection-rate-limit-allowlist"); allowlist != "" {
+			allowed, err = utils.ParseIPNets(allowlist)
+			if err != nil {
+				log.Fatalln("Error parsing ssh-connection-rate-limit-allowlist:", err)
+			}
+		}
+
+		state.ConnectionRateLimiter = utils.NewConnectionRateLimiter(limit, window, allowed)
+
+		go func() {
+			ticker := time.NewTicker(window)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				state.ConnectionRateLimiter.EvictStale()
+			}
+		}()
+	}
+
+	if reapIdleAfter := viper.GetDuration("reap-idle-after"); reapIdleAfter > 0 {
+		if viper.GetDuration("reap-interval") <= 0 {
+			log.Fatalln("Error starting reaper: reap-interval must be greater than 0")
+		}
+
+		go func() {
+			ticker := time.NewTicker(viper.GetDuration("reap-interval"))
+			defer ticker.Stop()
+
+			for range ticker.C {
+				state.ReapIdleConnections(reapIdleAfter)
+			}
+		}()
+	}
+
 	debugInterval := viper.GetDuration("debug-interval")
 
 	if viper.GetBool("debug") && debugInterval > 0 {
@@ -99,14 +279,14 @@ func Start() {
 						return true
 					})
 
-					log.Println(key, value.SSHConn.User(), listeners)
+					log.Println(utils.LogHostPort(key), value.SSHConn.User(), listeners)
 					return true
 				})
 				log.Println("===HTTP Listeners===")
 				state.HTTPListeners.Range(func(key string, value *utils.HTTPHolder) bool {
 					clients := []string{}
 					value.SSHConnections.Range(func(name string, conn *utils.SSHConnection) bool {
-						clients = append(clients, conn.SSHConn.RemoteAddr().String())
+						clients = append(clients, utils.LogAddr(conn.SSHConn.RemoteAddr()))
 						return true
 					})
 
@@ -117,7 +297,7 @@ func Start() {
 				state.AliasListeners.Range(func(key string, value *utils.AliasHolder) bool {
 					clients := []string{}
 					value.SSHConnections.Range(func(name string, conn *utils.SSHConnection) bool {
-						clients = append(clients, conn.SSHConn.RemoteAddr().String())
+						clients = append(clients, utils.LogAddr(conn.SSHConn.RemoteAddr()))
 						return true
 					})
 
@@ -128,7 +308,7 @@ func Start() {
 				state.TCPListeners.Range(func(key string, value *utils.TCPHolder) bool {
 					clients := []string{}
 					value.SSHConnections.Range(func(name string, conn *utils.SSHConnection) bool {
-						clients = append(clients, conn.SSHConn.RemoteAddr().String())
+						clients = append(clients, utils.LogAddr(conn.SSHConn.RemoteAddr()))
 						return true
 					})
 
@@ -160,51 +340,91 @@ func Start() {
 	log.Println("Starting SSH service on address:", viper.GetString("ssh-address"))
 
 	sshConfig := utils.GetSSHConfig()
+	state.LimitUserConnections(sshConfig)
 
-	var listener net.Listener
-
-	l, err := utils.Listen(viper.GetString("ssh-address"))
+	listeners, err := utils.ListenEach(viper.GetString("ssh-address"))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if viper.GetBool("proxy-protocol-listener") {
-		hListener := &proxyproto.Listener{
-			Listener: l,
+	conns := make(chan net.Conn)
+
+	for _, l := range listeners {
+		var listener net.Listener = l
+
+		if viper.GetBool("proxy-protocol-listener") {
+			hListener := &proxyproto.Listener{
+				Listener: l,
+			}
+
+			utils.LoadProxyProtoConfig(hListener)
+			listener = hListener
 		}
 
-		utils.LoadProxyProtoConfig(hListener)
-		listener = hListener
-	} else {
-		listener = l
+		listenerAddr := l.Addr().String()
+		state.Listeners.Store(listenerAddr, listener)
+
+		go func() {
+			defer func() {
+				err := listener.Close()
+				if err != nil && !utils.ListenerClosed(err) {
+					log.Println("Error closing listener:", err)
+				}
+
+				state.Listeners.Delete(listenerAddr)
+			}()
+
+			for {
+				conn, err := listener.Accept()
+				if utils.ListenerClosed(err) {
+					return
+				} else if err != nil {
+					log.Println(err)
+					continue
+				}
+
+				conns <- conn
+			}
+		}()
 	}
 
-	state.Listeners.Store(viper.GetString("ssh-address"), listener)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			_, _, err := utils.ReloadKeys()
+			if err != nil {
+				log.Println("Error reloading authentication keys:", err)
+			}
 
-	defer func() {
-		err := listener.Close()
-		if err != nil {
-			log.Println("Error closing listener:", err)
+			if viper.GetBool("proxy-protocol-listener") {
+				_, err = utils.ReloadProxyProtoTrustedCIDRs()
+				if err != nil {
+					log.Println("Error reloading proxy protocol trusted cidrs:", err)
+				}
+			}
 		}
-
-		state.Listeners.Delete(viper.GetString("ssh-address"))
 	}()
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		for range c {
+			closed := state.CloseAll(viper.GetString("shutdown-message"))
+			log.Println("Closed SSH connections before shutdown:", closed)
+
+			state.CloseListeners()
+
+			err := state.AccountQuotas()
+			if err != nil {
+				log.Println("Error saving bandwidth quotas:", err)
+			}
+
 			os.Exit(0)
 		}
 	}()
 
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-
+	for conn := range conns {
 		go func() {
 			clientRemote, _, err := net.SplitHostPort(conn.RemoteAddr().String())
 
@@ -215,7 +435,20 @@ func Start() {
 				}
 
 				if viper.GetBool("debug") {
-					log.Printf("Blocked connection from %s to %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
+					log.Printf("Blocked connection from %s to %s", utils.LogAddr(conn.RemoteAddr()), conn.LocalAddr().String())
+				}
+
+				return
+			}
+
+			if !state.ConnectionRateLimiter.Allow(clientRemote) {
+				err := conn.Close()
+				if err != nil {
+					log.Println("Error closing connection:", err)
+				}
+
+				if viper.GetBool("debug") {
+					log.Printf("Rate limited connection from %s to %s", utils.LogAddr(conn.RemoteAddr()), conn.LocalAddr().String())
 				}
 
 				return
@@ -241,7 +474,7 @@ func Start() {
 				}()
 			}
 
-			log.Println("Accepted SSH connection for:", conn.RemoteAddr())
+			utils.LogEvent("connection_accepted", utils.LogFields{"remote_addr": utils.LogAddr(conn.RemoteAddr())}, "Accepted SSH connection for:", utils.LogAddr(conn.RemoteAddr()))
 
 			sshConn, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
 			clientLoggedInMutex.Lock()
@@ -275,9 +508,25 @@ func Start() {
 				Session:                make(chan bool),
 				SetupLock:              &sync.Mutex{},
 				TCPAliasesAllowedUsers: []string{pubKeyFingerprint},
+				Created:                time.Now(),
+				KeyPermissions:         utils.KeyPermissionsFromSSH(sshConn.Permissions),
+			}
+
+			if holderConn.KeyPermissions != nil {
+				holderConn.Priority = holderConn.KeyPermissions.Priority
+			}
+
+			if viper.GetBool("circuit-breaker") {
+				holderConn.Breaker = utils.NewCircuitBreaker(holderConn)
 			}
 
 			state.SSHConnections.Store(sshConn.RemoteAddr().String(), holderConn)
+			state.Metrics.ConnectionOpened()
+
+			if !state.RegisterUserConnection(holderConn) {
+				log.Println("Connection limit reached for user:", holderConn.UserKey())
+				holderConn.ConnectionLimitReached = true
+			}
 
 			go func() {
 				err := sshConn.Wait()
@@ -289,13 +538,17 @@ func Start() {
 				case <-holderConn.Close:
 					break
 				default:
-					holderConn.CleanUp(state)
+					holderConn.CleanUp(state, utils.CloseReasonClientDisconnect)
 				}
 			}()
 
 			go handleRequests(reqs, holderConn, state)
 			go handleChannels(chans, holderConn, state)
 
+			if keepAliveInterval := viper.GetDuration("ssh-keepalive-interval"); keepAliveInterval > 0 {
+				go holderConn.KeepAlive(state, keepAliveInterval, viper.GetInt("ssh-keepalive-max-failures"))
+			}
+
 			go func() {
 				select {
 				case <-holderConn.Exec:
@@ -306,6 +559,9 @@ func Start() {
 				runTime := 0.0
 				ticker := time.NewTicker(1 * time.Second)
 
+				maxLifetime := viper.GetDuration("max-connection-lifetime")
+				var lifetimeCleanup time.Time
+
 				for {
 					select {
 					case <-ticker.C:
@@ -314,14 +570,28 @@ func Start() {
 						if holderConn.Deadline != nil && time.Now().After(*holderConn.Deadline) {
 							holderConn.SendMessage("Connection deadline reached. Closing connection.", true)
 							time.Sleep(1 * time.Millisecond)
-							holderConn.CleanUp(state)
+							holderConn.CleanUp(state, utils.CloseReasonDeadline)
+							return
+						}
+
+						if maxLifetime > 0 && lifetimeCleanup.IsZero() && time.Since(holderConn.Created) > maxLifetime {
+							grace := viper.GetDuration("max-connection-lifetime-grace")
+							lifetimeCleanup = time.Now().Add(grace)
+
+							holderConn.SendMessage(fmt.Sprintf("Connection has reached the maximum lifetime of %s and will be closed in %s. Please reconnect to continue.", maxLifetime, grace), true)
+						}
+
+						if !lifetimeCleanup.IsZero() && !time.Now().Before(lifetimeCleanup) {
+							holderConn.SendMessage("Maximum connection lifetime reached. Closing connection.", true)
+							time.Sleep(1 * time.Millisecond)
+							holderConn.CleanUp(state, utils.CloseReasonLifetime)
 							return
 						}
 
 						if ((viper.GetBool("cleanup-unbound") && runTime > viper.GetDuration("cleanup-unbound-timeout").Seconds()) || holderConn.AutoClose) && holderConn.ListenerCount() == 0 {
 							holderConn.SendMessage("No forwarding requests sent. Closing connection.", true)
 							time.Sleep(1 * time.Millisecond)
-							holderConn.CleanUp(state)
+							holderConn.CleanUp(state, utils.CloseReasonUnbound)
 						}
 					case <-holderConn.Close:
 						return
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/antoniomika/multilistener"
@@ -33,11 +34,33 @@ func handleTCPListener(check *channelForwardMsg, bindPort uint32, requestMessage
 		balancerName = check.Addr
 	}
 
+	// closeNewListener closes the listener if it was created for this forward.
+	closeNewListener := func() {}
+
 	if tH == nil {
-		lis, err := utils.Listen(tcpAddr)
-		if err != nil {
-			log.Println("Error listening on addr:", err)
-			return nil, nil, "", nil, "", "", err
+		var l net.Listener
+
+		// Raw TCP connections to the multiprotocol port are handed over by
+		// its listener, which has already read any proxy protocol header.
+		if multiProtocolListener := state.MultiProtocol.TCPListener(tcpPort); multiProtocolListener != nil {
+			l = multiProtocolListener
+		} else {
+			lis, err := utils.Listen(tcpAddr)
+			if err != nil {
+				log.Println("Error listening on addr:", err)
+				return nil, nil, "", nil, "", "", err
+			}
+
+			l = lis
+
+			if viper.GetBool("proxy-protocol-listener") {
+				ln := &proxyproto.Listener{
+					Listener: lis,
+				}
+
+				utils.LoadProxyProtoConfig(ln)
+				l = ln
+			}
 		}
 
 		tH = &utils.TCPHolder{
@@ -51,33 +74,42 @@ func handleTCPListener(check *channelForwardMsg, bindPort uint32, requestMessage
 			balancerName = check.Addr
 		}
 
-		var l net.Listener
-
-		if viper.GetBool("proxy-protocol-listener") {
-			ln := &proxyproto.Listener{
-				Listener: lis,
-			}
-
-			utils.LoadProxyProtoConfig(ln)
-			l = ln
-		} else {
-			l = lis
-		}
-
 		tH.Listener = l
 
 		state.Listeners.Store(tcpAddr, l)
 		state.TCPListeners.Store(tcpAddr, tH)
+
+		closeNewListener = func() {
+			err := l.Close()
+			if err != nil {
+				log.Println("Error closing TCPListener:", err)
+			}
+
+			state.Listeners.Delete(tcpAddr)
+			state.TCPListeners.Delete(tcpAddr)
+		}
 	}
 
+	domainName := viper.GetString("domain")
+
 	if sniProxyEnabled {
 		newName, err := utils.GetOpenSNIHost(balancerName, state, sshConn, tH)
 
 		if err != nil || (!strings.HasPrefix(newName, check.Addr) && viper.GetBool("force-requested-subdomains")) {
+			closeNewListener()
 			return nil, nil, "", nil, "", "", fmt.Errorf("error assigning requested address to tunnel")
 		}
 
-		balancerName = newName
+		if !sshConn.KeyPermissions.ServerNameAllowed(newName) {
+			closeNewListener()
+			sshConn.SendMessage(fmt.Sprintf("The server name %s is not allowed for your key.", newName), true)
+			return nil, nil, "", nil, "", "", fmt.Errorf("server name not allowed for key")
+		}
+
+		domainName = newName
+		balancerName = utils.SNIRouteKey(newName, sshConn.ALPN)
+	} else if balancerName != "" {
+		domainName = balancerName
 	}
 
 	foundBalancer, ok := tH.Balancers.Load(balancerName)
@@ -102,24 +134,28 @@ func handleTCPListener(check *channelForwardMsg, bindPort uint32, requestMessage
 		Host: base64.StdEncoding.EncodeToString([]byte(listenerHolder.Addr().String())),
 	}
 
-	err := balancer.UpsertServer(serverURL)
+	err := balancer.UpsertServer(serverURL, roundrobin.Weight(sshConn.BalancerWeight()))
 	if err != nil {
 		log.Println("Unable to add server to balancer")
 	}
 
-	domainName := viper.GetString("domain")
-	if balancerName != "" {
-		domainName = balancerName
-	}
-
 	connType := "TCP"
 	if sniProxyEnabled {
 		connType = "TLS"
+
+		if sshConn.ALPN != "" {
+			connType = fmt.Sprintf("TLS (%s)", sshConn.ALPN)
+		}
 	}
 
 	listenPort := tH.Listener.Addr().(*multilistener.MultiListener).Addresses()[0].(*net.TCPAddr).Port
 	requestMessages += fmt.Sprintf("%s: %s:%d\r\n", aurora.BgBlue(connType), domainName, listenPort)
-	log.Printf("%s forwarding started: %s:%d -> %s for client: %s\n", aurora.BgBlue(connType), domainName, listenPort, listenerHolder.Addr().String(), sshConn.SSHConn.RemoteAddr().String())
+	listenerHolder.AddAddress(fmt.Sprintf("%s://%s:%d", strings.ToLower(strings.Fields(connType)[0]), domainName, listenPort))
+	log.Printf("%s forwarding started: %s:%d -> %s for client: %s\n", aurora.BgBlue(connType), domainName, listenPort, listenerHolder.Addr().String(), utils.LogAddr(sshConn.SSHConn.RemoteAddr()))
+
+	if !sniProxyEnabled {
+		state.AddReservedForward(sshConn, utils.ReservedTCP, fmt.Sprintf("%s:%d", check.Addr, bindPort), strconv.Itoa(listenPort))
+	}
 
 	return tH, balancer, balancerName, serverURL, tcpAddr, requestMessages, nil
 }
@@ -0,0 +1,79 @@
+package sshmuxer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+
+	"github.com/antoniomika/sish/utils"
+	"github.com/logrusorgru/aurora"
+	"github.com/spf13/viper"
+	"github.com/vulcand/oxy/roundrobin"
+)
+
+// handleUDPListener handles the creation of the udpHandler
+// (or addition for load balancing) and sets up the underlying listener.
+func handleUDPListener(check *channelForwardMsg, bindPort uint32, requestMessages string, listenerHolder *utils.ListenerHolder, state *utils.State, sshConn *utils.SSHConnection) (*utils.UDPHolder, *url.URL, string, error) {
+	udpAddr, udpPort, uH, err := utils.GetOpenUDPPort(check.Addr, bindPort, state, sshConn)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if udpPort != bindPort && viper.GetBool("force-requested-ports") {
+		return nil, nil, "", fmt.Errorf("error assigning requested port to tunnel")
+	}
+
+	if uH == nil {
+		conn, err := net.ListenPacket("udp", udpAddr)
+		if err != nil {
+			log.Println("Error listening on addr:", err)
+			return nil, nil, "", err
+		}
+
+		balancer, err := roundrobin.New(nil)
+		if err != nil {
+			log.Println("Error initializing udp balancer:", err)
+
+			err := conn.Close()
+			if err != nil {
+				log.Println("Error closing UDP listener:", err)
+			}
+
+			return nil, nil, "", err
+		}
+
+		host, _, err := net.SplitHostPort(udpAddr)
+		if err != nil {
+			host = udpAddr
+		}
+
+		udpAddr = net.JoinHostPort(host, fmt.Sprint(conn.LocalAddr().(*net.UDPAddr).Port))
+
+		uH = utils.NewUDPHolder(udpAddr, conn, balancer)
+		state.UDPListeners.Store(udpAddr, uH)
+
+		uH.Start(state)
+	}
+
+	uH.SSHConnections.Store(listenerHolder.Addr().String(), sshConn)
+
+	serverURL := &url.URL{
+		Host: base64.StdEncoding.EncodeToString([]byte(listenerHolder.Addr().String())),
+	}
+
+	err = uH.Balancer.UpsertServer(serverURL, roundrobin.Weight(sshConn.BalancerWeight()))
+	if err != nil {
+		log.Println("Unable to add server to balancer")
+	}
+
+	listenPort := uH.Conn.LocalAddr().(*net.UDPAddr).Port
+	domainName := viper.GetString("domain")
+
+	requestMessages += fmt.Sprintf("%s: %s:%d\r\n", aurora.BgBlue("UDP"), domainName, listenPort)
+	listenerHolder.AddAddress(fmt.Sprintf("udp://%s:%d", domainName, listenPort))
+	log.Printf("%s forwarding started: %s:%d -> %s for client: %s\n", aurora.BgBlue("UDP"), domainName, listenPort, listenerHolder.Addr().String(), utils.LogAddr(sshConn.SSHConn.RemoteAddr()))
+
+	return uH, serverURL, requestMessages, nil
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	// AccessLogFormatCommon writes access logs in the Common Log Format,
+	// followed by the host, duration and connection id.
+	AccessLogFormatCommon = "common"
+
+	// AccessLogFormatJSON writes access logs as JSON objects.
+	AccessLogFormatJSON = "json"
+)
+
+// AccessLogEntry describes a HTTP request that was handled by the HTTP muxer.
+type AccessLogEntry struct {
+	Time     time.Time
+	ClientIP string
+	Method   string
+	Host     string
+	Path     string
+	Proto    string
+	Status   int
+	Bytes    int
+	Duration time.Duration
+
+	// ConnectionID is the remote address of the SSH connection that served
+	// the request. It is empty if no forward served it.
+	ConnectionID string
+
+	// Env is the environment variables set by the client of the SSH
+	// connection that served the request. It is only written in JSON.
+	Env map[string]string
+}
+
+// AccessLogger is called after each HTTP request handled by the HTTP muxer
+// completes.
+type AccessLogger interface {
+	LogAccess(entry AccessLogEntry)
+}
+
+// AccessLoggerFunc is a function that implements AccessLogger.
+type AccessLoggerFunc func(entry AccessLogEntry)
+
+// LogAccess calls f(entry).
+func (f AccessLoggerFunc) LogAccess(entry AccessLogEntry) {
+	f(entry)
+}
+
+// NewAccessLogger returns an AccessLogger that writes each entry to w in
+// format.
+func NewAccessLogger(format string, w io.Writer) (AccessLogger, error) {
+	var formatter func(AccessLogEntry) []byte
+
+	switch format {
+	case AccessLogFormatCommon:
+		formatter = commonAccessLogLine
+	case AccessLogFormatJSON:
+		formatter = jsonAccessLogLine
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", format)
+	}
+
+	return AccessLoggerFunc(func(entry AccessLogEntry) {
+		_, err := w.Write(formatter(entry))
+		if err != nil {
+			log.Println("Error writing access log:", err)
+		}
+	}), nil
+}
+
+// commonAccessLogLine formats entry in the Common Log Format, followed by the
+// host, duration and connection id.
+func commonAccessLogLine(entry AccessLogEntry) []byte {
+	connectionID := entry.ConnectionID
+	if connectionID == "" {
+		connectionID = "-"
+	}
+
+	return fmt.Appendf(nil, "%s - - [%s] \"%s %s %s\" %d %d %q %s %s\n",
+		entry.ClientIP,
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method, entry.Path, entry.Proto,
+		entry.Status,
+		entry.Bytes,
+		entry.Host,
+		entry.Duration,
+		connectionID,
+	)
+}
+
+// jsonAccessLogLine formats entry as a JSON object.
+func jsonAccessLogLine(entry AccessLogEntry) []byte {
+	fields := LogFields{
+		"client_ip":     entry.ClientIP,
+		"method":        entry.Method,
+		"host":          entry.Host,
+		"path":          entry.Path,
+		"proto":         entry.Proto,
+		"status":        entry.Status,
+		"bytes":         entry.Bytes,
+		"duration_ms":   float64(entry.Duration.Microseconds()) / 1000,
+		"connection_id": entry.ConnectionID,
+	}
+
+	if len(entry.Env) > 0 {
+		fields["env"] = entry.Env
+	}
+
+	return jsonLogLine("http_request", fmt.Sprintf("%s %s%s %d", entry.Method, entry.Host, entry.Path, entry.Status), fields)
+}
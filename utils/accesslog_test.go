@@ -0,0 +1,78 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestNewAccessLogger validates the common and JSON access log formats.
+func TestNewAccessLogger(t *testing.T) {
+	entry := AccessLogEntry{
+		Time:         time.Date(2024, time.March, 5, 10, 4, 5, 0, time.UTC),
+		ClientIP:     "203.0.113.10",
+		Method:       "GET",
+		Host:         "app.example.com",
+		Path:         "/index.html?q=1",
+		Proto:        "HTTP/1.1",
+		Status:       200,
+		Bytes:        512,
+		Duration:     1500 * time.Microsecond,
+		ConnectionID: "198.51.100.1:51234",
+	}
+
+	buf := &bytes.Buffer{}
+
+	logger, err := NewAccessLogger(AccessLogFormatCommon, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.LogAccess(entry)
+
+	want := "203.0.113.10 - - [05/Mar/2024:10:04:05 +0000] \"GET /index.html?q=1 HTTP/1.1\" 200 512 \"app.example.com\" 1.5ms 198.51.100.1:51234\n"
+	if buf.String() != want {
+		t.Errorf("Common log line %q when should have been %q", buf.String(), want)
+	}
+
+	buf.Reset()
+
+	logger, err = NewAccessLogger(AccessLogFormatJSON, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger.LogAccess(entry)
+
+	line := map[string]any{}
+
+	err = json.Unmarshal(buf.Bytes(), &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if line["event"] != "http_request" || line["status"] != float64(200) || line["duration_ms"] != 1.5 || line["connection_id"] != entry.ConnectionID {
+		t.Errorf("Invalid JSON log line %s", buf.String())
+	}
+
+	buf.Reset()
+	entry.Env = map[string]string{"CI_BUILD_ID": "1234"}
+	logger.LogAccess(entry)
+
+	line = map[string]any{}
+
+	err = json.Unmarshal(buf.Bytes(), &line)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if env, ok := line["env"].(map[string]any); !ok || env["CI_BUILD_ID"] != "1234" {
+		t.Errorf("JSON log line %s should have included the client's environment variables", buf.String())
+	}
+
+	_, err = NewAccessLogger("apache", buf)
+	if err == nil {
+		t.Error("Unknown format should have been rejected")
+	}
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"net"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// CertificateHostAllowed returns whether sish can request a certificate for
+// name on demand. The name must be the domain, a host bound by a HTTP forward
+// or the host of a TLS alias. Custom domains are only bound once the client
+// has proven it owns them, so certificates aren't issued for hosts nobody
+// claimed.
+func (s *State) CertificateHostAllowed(name string) bool {
+	name = strings.ToLower(name)
+
+	if name == viper.GetString("domain") {
+		return true
+	}
+
+	ok := false
+
+	s.HTTPListeners.Range(func(key string, locationListener *HTTPHolder) bool {
+		if name == locationListener.HTTPUrl.Host || MatchesWildcardHost(name, locationListener.HTTPUrl.Host) {
+			ok = true
+			return false
+		}
+
+		return true
+	})
+
+	if ok {
+		return true
+	}
+
+	s.AliasListeners.Range(func(key string, aliasHolder *AliasHolder) bool {
+		aliasHost, _, err := net.SplitHostPort(aliasHolder.AliasHost)
+		if err == nil && aliasHolder.TLS && name == aliasHost {
+			ok = true
+			return false
+		}
+
+		return true
+	})
+
+	return ok
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// TestCertificateHostAllowed validates that certificates are only allowed for
+// the domain and hosts claimed by a forward.
+func TestCertificateHostAllowed(t *testing.T) {
+	viper.Set("domain", "example.com")
+	defer viper.Set("domain", nil)
+
+	state := NewState()
+
+	state.HTTPListeners.Store("http://custom.org/", &HTTPHolder{HTTPUrl: &url.URL{Host: "custom.org"}})
+	state.HTTPListeners.Store("http://*.wild.org/", &HTTPHolder{HTTPUrl: &url.URL{Host: "*.wild.org"}})
+	state.AliasListeners.Store("tls.org:443", &AliasHolder{AliasHost: "tls.org:443", TLS: true})
+	state.AliasListeners.Store("plain.org:443", &AliasHolder{AliasHost: "plain.org:443"})
+
+	for name, allowed := range map[string]bool{
+		"example.com":       true,
+		"custom.org":        true,
+		"Custom.org":        true,
+		"app.wild.org":      true,
+		"wild.org":          false,
+		"tls.org":           true,
+		"plain.org":         false,
+		"unclaimed.org":     false,
+		"sub.custom.org":    false,
+		"other.example.com": false,
+	} {
+		if got := state.CertificateHostAllowed(name); got != allowed {
+			t.Errorf("Certificate for %s allowed was %t when should have been %t", name, got, allowed)
+		}
+	}
+}
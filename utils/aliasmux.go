@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+)
+
+// AliasMuxHintMagic starts the routing hint a client sends to the TCP alias
+// multiplexer when its protocol doesn't use TLS. It is followed by one byte
+// with the length of the alias name and the name itself.
+const AliasMuxHintMagic = "SISH"
+
+// ReadAliasMuxHint reads the routing hint from the start of buffer. It
+// returns whether or not the connection started with a hint. If it didn't,
+// nothing is consumed from buffer.
+func ReadAliasMuxHint(buffer *bufio.Reader) (string, bool, error) {
+	magic, err := buffer.Peek(len(AliasMuxHintMagic) + 1)
+	if err != nil || string(magic[:len(AliasMuxHintMagic)]) != AliasMuxHintMagic {
+		return "", false, nil
+	}
+
+	nameLength := int(magic[len(AliasMuxHintMagic)])
+	if nameLength == 0 {
+		return "", true, fmt.Errorf("routing hint does not contain an alias")
+	}
+
+	hint, err := buffer.Peek(len(magic) + nameLength)
+	if err != nil {
+		return "", true, fmt.Errorf("unable to read routing hint: %w", err)
+	}
+
+	name := string(hint[len(magic):])
+
+	_, err = buffer.Discard(len(hint))
+	if err != nil {
+		return "", true, err
+	}
+
+	return name, true, nil
+}
+
+// AliasMuxRoute returns the alias a connection to the TCP alias multiplexer
+// should be sent to. name is either the full alias (host:port), or a host
+// that only one alias uses. Only aliases that enabled multiplexing are used,
+// and other aliases are reported as not found.
+func (s *State) AliasMuxRoute(name string) (*AliasHolder, error) {
+	if aH, ok := s.AliasListeners.Load(name); ok && aH.Mux {
+		return aH, nil
+	}
+
+	var match *AliasHolder
+	matches := 0
+
+	s.AliasListeners.Range(func(alias string, aH *AliasHolder) bool {
+		host, _, err := net.SplitHostPort(alias)
+		if err == nil && host == name && aH.Mux {
+			match = aH
+			matches++
+		}
+
+		return true
+	})
+
+	switch matches {
+	case 0:
+		return nil, fmt.Errorf("no alias matches %s", name)
+	case 1:
+		return match, nil
+	}
+
+	return nil, fmt.Errorf("%s matches %d aliases, include the port to select one", name, matches)
+}
@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// TestReadAliasMuxHint validates that a routing hint is removed from the
+// connection and that other data is left untouched.
+func TestReadAliasMuxHint(t *testing.T) {
+	buffer := bufio.NewReader(bytes.NewReader(append([]byte(AliasMuxHintMagic+"\x0cmyalias:5432"), []byte("payload")...)))
+
+	name, ok, err := ReadAliasMuxHint(buffer)
+	if err != nil || !ok || name != "myalias:5432" {
+		t.Fatalf("Read hint %q (%t, %v) when should have been \"myalias:5432\"", name, ok, err)
+	}
+
+	rest, err := io.ReadAll(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(rest) != "payload" {
+		t.Errorf("Remaining data %q when should have been \"payload\"", rest)
+	}
+
+	buffer = bufio.NewReader(bytes.NewReader([]byte("GET / HTTP/1.1\r\n")))
+
+	_, ok, err = ReadAliasMuxHint(buffer)
+	if ok || err != nil {
+		t.Errorf("Connection without a hint returned %t, %v", ok, err)
+	}
+
+	if buffer.Buffered() != len("GET / HTTP/1.1\r\n") {
+		t.Error("Data was consumed from a connection without a hint")
+	}
+
+	_, ok, err = ReadAliasMuxHint(bufio.NewReader(bytes.NewReader([]byte(AliasMuxHintMagic + "\x10short"))))
+	if !ok || err == nil {
+		t.Error("Truncated hint should have returned an error")
+	}
+}
+
+// TestAliasMuxRoute validates that aliases are routed by full name or unique
+// host, and only when they allow multiplexing.
+func TestAliasMuxRoute(t *testing.T) {
+	state := NewState()
+
+	db := &AliasHolder{AliasHost: "db:5432", Mux: true}
+	web := &AliasHolder{AliasHost: "web:80", Mux: true}
+	webTLS := &AliasHolder{AliasHost: "web:443", Mux: true}
+	private := &AliasHolder{AliasHost: "private:22"}
+
+	for _, aH := range []*AliasHolder{db, web, webTLS, private} {
+		state.AliasListeners.Store(aH.AliasHost, aH)
+	}
+
+	testCases := []struct {
+		name   string
+		holder *AliasHolder
+	}{
+		{"db:5432", db},
+		{"db", db},
+		{"web:443", webTLS},
+		{"web", nil},
+		{"private:22", nil},
+		{"private", nil},
+		{"missing", nil},
+	}
+
+	for _, testCase := range testCases {
+		aH, err := state.AliasMuxRoute(testCase.name)
+		if aH != testCase.holder || (err == nil) != (testCase.holder != nil) {
+			t.Errorf("Unexpected route for %s: %v", testCase.name, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/logrusorgru/aurora"
+	"github.com/spf13/viper"
+)
+
+// HostAllocator chooses the host of a HTTP forward. requested is the address
+// the client asked for, which can start with credentials and end with a path
+// if bind-http-auth or bind-http-path are enabled. An error rejects the
+// forward and is shown to the client.
+type HostAllocator interface {
+	AllocateHost(sshConn *SSHConnection, requested string) (string, error)
+}
+
+// HostAllocatorFunc is a function that implements HostAllocator.
+type HostAllocatorFunc func(sshConn *SSHConnection, requested string) (string, error)
+
+// AllocateHost calls f(sshConn, requested).
+func (f HostAllocatorFunc) AllocateHost(sshConn *SSHConnection, requested string) (string, error) {
+	return f(sshConn, requested)
+}
+
+// DefaultHostAllocator assigns the requested subdomain if it is available and
+// a random one otherwise. If load balancing is enabled, a host that is in use
+// is assigned so the forward joins its balancer.
+type DefaultHostAllocator struct {
+	State *State
+}
+
+// hostRequest is the address a client asked for when creating a HTTP forward.
+type hostRequest struct {
+	Addr     string
+	Username string
+	Password string
+	Path     string
+}
+
+// parseHostRequest splits the credentials and path off of a requested
+// address. They are only kept if bind-http-auth and bind-http-path are
+// enabled.
+func parseHostRequest(requested string) hostRequest {
+	request := hostRequest{
+		Addr: requested,
+	}
+
+	if strings.Contains(request.Addr, "@") {
+		hostParts := strings.SplitN(request.Addr, "@", 2)
+
+		request.Addr = hostParts[1]
+
+		if viper.GetBool("bind-http-auth") && len(hostParts[0]) > 0 {
+			authParts := strings.Split(hostParts[0], ":")
+
+			if len(authParts) > 0 {
+				request.Username = authParts[0]
+			}
+
+			if len(authParts) > 1 {
+				request.Password = authParts[1]
+			}
+		}
+	}
+
+	if strings.Contains(request.Addr, "/") {
+		pathParts := strings.SplitN(request.Addr, "/", 2)
+
+		if viper.GetBool("bind-http-path") && len(pathParts[1]) > 0 {
+			request.Path = fmt.Sprintf("/%s", pathParts[1])
+		}
+
+		request.Addr = pathParts[0]
+	}
+
+	return request
+}
+
+// httpHolderFor returns the HTTP holder bound to exactly host, path and
+// credentials, or nil if there is none.
+func (s *State) httpHolderFor(host string, request hostRequest) *HTTPHolder {
+	var holder *HTTPHolder
+
+	s.HTTPListeners.Range(func(key string, locationListener *HTTPHolder) bool {
+		parsedPassword, _ := locationListener.HTTPUrl.User.Password()
+
+		if host == locationListener.HTTPUrl.Host && request.Path == locationListener.HTTPUrl.Path && request.Username == locationListener.HTTPUrl.User.Username() && request.Password == parsedPassword {
+			holder = locationListener
+			return false
+		}
+
+		return true
+	})
+
+	return holder
+}
+
+// AllocateHost implements HostAllocator.
+func (d *DefaultHostAllocator) AllocateHost(sshConn *SSHConnection, requested string) (string, error) {
+	state := d.State
+	request := parseHostRequest(requested)
+	addr := request.Addr
+
+	first := true
+	hostExtension := ""
+
+	if viper.GetBool("append-user-to-subdomain") {
+		hostExtension = viper.GetString("append-user-to-subdomain-separator") + sshConn.SSHConn.User()
+	}
+
+	var bindErr error
+
+	dnsMatch, _, err := verifyDNS(addr, sshConn)
+	if err != nil && viper.GetBool("debug") {
+		log.Println("Error looking up txt records for domain:", addr)
+	}
+
+	proposedHost := fmt.Sprintf("%s%s.%s", addr, hostExtension, viper.GetString("domain"))
+	domainParts := strings.Join(strings.Split(addr, ".")[1:], ".")
+
+	if dnsMatch || (viper.GetBool("bind-any-host") && strings.Contains(addr, ".")) || inList(domainParts, strings.FieldsFunc(viper.GetString("bind-hosts"), CommaSplitFields)) {
+		proposedHost = addr
+
+		if proposedHost == fmt.Sprintf(".%s", viper.GetString("domain")) {
+			proposedHost = viper.GetString("domain")
+		}
+	}
+
+	if viper.GetBool("bind-root-domain") && proposedHost == fmt.Sprintf(".%s", viper.GetString("domain")) {
+		proposedHost = viper.GetString("domain")
+	}
+
+	if strings.Contains(addr, ".") && sshConn.KeyPermissions.HoldsWildcard(addr) {
+		proposedHost = addr
+	}
+
+	host := strings.ToLower(proposedHost)
+
+	getRandomHost := func() string {
+		return strings.ToLower(RandStringBytesMaskImprSrc(viper.GetInt("bind-random-subdomains-length")) + "." + viper.GetString("domain"))
+	}
+
+	reportUnavailable := func(unavailable bool) {
+		if first && unavailable {
+			if viper.GetBool("force-requested-subdomains") {
+				bindErr = fmt.Errorf("the subdomain %s is unavailable", host)
+				return
+			}
+
+			sshConn.SendMessage(aurora.Sprintf("The subdomain %s is unavailable. Assigning a random subdomain.", aurora.Red(host)), true)
+		}
+	}
+
+	checkHost := func() bool {
+		if bindErr != nil {
+			return false
+		}
+
+		held := first && sshConn.KeyPermissions.HoldsWildcard(host)
+
+		if (viper.GetBool("bind-random-subdomains") && !held) || !first || inList(host, bannedSubdomainList) {
+			reportUnavailable(true)
+			host = getRandomHost()
+		}
+
+		if !viper.GetBool("bind-wildcards") && !held && strings.HasPrefix(host, wildcardPrefix) {
+			reportUnavailable(true)
+			host = getRandomHost()
+		}
+
+		holder := state.httpHolderFor(host, request)
+		ok := holder != nil
+
+		if ok && viper.GetBool("http-load-balancer") {
+			ok = false
+		}
+
+		if !ok && holder == nil && state.reservedByOther(sshConn, ReservedHTTP, host) {
+			ok = true
+		}
+
+		if !ok && wildcardReservedByOther(sshConn, host) {
+			ok = true
+		}
+
+		reportUnavailable(ok)
+
+		first = false
+		return ok
+	}
+
+	reclaimed := false
+
+	for _, reservedHost := range state.reservedForwards(sshConn, ReservedHTTP, requested) {
+		if state.httpHolderFor(reservedHost, request) == nil {
+			host = reservedHost
+			reclaimed = true
+			break
+		}
+	}
+
+	for !reclaimed && checkHost() {
+	}
+
+	if bindErr != nil {
+		return "", bindErr
+	}
+
+	return host, nil
+}
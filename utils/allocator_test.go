@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// TestHostAllocator validates that a custom allocator chooses the host of a
+// HTTP forward, and that failures and hosts in use are rejected.
+func TestHostAllocator(t *testing.T) {
+	viper.Set("bind-http-path", true)
+	defer viper.Set("bind-http-path", nil)
+
+	state := NewState()
+	state.HostAllocator = HostAllocatorFunc(func(sshConn *SSHConnection, requested string) (string, error) {
+		if strings.HasPrefix(requested, "denied") {
+			return "", errors.New("not in the service registry")
+		}
+
+		return "Web-" + sshConn.UserKey() + ".example.com", nil
+	})
+
+	sshConn := reservationTestConn("alice")
+	sshConn.Messages = make(chan string, 10)
+
+	hostURL, holder := GetOpenHost("app/api", state, sshConn)
+	if hostURL == nil || holder != nil {
+		t.Fatalf("Allocated %v with holder %v when should have been a new host", hostURL, holder)
+	}
+
+	if hostURL.Host != "web-alice.example.com" || hostURL.Path != "/api" {
+		t.Errorf("Allocated %s%s when should have been web-alice.example.com/api", hostURL.Host, hostURL.Path)
+	}
+
+	hostURL, _ = GetOpenHost("denied", state, sshConn)
+	if hostURL != nil {
+		t.Errorf("Allocated %s when the allocator failed", hostURL.Host)
+	}
+
+	if message := <-sshConn.Messages; !strings.Contains(message, "not in the service registry") {
+		t.Errorf("Rejection message %q does not contain the allocator error", message)
+	}
+
+	state.HTTPListeners.Store("taken", &HTTPHolder{
+		HTTPUrl: &url.URL{User: url.UserPassword("", ""), Host: "web-alice.example.com", Path: "/api"},
+	})
+
+	hostURL, _ = GetOpenHost("app/api", state, sshConn)
+	if hostURL != nil {
+		t.Errorf("Allocated %s when it is in use", hostURL.Host)
+	}
+
+	viper.Set("http-load-balancer", true)
+	defer viper.Set("http-load-balancer", nil)
+
+	if hostURL, holder := GetOpenHost("app/api", state, sshConn); hostURL == nil || holder == nil {
+		t.Error("Host in use was not joined when load balancing is enabled")
+	}
+}
@@ -0,0 +1,143 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// IPAnonymizationNone logs client IPs as they are.
+	IPAnonymizationNone = "none"
+
+	// IPAnonymizationTruncate logs the /24 network of IPv4 clients and the /48
+	// network of IPv6 clients.
+	IPAnonymizationTruncate = "truncate"
+
+	// IPAnonymizationHash logs a HMAC of client IPs, keyed with
+	// ip-anonymization-key.
+	IPAnonymizationHash = "hash"
+)
+
+var (
+	// anonymizationKey is the key used to hash client IPs when
+	// ip-anonymization-key isn't set. It is random for each run of sish.
+	anonymizationKey     []byte
+	anonymizationKeyOnce sync.Once
+)
+
+// hashKey returns the key client IPs are hashed with.
+func hashKey() []byte {
+	if key := viper.GetString("ip-anonymization-key"); key != "" {
+		return []byte(key)
+	}
+
+	anonymizationKeyOnce.Do(func() {
+		anonymizationKey = make([]byte, 32)
+		_, _ = rand.Read(anonymizationKey)
+	})
+
+	return anonymizationKey
+}
+
+// LogIP returns ip as it should be written to logs, according to
+// ip-anonymization. Values that aren't IPs are returned unchanged. Unknown
+// anonymization modes truncate, so a typo doesn't log full client IPs.
+func LogIP(ip string) string {
+	mode := viper.GetString("ip-anonymization")
+	if mode == "" || mode == IPAnonymizationNone {
+		return ip
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+
+	addr = addr.Unmap()
+
+	if mode == IPAnonymizationHash {
+		mac := hmac.New(sha256.New, hashKey())
+		mac.Write(addr.AsSlice())
+
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+
+	bits := 24
+	if addr.Is6() {
+		bits = 48
+	}
+
+	prefix, err := addr.WithZone("").Prefix(bits)
+	if err != nil {
+		return ip
+	}
+
+	return prefix.Addr().String()
+}
+
+// LogAddr returns addr as it should be written to logs, anonymizing its IP
+// according to ip-anonymization.
+func LogAddr(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+
+	return LogHostPort(addr.String())
+}
+
+// LogHostPort returns a host:port address as it should be written to logs,
+// anonymizing its host according to ip-anonymization. The port is kept so
+// connections from the same network can still be told apart.
+func LogHostPort(hostPort string) string {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return LogIP(hostPort)
+	}
+
+	return net.JoinHostPort(LogIP(host), port)
+}
+
+// anonymizedAddr is a net.Addr that has already been anonymized.
+type anonymizedAddr struct {
+	network string
+	addr    string
+}
+
+// Network returns the network of the address.
+func (a anonymizedAddr) Network() string {
+	return a.network
+}
+
+// String returns the anonymized address.
+func (a anonymizedAddr) String() string {
+	return a.addr
+}
+
+// logError returns err as it should be written to logs. Network errors
+// include the addresses of the connection, which are anonymized according to
+// ip-anonymization.
+func logError(err error) error {
+	opErr, ok := err.(*net.OpError)
+	if !ok {
+		return err
+	}
+
+	logged := *opErr
+
+	if opErr.Source != nil {
+		logged.Source = anonymizedAddr{network: opErr.Source.Network(), addr: LogAddr(opErr.Source)}
+	}
+
+	if opErr.Addr != nil {
+		logged.Addr = anonymizedAddr{network: opErr.Addr.Network(), addr: LogAddr(opErr.Addr)}
+	}
+
+	return &logged
+}
@@ -0,0 +1,68 @@
+package utils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// TestLogIP validates that client IPs are truncated or hashed according to
+// ip-anonymization.
+func TestLogIP(t *testing.T) {
+	defer func() {
+		viper.Set("ip-anonymization", nil)
+		viper.Set("ip-anonymization-key", nil)
+	}()
+
+	addr := &net.TCPAddr{IP: net.ParseIP("203.0.113.10"), Port: 51234}
+
+	if logged := LogAddr(addr); logged != "203.0.113.10:51234" {
+		t.Errorf("Logged %s when should have been unchanged", logged)
+	}
+
+	viper.Set("ip-anonymization", IPAnonymizationTruncate)
+
+	for ip, want := range map[string]string{
+		"203.0.113.10":            "203.0.113.0",
+		"::ffff:203.0.113.10":     "203.0.113.0",
+		"2001:db8:1234:5678::1":   "2001:db8:1234::",
+		"fe80::1%eth0":            "fe80::",
+		"/tmp/sish.sock":          "/tmp/sish.sock",
+		"[2001:db8:1234::1]:2222": "[2001:db8:1234::]:2222",
+		"203.0.113.10:2222":       "203.0.113.0:2222",
+	} {
+		if logged := LogHostPort(ip); logged != want {
+			t.Errorf("Logged %s as %s when should have been %s", ip, logged, want)
+		}
+	}
+
+	viper.Set("ip-anonymization", IPAnonymizationHash)
+	viper.Set("ip-anonymization-key", "secret")
+
+	hashed := LogIP("203.0.113.10")
+	if hashed == "203.0.113.10" || len(hashed) != 16 || LogIP("203.0.113.10") != hashed || LogIP("203.0.113.11") == hashed {
+		t.Errorf("Hashed %s when should have been a stable 16 character HMAC", hashed)
+	}
+
+	if logged := LogAddr(addr); logged != hashed+":51234" {
+		t.Errorf("Logged %s when should have been %s:51234", logged, hashed)
+	}
+
+	viper.Set("ip-anonymization-key", "other")
+
+	if LogIP("203.0.113.10") == hashed {
+		t.Error("Hash should have changed with the key")
+	}
+
+	viper.Set("ip-anonymization", "truncat")
+
+	err := logError(&net.OpError{Op: "close", Net: "tcp", Source: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2222}, Addr: addr, Err: net.ErrClosed})
+	if want := "close tcp 127.0.0.0:2222->203.0.113.0:51234: use of closed network connection"; err.Error() != want {
+		t.Errorf("Logged error %q when should have been %q", err, want)
+	}
+
+	if logged := LogIP("203.0.113.10"); logged != "203.0.113.0" {
+		t.Errorf("Unknown mode logged %s when should have truncated", logged)
+	}
+}
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/vulcand/oxy/roundrobin"
+)
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed routes to the connection as usual.
+	CircuitClosed CircuitState = iota
+
+	// CircuitOpen skips the connection in its balancers until the cooldown ends.
+	CircuitOpen
+
+	// CircuitHalfOpen routes to the connection again to test if it recovered.
+	// The next success closes the circuit and the next failure opens it again.
+	CircuitHalfOpen
+)
+
+// String returns the name of the state.
+func (c CircuitState) String() string {
+	switch c {
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// CircuitBreaker stops routing to a SSH connection whose forwarded channels
+// keep failing to open. After Threshold failures within Window, the circuit
+// opens and the connection is skipped by its balancers for Cooldown. The
+// circuit then half-opens to test if the connection recovered.
+type CircuitBreaker struct {
+	SSHConn   *SSHConnection
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+
+	lock     sync.Mutex
+	state    CircuitState
+	failures []time.Time
+	timer    *time.Timer
+	servers  map[*circuitServer]struct{}
+}
+
+// circuitServer is a balancer entry of the connection that a CircuitBreaker
+// updates when it opens or closes.
+type circuitServer struct {
+	balancer  *roundrobin.RoundRobin
+	serverURL *url.URL
+	listener  *ListenerHolder
+}
+
+// NewCircuitBreaker returns a CircuitBreaker for sshConn configured from the
+// circuit breaker settings.
+func NewCircuitBreaker(sshConn *SSHConnection) *CircuitBreaker {
+	return &CircuitBreaker{
+		SSHConn:   sshConn,
+		Threshold: viper.GetInt("circuit-breaker-threshold"),
+		Window:    viper.GetDuration("circuit-breaker-window"),
+		Cooldown:  viper.GetDuration("circuit-breaker-cooldown"),
+		servers:   map[*circuitServer]struct{}{},
+	}
+}
+
+// State returns the state of the circuit. It is always closed if c is nil.
+func (c *CircuitBreaker) State() CircuitState {
+	if c == nil {
+		return CircuitClosed
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.state
+}
+
+// Open returns whether the connection is being skipped by its balancers.
+func (c *CircuitBreaker) Open() bool {
+	return c.State() == CircuitOpen
+}
+
+// Watch registers a balancer entry of the connection so it is skipped while
+// the circuit is open. The returned function unregisters it and must be
+// called before the entry is removed from the balancer. Entries of listeners
+// that are failing health checks stay skipped when the circuit closes.
+func (c *CircuitBreaker) Watch(balancer *roundrobin.RoundRobin, serverURL *url.URL, listener *ListenerHolder) func() {
+	if c == nil || balancer == nil {
+		return func() {}
+	}
+
+	server := &circuitServer{
+		balancer:  balancer,
+		serverURL: serverURL,
+		listener:  listener,
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.servers[server] = struct{}{}
+
+	return func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		delete(c.servers, server)
+	}
+}
+
+// Success records a forwarded channel that opened. It closes a half-open circuit.
+func (c *CircuitBreaker) Success() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.failures = c.failures[:0]
+
+	if c.state == CircuitHalfOpen {
+		c.state = CircuitClosed
+		log.Println("Circuit breaker closed for:", LogAddr(c.SSHConn.SSHConn.RemoteAddr()))
+	}
+}
+
+// Failure records a forwarded channel that failed to open. It opens the
+// circuit if there have been Threshold failures within Window, or if the
+// circuit is half-open.
+func (c *CircuitBreaker) Failure() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state == CircuitOpen {
+		return
+	}
+
+	now := time.Now()
+
+	if c.state == CircuitClosed {
+		recent := c.failures[:0]
+		for _, failure := range c.failures {
+			if now.Sub(failure) < c.Window {
+				recent = append(recent, failure)
+			}
+		}
+
+		c.failures = append(recent, now)
+
+		if len(c.failures) < c.Threshold {
+			return
+		}
+	}
+
+	c.state = CircuitOpen
+	c.failures = c.failures[:0]
+	c.timer = time.AfterFunc(c.Cooldown, c.halfOpen)
+
+	log.Println("Circuit breaker opened, skipping in balancer:", LogAddr(c.SSHConn.SSHConn.RemoteAddr()))
+
+	c.updateServers()
+}
+
+// Stop stops the cooldown timer of an open circuit.
+func (c *CircuitBreaker) Stop() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+}
+
+// halfOpen routes to the connection again once the cooldown ends.
+func (c *CircuitBreaker) halfOpen() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.state != CircuitOpen {
+		return
+	}
+
+	c.state = CircuitHalfOpen
+
+	log.Println("Circuit breaker half-open, testing recovery for:", LogAddr(c.SSHConn.SSHConn.RemoteAddr()))
+
+	c.updateServers()
+}
+
+// updateServers sets the weight of the watched balancer entries for the
+// current state. Entries are kept in their balancers with a weight of 0 so
+// they are skipped without affecting cleanup of the balancer. The lock must
+// be held.
+func (c *CircuitBreaker) updateServers() {
+	for server := range c.servers {
+		weight := 0
+		if c.state != CircuitOpen && server.listener.Healthy() {
+			weight = c.SSHConn.BalancerWeight()
+		}
+
+		err := server.balancer.UpsertServer(server.serverURL, roundrobin.Weight(weight))
+		if err != nil {
+			log.Println("Unable to update server in balancer:", err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/vulcand/oxy/roundrobin"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestCircuitBreaker validates that the circuit opens after Threshold
+// failures within Window, that its balancer entries are skipped while it is
+// open, and that it half-opens after Cooldown to test recovery.
+func TestCircuitBreaker(t *testing.T) {
+	sshConn := &SSHConnection{
+		SSHConn: &ssh.ServerConn{Conn: &closeTestConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}},
+		Weight:  3,
+	}
+
+	breaker := &CircuitBreaker{
+		SSHConn:   sshConn,
+		Threshold: 3,
+		Window:    time.Minute,
+		Cooldown:  50 * time.Millisecond,
+		servers:   map[*circuitServer]struct{}{},
+	}
+	sshConn.Breaker = breaker
+	defer breaker.Stop()
+
+	balancer, err := roundrobin.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverURL := &url.URL{Host: "backend"}
+
+	err = balancer.UpsertServer(serverURL, roundrobin.Weight(sshConn.BalancerWeight()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stopWatch := breaker.Watch(balancer, serverURL, nil)
+
+	weight := func() int {
+		w, _ := balancer.ServerWeight(serverURL)
+		return w
+	}
+
+	breaker.Failure()
+	breaker.Failure()
+	breaker.Success()
+	breaker.Failure()
+	breaker.Failure()
+
+	if breaker.State() != CircuitClosed {
+		t.Errorf("Circuit is %s when should have been closed, a success resets the failures", breaker.State())
+	}
+
+	breaker.Failure()
+
+	if breaker.State() != CircuitOpen {
+		t.Fatalf("Circuit is %s when should have been open", breaker.State())
+	}
+
+	if weight() != 0 || sshConn.routingWeight("backend") != 0 {
+		t.Errorf("Weight is %d when should have been 0 while the circuit is open", weight())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if breaker.State() != CircuitHalfOpen {
+		t.Fatalf("Circuit is %s when should have been half-open after the cooldown", breaker.State())
+	}
+
+	if weight() != 3 {
+		t.Errorf("Weight is %d when should have been 3 while the circuit is half-open", weight())
+	}
+
+	breaker.Failure()
+
+	if breaker.State() != CircuitOpen || weight() != 0 {
+		t.Fatalf("Circuit is %s when a half-open failure should have opened it", breaker.State())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	breaker.Success()
+
+	if breaker.State() != CircuitClosed || weight() != 3 {
+		t.Errorf("Circuit is %s when a half-open success should have closed it", breaker.State())
+	}
+
+	stopWatch()
+
+	for i := 0; i < 3; i++ {
+		breaker.Failure()
+	}
+
+	if weight() != 3 {
+		t.Errorf("Weight is %d when an unwatched entry should not have been updated", weight())
+	}
+}
+
+// TestCircuitBreakerWindow validates that failures older than Window don't
+// count towards the threshold, and that a nil breaker is always closed.
+func TestCircuitBreakerWindow(t *testing.T) {
+	breaker := &CircuitBreaker{
+		SSHConn:   &SSHConnection{SSHConn: &ssh.ServerConn{Conn: &closeTestConn{addr: &net.TCPAddr{}}}},
+		Threshold: 2,
+		Window:    20 * time.Millisecond,
+		Cooldown:  time.Minute,
+		servers:   map[*circuitServer]struct{}{},
+	}
+	defer breaker.Stop()
+
+	breaker.Failure()
+	time.Sleep(50 * time.Millisecond)
+	breaker.Failure()
+
+	if breaker.State() != CircuitClosed {
+		t.Errorf("Circuit is %s when should have been closed, the first failure is outside the window", breaker.State())
+	}
+
+	breaker.Failure()
+
+	if breaker.State() != CircuitOpen {
+		t.Errorf("Circuit is %s when should have been open", breaker.State())
+	}
+
+	var nilBreaker *CircuitBreaker
+	nilBreaker.Failure()
+	nilBreaker.Success()
+
+	if nilBreaker.Open() || nilBreaker.State() != CircuitClosed {
+		t.Error("Nil circuit breaker should always be closed")
+	}
+}
@@ -0,0 +1,463 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// pcapLinkTypeRaw is the pcap link type of packets that start with an
+	// IPv4 or IPv6 header.
+	pcapLinkTypeRaw = 101
+
+	// pcapSnapLen is the maximum size of a captured packet.
+	pcapSnapLen = 65535
+
+	// captureSegmentSize is the maximum payload of a captured packet. Larger
+	// reads are split into several packets.
+	captureSegmentSize = 65000
+
+	// captureQueueSize is how many packets can wait to be written to a
+	// capture file before the forwards being captured block.
+	captureQueueSize = 64
+)
+
+// ErrCaptureRunning is returned when starting a capture on a connection that
+// is already being captured.
+var ErrCaptureRunning = errors.New("a capture is already running for this connection")
+
+// captureFlowID numbers the flows whose addresses aren't IP addresses, like
+// the unix sockets of HTTP forwards, so they get distinct ports.
+var captureFlowID atomic.Uint32
+
+// Capture writes the data copied over the forwards of a SSH connection to a
+// pcap file, as packets of a TCP connection between the forwarded
+// connection's remote and local addresses. It stops once it has run for its
+// duration or the file reaches its maximum size, whichever comes first.
+// Packets are written to the file by their own goroutine, so forwards aren't
+// held up by each other's disk writes.
+type Capture struct {
+	Path    string
+	Started time.Time
+	Expires time.Time
+	MaxSize int64
+
+	sshConn  *SSHConnection
+	lock     sync.Mutex
+	file     *os.File
+	size     int64
+	stopped  bool
+	timer    *time.Timer
+	packets  chan []byte
+	queueing sync.WaitGroup
+	done     chan struct{}
+	closed   chan struct{}
+}
+
+// CaptureInfo is a point in time view of a Capture.
+type CaptureInfo struct {
+	Path    string    `json:"path"`
+	Started time.Time `json:"started"`
+	Expires time.Time `json:"expires"`
+	MaxSize int64     `json:"max_size"`
+	Size    int64     `json:"size"`
+	Stopped bool      `json:"stopped"`
+}
+
+// captureFlow is the addresses and TCP sequence numbers of a forwarded
+// connection in a capture.
+type captureFlow struct {
+	remote netip.AddrPort
+	local  netip.AddrPort
+
+	lock     sync.Mutex
+	sentSeq  uint32
+	recvSeq  uint32
+	lastSeen *Capture
+}
+
+// newCaptureFlow returns the flow of a forwarded connection between
+// remoteAddr and localAddr.
+func newCaptureFlow(remoteAddr string, localAddr string) *captureFlow {
+	remote, remoteErr := netip.ParseAddrPort(remoteAddr)
+	local, localErr := netip.ParseAddrPort(localAddr)
+
+	if remoteErr != nil || localErr != nil {
+		port := uint16(1024 + captureFlowID.Add(1)%64000)
+		remote = netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 1}), port)
+		local = netip.AddrPortFrom(netip.AddrFrom4([4]byte{127, 0, 0, 2}), 80)
+	}
+
+	remote = netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port())
+	local = netip.AddrPortFrom(local.Addr().Unmap(), local.Port())
+
+	if remote.Addr().Is4() != local.Addr().Is4() {
+		remote = netip.AddrPortFrom(netip.AddrFrom16(remote.Addr().As16()), remote.Port())
+		local = netip.AddrPortFrom(netip.AddrFrom16(local.Addr().As16()), local.Port())
+	}
+
+	return &captureFlow{
+		remote: remote,
+		local:  local,
+	}
+}
+
+// StartCapture starts capturing the connection's forwarded data to a new file
+// in capture-directory. duration and maxSize are capped at
+// capture-max-duration and capture-max-size, and default to them if they are
+// not positive.
+func (s *SSHConnection) StartCapture(duration time.Duration, maxSize int64) (*Capture, error) {
+	maxDuration := viper.GetDuration("capture-max-duration")
+	if duration <= 0 || duration > maxDuration {
+		duration = maxDuration
+	}
+
+	if limit := viper.GetInt64("capture-max-size"); maxSize <= 0 || maxSize > limit {
+		maxSize = limit
+	}
+
+	if duration <= 0 || maxSize <= 0 {
+		return nil, fmt.Errorf("captures are limited to a duration and size of 0")
+	}
+
+	if s.capture.Load() != nil {
+		return nil, ErrCaptureRunning
+	}
+
+	directory := viper.GetString("capture-directory")
+
+	err := os.MkdirAll(directory, 0o700)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	pattern := fmt.Sprintf("%s-%s-*.pcap", strings.NewReplacer(":", "_", "[", "", "]", "").Replace(LogAddr(s.SSHConn.RemoteAddr())), now.UTC().Format("20060102T150405"))
+
+	file, err := os.CreateTemp(directory, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Capture{
+		Path:    file.Name(),
+		Started: now,
+		Expires: now.Add(duration),
+		MaxSize: maxSize,
+		sshConn: s,
+		file:    file,
+		packets: make(chan []byte, captureQueueSize),
+		done:    make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+
+	_, err = file.Write(header)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	c.size = int64(len(header))
+
+	if !s.capture.CompareAndSwap(nil, c) {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, ErrCaptureRunning
+	}
+
+	go c.writePackets()
+
+	c.lock.Lock()
+	c.timer = time.AfterFunc(duration, c.Stop)
+	c.lock.Unlock()
+
+	LogEvent("capture_started", s.logFields(LogFields{"path": c.Path, "duration": duration.String(), "max_size": maxSize}), "Started capture for:", LogAddr(s.SSHConn.RemoteAddr()), "to", c.Path)
+
+	return c, nil
+}
+
+// StopCapture stops the connection's capture and returns it, or nil if the
+// connection isn't being captured.
+func (s *SSHConnection) StopCapture() *Capture {
+	c := s.capture.Load()
+	if c == nil {
+		return nil
+	}
+
+	c.Stop()
+
+	return c
+}
+
+// Capturing returns whether the connection's forwarded data is being captured.
+func (s *SSHConnection) Capturing() bool {
+	return s.capture.Load() != nil
+}
+
+// Stop stops the capture and waits for its queued packets to be written and
+// its file to be closed.
+func (c *Capture) Stop() {
+	c.lock.Lock()
+	c.stopLocked()
+	c.lock.Unlock()
+
+	<-c.closed
+}
+
+// stopLocked stops the capture without waiting for its file to be closed.
+// The lock must be held.
+func (c *Capture) stopLocked() {
+	if c.stopped {
+		return
+	}
+
+	c.stopped = true
+	c.sshConn.capture.CompareAndSwap(c, nil)
+	close(c.done)
+
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+
+	LogEvent("capture_stopped", c.sshConn.logFields(LogFields{"path": c.Path, "size": c.size}), "Stopped capture for:", LogAddr(c.sshConn.SSHConn.RemoteAddr()), "wrote", c.size, "bytes to", c.Path)
+}
+
+// Info returns the CaptureInfo of the capture.
+func (c *Capture) Info() CaptureInfo {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return CaptureInfo{
+		Path:    c.Path,
+		Started: c.Started,
+		Expires: c.Expires,
+		MaxSize: c.MaxSize,
+		Size:    c.size,
+		Stopped: c.stopped,
+	}
+}
+
+// writePackets writes queued packets to the capture file until the capture
+// is stopped and every packet queued before then is written. Then it closes
+// the file.
+func (c *Capture) writePackets() {
+	defer close(c.closed)
+
+	queued := make(chan struct{})
+	stopped := c.done
+
+	failed := false
+
+	for {
+		select {
+		case packet := <-c.packets:
+			if failed {
+				continue
+			}
+
+			_, err := c.file.Write(packet)
+			if err != nil {
+				log.Println("Error writing capture file:", err)
+				failed = true
+
+				c.lock.Lock()
+				c.stopLocked()
+				c.lock.Unlock()
+			}
+		case <-stopped:
+			stopped = nil
+
+			go func() {
+				c.queueing.Wait()
+				close(queued)
+			}()
+		case <-queued:
+			err := c.file.Close()
+			if err != nil {
+				log.Println("Error closing capture file:", err)
+			}
+
+			return
+		}
+	}
+}
+
+// write records data read from one side of a flow. If toRemote is true, it
+// was sent by the SSH client to the forwarded connection's remote address.
+// Packets are queued for writePackets, so the capture's lock isn't held
+// while the file is written.
+func (c *Capture) write(flow *captureFlow, toRemote bool, data []byte) {
+	flow.lock.Lock()
+	defer flow.lock.Unlock()
+
+	packets, full, ok := c.packetsFor(flow, toRemote, data)
+	if !ok {
+		return
+	}
+
+	for _, packet := range packets {
+		c.packets <- packet
+	}
+
+	c.queueing.Done()
+
+	if full {
+		c.lock.Lock()
+		c.stopLocked()
+		c.lock.Unlock()
+	}
+}
+
+// packetsFor returns the packets recording data in flow and counts them
+// towards the capture's size. If a packet would exceed MaxSize, it only
+// returns the packets before it and full is true. ok is false if the capture
+// is stopped. Otherwise the caller must call c.queueing.Done once the packets
+// are queued. The flow's lock must be held.
+func (c *Capture) packetsFor(flow *captureFlow, toRemote bool, data []byte) (packets [][]byte, full bool, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.stopped {
+		return nil, false, false
+	}
+
+	c.queueing.Add(1)
+
+	if flow.lastSeen != c {
+		flow.lastSeen = c
+		flow.sentSeq = 1
+		flow.recvSeq = 1
+	}
+
+	for len(data) > 0 {
+		segment := data[:min(len(data), captureSegmentSize)]
+		data = data[len(segment):]
+
+		src, dst := flow.remote, flow.local
+		seq, ack := &flow.recvSeq, flow.sentSeq
+		if toRemote {
+			src, dst = flow.local, flow.remote
+			seq, ack = &flow.sentSeq, flow.recvSeq
+		}
+
+		packet := capturePacket(time.Now(), src, dst, *seq, ack, segment)
+		if c.size+int64(len(packet)) > c.MaxSize {
+			return packets, true, true
+		}
+
+		packets = append(packets, packet)
+		c.size += int64(len(packet))
+		*seq += uint32(len(segment))
+	}
+
+	return packets, false, true
+}
+
+// capturePacket returns a pcap record of a TCP segment carrying payload.
+func capturePacket(now time.Time, src netip.AddrPort, dst netip.AddrPort, seq uint32, ack uint32, payload []byte) []byte {
+	ipHeaderLen := 20
+	if !src.Addr().Is4() {
+		ipHeaderLen = 40
+	}
+
+	packetLen := ipHeaderLen + 20 + len(payload)
+	record := make([]byte, 16+packetLen)
+
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(packetLen))
+	binary.LittleEndian.PutUint32(record[12:], uint32(packetLen))
+
+	ip := record[16:]
+
+	if src.Addr().Is4() {
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(packetLen))
+		binary.BigEndian.PutUint16(ip[6:], 0x4000)
+		ip[8] = 64
+		ip[9] = 6
+
+		srcIP, dstIP := src.Addr().As4(), dst.Addr().As4()
+		copy(ip[12:], srcIP[:])
+		copy(ip[16:], dstIP[:])
+
+		binary.BigEndian.PutUint16(ip[10:], ipv4Checksum(ip[:20]))
+	} else {
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(20+len(payload)))
+		ip[6] = 6
+		ip[7] = 64
+
+		srcIP, dstIP := src.Addr().As16(), dst.Addr().As16()
+		copy(ip[8:], srcIP[:])
+		copy(ip[24:], dstIP[:])
+	}
+
+	tcp := ip[ipHeaderLen:]
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18 // PSH, ACK
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+
+	copy(tcp[20:], payload)
+
+	return record
+}
+
+// ipv4Checksum returns the checksum of an IPv4 header.
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return ^uint16(sum)
+}
+
+// captureReader records the data read from one side of a forwarded
+// connection while its SSH connection is being captured.
+type captureReader struct {
+	io.Reader
+	SSHConn  *SSHConnection
+	Flow     *captureFlow
+	ToRemote bool
+}
+
+// Read reads from the underlying reader and records the data read.
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+
+	if n > 0 {
+		if c := r.SSHConn.capture.Load(); c != nil {
+			c.write(r.Flow, r.ToRemote, p[:n])
+		}
+	}
+
+	return n, err
+}
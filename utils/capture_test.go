@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// capturedPacket is a TCP segment read back from a capture file.
+type capturedPacket struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	payload []byte
+}
+
+// readCapture parses the IPv4 TCP segments of a capture file.
+func readCapture(t *testing.T, path string) []capturedPacket {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) < 24 || binary.LittleEndian.Uint32(data) != 0xa1b2c3d4 || binary.LittleEndian.Uint32(data[20:]) != pcapLinkTypeRaw {
+		t.Fatalf("Invalid pcap header %x", data[:min(len(data), 24)])
+	}
+
+	packets := []capturedPacket{}
+
+	for data = data[24:]; len(data) > 0; {
+		length := binary.LittleEndian.Uint32(data[8:])
+		packet := data[16 : 16+length]
+		data = data[16+length:]
+
+		if packet[0] != 0x45 || ipv4Checksum(packet[:20]) != 0 {
+			t.Fatalf("Invalid IPv4 header %x", packet[:20])
+		}
+
+		tcp := packet[20:]
+		packets = append(packets, capturedPacket{
+			srcPort: binary.BigEndian.Uint16(tcp[0:]),
+			dstPort: binary.BigEndian.Uint16(tcp[2:]),
+			seq:     binary.BigEndian.Uint32(tcp[4:]),
+			payload: tcp[20:],
+		})
+	}
+
+	return packets
+}
+
+// TestCapture validates that both directions of a forwarded connection are
+// captured as TCP segments while a capture runs, and that captures stop at
+// their size limit.
+func TestCapture(t *testing.T) {
+	viper.Set("capture-directory", t.TempDir())
+	viper.Set("capture-max-duration", time.Minute)
+	viper.Set("capture-max-size", 1024*1024)
+	defer func() {
+		viper.Set("capture-directory", nil)
+		viper.Set("capture-max-duration", nil)
+		viper.Set("capture-max-size", nil)
+	}()
+
+	sshConn := &SSHConnection{
+		SSHConn: &ssh.ServerConn{Conn: &closeTestConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}},
+	}
+
+	flow := newCaptureFlow("198.51.100.7:40112", "203.0.113.1:7000")
+	request := &captureReader{Reader: strings.NewReader("GET / HTTP/1.1\r\n\r\n"), SSHConn: sshConn, Flow: flow}
+	response := &captureReader{Reader: strings.NewReader("HTTP/1.1 200 OK\r\n\r\nhello"), SSHConn: sshConn, Flow: flow, ToRemote: true}
+
+	_, err := io.ReadAll(io.LimitReader(request, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	capture, err := sshConn.StartCapture(time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if capture.Expires.Sub(capture.Started) != time.Minute || capture.MaxSize != 1024*1024 {
+		t.Errorf("Capture runs for %s up to %d bytes when should have been capped at 1m0s and 1048576 bytes", capture.Expires.Sub(capture.Started), capture.MaxSize)
+	}
+
+	_, err = sshConn.StartCapture(0, 0)
+	if err != ErrCaptureRunning {
+		t.Errorf("Second capture returned %v when should have been ErrCaptureRunning", err)
+	}
+
+	if !sshConn.Capturing() {
+		t.Error("Connection should have been capturing")
+	}
+
+	for _, reader := range []io.Reader{request, response} {
+		_, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if sshConn.StopCapture() != capture || sshConn.Capturing() || sshConn.StopCapture() != nil {
+		t.Error("Capture should have been stopped once")
+	}
+
+	packets := readCapture(t, capture.Path)
+	if len(packets) != 2 {
+		t.Fatalf("Captured %d packets when should have been 2", len(packets))
+	}
+
+	if packets[0].srcPort != 40112 || packets[0].dstPort != 7000 || string(packets[0].payload) != "/ HTTP/1.1\r\n\r\n" {
+		t.Errorf("Captured request %d->%d %q when should have been 40112->7000 \"/ HTTP/1.1\\r\\n\\r\\n\"", packets[0].srcPort, packets[0].dstPort, packets[0].payload)
+	}
+
+	if packets[1].srcPort != 7000 || packets[1].dstPort != 40112 || !bytes.HasSuffix(packets[1].payload, []byte("hello")) {
+		t.Errorf("Captured response %d->%d %q when should have been 7000->40112 ending with \"hello\"", packets[1].srcPort, packets[1].dstPort, packets[1].payload)
+	}
+
+	info, err := os.Stat(capture.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0o600 || info.Size() != capture.Info().Size {
+		t.Errorf("Capture file has mode %s and size %d when should have been -rw------- and %d", info.Mode().Perm(), info.Size(), capture.Info().Size)
+	}
+
+	capture, err = sshConn.StartCapture(0, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := &captureReader{Reader: bytes.NewReader(make([]byte, 150)), SSHConn: sshConn, Flow: flow}
+	for i := 0; i < 3; i++ {
+		_, err := large.Read(make([]byte, 50))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if sshConn.Capturing() || !capture.Info().Stopped {
+		t.Error("Capture should have stopped at its size limit")
+	}
+
+	// Wait for the packets queued before the capture stopped to be written.
+	capture.Stop()
+
+	if size := capture.Info().Size; size > 200 {
+		t.Errorf("Capture wrote %d bytes when should have been at most 200", size)
+	}
+
+	if packets := readCapture(t, capture.Path); len(packets) != 1 || packets[0].seq != 1 {
+		t.Errorf("Captured %d packets when should have been 1 starting at sequence 1", len(packets))
+	}
+}
+
+// TestCaptureDuration validates that a capture stops once its duration passes.
+func TestCaptureDuration(t *testing.T) {
+	viper.Set("capture-directory", t.TempDir())
+	viper.Set("capture-max-duration", 50*time.Millisecond)
+	viper.Set("capture-max-size", 1024)
+	defer func() {
+		viper.Set("capture-directory", nil)
+		viper.Set("capture-max-duration", nil)
+		viper.Set("capture-max-size", nil)
+	}()
+
+	sshConn := &SSHConnection{
+		SSHConn: &ssh.ServerConn{Conn: &closeTestConn{addr: &net.TCPAddr{IP: net.IPv6loopback, Port: 1234}}},
+	}
+
+	capture, err := sshConn.StartCapture(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	if sshConn.Capturing() || !capture.Info().Stopped {
+		t.Error("Capture should have stopped after its duration")
+	}
+}
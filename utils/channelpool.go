@@ -0,0 +1,214 @@
+package utils
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// ChannelPool keeps forwarded channels of a TCP alias open ahead of time, so
+// connections to the alias don't wait for a round trip to the SSH client.
+// A channel carries a single forwarded connection and the client closes it
+// when that connection ends, so borrowed channels are not put back. Instead,
+// the pool opens a replacement for each channel that is borrowed.
+type ChannelPool struct {
+	Open        func() (ssh.Channel, <-chan *ssh.Request, error)
+	Size        int
+	IdleTimeout time.Duration
+
+	lock     sync.Mutex
+	stopped  bool
+	done     chan struct{}
+	refill   chan struct{}
+	channels chan *pooledChannel
+}
+
+// pooledChannel is a channel waiting in a ChannelPool.
+type pooledChannel struct {
+	ssh.Channel
+	opened time.Time
+	closed chan struct{}
+}
+
+// NewChannelPool returns a ChannelPool configured from the TCP alias pool
+// settings that opens channels with open.
+func NewChannelPool(open func() (ssh.Channel, <-chan *ssh.Request, error)) *ChannelPool {
+	size := viper.GetInt("tcp-aliases-pool-size")
+
+	return &ChannelPool{
+		Open:        open,
+		Size:        size,
+		IdleTimeout: viper.GetDuration("tcp-aliases-pool-idle-timeout"),
+		done:        make(chan struct{}),
+		refill:      make(chan struct{}, 1),
+		channels:    make(chan *pooledChannel, size),
+	}
+}
+
+// Run fills the pool and closes channels that have been idle for longer than
+// IdleTimeout until Stop is called.
+func (p *ChannelPool) Run() {
+	var evict <-chan time.Time
+
+	if p.IdleTimeout > 0 {
+		ticker := time.NewTicker(p.IdleTimeout / 2)
+		defer ticker.Stop()
+
+		evict = ticker.C
+	}
+
+	p.fill()
+
+	for {
+		select {
+		case <-p.refill:
+			p.fill()
+		case <-evict:
+			p.evict()
+			p.fill()
+		case <-p.done:
+			p.drain()
+			return
+		}
+	}
+}
+
+// Get returns a channel from the pool, or opens a new one if the pool is
+// empty. Requests on the returned channel are discarded.
+func (p *ChannelPool) Get() (ssh.Channel, error) {
+	defer p.requestRefill()
+
+	for {
+		select {
+		case channel := <-p.channels:
+			if p.usable(channel) {
+				return channel.Channel, nil
+			}
+
+			channel.Close()
+			continue
+		default:
+		}
+
+		break
+	}
+
+	channel, requests, err := p.Open()
+	if err != nil {
+		return nil, err
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	return channel, nil
+}
+
+// Stop stops filling the pool and closes the channels in it. It does nothing
+// if p is nil.
+func (p *ChannelPool) Stop() {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.stopped {
+		return
+	}
+
+	p.stopped = true
+	close(p.done)
+}
+
+// requestRefill wakes up Run to replace borrowed channels.
+func (p *ChannelPool) requestRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// usable returns whether a pooled channel is still open and has not been idle
+// for too long.
+func (p *ChannelPool) usable(channel *pooledChannel) bool {
+	select {
+	case <-channel.closed:
+		return false
+	default:
+	}
+
+	return p.IdleTimeout <= 0 || time.Since(channel.opened) < p.IdleTimeout
+}
+
+// fill opens channels until the pool is full. If a channel can't be opened,
+// the pool is filled again on the next refill or eviction.
+func (p *ChannelPool) fill() {
+	for len(p.channels) < p.Size {
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+
+		channel, requests, err := p.Open()
+		if err != nil {
+			if viper.GetBool("debug") {
+				log.Println("Unable to open pooled channel:", err)
+			}
+
+			return
+		}
+
+		pooled := &pooledChannel{
+			Channel: channel,
+			opened:  time.Now(),
+			closed:  make(chan struct{}),
+		}
+
+		// The requests channel is closed once the channel is closed by either side.
+		go func() {
+			ssh.DiscardRequests(requests)
+			close(pooled.closed)
+		}()
+
+		select {
+		case p.channels <- pooled:
+		default:
+			channel.Close()
+			return
+		}
+	}
+}
+
+// evict closes the pooled channels that are no longer usable.
+func (p *ChannelPool) evict() {
+	for i := len(p.channels); i > 0; i-- {
+		select {
+		case channel := <-p.channels:
+			if p.usable(channel) {
+				p.channels <- channel
+				continue
+			}
+
+			channel.Close()
+		default:
+			return
+		}
+	}
+}
+
+// drain closes every channel in the pool.
+func (p *ChannelPool) drain() {
+	for {
+		select {
+		case channel := <-p.channels:
+			channel.Close()
+		default:
+			return
+		}
+	}
+}
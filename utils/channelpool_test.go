@@ -0,0 +1,311 @@
+package utils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// latencyConn delays every write to simulate the latency of a network.
+// Writes are sent in order, but don't wait for earlier writes to arrive.
+type latencyConn struct {
+	net.Conn
+	latency time.Duration
+	writes  chan latencyWrite
+}
+
+// latencyWrite is a write waiting to be sent by a latencyConn.
+type latencyWrite struct {
+	data []byte
+	due  time.Time
+}
+
+func newLatencyConn(conn net.Conn, latency time.Duration) *latencyConn {
+	c := &latencyConn{
+		Conn:    conn,
+		latency: latency,
+		writes:  make(chan latencyWrite, 1024),
+	}
+
+	go func() {
+		for write := range c.writes {
+			time.Sleep(time.Until(write.due))
+
+			_, err := c.Conn.Write(write.data)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+func (c *latencyConn) Write(p []byte) (int, error) {
+	c.writes <- latencyWrite{data: append([]byte(nil), p...), due: time.Now().Add(c.latency)}
+	return len(p), nil
+}
+
+// channelPoolTestConn returns the server side of a SSH connection whose
+// client echoes everything written to its forwarded channels. If
+// closeChannels is true, the client closes channels as soon as it accepts
+// them instead. Everything the client sends is delayed by latency.
+func channelPoolTestConn(tb testing.TB, closeChannels bool, latency time.Duration) ssh.Conn {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		clientSide, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			return
+		}
+
+		clientConn, chans, reqs, err := ssh.NewClientConn(newLatencyConn(clientSide, latency), listener.Addr().String(), &ssh.ClientConfig{
+			User:            "pool",
+			HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		})
+		if err != nil {
+			return
+		}
+		defer clientConn.Close()
+
+		go ssh.DiscardRequests(reqs)
+
+		for newChannel := range chans {
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+
+			go ssh.DiscardRequests(requests)
+
+			if closeChannels {
+				channel.Close()
+				continue
+			}
+
+			go func() {
+				defer channel.Close()
+				_, _ = io.Copy(channel, channel)
+			}()
+		}
+	}()
+
+	serverSide, err := listener.Accept()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	conn, chans, reqs, err := ssh.NewServerConn(serverSide, serverConfig)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	go ssh.DiscardRequests(reqs)
+	go func() {
+		for newChannel := range chans {
+			_ = newChannel.Reject(ssh.Prohibited, "not supported")
+		}
+	}()
+
+	tb.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+// channelPoolTestOpen returns a function that opens forwarded channels on
+// conn and counts how many were opened.
+func channelPoolTestOpen(conn ssh.Conn, opened *atomic.Int32) func() (ssh.Channel, <-chan *ssh.Request, error) {
+	return func() (ssh.Channel, <-chan *ssh.Request, error) {
+		opened.Add(1)
+		return conn.OpenChannel("forwarded-tcpip", nil)
+	}
+}
+
+// waitForPool waits until pool holds size channels.
+func waitForPool(tb testing.TB, pool *ChannelPool, size int) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(pool.channels) < size {
+		if time.Now().After(deadline) {
+			tb.Fatalf("Pool holds %d channels when should have held %d", len(pool.channels), size)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// pingChannel writes to a channel and reads back the echo.
+func pingChannel(tb testing.TB, channel ssh.Channel) {
+	_, err := channel.Write([]byte("ping"))
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	data := make([]byte, 4)
+
+	_, err = io.ReadFull(channel, data)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	if string(data) != "ping" {
+		tb.Fatalf("Read %q when should have been \"ping\"", data)
+	}
+}
+
+// TestChannelPool validates that channels are borrowed from the pool, that
+// borrowed channels are replaced, and that stopping the pool closes them.
+func TestChannelPool(t *testing.T) {
+	conn := channelPoolTestConn(t, false, 0)
+
+	opened := &atomic.Int32{}
+	pool := &ChannelPool{
+		Open:     channelPoolTestOpen(conn, opened),
+		Size:     2,
+		done:     make(chan struct{}),
+		refill:   make(chan struct{}, 1),
+		channels: make(chan *pooledChannel, 2),
+	}
+
+	go pool.Run()
+	waitForPool(t, pool, 2)
+
+	channel, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pingChannel(t, channel)
+	channel.Close()
+
+	waitForPool(t, pool, 2)
+
+	if opened.Load() != 3 {
+		t.Errorf("Opened %d channels when should have opened 3", opened.Load())
+	}
+
+	pooled := <-pool.channels
+	pool.channels <- pooled
+
+	pool.Stop()
+	pool.Stop()
+
+	select {
+	case <-pooled.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pooled channel was not closed when the pool stopped")
+	}
+}
+
+// TestChannelPoolEviction validates that channels closed by the client or
+// idle for too long are not borrowed, and that an empty pool opens channels
+// on demand.
+func TestChannelPoolEviction(t *testing.T) {
+	closedConn := channelPoolTestConn(t, true, 0)
+
+	opened := &atomic.Int32{}
+	pool := &ChannelPool{
+		Open:     channelPoolTestOpen(closedConn, opened),
+		Size:     1,
+		channels: make(chan *pooledChannel, 1),
+		refill:   make(chan struct{}, 1),
+	}
+
+	pool.fill()
+	pooled := <-pool.channels
+	<-pooled.closed
+	pool.channels <- pooled
+
+	pool.Open = channelPoolTestOpen(channelPoolTestConn(t, false, 0), opened)
+
+	channel, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if channel == pooled.Channel {
+		t.Error("Channel closed by the client should not have been borrowed")
+	}
+
+	pingChannel(t, channel)
+
+	pool.IdleTimeout = time.Minute
+	pool.fill()
+	idle := <-pool.channels
+	idle.opened = time.Now().Add(-2 * time.Minute)
+	pool.channels <- idle
+
+	pool.evict()
+
+	if len(pool.channels) != 0 {
+		t.Error("Idle channel should have been evicted")
+	}
+}
+
+// BenchmarkChannelPool compares the latency of a forwarded connection that
+// opens its channel on demand with one that borrows it from a pool, for a
+// client that is a millisecond away.
+func BenchmarkChannelPool(b *testing.B) {
+	for _, size := range []int{0, 8} {
+		name := "on-demand"
+		if size > 0 {
+			name = "pooled"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			conn := channelPoolTestConn(b, false, time.Millisecond)
+
+			pool := &ChannelPool{
+				Open:     channelPoolTestOpen(conn, &atomic.Int32{}),
+				Size:     size,
+				done:     make(chan struct{}),
+				refill:   make(chan struct{}, 1),
+				channels: make(chan *pooledChannel, size),
+			}
+
+			go pool.Run()
+			defer pool.Stop()
+
+			waitForPool(b, pool, size)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				channel, err := pool.Get()
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				pingChannel(b, channel)
+				channel.Close()
+
+				// Leave time between connections for the pool to refill.
+				b.StopTimer()
+				waitForPool(b, pool, size)
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package utils
+
+// CloseReason records why a SSH connection was cleaned up.
+type CloseReason int
+
+const (
+	// CloseReasonUnknown is the reason of connections that are still open.
+	CloseReasonUnknown CloseReason = iota
+
+	// CloseReasonClientDisconnect is used when the client closed the SSH connection.
+	CloseReasonClientDisconnect
+
+	// CloseReasonClientInterrupt is used when the client pressed Ctrl-C in its session.
+	CloseReasonClientInterrupt
+
+	// CloseReasonIdleTimeout is used when the connection was reaped for being idle.
+	CloseReasonIdleTimeout
+
+	// CloseReasonKeepAliveFailure is used when the client stopped answering keepalives.
+	CloseReasonKeepAliveFailure
+
+	// CloseReasonLifetime is used when the connection reached max-connection-lifetime.
+	CloseReasonLifetime
+
+	// CloseReasonDeadline is used when the connection reached the deadline it set.
+	CloseReasonDeadline
+
+	// CloseReasonUnbound is used when the connection didn't request any forwards.
+	CloseReasonUnbound
+
+	// CloseReasonAdminKill is used when the connection was closed from the admin console.
+	CloseReasonAdminKill
+
+	// CloseReasonReconnected is used when a new connection claimed the reconnect token.
+	CloseReasonReconnected
+
+	// CloseReasonConnectionLimit is used when the user has too many connections.
+	CloseReasonConnectionLimit
+
+	// CloseReasonDraining is used when the server stopped accepting new connections.
+	CloseReasonDraining
+
+	// CloseReasonShutdown is used when the server is shutting down.
+	CloseReasonShutdown
+
+	// CloseReasonError is used when the connection's channels failed.
+	CloseReasonError
+)
+
+// closeReasonNames are the names of close reasons used in logs.
+var closeReasonNames = map[CloseReason]string{
+	CloseReasonUnknown:          "unknown",
+	CloseReasonClientDisconnect: "client_disconnect",
+	CloseReasonClientInterrupt:  "client_interrupt",
+	CloseReasonIdleTimeout:      "idle_timeout",
+	CloseReasonKeepAliveFailure: "keepalive_failure",
+	CloseReasonLifetime:         "lifetime",
+	CloseReasonDeadline:         "deadline",
+	CloseReasonUnbound:          "unbound",
+	CloseReasonAdminKill:        "admin_kill",
+	CloseReasonReconnected:      "reconnected",
+	CloseReasonConnectionLimit:  "connection_limit",
+	CloseReasonDraining:         "draining",
+	CloseReasonShutdown:         "shutdown",
+	CloseReasonError:            "error",
+}
+
+// String returns the name of the close reason.
+func (r CloseReason) String() string {
+	if name, ok := closeReasonNames[r]; ok {
+		return name
+	}
+
+	return closeReasonNames[CloseReasonUnknown]
+}
+
+// ServerInitiated returns whether sish closed the connection, rather than
+// the client.
+func (r CloseReason) ServerInitiated() bool {
+	return r != CloseReasonUnknown && r != CloseReasonClientDisconnect && r != CloseReasonClientInterrupt
+}
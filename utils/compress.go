@@ -0,0 +1,163 @@
+package utils
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minCompressSize is the smallest response with a known length that is
+// compressed. Smaller responses barely shrink.
+const minCompressSize = 1024
+
+// incompressibleTypes are the content type prefixes of responses that are
+// already compressed or need to be streamed as they are written.
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/zstd",
+	"application/pdf",
+	"application/octet-stream",
+	"text/event-stream",
+}
+
+// AcceptsGzip returns whether or not an Accept-Encoding header allows gzip.
+func AcceptsGzip(acceptEncoding string) bool {
+	accepted := false
+
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+
+		if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+			continue
+		}
+
+		q := 1.0
+		name, value, ok := strings.Cut(strings.TrimSpace(params), "=")
+		if ok && strings.TrimSpace(name) == "q" {
+			parsedQ, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err == nil {
+				q = parsedQ
+			}
+		}
+
+		if coding != "*" {
+			return q > 0
+		}
+
+		accepted = q > 0
+	}
+
+	return accepted
+}
+
+// compressible returns whether or not a response can be gzipped. Responses
+// that are already encoded, partial, small or of an incompressible content
+// type are left alone.
+func compressible(response *http.Response) bool {
+	if response.Request != nil && response.Request.Method == http.MethodHead {
+		return false
+	}
+
+	switch {
+	case response.StatusCode < http.StatusOK,
+		response.StatusCode == http.StatusNoContent,
+		response.StatusCode == http.StatusPartialContent,
+		response.StatusCode == http.StatusNotModified:
+		return false
+	}
+
+	if encoding := response.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false
+	}
+
+	if response.Header.Get("Content-Range") != "" || strings.Contains(response.Header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+
+	if response.ContentLength > -1 && response.ContentLength < minCompressSize {
+		return false
+	}
+
+	contentType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	if contentType == "image/svg+xml" {
+		return true
+	}
+
+	for _, incompressibleType := range incompressibleTypes {
+		if strings.HasPrefix(contentType, incompressibleType) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// gzipBody is a response body that is gzipped as it is read.
+type gzipBody struct {
+	*io.PipeReader
+	body io.Closer
+}
+
+// Close closes the gzipped body and the original body.
+func (g gzipBody) Close() error {
+	err := g.PipeReader.Close()
+	if bodyErr := g.body.Close(); bodyErr != nil {
+		return bodyErr
+	}
+
+	return err
+}
+
+// CompressResponse gzips the body of response if the client allows it with
+// acceptEncoding and the response is compressible. Responses that are already
+// encoded are never compressed again. It returns whether or not the response
+// was compressed.
+func CompressResponse(response *http.Response, acceptEncoding string) bool {
+	if response.Body == nil || response.Body == http.NoBody || !AcceptsGzip(acceptEncoding) || !compressible(response) {
+		return false
+	}
+
+	body := response.Body
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		gzipWriter := gzip.NewWriter(pipeWriter)
+
+		_, err := io.Copy(gzipWriter, body)
+		if closeErr := gzipWriter.Close(); err == nil {
+			err = closeErr
+		}
+
+		pipeWriter.CloseWithError(err)
+	}()
+
+	response.Body = gzipBody{PipeReader: pipeReader, body: body}
+	response.ContentLength = -1
+	response.Header.Del("Content-Length")
+	response.Header.Set("Content-Encoding", "gzip")
+	response.Header.Add("Vary", "Accept-Encoding")
+
+	if etag := response.Header.Get("ETag"); strings.HasPrefix(etag, "\"") {
+		response.Header.Set("ETag", "W/"+etag)
+	}
+
+	return true
+}
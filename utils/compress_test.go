@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestAcceptsGzip validates parsing of Accept-Encoding headers.
+func TestAcceptsGzip(t *testing.T) {
+	tests := map[string]bool{
+		"":                     false,
+		"gzip":                 true,
+		"deflate, GZIP;q=0.5":  true,
+		"br, gzip;q=0":         false,
+		"*":                    true,
+		"gzip;q=0, *":          false,
+		"identity, *;q=0":      false,
+		"br;q=1.0, x-gzip":     true,
+		"deflate, br, zstd":    false,
+		"gzip;q=invalid":       true,
+		"compress, *;q=0.1":    true,
+		"gzip;level=1;q=0.001": true,
+	}
+
+	for header, want := range tests {
+		if AcceptsGzip(header) != want {
+			t.Errorf("Header %q accepts gzip %t when should have been %t", header, !want, want)
+		}
+	}
+}
+
+// TestCompressResponse validates that compressible responses are gzipped
+// once, and that encoded, small and incompressible responses are left
+// alone.
+func TestCompressResponse(t *testing.T) {
+	body := strings.Repeat("compress me ", 200)
+
+	newResponse := func(contentType string, contentLength int64) *http.Response {
+		response := &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: contentLength,
+			Request:       &http.Request{Method: http.MethodGet},
+		}
+
+		response.Header.Set("Content-Type", contentType)
+		response.Header.Set("ETag", "\"abc\"")
+
+		return response
+	}
+
+	response := newResponse("text/html; charset=utf-8", int64(len(body)))
+	if !CompressResponse(response, "gzip") {
+		t.Fatal("Compressible response was not compressed")
+	}
+
+	if response.Header.Get("Content-Encoding") != "gzip" || response.ContentLength != -1 || response.Header.Get("ETag") != "W/\"abc\"" {
+		t.Errorf("Compressed response has invalid headers %v", response.Header)
+	}
+
+	if CompressResponse(response, "gzip") {
+		t.Error("Compressed response was compressed again")
+	}
+
+	compressed, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = response.Body.Close()
+	if err != nil {
+		t.Error(err)
+	}
+
+	gzipReader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decompressed, err := io.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(decompressed) != body {
+		t.Error("Decompressed body does not match the original body")
+	}
+
+	if len(compressed) >= len(body) {
+		t.Errorf("Compressed body is %d bytes when the original is %d bytes", len(compressed), len(body))
+	}
+
+	skipped := map[string]*http.Response{
+		"not accepted": newResponse("text/html", -1),
+		"small":        newResponse("text/html", 10),
+		"image":        newResponse("image/png", -1),
+		"event stream": newResponse("text/event-stream", -1),
+		"encoded":      newResponse("text/html", -1),
+		"no transform": newResponse("text/html", -1),
+	}
+	skipped["encoded"].Header.Set("Content-Encoding", "br")
+	skipped["no transform"].Header.Set("Cache-Control", "public, no-transform")
+
+	for name, response := range skipped {
+		acceptEncoding := "gzip"
+		if name == "not accepted" {
+			acceptEncoding = "br"
+		}
+
+		if CompressResponse(response, acceptEncoding) {
+			t.Errorf("Response %s was compressed", name)
+		}
+	}
+
+	svg := newResponse("image/svg+xml", -1)
+	if !CompressResponse(svg, "gzip") {
+		t.Error("SVG response was not compressed")
+	}
+
+	err = svg.Body.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
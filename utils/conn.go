@@ -4,10 +4,17 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	mathrand "math/rand"
 	"net"
+	"net/http"
+	"os"
+	"regexp"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/antoniomika/syncmap"
@@ -26,42 +33,228 @@ type SSHConnection struct {
 	Messages               chan string
 	ProxyProto             byte
 	HostHeader             string
+	HostRewrites           []HostRewrite
+	HostRegexes            []*regexp.Regexp
+	ResponseHeaders        http.Header
+	HTTPAuth               *HTTPAuth
+	CompressResponses      bool
 	StripPath              bool
 	SNIProxy               bool
+	ALPN                   string
 	TCPAddress             string
 	TCPAlias               bool
+	TCPAliasTLS            bool
+	TCPAliasMux            bool
+	UDP                    bool
 	LocalForward           bool
 	TCPAliasesAllowedUsers []string
+	AllowedIPs             []*net.IPNet
+	DeniedIPs              []*net.IPNet
 	AutoClose              bool
 	ForceHTTPS             bool
 	Session                chan bool
 	CleanupHandler         bool
 	SetupLock              *sync.Mutex
 	Deadline               *time.Time
+	Created                time.Time
+	Weight                 int
+	MaxRequestBodySize     int64
+	MaxRequestHeaderSize   int64
+	MaxRequestRate         int64
+	DSCP                   int
+	NoDelay                *bool
+	IdleTimeout            time.Duration
+	ConnectionLimitReached bool
+	KeyPermissions         *KeyPermissions
+	Breaker                *CircuitBreaker
+	Webhook                *ClientWebhook
+	ReconnectToken         string
+	CloseReason            CloseReason
+	Priority               int
+	labels                 map[string]string
+	labelsLock             sync.Mutex
+	env                    map[string]string
+	envLock                sync.Mutex
+	userKey                string
+	listeners              atomic.Int64
+	bytesIn                atomic.Uint64
+	bytesOut               atomic.Uint64
+	quotaAccounted         uint64
+	quotaAccountedAt       time.Time
+	lastActivity           atomic.Int64
+	capture                atomic.Pointer[Capture]
+	pauseLock              sync.Mutex
+	streamsLock            sync.Mutex
+	streams                map[*Stream]struct{}
+	fromClientStalls       stallMeter
+	toClientStalls         stallMeter
+	resumed                chan struct{}
+}
+
+// messageRetryDelay returns how long to wait after the attempt'th failed try
+// of sending a non-blocking console message. The delay starts at interval and
+// doubles with each attempt up to maxInterval. It is jittered between half and
+// all of that, so connections that retry at the same time spread out.
+func messageRetryDelay(attempt int, interval time.Duration, maxInterval time.Duration) time.Duration {
+	if maxInterval < interval {
+		maxInterval = interval
+	}
+
+	delay := interval
+	for i := 0; i < attempt && delay < maxInterval; i++ {
+		delay *= 2
+	}
+
+	if delay > maxInterval {
+		delay = maxInterval
+	}
+
+	if delay <= 0 {
+		return 0
+	}
+
+	return delay/2 + time.Duration(mathrand.Int63n(int64(delay-delay/2)+1))
 }
 
 // SendMessage sends a console message to the connection. If block is true, it
 // will block until the message is sent. If it is false, it will try to send the
-// message 5 times, waiting 100ms each time.
-func (s *SSHConnection) SendMessage(message string, block bool) {
+// message once and retry it message-retry-count times, backing off from
+// message-retry-interval up to message-retry-max-interval between tries. It
+// returns whether the message was delivered.
+func (s *SSHConnection) SendMessage(message string, block bool) bool {
 	if block {
 		s.Messages <- message
-		return
+		return true
 	}
 
-	for i := 0; i < 5; {
+	retryCount := viper.GetInt("message-retry-count")
+	retryInterval := viper.GetDuration("message-retry-interval")
+	retryMaxInterval := viper.GetDuration("message-retry-max-interval")
+
+	for i := 0; ; i++ {
 		select {
 		case <-s.Close:
-			return
+			return false
 		case s.Messages <- message:
-			return
+			return true
 		default:
-			time.Sleep(100 * time.Millisecond)
-			i++
+		}
+
+		if i >= retryCount {
+			break
+		}
+
+		time.Sleep(messageRetryDelay(i, retryInterval, retryMaxInterval))
+	}
+
+	if viper.GetBool("debug") {
+		log.Println("Dropped console message for:", LogAddr(s.SSHConn.RemoteAddr()))
+	}
+
+	return false
+}
+
+// BytesIn returns the total number of bytes received from the SSH client
+// across all forwarded connections.
+func (s *SSHConnection) BytesIn() uint64 {
+	return s.bytesIn.Load()
+}
+
+// BytesOut returns the total number of bytes sent to the SSH client
+// across all forwarded connections.
+func (s *SSHConnection) BytesOut() uint64 {
+	return s.bytesOut.Load()
+}
+
+// ReserveListener counts a new forward listener of the connection. It returns
+// false if max-listeners-per-connection has already been reached, in which
+// case the listener is not counted.
+func (s *SSHConnection) ReserveListener() bool {
+	limit := viper.GetInt64("max-listeners-per-connection")
+
+	for {
+		current := s.listeners.Load()
+		if limit > 0 && current >= limit {
+			return false
+		}
+
+		if s.listeners.CompareAndSwap(current, current+1) {
+			return true
 		}
 	}
 }
 
+// ReleaseListener removes a closed forward listener of the connection from
+// the count.
+func (s *SSHConnection) ReleaseListener() {
+	s.listeners.Add(-1)
+}
+
+// LastActivity returns when data was last copied over one of the
+// connection's forwards, or when the connection was created if there
+// hasn't been any.
+func (s *SSHConnection) LastActivity() time.Time {
+	lastActivity := s.lastActivity.Load()
+	if lastActivity == 0 {
+		return s.Created
+	}
+
+	return time.Unix(0, lastActivity)
+}
+
+// Healthy returns whether or not every forward of the connection is passing
+// its health checks.
+func (s *SSHConnection) Healthy() bool {
+	healthy := true
+
+	s.Listeners.Range(func(key string, value net.Listener) bool {
+		if holder, ok := value.(*ListenerHolder); ok && !holder.Healthy() {
+			healthy = false
+			return false
+		}
+
+		return true
+	})
+
+	return healthy
+}
+
+// listenerHealthy returns whether or not the forward of the connection
+// listening on listenAddr is passing its health checks.
+func (s *SSHConnection) listenerHealthy(listenAddr string) bool {
+	if s.Listeners == nil {
+		return true
+	}
+
+	listener, ok := s.Listeners.Load(listenAddr)
+	if !ok {
+		return true
+	}
+
+	holder, ok := listener.(*ListenerHolder)
+	return !ok || holder.Healthy()
+}
+
+// routingWeight returns the balancer weight of the connection's forward
+// listening on listenAddr, or 0 if it is failing health checks or the
+// connection's circuit breaker is open.
+func (s *SSHConnection) routingWeight(listenAddr string) int {
+	if !s.listenerHealthy(listenAddr) || s.Breaker.Open() {
+		return 0
+	}
+
+	return s.BalancerWeight()
+}
+
+// BalancerWeight returns the weight used when adding this connection to a load balancer.
+func (s *SSHConnection) BalancerWeight() int {
+	if s.Weight < 1 {
+		return 1
+	}
+
+	return s.Weight
+}
+
 // ListenerCount returns the number of current active listeners on this connection.
 func (s *SSHConnection) ListenerCount() int {
 	if s.LocalForward {
@@ -78,26 +271,257 @@ func (s *SSHConnection) ListenerCount() int {
 	return count
 }
 
+// KeepAlive sends keepalive requests to the SSH client on the provided interval.
+// If maxFailures consecutive requests fail, the connection is cleaned up. It
+// returns when the connection is closed.
+func (s *SSHConnection) KeepAlive(state *State, interval time.Duration, maxFailures int) {
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failures := 0
+
+	for {
+		select {
+		case <-ticker.C:
+			if s.sendKeepAlive(interval) {
+				failures = 0
+				continue
+			}
+
+			failures++
+
+			if viper.GetBool("debug") {
+				log.Printf("Keepalive failed for %s (%d/%d)", LogAddr(s.SSHConn.RemoteAddr()), failures, maxFailures)
+			}
+
+			if failures >= maxFailures {
+				log.Println("Keepalive failures exceeded, closing SSH connection for:", LogAddr(s.SSHConn.RemoteAddr()))
+				s.CleanUp(state, CloseReasonKeepAliveFailure)
+				return
+			}
+		case <-s.Close:
+			return
+		}
+	}
+}
+
+// sendKeepAlive sends a single keepalive request and waits up to timeout for
+// the client to reply. Any reply means the client is still alive.
+func (s *SSHConnection) sendKeepAlive(timeout time.Duration) bool {
+	reply := make(chan error, 1)
+
+	go func() {
+		_, _, err := s.SSHConn.SendRequest("keepalive@sish", true, nil)
+		reply <- err
+	}()
+
+	select {
+	case err := <-reply:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	case <-s.Close:
+		return false
+	}
+}
+
+// PortBindRange returns the port range TCP forwards can be bound to. The
+// connection's key permissions take precedence over port-bind-range.
+func (s *SSHConnection) PortBindRange() string {
+	if s.KeyPermissions != nil && s.KeyPermissions.AllowedPorts != "" {
+		return s.KeyPermissions.AllowedPorts
+	}
+
+	return viper.GetString("port-bind-range")
+}
+
+// RequestBodyLimit returns the maximum size in bytes of request bodies sent to
+// the connection's HTTP forwards. A limit set by the connection can lower
+// max-request-body-size but not raise it. 0 means unlimited.
+func (s *SSHConnection) RequestBodyLimit() int64 {
+	limit := viper.GetInt64("max-request-body-size")
+
+	if s.MaxRequestBodySize > 0 && (limit <= 0 || s.MaxRequestBodySize < limit) {
+		return s.MaxRequestBodySize
+	}
+
+	return limit
+}
+
+// RequestHeaderLimit returns the maximum size in bytes of request headers
+// sent to the connection's HTTP forwards. A limit set by the connection can
+// lower max-request-header-size but not raise it. 0 means unlimited.
+func (s *SSHConnection) RequestHeaderLimit() int64 {
+	limit := viper.GetInt64("max-request-header-size")
+
+	if s.MaxRequestHeaderSize > 0 && (limit <= 0 || s.MaxRequestHeaderSize < limit) {
+		return s.MaxRequestHeaderSize
+	}
+
+	return limit
+}
+
+// RequestRateLimit returns the maximum number of requests per second sent to
+// each of the connection's HTTP forwards. A limit set by the connection can
+// lower http-request-rate-limit but not raise it. 0 means unlimited.
+func (s *SSHConnection) RequestRateLimit() int64 {
+	limit := viper.GetInt64("http-request-rate-limit")
+
+	if s.MaxRequestRate > 0 && (limit <= 0 || s.MaxRequestRate < limit) {
+		return s.MaxRequestRate
+	}
+
+	return limit
+}
+
+// SetIdleTimeout sets the idle timeout of the connection's forwarded
+// connections, capped at idle-connection-max-timeout. It returns the timeout
+// that was set, or 0 if connections can't change their idle timeout.
+func (s *SSHConnection) SetIdleTimeout(timeout time.Duration) time.Duration {
+	maxTimeout := viper.GetDuration("idle-connection-max-timeout")
+	if maxTimeout <= 0 || timeout <= 0 {
+		return 0
+	}
+
+	s.IdleTimeout = min(timeout, maxTimeout)
+
+	return s.IdleTimeout
+}
+
+// MaxBandwidth returns the maximum bandwidth for each forwarded connection.
+// The connection's key permissions take precedence over max-bandwidth-per-connection.
+func (s *SSHConnection) MaxBandwidth() int64 {
+	if s.KeyPermissions != nil && s.KeyPermissions.MaxBandwidth > 0 {
+		return s.KeyPermissions.MaxBandwidth
+	}
+
+	return viper.GetInt64("max-bandwidth-per-connection")
+}
+
+// UserKey returns the key used to identify the user of the connection. This is
+// the public key fingerprint if one was used to authenticate, otherwise the username.
+func (s *SSHConnection) UserKey() string {
+	if s.SSHConn.Permissions != nil {
+		if fingerprint := s.SSHConn.Permissions.Extensions["pubKeyFingerprint"]; fingerprint != "" {
+			return fingerprint
+		}
+	}
+
+	return s.SSHConn.User()
+}
+
+// logFields returns the structured log fields describing the connection,
+// merged with any extra fields.
+func (s *SSHConnection) logFields(extra ...LogFields) LogFields {
+	fields := LogFields{
+		"remote_addr": LogAddr(s.SSHConn.RemoteAddr()),
+		"user":        s.SSHConn.User(),
+	}
+
+	for _, e := range extra {
+		for k, v := range e {
+			fields[k] = v
+		}
+	}
+
+	return fields
+}
+
 // CleanUp closes all allocated resources for a SSH session and cleans them up.
-func (s *SSHConnection) CleanUp(state *State) {
+// The reason of the first call is kept in CloseReason, which is set before
+// Close is closed and teardown hooks run.
+func (s *SSHConnection) CleanUp(state *State, reason CloseReason) {
 	s.Closed.Do(func() {
+		s.CloseReason = reason
 		close(s.Close)
 
 		err := s.SSHConn.Close()
 		if err != nil {
-			log.Println("Error closing SSH connection:", err)
+			err = logError(err)
+			LogEvent("connection_close_error", s.logFields(LogFields{"error": err}), "Error closing SSH connection:", err)
 		}
 
 		state.SSHConnections.Delete(s.SSHConn.RemoteAddr().String())
-		log.Println("Closed SSH connection for:", s.SSHConn.RemoteAddr().String(), "user:", s.SSHConn.User())
+		state.releaseUserConnection(s)
+		state.releaseReservation(s)
+		state.releaseQuota(s)
+		s.Breaker.Stop()
+		s.StopCapture()
+		state.Metrics.ConnectionClosed()
+		LogEvent("connection_closed", s.logFields(LogFields{"reason": reason.String(), "server_initiated": reason.ServerInitiated()}), "Closed SSH connection for:", LogAddr(s.SSHConn.RemoteAddr()), "user:", s.SSHConn.User(), "reason:", reason)
+
+		state.runTeardownHooks(s)
 	})
 }
 
+// ChannelConn wraps an SSH channel to fit net.Conn, using the addresses of
+// the SSH connection the channel was opened on.
+type ChannelConn struct {
+	io.ReadWriteCloser
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+// NewChannelConn returns a new ChannelConn for a channel of conn.
+func NewChannelConn(channel io.ReadWriteCloser, conn ssh.Conn) *ChannelConn {
+	return &ChannelConn{
+		ReadWriteCloser: channel,
+		localAddr:       conn.LocalAddr(),
+		remoteAddr:      conn.RemoteAddr(),
+	}
+}
+
+// CloseWrite closes the write side of the channel, if it supports it.
+func (conn *ChannelConn) CloseWrite() error {
+	cw, ok := conn.ReadWriteCloser.(closeWriter)
+	if !ok {
+		return fmt.Errorf("channel can't be half-closed")
+	}
+
+	return cw.CloseWrite()
+}
+
+// LocalAddr returns the local address of the SSH connection.
+func (conn *ChannelConn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
+
+// RemoteAddr returns the remote address of the SSH connection.
+func (conn *ChannelConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// SetDeadline is a shim function to fit net.Conn. Channels do not support deadlines.
+func (conn *ChannelConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// SetReadDeadline is a shim function to fit net.Conn. Channels do not support deadlines.
+func (conn *ChannelConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// SetWriteDeadline is a shim function to fit net.Conn. Channels do not support deadlines.
+func (conn *ChannelConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
 // TeeConn represents a simple net.Conn interface for SNI Processing.
+// Conn may be nil if the TeeConn was created from a reader, in which case
+// addresses are nil and writes return io.EOF.
 type TeeConn struct {
 	Conn     net.Conn
 	Buffer   *bufio.Reader
 	Unbuffer bool
+
+	// JA3 is the JA3 fingerprint of the TLS hello read by PeekTLSHello.
+	JA3 string
+
+	reader io.Reader
 }
 
 // Read implements a reader ontop of the TeeReader.
@@ -105,45 +529,155 @@ func (conn *TeeConn) Read(p []byte) (int, error) {
 	if conn.Unbuffer && conn.Buffer.Buffered() > 0 {
 		return conn.Buffer.Read(p)
 	}
-	return conn.Conn.Read(p)
+	return conn.reader.Read(p)
 }
 
 // Write is a shim function to fit net.Conn.
 func (conn *TeeConn) Write(p []byte) (int, error) {
+	if conn.Conn == nil {
+		return 0, io.EOF
+	}
 	return conn.Conn.Write(p)
 }
 
 // Close is a shim function to fit net.Conn.
 func (conn *TeeConn) Close() error {
+	if conn.Conn == nil {
+		return nil
+	}
 	return conn.Conn.Close()
 }
 
 // LocalAddr is a shim function to fit net.Conn.
-func (conn *TeeConn) LocalAddr() net.Addr { return conn.Conn.LocalAddr() }
+func (conn *TeeConn) LocalAddr() net.Addr {
+	if conn.Conn == nil {
+		return nil
+	}
+	return conn.Conn.LocalAddr()
+}
 
 // RemoteAddr is a shim function to fit net.Conn.
-func (conn *TeeConn) RemoteAddr() net.Addr { return conn.Conn.RemoteAddr() }
+func (conn *TeeConn) RemoteAddr() net.Addr {
+	if conn.Conn == nil {
+		return nil
+	}
+	return conn.Conn.RemoteAddr()
+}
 
 // SetDeadline is a shim function to fit net.Conn.
-func (conn *TeeConn) SetDeadline(t time.Time) error { return conn.Conn.SetDeadline(t) }
+func (conn *TeeConn) SetDeadline(t time.Time) error {
+	if conn.Conn == nil {
+		return nil
+	}
+	return conn.Conn.SetDeadline(t)
+}
 
 // SetReadDeadline is a shim function to fit net.Conn.
-func (conn *TeeConn) SetReadDeadline(t time.Time) error { return conn.Conn.SetReadDeadline(t) }
+func (conn *TeeConn) SetReadDeadline(t time.Time) error {
+	if conn.Conn == nil {
+		return nil
+	}
+	return conn.Conn.SetReadDeadline(t)
+}
 
 // SetWriteDeadline is a shim function to fit net.Conn.
-func (conn *TeeConn) SetWriteDeadline(t time.Time) error { return conn.Conn.SetWriteDeadline(t) }
+func (conn *TeeConn) SetWriteDeadline(t time.Time) error {
+	if conn.Conn == nil {
+		return nil
+	}
+	return conn.Conn.SetWriteDeadline(t)
+}
 
+// NewTeeConn returns a TeeConn that buffers reads from conn. LocalAddr and
+// RemoteAddr proxy through to conn.
 func NewTeeConn(conn net.Conn) *TeeConn {
+	teeConn := NewTeeReader(conn)
+	teeConn.Conn = conn
+
+	return teeConn
+}
+
+// NewTeeReader returns a TeeConn that buffers reads from reader for callers that
+// do not have an underlying connection.
+func NewTeeReader(reader io.Reader) *TeeConn {
 	teeConn := &TeeConn{
-		Conn:   conn,
-		Buffer: bufio.NewReaderSize(conn, 65535),
+		Buffer: bufio.NewReaderSize(reader, 65535),
+		reader: reader,
 	}
 
 	return teeConn
 }
 
+// ReplayConn is a net.Conn that replays bytes that were already read from
+// Conn before continuing to read from Conn. Writes, deadlines and addresses
+// are those of Conn.
+type ReplayConn struct {
+	net.Conn
+	replay []byte
+}
+
+// NewReplayConn returns a ReplayConn that replays the replay bytes before
+// reading from conn.
+func NewReplayConn(conn net.Conn, replay []byte) *ReplayConn {
+	return &ReplayConn{
+		Conn:   conn,
+		replay: replay,
+	}
+}
+
+// Read reads the replayed bytes first and then reads from the connection.
+func (conn *ReplayConn) Read(p []byte) (int, error) {
+	if len(conn.replay) > 0 {
+		n := copy(p, conn.replay)
+		conn.replay = conn.replay[n:]
+
+		return n, nil
+	}
+
+	return conn.Conn.Read(p)
+}
+
+// ReplayConn returns a ReplayConn that replays the bytes buffered by the
+// TeeConn before reading from its connection. The TeeConn should not be read
+// from afterwards.
+func (conn *TeeConn) ReplayConn() *ReplayConn {
+	buffered, _ := conn.Buffer.Peek(conn.Buffer.Buffered())
+
+	return NewReplayConn(conn.Conn, bytes.Clone(buffered))
+}
+
 // PeekTLSHello peeks the TLS Connection Hello to proxy based on SNI.
+// The returned TeeConn will always replay the bytes that were read, even
+// if an error is returned, so callers can treat the connection as non-TLS.
+// Reading the hello is limited by tls-peek-timeout. Hellos with a JA3
+// fingerprint that is blocked return a nil hello and ErrJA3Blocked. Callers
+// should drop the connection if the returned error is os.ErrDeadlineExceeded
+// or ErrJA3Blocked.
 func PeekTLSHello(conn net.Conn) (*tls.ClientHelloInfo, *TeeConn, error) {
+	if !viper.GetBool("debug") {
+		return peekTLSHello(conn)
+	}
+
+	start := time.Now()
+	tlsHello, teeConn, err := peekTLSHello(conn)
+	elapsed := time.Since(start)
+
+	if tlsHello == nil {
+		log.Printf("Peeked TLS hello from %s in %s: %s", LogAddr(conn.RemoteAddr()), elapsed, err)
+		return tlsHello, teeConn, err
+	}
+
+	if err != nil {
+		log.Printf("Peeked TLS hello from %s in %s with server name %q, alpn %q and ja3 %s: %s", LogAddr(conn.RemoteAddr()), elapsed, tlsHello.ServerName, tlsHello.SupportedProtos, teeConn.JA3, err)
+	} else {
+		log.Printf("Peeked TLS hello from %s in %s with server name %q, alpn %q and ja3 %s", LogAddr(conn.RemoteAddr()), elapsed, tlsHello.ServerName, tlsHello.SupportedProtos, teeConn.JA3)
+	}
+
+	return tlsHello, teeConn, err
+}
+
+// peekTLSHello implements PeekTLSHello without logging.
+func peekTLSHello(conn net.Conn) (*tls.ClientHelloInfo, *TeeConn, error) {
 	var tlsHello *tls.ClientHelloInfo
 
 	tlsConfig := &tls.Config{
@@ -154,45 +688,174 @@ func PeekTLSHello(conn net.Conn) (*tls.ClientHelloInfo, *TeeConn, error) {
 	}
 
 	teeConn := NewTeeConn(conn)
+	defer func() {
+		teeConn.Unbuffer = true
+	}()
+
+	if timeout := viper.GetDuration("tls-peek-timeout"); timeout > 0 {
+		err := conn.SetReadDeadline(time.Now().Add(timeout))
+		if err != nil && viper.GetBool("debug") {
+			log.Println("Unable to set tls hello read deadline:", err)
+		}
+
+		defer func() {
+			err := conn.SetReadDeadline(time.Time{})
+			if err != nil && viper.GetBool("debug") {
+				log.Println("Unable to clear tls hello read deadline:", err)
+			}
+		}()
+	}
 
 	header, err := teeConn.Buffer.Peek(5)
 	if err != nil {
-		return tlsHello, teeConn, err
+		return tlsHello, teeConn, peekError(err)
 	}
 
 	if header[0] != 0x16 {
-		return tlsHello, teeConn, err
+		return tlsHello, teeConn, fmt.Errorf("connection is not a tls handshake")
 	}
 
 	helloBytes, err := teeConn.Buffer.Peek(len(header) + (int(header[3])<<8 | int(header[4])))
 	if err != nil {
-		return tlsHello, teeConn, err
+		return tlsHello, teeConn, peekError(err)
 	}
 
-	err = tls.Server(bufConn{reader: bytes.NewReader(helloBytes)}, tlsConfig).Handshake()
+	err = tls.Server(bufConn{
+		reader:     bytes.NewReader(helloBytes),
+		localAddr:  teeConn.LocalAddr(),
+		remoteAddr: teeConn.RemoteAddr(),
+	}, tlsConfig).Handshake()
+
+	if tlsHello != nil {
+		fingerprint, ja3Err := JA3(helloBytes)
+		if ja3Err != nil && viper.GetBool("debug") {
+			log.Println("Unable to fingerprint tls hello:", ja3Err)
+		}
 
-	teeConn.Unbuffer = true
+		teeConn.JA3 = fingerprint
+
+		if JA3Blocked(fingerprint) {
+			return nil, teeConn, fmt.Errorf("%w: %s", ErrJA3Blocked, fingerprint)
+		}
+	}
 
 	return tlsHello, teeConn, err
 }
 
+// peekError explains errors from reading the TLS hello if it timed out.
+func peekError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("timed out reading tls hello: %w", err)
+	}
+
+	return err
+}
+
 type bufConn struct {
-	reader io.Reader
+	reader     io.Reader
+	localAddr  net.Addr
+	remoteAddr net.Addr
 	net.Conn
 }
 
 func (b bufConn) Read(p []byte) (int, error) { return b.reader.Read(p) }
 func (bufConn) Write(p []byte) (int, error)  { return 0, io.EOF }
+func (b bufConn) LocalAddr() net.Addr        { return b.localAddr }
+func (b bufConn) RemoteAddr() net.Addr       { return b.remoteAddr }
 
 // IdleTimeoutConn handles the connection with a context deadline.
 // code adapted from https://qiita.com/kwi/items/b38d6273624ad3f6ae79
 type IdleTimeoutConn struct {
 	Conn net.Conn
+
+	// Timeout overrides the read and write idle timeouts if it is set.
+	Timeout time.Duration
+
+	// Deadline is an absolute deadline that activity doesn't extend past. It
+	// is not set if it is zero.
+	Deadline time.Time
+
+	// SSHConn is the connection the forward belongs to. Idle timeouts are
+	// suspended while it is paused, see Pause.
+	SSHConn *SSHConnection
+}
+
+// HardDeadline returns the absolute deadline of a forwarded connection that
+// starts now, or the zero time if max-connection-duration-hard is not set.
+func HardDeadline() time.Time {
+	duration := viper.GetDuration("max-connection-duration-hard")
+	if duration <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(duration)
+}
+
+// idleTimeouts returns the read and write idle timeouts. Each falls back to
+// idle-connection-timeout if a direction specific timeout is not set.
+func idleTimeouts() (time.Duration, time.Duration) {
+	readTimeout := viper.GetDuration("idle-read-timeout")
+	writeTimeout := viper.GetDuration("idle-write-timeout")
+
+	if readTimeout == 0 {
+		readTimeout = viper.GetDuration("idle-connection-timeout")
+	}
+
+	if writeTimeout == 0 {
+		writeTimeout = viper.GetDuration("idle-connection-timeout")
+	}
+
+	return readTimeout, writeTimeout
+}
+
+// timeouts returns the read and write idle timeouts of the connection.
+func (i IdleTimeoutConn) timeouts() (time.Duration, time.Duration) {
+	if i.Timeout > 0 {
+		return i.Timeout, i.Timeout
+	}
+
+	return idleTimeouts()
+}
+
+// deadline returns the deadline after timeout from now, capped at the
+// connection's absolute deadline.
+func (i IdleTimeoutConn) deadline(timeout time.Duration) time.Time {
+	deadline := time.Now().Add(timeout)
+	if !i.Deadline.IsZero() && i.Deadline.Before(deadline) {
+		return i.Deadline
+	}
+
+	return deadline
+}
+
+// setDeadline sets the deadline after timeout with set. While the connection
+// is paused, only the absolute deadline is set.
+func (i IdleTimeoutConn) setDeadline(set func(time.Time) error, timeout time.Duration) error {
+	if i.SSHConn == nil {
+		return set(i.deadline(timeout))
+	}
+
+	i.SSHConn.pauseLock.Lock()
+	defer i.SSHConn.pauseLock.Unlock()
+
+	if i.SSHConn.resumed != nil {
+		return set(i.Deadline)
+	}
+
+	return set(i.deadline(timeout))
 }
 
 // Read is needed to implement the reader part.
 func (i IdleTimeoutConn) Read(buf []byte) (int, error) {
-	err := i.Conn.SetDeadline(time.Now().Add(viper.GetDuration("idle-connection-timeout")))
+	readTimeout, writeTimeout := i.timeouts()
+
+	var err error
+	if readTimeout == writeTimeout {
+		err = i.setDeadline(i.Conn.SetDeadline, readTimeout)
+	} else {
+		err = i.setDeadline(i.Conn.SetReadDeadline, readTimeout)
+	}
+
 	if err != nil {
 		return 0, err
 	}
@@ -202,7 +865,15 @@ func (i IdleTimeoutConn) Read(buf []byte) (int, error) {
 
 // Write is needed to implement the writer part.
 func (i IdleTimeoutConn) Write(buf []byte) (int, error) {
-	err := i.Conn.SetDeadline(time.Now().Add(viper.GetDuration("idle-connection-timeout")))
+	readTimeout, writeTimeout := i.timeouts()
+
+	var err error
+	if readTimeout == writeTimeout {
+		err = i.setDeadline(i.Conn.SetDeadline, writeTimeout)
+	} else {
+		err = i.setDeadline(i.Conn.SetWriteDeadline, writeTimeout)
+	}
+
 	if err != nil {
 		return 0, err
 	}
@@ -210,9 +881,306 @@ func (i IdleTimeoutConn) Write(buf []byte) (int, error) {
 	return i.Conn.Write(buf)
 }
 
+// NoIdleTimeoutConn wraps a connection that should not have idle timeouts
+// applied when it is copied.
+type NoIdleTimeoutConn struct {
+	net.Conn
+}
+
+// Pause holds the data flow of the connection's forwards until Resume is
+// called. Forwarded connections stay open and no data is dropped. Their idle
+// timeouts are suspended until they are resumed.
+func (s *SSHConnection) Pause() {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	if s.resumed != nil {
+		return
+	}
+
+	s.resumed = make(chan struct{})
+
+	for _, idle := range s.idleConns() {
+		_ = idle.Conn.SetDeadline(idle.Deadline)
+	}
+}
+
+// Resume lets the data flow of the connection's forwards continue after Pause,
+// and restarts their idle timeouts.
+func (s *SSHConnection) Resume() {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	if s.resumed == nil {
+		return
+	}
+
+	close(s.resumed)
+	s.resumed = nil
+
+	for _, idle := range s.idleConns() {
+		readTimeout, writeTimeout := idle.timeouts()
+
+		_ = idle.Conn.SetReadDeadline(idle.deadline(readTimeout))
+		_ = idle.Conn.SetWriteDeadline(idle.deadline(writeTimeout))
+	}
+}
+
+// Paused returns whether or not the connection's forwards are paused.
+func (s *SSHConnection) Paused() bool {
+	s.pauseLock.Lock()
+	defer s.pauseLock.Unlock()
+
+	return s.resumed != nil
+}
+
+// waitResumed blocks while the connection is paused, until it is resumed or
+// done is closed.
+func (s *SSHConnection) waitResumed(done <-chan struct{}) {
+	s.pauseLock.Lock()
+	resumed := s.resumed
+	s.pauseLock.Unlock()
+
+	if resumed == nil {
+		return
+	}
+
+	select {
+	case <-resumed:
+	case <-s.Close:
+	case <-done:
+	}
+}
+
+// pausingReader holds reads while its connection is paused. Data returned by
+// a read that was already waiting when the connection was paused is held
+// until the connection is resumed.
+type pausingReader struct {
+	Reader  io.Reader
+	SSHConn *SSHConnection
+	Done    <-chan struct{}
+}
+
+// Read implements the reader and waits while the connection is paused.
+func (p *pausingReader) Read(b []byte) (int, error) {
+	p.SSHConn.waitResumed(p.Done)
+
+	n, err := p.Reader.Read(b)
+	if n > 0 {
+		p.SSHConn.waitResumed(p.Done)
+	}
+
+	return n, err
+}
+
+// countingReader counts the bytes read from the underlying reader and
+// records when they were read.
+type countingReader struct {
+	Reader   io.Reader
+	Counter  *atomic.Uint64
+	Activity *atomic.Int64
+}
+
+// Read implements the reader and records the bytes read.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.Reader.Read(p)
+	if n > 0 {
+		c.Counter.Add(uint64(n))
+		c.Activity.Store(time.Now().UnixNano())
+	}
+
+	return n, err
+}
+
+// copyBufferPool holds the buffers used to copy forwarded connections.
+var copyBufferPool = sync.Pool{}
+
+// copyBuffer copies from src to dst like io.Copy, using a pooled buffer of
+// size bytes. io.Copy's buffer is used if size is 0.
+func copyBuffer(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		return io.Copy(dst, src)
+	}
+
+	buf, ok := copyBufferPool.Get().(*[]byte)
+	if !ok || len(*buf) != size {
+		newBuf := make([]byte, size)
+		buf = &newBuf
+	}
+	defer copyBufferPool.Put(buf)
+
+	return io.CopyBuffer(dst, src, *buf)
+}
+
+// CopyResult is the result of copying between a reader and writer.
+type CopyResult struct {
+	// ToReader is the number of bytes copied from the writer to the reader.
+	ToReader int64
+
+	// ToWriter is the number of bytes copied from the reader to the writer.
+	ToWriter int64
+
+	// Err is the error that ended the copy, if the copy that finished first
+	// did not end with an EOF.
+	Err error
+}
+
+// closeWriter is implemented by connections that can be half-closed, like
+// *net.TCPConn, *tls.Conn and ssh.Channel.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite closes the write side of conn. It returns false if conn can't
+// be half-closed.
+func closeWrite(conn any) bool {
+	cw, ok := conn.(closeWriter)
+	if !ok {
+		return false
+	}
+
+	return cw.CloseWrite() == nil
+}
+
+// CopyOptions are the wrappers and settings CopyBothWith applies to a copy.
+// CopyOptionsFor returns the options set by the configuration, other options
+// can be used to copy without reading the configuration.
+type CopyOptions struct {
+	// Idle wraps the writer to apply idle timeouts. The writer is used as is
+	// if it is nil.
+	Idle func(writer net.Conn) io.ReadWriter
+
+	// Limit wraps the reader of each direction to apply bandwidth limits. It
+	// is called once per direction, and readers are used as is if it is nil.
+	// done is closed when the copy ends.
+	Limit func(reader io.Reader, done <-chan struct{}) io.Reader
+
+	// StallSampleRate records stalls on the SSH connection for 1 in
+	// StallSampleRate reads and writes. Stalls are not recorded if it is 0.
+	StallSampleRate int
+
+	// BufferSize is the size of the buffers used to copy. io.Copy's buffer is
+	// used if it is 0.
+	BufferSize int
+
+	// Linger is how long the other direction can drain after one direction
+	// ends with EOF. Both sides are closed right away if it is 0.
+	Linger time.Duration
+
+	// Deadline is an absolute deadline for the writer that activity doesn't
+	// extend. The copy is torn down when it is reached. It is not set if it
+	// is zero.
+	Deadline time.Time
+}
+
+// CopyOptionsFor returns the options set by the configuration for copying
+// to writer on behalf of sshConn, which can be nil.
+func CopyOptionsFor(writer net.Conn, sshConn *SSHConnection) CopyOptions {
+	options := CopyOptions{
+		BufferSize: viper.GetInt("copy-buffer-size"),
+		Linger:     viper.GetDuration("close-linger"),
+		Deadline:   HardDeadline(),
+	}
+
+	switch writer.(type) {
+	case *WebSocketIdleTimeoutConn, NoIdleTimeoutConn:
+	default:
+		if viper.GetBool("idle-connection") {
+			options.Idle = func(writer net.Conn) io.ReadWriter {
+				idleConn := IdleTimeoutConn{
+					Conn:     writer,
+					Deadline: options.Deadline,
+					SSHConn:  sshConn,
+				}
+
+				if sshConn != nil {
+					idleConn.Timeout = sshConn.IdleTimeout
+				}
+
+				return idleConn
+			}
+		}
+	}
+
+	if sshConn != nil {
+		options.StallSampleRate = viper.GetInt("stall-sample-rate")
+	}
+
+	bandwidth := viper.GetInt64("max-bandwidth-per-connection")
+	if sshConn != nil {
+		bandwidth = sshConn.MaxBandwidth()
+	}
+
+	shared := viper.GetInt64("max-bandwidth-total") > 0
+
+	if bandwidth > 0 || shared {
+		burst := viper.GetInt64("max-bandwidth-burst")
+
+		options.Limit = func(reader io.Reader, done <-chan struct{}) io.Reader {
+			limited := &RateLimitedReader{Reader: reader, Done: done}
+
+			if bandwidth > 0 {
+				limited.Bucket = NewTokenBucket(bandwidth, burst)
+			}
+
+			if shared {
+				limited.Shared = totalBandwidth
+
+				if sshConn != nil {
+					limited.Priority = sshConn.Priority
+				}
+			}
+
+			return limited
+		}
+	}
+
+	return options
+}
+
 // CopyBoth copies betwen a reader and writer and will cleanup each.
-func CopyBoth(writer net.Conn, reader io.ReadWriteCloser) {
+// If sshConn is not nil, reader is treated as the side facing the SSH client
+// and the bytes copied are recorded on the connection.
+func CopyBoth(writer net.Conn, reader io.ReadWriteCloser, sshConn *SSHConnection) {
+	CopyBothResult(writer, reader, sshConn)
+}
+
+// CopyBothResult is the same as CopyBoth, but waits for both directions to
+// finish and returns the bytes copied each way and the error that ended the copy.
+func CopyBothResult(writer net.Conn, reader io.ReadWriteCloser, sshConn *SSHConnection) CopyResult {
+	return CopyBothWith(writer, reader, sshConn, CopyOptionsFor(writer, sshConn))
+}
+
+// CopyBothWith is the same as CopyBothResult, but applies options instead of
+// the options set by the configuration.
+func CopyBothWith(writer net.Conn, reader io.ReadWriteCloser, sshConn *SSHConnection, options CopyOptions) CopyResult {
+	result := CopyResult{}
+	resultLock := &sync.Mutex{}
+
+	// setErr records the first error that ended a direction of the copy.
+	// Directions that end cleanly or because the other one closed both
+	// connections don't hide an error from the other direction.
+	setErr := func(err error) {
+		if err == nil || errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || errors.Is(err, io.ErrClosedPipe) {
+			return
+		}
+
+		resultLock.Lock()
+		defer resultLock.Unlock()
+
+		if result.Err == nil {
+			result.Err = err
+		}
+	}
+
+	done := make(chan struct{})
+	doneOnce := &sync.Once{}
+
 	closeBoth := func() {
+		doneOnce.Do(func() {
+			close(done)
+		})
+
 		err := reader.Close()
 		if err != nil {
 			log.Println("Error closing reader:", err)
@@ -224,34 +1192,159 @@ func CopyBoth(writer net.Conn, reader io.ReadWriteCloser) {
 		}
 	}
 
-	var tcon io.ReadWriter
+	if !options.Deadline.IsZero() {
+		err := writer.SetDeadline(options.Deadline)
+		if err != nil {
+			log.Println("Error setting connection deadline:", err)
+		}
+	}
+
+	var tcon io.ReadWriter = writer
+	if options.Idle != nil {
+		tcon = options.Idle(writer)
+	}
+
+	var fromWriter io.Reader = tcon
+	var fromReader io.Reader = reader
+	var toWriter io.Writer = tcon
+	var toReader io.Writer = reader
+
+	if rate := options.StallSampleRate; sshConn != nil && rate > 0 {
+		fromWriter = &stallReader{Reader: tcon, Meter: &sshConn.toClientStalls, Rate: rate}
+		toReader = &stallWriter{Writer: reader, Meter: &sshConn.toClientStalls, Rate: rate}
+		fromReader = &stallReader{Reader: reader, Meter: &sshConn.fromClientStalls, Rate: rate}
+		toWriter = &stallWriter{Writer: tcon, Meter: &sshConn.fromClientStalls, Rate: rate}
+	}
+
+	if options.Limit != nil {
+		fromWriter = options.Limit(fromWriter, done)
+		fromReader = options.Limit(fromReader, done)
+	}
 
-	if viper.GetBool("idle-connection") {
-		tcon = IdleTimeoutConn{
-			Conn: writer,
+	if sshConn != nil {
+		fromWriter = &pausingReader{
+			Reader:  fromWriter,
+			SSHConn: sshConn,
+			Done:    done,
 		}
-	} else {
-		tcon = writer
+
+		fromReader = &pausingReader{
+			Reader:  fromReader,
+			SSHConn: sshConn,
+			Done:    done,
+		}
+
+		var idle *IdleTimeoutConn
+		switch idleConn := tcon.(type) {
+		case IdleTimeoutConn:
+			idle = &idleConn
+		case *WebSocketIdleTimeoutConn:
+			idle = &idleConn.idle
+		}
+
+		stream := sshConn.openStream(writer, idle)
+		defer sshConn.closeStream(stream)
+
+		fromWriter = &countingReader{
+			Reader: &countingReader{
+				Reader:   fromWriter,
+				Counter:  &stream.bytesOut,
+				Activity: &stream.lastActivity,
+			},
+			Counter:  &sshConn.bytesOut,
+			Activity: &sshConn.lastActivity,
+		}
+
+		fromReader = &countingReader{
+			Reader: &countingReader{
+				Reader:   fromReader,
+				Counter:  &stream.bytesIn,
+				Activity: &stream.lastActivity,
+			},
+			Counter:  &sshConn.bytesIn,
+			Activity: &sshConn.lastActivity,
+		}
+
+		flow := newCaptureFlow(LogHostPort(stream.RemoteAddr), stream.LocalAddr)
+
+		fromWriter = &captureReader{
+			Reader:  fromWriter,
+			SSHConn: sshConn,
+			Flow:    flow,
+		}
+
+		fromReader = &captureReader{
+			Reader:   fromReader,
+			SSHConn:  sshConn,
+			Flow:     flow,
+			ToRemote: true,
+		}
+	}
+
+	copyErrorFields := func(err error) LogFields {
+		err = logError(err)
+
+		if sshConn != nil {
+			return sshConn.logFields(LogFields{"error": err})
+		}
+
+		return LogFields{
+			"remote_addr": LogAddr(writer.RemoteAddr()),
+			"error":       err,
+		}
+	}
+
+	linger := options.Linger
+	halfClosed := atomic.Bool{}
+
+	// finish is called when one direction of the copy ends. If it ended with
+	// EOF and close-linger is set, only the write side of dst is closed and
+	// the other direction gets close-linger to drain before both are closed.
+	finish := func(err error, dst any) {
+		if linger > 0 && err == nil && halfClosed.CompareAndSwap(false, true) && closeWrite(dst) {
+			lingerTimer := time.AfterFunc(linger, closeBoth)
+
+			go func() {
+				<-done
+				lingerTimer.Stop()
+			}()
+
+			return
+		}
+
+		closeBoth()
 	}
 
+	copiedToReader := make(chan struct{})
+
 	copyToReader := func() {
-		_, err := io.Copy(reader, tcon)
+		defer close(copiedToReader)
+
+		n, err := copyBuffer(toReader, fromWriter, options.BufferSize)
 		if err != nil && viper.GetBool("debug") {
-			log.Println("Error copying to reader:", err)
+			LogEvent("copy_error", copyErrorFields(err), "Error copying to reader:", logError(err))
 		}
 
-		closeBoth()
+		result.ToReader = n
+		setErr(err)
+		finish(err, reader)
 	}
 
 	copyToWriter := func() {
-		_, err := io.Copy(tcon, reader)
+		n, err := copyBuffer(toWriter, fromReader, options.BufferSize)
 		if err != nil && viper.GetBool("debug") {
-			log.Println("Error copying to writer:", err)
+			LogEvent("copy_error", copyErrorFields(err), "Error copying to writer:", logError(err))
 		}
 
-		closeBoth()
+		result.ToWriter = n
+		setErr(err)
+		finish(err, writer)
 	}
 
 	go copyToReader()
 	copyToWriter()
+
+	<-copiedToReader
+
+	return result
 }
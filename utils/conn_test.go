@@ -0,0 +1,664 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TestPeekTLSHelloNonTLS validates that PeekTLSHello returns a TeeConn that
+// replays the bytes it read when the connection is not a TLS handshake.
+func TestPeekTLSHelloNonTLS(t *testing.T) {
+	testCases := [][]byte{
+		[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		[]byte("SSH-2.0-OpenSSH_9.6\r\n"),
+		{0x16, 0x03, 0x01, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00},
+	}
+
+	for caseIdx, payload := range testCases {
+		client, server := net.Pipe()
+
+		go func() {
+			_, err := client.Write(payload)
+			if err != nil {
+				t.Error(err)
+			}
+
+			err = client.Close()
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+
+		tlsHello, teeConn, err := PeekTLSHello(server)
+		if tlsHello != nil {
+			t.Errorf("Expected no tls hello for case %d", caseIdx)
+		}
+
+		if err == nil {
+			t.Errorf("Expected an error for case %d", caseIdx)
+		}
+
+		buffered, err := teeConn.Buffer.Peek(teeConn.Buffer.Buffered())
+		if err != nil {
+			t.Error(err)
+		}
+
+		if !bytes.Equal(buffered, payload[:len(buffered)]) {
+			t.Errorf("Buffered %q does not match payload %q for case %d", buffered, payload, caseIdx)
+		}
+
+		data, err := io.ReadAll(teeConn)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if !bytes.Equal(data, payload) {
+			t.Errorf("Read %q when should have been %q for case %d", data, payload, caseIdx)
+		}
+
+		err = server.Close()
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// TestTeeConnAddrs validates that TeeConn addresses pass through to the
+// underlying connection and are visible during PeekTLSHello.
+func TestTeeConnAddrs(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer client.Close()
+
+		_ = tls.Client(client, &tls.Config{ServerName: "example.com"}).Handshake()
+	}()
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	tlsHello, teeConn, err := PeekTLSHello(server)
+	if tlsHello == nil {
+		t.Fatalf("Expected a tls hello, got error: %s", err)
+	}
+
+	if teeConn.LocalAddr().String() != server.LocalAddr().String() {
+		t.Errorf("LocalAddr %s when should have been %s", teeConn.LocalAddr(), server.LocalAddr())
+	}
+
+	if teeConn.RemoteAddr().String() != server.RemoteAddr().String() {
+		t.Errorf("RemoteAddr %s when should have been %s", teeConn.RemoteAddr(), server.RemoteAddr())
+	}
+
+	if tlsHello.Conn.RemoteAddr().String() != server.RemoteAddr().String() {
+		t.Errorf("Hello RemoteAddr %s when should have been %s", tlsHello.Conn.RemoteAddr(), server.RemoteAddr())
+	}
+
+	readerConn := NewTeeReader(bytes.NewReader([]byte("data")))
+	if readerConn.LocalAddr() != nil || readerConn.RemoteAddr() != nil {
+		t.Error("Expected nil addresses for a reader TeeConn")
+	}
+}
+
+// TestCopyBothResult validates that the bytes copied in each direction are
+// reported once both sides are closed.
+func TestCopyBothResult(t *testing.T) {
+	client, writer := net.Pipe()
+	reader, backend := net.Pipe()
+
+	results := make(chan CopyResult)
+	go func() {
+		results <- CopyBothResult(writer, reader, nil)
+	}()
+
+	go func() {
+		buf := make([]byte, 5)
+
+		_, err := io.ReadFull(backend, buf)
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, err = backend.Write([]byte("pong"))
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	_, err := client.Write([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+
+	_, err = io.ReadFull(client, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := <-results
+
+	if result.ToReader != 5 || result.ToWriter != 4 {
+		t.Errorf("Copied %d and %d bytes when should have been 5 and 4", result.ToReader, result.ToWriter)
+	}
+
+	if result.Err != nil {
+		t.Errorf("Expected no error, got: %s", result.Err)
+	}
+}
+
+// tcpPair returns both ends of a loopback TCP connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// TestCloseLinger validates that a response sent after the client finished
+// sending is only delivered if close-linger gives it time to drain.
+func TestCloseLinger(t *testing.T) {
+	defer viper.Set("close-linger", nil)
+
+	for _, linger := range []time.Duration{0, time.Second} {
+		viper.Set("close-linger", linger)
+
+		client, writer := tcpPair(t)
+		reader, backend := tcpPair(t)
+
+		copied := make(chan struct{})
+
+		go func() {
+			CopyBoth(writer, reader, nil)
+			close(copied)
+		}()
+
+		go func() {
+			request, err := io.ReadAll(backend)
+			if err != nil {
+				return
+			}
+
+			time.Sleep(50 * time.Millisecond)
+
+			_, _ = backend.Write(append([]byte("re:"), request...))
+			backend.Close()
+		}()
+
+		_, err := client.Write([]byte("download"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = client.CloseWrite()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, _ := io.ReadAll(client)
+		<-copied
+
+		if linger > 0 && string(response) != "re:download" {
+			t.Errorf("Received %q when should have been \"re:download\" with close-linger", response)
+		}
+
+		if linger == 0 && len(response) != 0 {
+			t.Errorf("Received %q when the connection should have closed without close-linger", response)
+		}
+	}
+}
+
+// TestLastActivity validates that reading through a counted forward updates
+// the connection's last activity.
+func TestLastActivity(t *testing.T) {
+	created := time.Now().Add(-time.Hour)
+	sshConn := &SSHConnection{Created: created}
+
+	if !sshConn.LastActivity().Equal(created) {
+		t.Errorf("Last activity %s when should have been %s", sshConn.LastActivity(), created)
+	}
+
+	reader := &countingReader{
+		Reader:   bytes.NewReader([]byte("hello")),
+		Counter:  &sshConn.bytesIn,
+		Activity: &sshConn.lastActivity,
+	}
+
+	_, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(sshConn.LastActivity()) > time.Minute {
+		t.Errorf("Last activity %s was not updated", sshConn.LastActivity())
+	}
+
+	if sshConn.BytesIn() != 5 {
+		t.Errorf("Counted %d bytes when should have been 5", sshConn.BytesIn())
+	}
+}
+
+// TestPausingReader validates that reads are held while a connection is
+// paused and return the data unchanged once it is resumed.
+func TestPausingReader(t *testing.T) {
+	sshConn := &SSHConnection{Close: make(chan bool)}
+	sshConn.Pause()
+
+	if !sshConn.Paused() {
+		t.Fatal("Connection should have been paused")
+	}
+
+	reader := &pausingReader{
+		Reader:  bytes.NewReader([]byte("hello")),
+		SSHConn: sshConn,
+		Done:    make(chan struct{}),
+	}
+
+	read := make(chan []byte)
+	go func() {
+		data, err := io.ReadAll(reader)
+		if err != nil {
+			t.Error(err)
+		}
+		read <- data
+	}()
+
+	select {
+	case <-read:
+		t.Fatal("Read returned while the connection was paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	sshConn.Resume()
+
+	select {
+	case data := <-read:
+		if string(data) != "hello" {
+			t.Errorf("Read %q when should have been \"hello\"", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read did not return after the connection was resumed")
+	}
+}
+
+// readCounter counts the Read calls made on a reader. It hides any other
+// methods of the reader so io.CopyBuffer uses the provided buffer.
+type readCounter struct {
+	reader io.Reader
+	reads  int
+}
+
+func (r *readCounter) Read(p []byte) (int, error) {
+	r.reads++
+	return r.reader.Read(p)
+}
+
+// writerOnly hides any other methods of a writer so io.CopyBuffer uses the
+// provided buffer.
+type writerOnly struct {
+	io.Writer
+}
+
+// BenchmarkCopyBuffer compares the number of reads needed to copy a large
+// transfer with different copy-buffer-size values.
+func BenchmarkCopyBuffer(b *testing.B) {
+	data := make([]byte, 16*1024*1024)
+
+	for _, size := range []int{32 * 1024, 256 * 1024, 1024 * 1024} {
+		b.Run(fmt.Sprintf("%dKB", size/1024), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+
+			reads := 0
+			for i := 0; i < b.N; i++ {
+				reader := &readCounter{reader: bytes.NewReader(data)}
+
+				_, err := copyBuffer(writerOnly{io.Discard}, reader, size)
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				reads += reader.reads
+			}
+
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+// TestPeekTLSHelloTimeout validates that a client that sends its TLS hello
+// too slowly times out, and that the read deadline is cleared afterwards.
+func TestPeekTLSHelloTimeout(t *testing.T) {
+	viper.Set("tls-peek-timeout", 50*time.Millisecond)
+	defer viper.Set("tls-peek-timeout", nil)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for _, b := range []byte{0x16, 0x03, 0x01} {
+			_, err := client.Write([]byte{b})
+			if err != nil {
+				return
+			}
+
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	tlsHello, teeConn, err := PeekTLSHello(server)
+	if tlsHello != nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Expected a timeout, got hello %v and error %v", tlsHello, err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Peek took %s when it should have timed out", elapsed)
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+
+		_, err := client.Write([]byte("late"))
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	data := make([]byte, 7)
+	_, err = io.ReadFull(teeConn, data)
+	if err != nil {
+		t.Fatalf("Read deadline was not cleared: %s", err)
+	}
+
+	if string(data) != "\x16\x03\x01late" {
+		t.Errorf("Read %q when should have been the replayed bytes and \"late\"", data)
+	}
+}
+
+// TestStreams validates that forwarded connections are tracked while they are
+// copied, ordered by most recent activity and capped by info-max-streams.
+func TestStreams(t *testing.T) {
+	sshConn := &SSHConnection{Close: make(chan bool)}
+
+	type pipes struct {
+		client  net.Conn
+		backend net.Conn
+		done    chan struct{}
+	}
+
+	open := func() pipes {
+		client, writer := net.Pipe()
+		reader, backend := net.Pipe()
+		done := make(chan struct{})
+
+		go func() {
+			CopyBothResult(writer, reader, sshConn)
+			close(done)
+		}()
+
+		return pipes{client: client, backend: backend, done: done}
+	}
+
+	send := func(p pipes, data string) {
+		go func() {
+			_, err := p.client.Write([]byte(data))
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+
+		buf := make([]byte, len(data))
+		_, err := io.ReadFull(p.backend, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := open()
+	send(first, "first")
+
+	time.Sleep(10 * time.Millisecond)
+
+	second := open()
+	send(second, "second!")
+
+	streams := sshConn.Streams()
+	if len(streams) != 2 {
+		t.Fatalf("Tracked %d streams when should have been 2", len(streams))
+	}
+
+	if streams[0].BytesOut != 7 || streams[1].BytesOut != 5 {
+		t.Errorf("Streams ordered with %d and %d bytes out when should have been 7 and 5", streams[0].BytesOut, streams[1].BytesOut)
+	}
+
+	viper.Set("info-max-streams", 1)
+	defer viper.Set("info-max-streams", nil)
+
+	if streams := sshConn.Streams(); len(streams) != 1 || streams[0].BytesOut != 7 {
+		t.Errorf("Capped streams %v when should have been the most recent stream", streams)
+	}
+
+	for _, p := range []pipes{first, second} {
+		_ = p.client.Close()
+		_ = p.backend.Close()
+		<-p.done
+	}
+
+	if streams := sshConn.Streams(); len(streams) != 0 {
+		t.Errorf("Tracked %d streams after they were closed", len(streams))
+	}
+}
+
+// TestReplayConn validates that a ReplayConn reads the buffered bytes before
+// the bytes still on the connection, and writes to the connection.
+func TestReplayConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		_, err := client.Write([]byte("buffered"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, err = client.Write([]byte("live"))
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	teeConn := NewTeeConn(server)
+
+	_, err := teeConn.Buffer.Peek(len("buffered"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replayConn := teeConn.ReplayConn()
+
+	small := make([]byte, 3)
+	n, err := replayConn.Read(small)
+	if err != nil || string(small[:n]) != "buf" {
+		t.Fatalf("Read %q with error %v when should have been \"buf\"", small[:n], err)
+	}
+
+	data := make([]byte, len("feredlive"))
+	_, err = io.ReadFull(replayConn, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "feredlive" {
+		t.Errorf("Read %q when should have been \"feredlive\"", data)
+	}
+
+	go func() {
+		_, err := replayConn.Write([]byte("reply"))
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	reply := make([]byte, len("reply"))
+	_, err = io.ReadFull(client, reply)
+	if err != nil || string(reply) != "reply" {
+		t.Errorf("Client read %q with error %v when should have been \"reply\"", reply, err)
+	}
+
+	if replayConn.RemoteAddr() != server.RemoteAddr() {
+		t.Error("ReplayConn should use the addresses of the connection")
+	}
+
+	err = replayConn.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// TestIdleTimeout validates that connections can only change their idle
+// timeout up to idle-connection-max-timeout, and that the timeout overrides
+// the global one.
+func TestIdleTimeout(t *testing.T) {
+	viper.Set("idle-connection-timeout", 20*time.Millisecond)
+	defer viper.Set("idle-connection-timeout", nil)
+
+	sshConn := &SSHConnection{}
+
+	if sshConn.SetIdleTimeout(time.Hour) != 0 || sshConn.IdleTimeout != 0 {
+		t.Error("Idle timeout was set when idle-connection-max-timeout is 0")
+	}
+
+	viper.Set("idle-connection-max-timeout", time.Second)
+	defer viper.Set("idle-connection-max-timeout", nil)
+
+	if timeout := sshConn.SetIdleTimeout(time.Hour); timeout != time.Second {
+		t.Errorf("Idle timeout set to %s when should have been capped at 1s", timeout)
+	}
+
+	if timeout := sshConn.SetIdleTimeout(0); timeout != 0 || sshConn.IdleTimeout != time.Second {
+		t.Errorf("Idle timeout set to %s when 0 should have been rejected", timeout)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+
+		_, err := client.Write([]byte("slow"))
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	idleConn := IdleTimeoutConn{Conn: server, Timeout: sshConn.IdleTimeout}
+
+	buf := make([]byte, 4)
+	_, err := io.ReadFull(idleConn, buf)
+	if err != nil {
+		t.Fatalf("Read with a longer idle timeout failed: %s", err)
+	}
+
+	_, err = IdleTimeoutConn{Conn: server}.Read(buf)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read with the global idle timeout returned %v when should have timed out", err)
+	}
+}
+
+// TestMessageRetryDelay validates that retry delays double up to the maximum
+// and are jittered between half and all of the backoff.
+func TestMessageRetryDelay(t *testing.T) {
+	interval := 100 * time.Millisecond
+	maxInterval := time.Second
+
+	for attempt, backoff := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		backoff *= time.Millisecond
+
+		for i := 0; i < 100; i++ {
+			delay := messageRetryDelay(attempt, interval, maxInterval)
+			if delay < backoff/2 || delay > backoff {
+				t.Fatalf("Attempt %d waited %s when should have been between %s and %s", attempt, delay, backoff/2, backoff)
+			}
+		}
+	}
+
+	if delay := messageRetryDelay(3, interval, 0); delay < interval/2 || delay > interval {
+		t.Errorf("Delay %s should not have backed off past a maximum below the interval", delay)
+	}
+
+	if delay := messageRetryDelay(3, 0, 0); delay != 0 {
+		t.Errorf("Delay %s should have been 0 without an interval", delay)
+	}
+}
+
+// TestSendMessageRetryCount validates that a non-blocking message is sent once
+// even without retries.
+func TestSendMessageRetryCount(t *testing.T) {
+	viper.Set("message-retry-count", 0)
+	defer viper.Set("message-retry-count", nil)
+
+	sshConn := &SSHConnection{
+		Messages: make(chan string, 1),
+		Close:    make(chan bool),
+	}
+
+	if !sshConn.SendMessage("first", false) {
+		t.Error("Message should have been sent without retries")
+	}
+
+	if sshConn.SendMessage("second", false) {
+		t.Error("Message should have been dropped while the console is full")
+	}
+
+	if message := <-sshConn.Messages; message != "first" {
+		t.Errorf("Message %q when should have been first", message)
+	}
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// ConnectionRateLimiter limits how many SSH connections each source IP can
+// open in a window, before the connection is authenticated. Each IP has a
+// token bucket holding Limit tokens that refills over Window, so bursts of up
+// to Limit connections are allowed.
+type ConnectionRateLimiter struct {
+	Limit   int
+	Window  time.Duration
+	Allowed []*net.IPNet
+
+	lock    sync.Mutex
+	buckets map[string]*connectionBucket
+}
+
+// connectionBucket is the token bucket of a source IP.
+type connectionBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewConnectionRateLimiter returns a new ConnectionRateLimiter allowing limit
+// connections per window from each IP. IPs in allowed are never limited.
+func NewConnectionRateLimiter(limit int, window time.Duration, allowed []*net.IPNet) *ConnectionRateLimiter {
+	return &ConnectionRateLimiter{
+		Limit:   limit,
+		Window:  window,
+		Allowed: allowed,
+		buckets: map[string]*connectionBucket{},
+	}
+}
+
+// Allow takes a token from the bucket of ip and returns whether a connection
+// from it should be accepted. A nil limiter allows every connection.
+func (c *ConnectionRateLimiter) Allow(ip string) bool {
+	if c == nil {
+		return true
+	}
+
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return false
+	}
+
+	for _, ipNet := range c.Allowed {
+		if ipNet.Contains(parsedIP) {
+			return true
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	key := parsedIP.String()
+
+	bucket, ok := c.buckets[key]
+	if !ok {
+		bucket = &connectionBucket{tokens: float64(c.Limit), last: now}
+		c.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() / c.Window.Seconds() * float64(c.Limit)
+	if bucket.tokens > float64(c.Limit) {
+		bucket.tokens = float64(c.Limit)
+	}
+
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	bucket.tokens--
+
+	return true
+}
+
+// EvictStale removes the buckets of IPs that haven't connected for a window.
+// Their buckets are full again, so they behave the same as new buckets. It
+// returns the number of buckets removed.
+func (c *ConnectionRateLimiter) EvictStale() int {
+	if c == nil {
+		return 0
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	evicted := 0
+
+	for ip, bucket := range c.buckets {
+		if time.Since(bucket.last) >= c.Window {
+			delete(c.buckets, ip)
+			evicted++
+		}
+	}
+
+	return evicted
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// TestConnectionRateLimiter validates that each IP can open its limit of
+// connections per window, that allowlisted IPs are never limited and that
+// stale buckets are evicted.
+func TestConnectionRateLimiter(t *testing.T) {
+	allowed, err := ParseIPNets("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limiter := NewConnectionRateLimiter(3, 100*time.Millisecond, allowed)
+
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("203.0.113.10") {
+			t.Fatalf("Connection %d should have been allowed", i+1)
+		}
+	}
+
+	if limiter.Allow("203.0.113.10") {
+		t.Error("Connection over the limit should have been rejected")
+	}
+
+	if !limiter.Allow("::ffff:203.0.113.11") {
+		t.Error("Connection from another IP should have been allowed")
+	}
+
+	for i := 0; i < 10; i++ {
+		if !limiter.Allow("10.1.2.3") {
+			t.Fatal("Connection from an allowlisted IP should have been allowed")
+		}
+	}
+
+	if limiter.Allow("not an ip") {
+		t.Error("Connection without an IP should have been rejected")
+	}
+
+	if limiter.EvictStale() != 0 {
+		t.Error("Buckets should not have been evicted before their window")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+
+	if !limiter.Allow("203.0.113.10") {
+		t.Error("Connection should have been allowed once a token refilled")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if evicted := limiter.EvictStale(); evicted != 2 || len(limiter.buckets) != 0 {
+		t.Errorf("Evicted %d buckets leaving %d when should have evicted 2", evicted, len(limiter.buckets))
+	}
+
+	var disabled *ConnectionRateLimiter
+	if !disabled.Allow("203.0.113.10") || disabled.EvictStale() != 0 {
+		t.Error("Nil limiter should allow every connection")
+	}
+}
@@ -2,11 +2,14 @@ package utils
 
 import (
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/antoniomika/syncmap"
 	"github.com/gin-gonic/gin"
@@ -53,6 +56,11 @@ func (c *WebConsole) HandleRequest(proxyUrl string, hostIsRoot bool, g *gin.Cont
 	userAuthed := false
 	userIsAdmin := false
 	if (viper.GetBool("admin-console") && viper.GetString("admin-console-token") != "") && (g.Request.URL.Query().Get("x-authorization") == viper.GetString("admin-console-token") || g.Request.Header.Get("x-authorization") == viper.GetString("admin-console-token")) {
+		if !c.State.AdminClientCerts.Verified(g.Request.TLS) {
+			g.AbortWithStatus(http.StatusForbidden)
+			return
+		}
+
 		userIsAdmin = true
 		userAuthed = true
 	}
@@ -78,12 +86,48 @@ func (c *WebConsole) HandleRequest(proxyUrl string, hostIsRoot bool, g *gin.Cont
 	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/disconnectclient/") && userIsAdmin {
 		c.HandleDisconnectClient(proxyUrl, g)
 		return
+	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/pauseclient/") && userIsAdmin {
+		c.HandlePauseClient(proxyUrl, true, g)
+		return
+	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/resumeclient/") && userIsAdmin {
+		c.HandlePauseClient(proxyUrl, false, g)
+		return
+	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/captureclient/") && userIsAdmin {
+		c.HandleCaptureClient(proxyUrl, true, g)
+		return
+	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/stopcaptureclient/") && userIsAdmin {
+		c.HandleCaptureClient(proxyUrl, false, g)
+		return
+	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/remaphost/") && userIsAdmin {
+		c.HandleRemapHost(proxyUrl, g)
+		return
 	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/disconnectroute/") && userIsAdmin {
 		c.HandleDisconnectRoute(proxyUrl, g)
 		return
 	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/clients") && hostIsRoot && userIsAdmin {
 		c.HandleClients(proxyUrl, g)
 		return
+	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/connections") && hostIsRoot && userIsAdmin {
+		c.HandleConnections(proxyUrl, g)
+		return
+	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/routes") && hostIsRoot && userIsAdmin {
+		c.HandleRoutes(proxyUrl, g)
+		return
+	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/broadcast") && hostIsRoot && userIsAdmin {
+		c.HandleBroadcast(proxyUrl, g)
+		return
+	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/reloadkeys") && hostIsRoot && userIsAdmin {
+		c.HandleReloadKeys(proxyUrl, g)
+		return
+	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/reloadtrustedcidrs") && hostIsRoot && userIsAdmin {
+		c.HandleReloadTrustedCIDRs(proxyUrl, g)
+		return
+	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/drainstatus") && hostIsRoot && userIsAdmin {
+		c.HandleDrainStatus(proxyUrl, g)
+		return
+	} else if strings.HasPrefix(g.Request.URL.Path, "/_sish/api/drain") && hostIsRoot && userIsAdmin {
+		c.HandleDrain(proxyUrl, g)
+		return
 	}
 }
 
@@ -129,23 +173,175 @@ func (c *WebConsole) HandleWebSocket(proxyUrl string, g *gin.Context) {
 func (c *WebConsole) HandleDisconnectClient(proxyUrl string, g *gin.Context) {
 	client := strings.TrimPrefix(g.Request.URL.Path, "/_sish/api/disconnectclient/")
 
-	c.State.SSHConnections.Range(func(clientName string, holderConn *SSHConnection) bool {
-		if clientName == client {
-			holderConn.CleanUp(c.State)
+	snapshot, ok := c.State.CloseConnection(client, g.Request.URL.Query().Get("message"))
+	if !ok {
+		g.JSON(http.StatusNotFound, map[string]any{
+			"status": false,
+			"error":  "connection not found",
+		})
+		return
+	}
 
-			return false
-		}
+	LogEvent("connection_disconnected", LogFields{"remote_addr": LogHostPort(client)}, "Disconnected SSH connection from the admin console:", LogHostPort(client))
 
-		return true
-	})
+	data := map[string]any{
+		"status":     true,
+		"connection": snapshot,
+	}
+
+	g.JSON(http.StatusOK, data)
+}
+
+// HandlePauseClient handles pausing or resuming the forwards of a SSH client.
+func (c *WebConsole) HandlePauseClient(proxyUrl string, pause bool, g *gin.Context) {
+	client := strings.TrimPrefix(strings.TrimPrefix(g.Request.URL.Path, "/_sish/api/pauseclient/"), "/_sish/api/resumeclient/")
+
+	holderConn, ok := c.State.SSHConnections.Load(client)
+	if !ok {
+		g.JSON(http.StatusNotFound, map[string]any{
+			"status": false,
+			"error":  "connection not found",
+		})
+		return
+	}
+
+	if pause {
+		holderConn.Pause()
+		LogEvent("connection_paused", holderConn.logFields(), "Paused SSH connection for:", LogHostPort(client))
+	} else {
+		holderConn.Resume()
+		LogEvent("connection_resumed", holderConn.logFields(), "Resumed SSH connection for:", LogHostPort(client))
+	}
 
 	data := map[string]any{
 		"status": true,
+		"paused": holderConn.Paused(),
 	}
 
 	g.JSON(http.StatusOK, data)
 }
 
+// HandleCaptureClient handles starting or stopping a capture of the forwarded
+// data of a SSH client. Captures must be enabled with capture and are bounded
+// by the duration and size query parameters, up to capture-max-duration and
+// capture-max-size.
+func (c *WebConsole) HandleCaptureClient(proxyUrl string, start bool, g *gin.Context) {
+	client := strings.TrimPrefix(strings.TrimPrefix(g.Request.URL.Path, "/_sish/api/captureclient/"), "/_sish/api/stopcaptureclient/")
+
+	holderConn, ok := c.State.SSHConnections.Load(client)
+	if !ok {
+		g.JSON(http.StatusNotFound, map[string]any{
+			"status": false,
+			"error":  "connection not found",
+		})
+		return
+	}
+
+	if !start {
+		capture := holderConn.StopCapture()
+		if capture == nil {
+			g.JSON(http.StatusNotFound, map[string]any{
+				"status": false,
+				"error":  "connection is not being captured",
+			})
+			return
+		}
+
+		g.JSON(http.StatusOK, map[string]any{
+			"status":  true,
+			"capture": capture.Info(),
+		})
+		return
+	}
+
+	if !viper.GetBool("capture") {
+		g.JSON(http.StatusForbidden, map[string]any{
+			"status": false,
+			"error":  "captures are disabled",
+		})
+		return
+	}
+
+	var duration time.Duration
+	var maxSize int64
+	var err error
+
+	if value := g.Request.URL.Query().Get("duration"); value != "" {
+		duration, err = time.ParseDuration(value)
+	}
+
+	if value := g.Request.URL.Query().Get("size"); value != "" && err == nil {
+		maxSize, err = strconv.ParseInt(value, 10, 64)
+	}
+
+	if err != nil {
+		g.JSON(http.StatusBadRequest, map[string]any{
+			"status": false,
+			"error":  fmt.Sprintf("invalid duration or size: %s", err),
+		})
+		return
+	}
+
+	capture, err := holderConn.StartCapture(duration, maxSize)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, ErrCaptureRunning) {
+			status = http.StatusConflict
+		}
+
+		g.JSON(status, map[string]any{
+			"status": false,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	holderConn.SendMessage(fmt.Sprintf("The server administrator is capturing the forwarded traffic of this connection until %s UTC.", capture.Expires.UTC().Format("2006-01-02 15:04:05")), false)
+
+	g.JSON(http.StatusOK, map[string]any{
+		"status":  true,
+		"capture": capture.Info(),
+	})
+}
+
+// HandleRemapHost handles moving the HTTP forwards of a SSH client from the
+// host query parameter to the to query parameter.
+func (c *WebConsole) HandleRemapHost(proxyUrl string, g *gin.Context) {
+	client := strings.TrimPrefix(g.Request.URL.Path, "/_sish/api/remaphost/")
+
+	holderConn, ok := c.State.SSHConnections.Load(client)
+	if !ok {
+		g.JSON(http.StatusNotFound, map[string]any{
+			"status": false,
+			"error":  "connection not found",
+		})
+		return
+	}
+
+	addresses, err := c.State.RemapHTTPHost(holderConn, g.Request.URL.Query().Get("host"), g.Request.URL.Query().Get("to"))
+	if err != nil {
+		status := http.StatusBadRequest
+
+		switch {
+		case errors.Is(err, errRemapNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, errRemapTaken), errors.Is(err, errRemapShared):
+			status = http.StatusConflict
+		}
+
+		g.JSON(status, map[string]any{
+			"status": false,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	g.JSON(http.StatusOK, map[string]any{
+		"status":    true,
+		"addresses": addresses,
+	})
+}
+
 // HandleDisconnectRoute handles the disconnection request for a forwarded route.
 func (c *WebConsole) HandleDisconnectRoute(proxyUrl string, g *gin.Context) {
 	route := strings.Split(strings.TrimPrefix(g.Request.URL.Path, "/_sish/api/disconnectroute/"), "/")
@@ -183,6 +379,89 @@ func (c *WebConsole) HandleDisconnectRoute(proxyUrl string, g *gin.Context) {
 	g.JSON(http.StatusOK, data)
 }
 
+// HandleBroadcast handles sending a message to the console of every SSH
+// client.
+func (c *WebConsole) HandleBroadcast(proxyUrl string, g *gin.Context) {
+	message := g.Request.URL.Query().Get("message")
+	if message == "" {
+		g.JSON(http.StatusBadRequest, map[string]any{
+			"status": false,
+			"error":  "message is required",
+		})
+		return
+	}
+
+	received := c.State.Broadcast(message)
+	log.Printf("Broadcast message to %d SSH connections", received)
+
+	data := map[string]any{
+		"status":   true,
+		"received": received,
+	}
+
+	g.JSON(http.StatusOK, data)
+}
+
+// HandleReloadKeys handles loading the public keys used for authentication
+// again, returning the number of keys that were added and removed.
+func (c *WebConsole) HandleReloadKeys(proxyUrl string, g *gin.Context) {
+	added, removed, err := ReloadKeys()
+	if err != nil {
+		g.JSON(http.StatusInternalServerError, map[string]any{
+			"status": false,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	data := map[string]any{
+		"status":  true,
+		"added":   added,
+		"removed": removed,
+	}
+
+	g.JSON(http.StatusOK, data)
+}
+
+// HandleReloadTrustedCIDRs handles reloading the upstreams PROXY protocol
+// headers are used from.
+func (c *WebConsole) HandleReloadTrustedCIDRs(proxyUrl string, g *gin.Context) {
+	trusted, err := ReloadProxyProtoTrustedCIDRs()
+	if err != nil {
+		g.JSON(http.StatusInternalServerError, map[string]any{
+			"status": false,
+			"error":  err.Error(),
+		})
+		return
+	}
+
+	data := map[string]any{
+		"status":  true,
+		"trusted": trusted,
+	}
+
+	g.JSON(http.StatusOK, data)
+}
+
+// HandleDrain handles putting the server into drain mode.
+func (c *WebConsole) HandleDrain(proxyUrl string, g *gin.Context) {
+	c.State.BeginDrain()
+
+	c.HandleDrainStatus(proxyUrl, g)
+}
+
+// HandleDrainStatus handles returning the drain state and the number of
+// connections that are still active.
+func (c *WebConsole) HandleDrainStatus(proxyUrl string, g *gin.Context) {
+	data := map[string]any{
+		"status":      true,
+		"draining":    c.State.Draining(),
+		"connections": c.State.DrainStatus(),
+	}
+
+	g.JSON(http.StatusOK, data)
+}
+
 // HandleClients handles returning all connected SSH clients. This will
 // also go through all of the forwarded connections for the SSH client and
 // return them.
@@ -302,6 +581,8 @@ func (c *WebConsole) HandleClients(proxyUrl string, g *gin.Context) {
 			"pubKeyFingerprint": pubKeyFingerprint,
 			"listeners":         listeners,
 			"routeListeners":    routeListeners,
+			"labels":            sshConn.GetLabels(),
+			"paused":            sshConn.Paused(),
 		}
 
 		return true
@@ -312,6 +593,84 @@ func (c *WebConsole) HandleClients(proxyUrl string, g *gin.Context) {
 	g.JSON(http.StatusOK, data)
 }
 
+// HandleConnections handles returning a snapshot of the connected SSH clients.
+// The snapshot can be filtered by user with the user query parameter, and by
+// labels with label=key:value query parameters.
+func (c *WebConsole) HandleConnections(proxyUrl string, g *gin.Context) {
+	filters := []SnapshotFilter{}
+
+	if user := g.Query("user"); user != "" {
+		filters = append(filters, UserFilter(user))
+	}
+
+	for _, label := range g.QueryArray("label") {
+		key, value, _ := strings.Cut(label, ":")
+		filters = append(filters, LabelFilter(key, value))
+	}
+
+	data := map[string]any{
+		"status":      true,
+		"connections": c.State.Snapshot(filters...),
+	}
+
+	g.JSON(http.StatusOK, data)
+}
+
+const (
+	// defaultRoutesLimit is the number of routes HandleRoutes returns if no
+	// limit is requested.
+	defaultRoutesLimit = 100
+
+	// maxRoutesLimit is the largest page of routes HandleRoutes returns.
+	// Larger limits are lowered to it.
+	maxRoutesLimit = 1000
+)
+
+// HandleRoutes handles returning the HTTP route table. The routes can be
+// paginated with the offset and limit query parameters, and next is the
+// offset of the next page or -1 if there are no more routes. limit must be at
+// least 1 and is capped at maxRoutesLimit.
+func (c *WebConsole) HandleRoutes(proxyUrl string, g *gin.Context) {
+	offset, limit := 0, defaultRoutesLimit
+
+	for param, value := range map[string]*int{"offset": &offset, "limit": &limit} {
+		query := g.Query(param)
+		if query == "" {
+			continue
+		}
+
+		parsed, err := strconv.Atoi(query)
+		if err != nil || parsed < 0 || (param == "limit" && parsed < 1) {
+			g.JSON(http.StatusBadRequest, map[string]any{
+				"status": false,
+				"error":  fmt.Sprintf("invalid %s: %s", param, query),
+			})
+			return
+		}
+
+		*value = parsed
+	}
+
+	limit = min(limit, maxRoutesLimit)
+
+	routes := c.State.HTTPRoutes()
+	page := PageRoutes(routes, offset, limit)
+
+	next := -1
+	if end := offset + len(page); len(page) > 0 && end < len(routes) {
+		next = end
+	}
+
+	data := map[string]any{
+		"status": true,
+		"routes": page,
+		"total":  len(routes),
+		"next":   next,
+	}
+
+	g.JSON(http.StatusOK, data)
+}
+
 // RouteToken returns the route token for a specific route.
 func (c *WebConsole) RouteToken(route string) (string, bool) {
 	token, ok := c.RouteTokens.Load(route)
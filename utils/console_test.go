@@ -0,0 +1,127 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/antoniomika/syncmap"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/ssh"
+)
+
+// consoleTestRequest calls handler with a request to target and returns the
+// status code and decoded JSON body of its response.
+func consoleTestRequest(t *testing.T, target string, handler func(g *gin.Context)) (int, map[string]any) {
+	recorder := httptest.NewRecorder()
+
+	g, _ := gin.CreateTestContext(recorder)
+	g.Request = httptest.NewRequest(http.MethodGet, target, nil)
+
+	handler(g)
+
+	var body map[string]any
+
+	err := json.Unmarshal(recorder.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return recorder.Code, body
+}
+
+// TestHandleRoutes validates that the route table is paginated, that limits
+// under 1 are rejected and that large limits are capped.
+func TestHandleRoutes(t *testing.T) {
+	console := NewWebConsole()
+	console.State = NewState()
+
+	for i := 0; i < maxRoutesLimit+10; i++ {
+		holder := &HTTPHolder{
+			HTTPUrl:        &url.URL{Host: fmt.Sprintf("%04d.example.com", i), Path: "/"},
+			SSHConnections: syncmap.New[string, *SSHConnection](),
+		}
+
+		console.State.HTTPListeners.Store(holder.HTTPUrl.String(), holder)
+	}
+
+	tests := map[string]struct {
+		status int
+		routes int
+		next   float64
+	}{
+		"/_sish/api/routes":                   {http.StatusOK, defaultRoutesLimit, defaultRoutesLimit},
+		"/_sish/api/routes?limit=5&offset=10": {http.StatusOK, 5, 15},
+		"/_sish/api/routes?limit=100000":      {http.StatusOK, maxRoutesLimit, maxRoutesLimit},
+		"/_sish/api/routes?offset=1000":       {http.StatusOK, 10, -1},
+		"/_sish/api/routes?limit=0":           {http.StatusBadRequest, 0, 0},
+		"/_sish/api/routes?limit=-1":          {http.StatusBadRequest, 0, 0},
+		"/_sish/api/routes?offset=a":          {http.StatusBadRequest, 0, 0},
+	}
+
+	for target, test := range tests {
+		status, body := consoleTestRequest(t, target, func(g *gin.Context) {
+			console.HandleRoutes("", g)
+		})
+
+		if status != test.status {
+			t.Errorf("%s returned %d when should have been %d", target, status, test.status)
+			continue
+		}
+
+		if status != http.StatusOK {
+			continue
+		}
+
+		routes, _ := body["routes"].([]any)
+		if len(routes) != test.routes || body["next"] != test.next {
+			t.Errorf("%s returned %d routes and next %v when should have been %d and %v", target, len(routes), body["next"], test.routes, test.next)
+		}
+	}
+}
+
+// TestHandlePauseClient validates that a client can be paused and resumed,
+// and that unknown clients return 404.
+func TestHandlePauseClient(t *testing.T) {
+	console := NewWebConsole()
+	console.State = NewState()
+
+	sshConn := &SSHConnection{
+		SSHConn: &ssh.ServerConn{Conn: &closeTestConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}},
+		Close:   make(chan bool),
+	}
+	console.State.SSHConnections.Store("127.0.0.1:1234", sshConn)
+
+	tests := []struct {
+		target string
+		pause  bool
+		status int
+		paused bool
+	}{
+		{"/_sish/api/pauseclient/127.0.0.1:1234", true, http.StatusOK, true},
+		{"/_sish/api/resumeclient/127.0.0.1:1234", false, http.StatusOK, false},
+		{"/_sish/api/pauseclient/127.0.0.1:9999", true, http.StatusNotFound, false},
+	}
+
+	for _, test := range tests {
+		status, body := consoleTestRequest(t, test.target, func(g *gin.Context) {
+			console.HandlePauseClient("", test.pause, g)
+		})
+
+		if status != test.status {
+			t.Errorf("%s returned %d when should have been %d", test.target, status, test.status)
+		}
+
+		if status == http.StatusNotFound && (body["status"] != false || body["error"] != "connection not found") {
+			t.Errorf("%s returned %v when should have been connection not found", test.target, body)
+		}
+
+		if status == http.StatusOK && (body["status"] != true || body["paused"] != test.paused || sshConn.Paused() != test.paused) {
+			t.Errorf("%s returned %v when paused should have been %t", test.target, body, test.paused)
+		}
+	}
+}
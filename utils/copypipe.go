@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// PipeCopy runs CopyBothWith between the ends of two in-memory pipes, so
+// forwarding can be driven and checked without sockets or SSH channels.
+type PipeCopy struct {
+	// Remote is the far end of the writer, like the client of a forward.
+	Remote net.Conn
+
+	// Client is the far end of the reader, like the SSH client's channel.
+	Client net.Conn
+
+	result chan CopyResult
+}
+
+// StartPipeCopy starts copying between two pipes with options. If sshConn is
+// not nil, the copied bytes are recorded on it like a forwarded connection.
+func StartPipeCopy(sshConn *SSHConnection, options CopyOptions) *PipeCopy {
+	remote, writer := net.Pipe()
+	reader, client := net.Pipe()
+
+	p := &PipeCopy{
+		Remote: remote,
+		Client: client,
+		result: make(chan CopyResult, 1),
+	}
+
+	go func() {
+		p.result <- CopyBothWith(writer, reader, sshConn, options)
+	}()
+
+	return p
+}
+
+// Exchange sends toClient from the remote end and fromClient from the client
+// end at the same time, and returns an error if either end doesn't receive
+// exactly what the other sent.
+func (p *PipeCopy) Exchange(toClient []byte, fromClient []byte) error {
+	errs := make(chan error, 4)
+
+	send := func(conn net.Conn, data []byte) {
+		_, err := conn.Write(data)
+		errs <- err
+	}
+
+	receive := func(conn net.Conn, want []byte, direction string) {
+		got := make([]byte, len(want))
+
+		_, err := io.ReadFull(conn, got)
+		if err == nil && !bytes.Equal(got, want) {
+			err = fmt.Errorf("%s received %q when should have been %q", direction, got, want)
+		}
+
+		errs <- err
+	}
+
+	go send(p.Remote, toClient)
+	go send(p.Client, fromClient)
+	go receive(p.Client, toClient, "client")
+	go receive(p.Remote, fromClient, "remote")
+
+	var err error
+	for i := 0; i < cap(errs); i++ {
+		err = errors.Join(err, <-errs)
+	}
+
+	return err
+}
+
+// Close closes the remote end and waits up to timeout for the copy to end.
+// It returns an error if the copy doesn't end in time or the client end isn't
+// closed with it.
+func (p *PipeCopy) Close(timeout time.Duration) (CopyResult, error) {
+	_ = p.Remote.Close()
+
+	return p.Wait(timeout)
+}
+
+// Wait waits up to timeout for the copy to end on its own, like after an idle
+// timeout. It returns an error if the copy doesn't end in time or the client
+// end isn't closed with it.
+func (p *PipeCopy) Wait(timeout time.Duration) (CopyResult, error) {
+	var result CopyResult
+
+	select {
+	case result = <-p.result:
+	case <-time.After(timeout):
+		return result, fmt.Errorf("copy did not end after %s", timeout)
+	}
+
+	_ = p.Client.SetReadDeadline(time.Now().Add(timeout))
+
+	_, err := p.Client.Read(make([]byte, 1))
+	if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrClosedPipe) {
+		return result, fmt.Errorf("client end was not closed with the copy: %v", err)
+	}
+
+	_ = p.Client.Close()
+	_ = p.Remote.Close()
+
+	return result, nil
+}
@@ -0,0 +1,207 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestPipeCopy validates that a copy over pipes reports and records the bytes
+// copied each way, and closes both ends when the remote end is closed.
+func TestPipeCopy(t *testing.T) {
+	sshConn := &SSHConnection{Close: make(chan bool)}
+
+	p := StartPipeCopy(sshConn, CopyOptions{})
+
+	err := p.Exchange([]byte("hello"), []byte("world!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := p.Close(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.ToReader != 5 || result.ToWriter != 6 || result.Err != nil {
+		t.Errorf("Copy result %+v when should have been 5 bytes to reader and 6 to writer", result)
+	}
+
+	if sshConn.BytesOut() != 5 || sshConn.BytesIn() != 6 {
+		t.Errorf("Recorded %d bytes out and %d in when should have been 5 and 6", sshConn.BytesOut(), sshConn.BytesIn())
+	}
+}
+
+// TestPipeCopyIdleTimeout validates that an injected idle timeout ends the
+// copy without any configuration being set.
+func TestPipeCopyIdleTimeout(t *testing.T) {
+	p := StartPipeCopy(nil, CopyOptions{
+		Idle: func(writer net.Conn) io.ReadWriter {
+			return IdleTimeoutConn{Conn: writer, Timeout: 50 * time.Millisecond}
+		},
+	})
+
+	err := p.Exchange([]byte("ping"), []byte("pong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := p.Wait(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !errors.Is(result.Err, os.ErrDeadlineExceeded) {
+		t.Errorf("Copy ended with %v when should have timed out", result.Err)
+	}
+}
+
+// errorAfterReader returns Err from Read once Delay has passed.
+type errorAfterReader struct {
+	Err   error
+	Delay time.Duration
+}
+
+func (e errorAfterReader) Read(p []byte) (int, error) {
+	time.Sleep(e.Delay)
+	return 0, e.Err
+}
+
+// TestPipeCopyError validates that an error ending one direction is reported
+// even if the other direction ended cleanly first.
+func TestPipeCopyError(t *testing.T) {
+	errCopy := errors.New("copy failed")
+	readers := 0
+
+	p := StartPipeCopy(nil, CopyOptions{
+		Limit: func(reader io.Reader, done <-chan struct{}) io.Reader {
+			readers++
+
+			if readers == 1 {
+				return errorAfterReader{Err: io.EOF}
+			}
+
+			return errorAfterReader{Err: errCopy, Delay: 50 * time.Millisecond}
+		},
+	})
+
+	result, err := p.Wait(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !errors.Is(result.Err, errCopy) {
+		t.Errorf("Copy ended with %v when should have been %v", result.Err, errCopy)
+	}
+}
+
+// TestPipeCopyLimit validates that an injected limiter wraps both directions
+// and throttles the copy.
+func TestPipeCopyLimit(t *testing.T) {
+	wrapped := 0
+
+	p := StartPipeCopy(nil, CopyOptions{
+		Limit: func(reader io.Reader, done <-chan struct{}) io.Reader {
+			wrapped++
+			return &RateLimitedReader{Reader: reader, Bucket: NewTokenBucket(1000, 100), Done: done}
+		},
+	})
+
+	start := time.Now()
+
+	err := p.Exchange(bytes.Repeat([]byte("a"), 300), []byte("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("Copied 300 bytes at 1000 bytes per second in %s", elapsed)
+	}
+
+	_, err = p.Close(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wrapped != 2 {
+		t.Errorf("Limiter wrapped %d readers when should have been 2", wrapped)
+	}
+}
+
+// TestPipeCopyHardDeadline validates that an absolute deadline ends the copy
+// even though a trickle of data keeps extending the idle timeout.
+func TestPipeCopyHardDeadline(t *testing.T) {
+	// The trickle stops well before the deadline so a slow exchange can't
+	// run into it.
+	deadline := time.Now().Add(time.Second)
+
+	p := StartPipeCopy(nil, CopyOptions{
+		Idle: func(writer net.Conn) io.ReadWriter {
+			return IdleTimeoutConn{Conn: writer, Timeout: 2 * time.Second, Deadline: deadline}
+		},
+		Deadline: deadline,
+	})
+
+	for time.Now().Before(deadline.Add(-500 * time.Millisecond)) {
+		err := p.Exchange([]byte("."), []byte("."))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	result, err := p.Wait(2 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !errors.Is(result.Err, os.ErrDeadlineExceeded) {
+		t.Errorf("Copy ended with %v when should have reached the deadline", result.Err)
+	}
+}
+
+// TestPipeCopyPauseIdleTimeout validates that a paused copy is not ended by
+// its idle timeout, and that the timeout applies again once it is resumed.
+func TestPipeCopyPauseIdleTimeout(t *testing.T) {
+	sshConn := &SSHConnection{Close: make(chan bool)}
+
+	p := StartPipeCopy(sshConn, CopyOptions{
+		Idle: func(writer net.Conn) io.ReadWriter {
+			return IdleTimeoutConn{Conn: writer, Timeout: 50 * time.Millisecond, SSHConn: sshConn}
+		},
+	})
+
+	err := p.Exchange([]byte("ping"), []byte("pong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshConn.Pause()
+
+	select {
+	case result := <-p.result:
+		t.Fatalf("Paused copy ended with %v", result.Err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	sshConn.Resume()
+
+	err = p.Exchange([]byte("ping"), []byte("pong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := p.Wait(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !errors.Is(result.Err, os.ErrDeadlineExceeded) {
+		t.Errorf("Copy ended with %v when should have timed out after resuming", result.Err)
+	}
+}
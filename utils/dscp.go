@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/spf13/viper"
+)
+
+// errDSCPUnsupported is returned when DSCP marking isn't supported on this platform.
+var errDSCPUnsupported = errors.New("DSCP marking is not supported on this platform")
+
+// dscpWarning logs that DSCP marking is unsupported only once.
+var dscpWarning sync.Once
+
+// DSCPValue returns the DSCP value to mark the connection's forwarded TCP
+// connections with. A value set by the connection takes precedence over dscp.
+// 0 means packets are not marked. It returns dscp if s is nil.
+func (s *SSHConnection) DSCPValue() int {
+	if s != nil && s.DSCP > 0 {
+		return s.DSCP
+	}
+
+	return viper.GetInt("dscp")
+}
+
+// ParseDSCP parses a DSCP value, which is a number between 0 and 63.
+func ParseDSCP(value string) (int, error) {
+	dscp, err := strconv.Atoi(value)
+	if err != nil || dscp < 0 || dscp > 63 {
+		return 0, fmt.Errorf("DSCP value %q must be a number between 0 and 63", value)
+	}
+
+	return dscp, nil
+}
+
+// SetDSCP sets the DSCP bits of the IP packets sent on conn, unwrapping it
+// until the underlying socket is found. It does nothing if dscp is 0.
+func SetDSCP(conn net.Conn, dscp int) error {
+	if dscp <= 0 {
+		return nil
+	}
+
+	for {
+		switch c := conn.(type) {
+		case syscall.Conn:
+			rawConn, err := c.SyscallConn()
+			if err != nil {
+				return err
+			}
+
+			ipv6 := false
+			if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+				ipv6 = addr.IP.To4() == nil
+			}
+
+			var sockErr error
+
+			err = rawConn.Control(func(fd uintptr) {
+				sockErr = setsockoptDSCP(fd, ipv6, dscp<<2)
+			})
+			if err != nil {
+				return err
+			}
+
+			return sockErr
+		case *TeeConn:
+			conn = c.Conn
+		case interface{ Raw() net.Conn }:
+			conn = c.Raw()
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return fmt.Errorf("unable to find the socket of %T", conn)
+		}
+	}
+}
+
+// MarkDSCP sets the DSCP bits of a forwarded TCP connection for sshConn and
+// logs if they can't be set.
+func MarkDSCP(conn net.Conn, sshConn *SSHConnection) {
+	err := SetDSCP(conn, sshConn.DSCPValue())
+	if errors.Is(err, errDSCPUnsupported) {
+		dscpWarning.Do(func() {
+			log.Println("Unable to mark forwarded connections with DSCP:", err)
+		})
+		return
+	}
+
+	if err != nil && viper.GetBool("debug") {
+		log.Println("Unable to mark forwarded connection with DSCP:", err)
+	}
+}
@@ -0,0 +1,93 @@
+package utils
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/spf13/viper"
+)
+
+// socketTOS returns the IPv4 type of service or IPv6 traffic class of conn.
+func socketTOS(t *testing.T, conn *net.TCPConn, ipv6 bool) int {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tos := 0
+	var sockErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		if ipv6 {
+			tos, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS)
+		} else {
+			tos, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+
+	return tos
+}
+
+// TestSetDSCP validates that the DSCP bits are set on the socket of wrapped
+// IPv4 and IPv6 connections, and that a connection's value overrides dscp.
+func TestSetDSCP(t *testing.T) {
+	for _, network := range []string{"tcp4", "tcp6"} {
+		address := "127.0.0.1:0"
+		if network == "tcp6" {
+			address = "[::1]:0"
+		}
+
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			t.Skipf("Unable to listen on %s: %s", network, err)
+		}
+		defer listener.Close()
+
+		client, err := net.Dial(network, listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		server, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+
+		wrapped := &TeeConn{Conn: proxyproto.NewConn(server)}
+
+		err = SetDSCP(wrapped, 46)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if tos := socketTOS(t, server.(*net.TCPConn), network == "tcp6"); tos != 46<<2 {
+			t.Errorf("%s socket has ToS %#x when should have been %#x", network, tos, 46<<2)
+		}
+	}
+
+	viper.Set("dscp", 10)
+	defer viper.Set("dscp", nil)
+
+	var nilConn *SSHConnection
+	if nilConn.DSCPValue() != 10 || (&SSHConnection{}).DSCPValue() != 10 || (&SSHConnection{DSCP: 34}).DSCPValue() != 34 {
+		t.Error("Connection DSCP value should override dscp")
+	}
+
+	for value, valid := range map[string]bool{"0": true, "46": true, "63": true, "64": false, "-1": false, "ef": false} {
+		_, err := ParseDSCP(value)
+		if (err == nil) != valid {
+			t.Errorf("ParseDSCP(%q) returned %v", value, err)
+		}
+	}
+}
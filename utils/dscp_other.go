@@ -0,0 +1,8 @@
+//go:build !unix
+
+package utils
+
+// setsockoptDSCP is not supported on this platform.
+func setsockoptDSCP(fd uintptr, ipv6 bool, tos int) error {
+	return errDSCPUnsupported
+}
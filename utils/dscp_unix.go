@@ -0,0 +1,14 @@
+//go:build unix
+
+package utils
+
+import "syscall"
+
+// setsockoptDSCP sets the IPv4 type of service or IPv6 traffic class of a socket.
+func setsockoptDSCP(fd uintptr, ipv6 bool, tos int) error {
+	if ipv6 {
+		return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+	}
+
+	return syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// maxEnv is the maximum number of environment variables a connection can set.
+	maxEnv = 16
+
+	// maxEnvValueLength is the maximum length of an environment variable value.
+	maxEnvValueLength = 1024
+)
+
+// envRequest is the payload of an env request, sent by clients for each
+// variable set with SetEnv or SendEnv.
+type envRequest struct {
+	Name  string
+	Value string
+}
+
+// ParseEnvRequest parses the payload of an env request.
+func ParseEnvRequest(payload []byte) (string, string, error) {
+	req := envRequest{}
+
+	err := ssh.Unmarshal(payload, &req)
+	if err != nil {
+		return "", "", err
+	}
+
+	if len(req.Value) > maxEnvValueLength {
+		return "", "", fmt.Errorf("environment variable %s is longer than %d characters", req.Name, maxEnvValueLength)
+	}
+
+	return req.Name, req.Value, nil
+}
+
+// EnvAllowed returns whether clients can set the environment variable name,
+// according to client-env-allowlist. Entries ending with * match names that
+// start with the rest of the entry.
+func EnvAllowed(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, allowed := range strings.FieldsFunc(viper.GetString("client-env-allowlist"), CommaSplitFields) {
+		allowed = strings.TrimSpace(allowed)
+
+		if prefix, ok := strings.CutSuffix(allowed, "*"); ok && strings.HasPrefix(name, prefix) {
+			return true
+		}
+
+		if allowed == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetEnv sets an environment variable on the connection. Variables over the
+// limit are rejected.
+func (s *SSHConnection) SetEnv(name string, value string) error {
+	s.envLock.Lock()
+	defer s.envLock.Unlock()
+
+	if s.env == nil {
+		s.env = map[string]string{}
+	}
+
+	if _, ok := s.env[name]; !ok && len(s.env) >= maxEnv {
+		return fmt.Errorf("a connection can set at most %d environment variables", maxEnv)
+	}
+
+	s.env[name] = value
+
+	return nil
+}
+
+// GetEnv returns a copy of the environment variables set by the client.
+func (s *SSHConnection) GetEnv() map[string]string {
+	s.envLock.Lock()
+	defer s.envLock.Unlock()
+
+	return maps.Clone(s.env)
+}
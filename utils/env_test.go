@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestParseEnvRequest validates that env requests are parsed and size-limited.
+func TestParseEnvRequest(t *testing.T) {
+	name, value, err := ParseEnvRequest(ssh.Marshal(envRequest{Name: "CI_BUILD_ID", Value: "1234"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name != "CI_BUILD_ID" || value != "1234" {
+		t.Errorf("Parsed %q=%q when should have been \"CI_BUILD_ID\"=\"1234\"", name, value)
+	}
+
+	_, _, err = ParseEnvRequest(ssh.Marshal(envRequest{Name: "CI_LOG", Value: strings.Repeat("v", maxEnvValueLength+1)}))
+	if err == nil {
+		t.Error("Value over the limit should have been rejected")
+	}
+
+	_, _, err = ParseEnvRequest([]byte{0, 0})
+	if err == nil {
+		t.Error("Invalid payload should have been rejected")
+	}
+}
+
+// TestEnvAllowed validates exact and prefix matches of client-env-allowlist.
+func TestEnvAllowed(t *testing.T) {
+	if EnvAllowed("CI_BUILD_ID") {
+		t.Error("No variables should be allowed by default")
+	}
+
+	viper.Set("client-env-allowlist", "DEPLOY_ENV, CI_*")
+	defer viper.Set("client-env-allowlist", nil)
+
+	for name, allowed := range map[string]bool{
+		"DEPLOY_ENV":   true,
+		"CI_BUILD_ID":  true,
+		"CI_":          true,
+		"DEPLOY_ENV_2": false,
+		"LD_PRELOAD":   false,
+		"":             false,
+	} {
+		if EnvAllowed(name) != allowed {
+			t.Errorf("EnvAllowed(%q) is %t when should have been %t", name, !allowed, allowed)
+		}
+	}
+}
+
+// TestSetEnv validates that a connection can't set more than maxEnv variables.
+func TestSetEnv(t *testing.T) {
+	sshConn := &SSHConnection{}
+
+	for i := 0; i < maxEnv; i++ {
+		err := sshConn.SetEnv(fmt.Sprintf("CI_%d", i), "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := sshConn.SetEnv("CI_EXTRA", "value")
+	if err == nil {
+		t.Error("Variable over the limit should have been rejected")
+	}
+
+	err = sshConn.SetEnv("CI_0", "updated")
+	if err != nil {
+		t.Errorf("Existing variable should have been updated: %s", err)
+	}
+
+	env := sshConn.GetEnv()
+	env["CI_1"] = "changed"
+
+	if sshConn.GetEnv()["CI_0"] != "updated" || sshConn.GetEnv()["CI_1"] != "value" {
+		t.Error("GetEnv returned the internal map")
+	}
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// HasBackend returns whether the holder has a forward that its balancer can
+// send requests to. Forwards that are failing health checks or whose circuit
+// breaker is open are kept in the balancer with a weight of 0.
+func (h *HTTPHolder) HasBackend() bool {
+	for _, server := range h.Balancer.Servers() {
+		if weight, ok := h.Balancer.ServerWeight(server); ok && weight > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// noBackendPage returns the page to serve for host from
+// no-backend-pages-directory, falling back to no-backend-page. It returns nil
+// if neither has a page.
+func noBackendPage(host string) []byte {
+	if directory := viper.GetString("no-backend-pages-directory"); directory != "" && host != "" && host == filepath.Base(host) && !strings.HasPrefix(host, ".") {
+		page, err := os.ReadFile(filepath.Join(directory, host+".html"))
+		if err == nil {
+			return page
+		}
+
+		if !os.IsNotExist(err) {
+			log.Println("Error reading no backend page:", err)
+		}
+	}
+
+	if path := viper.GetString("no-backend-page"); path != "" {
+		page, err := os.ReadFile(path)
+		if err == nil {
+			return page
+		}
+
+		log.Println("Error reading no backend page:", err)
+	}
+
+	return nil
+}
+
+// ServeNoBackend responds to a request for host, which has no forward that can
+// serve it, with the page from no-backend-pages-directory or no-backend-page,
+// or a redirect to no-backend-redirect. Pages are served with
+// no-backend-status. It returns false without writing a response if none of
+// them are set.
+func ServeNoBackend(w http.ResponseWriter, r *http.Request, host string) bool {
+	host = strings.ToLower(host)
+
+	page := noBackendPage(host)
+	if page == nil {
+		location := viper.GetString("no-backend-redirect")
+		if location == "" {
+			return false
+		}
+
+		http.Redirect(w, r, location, http.StatusFound)
+
+		return true
+	}
+
+	status := viper.GetInt("no-backend-status")
+	if status < 100 || status > 999 {
+		status = http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	_, err := w.Write(page)
+	if err != nil && viper.GetBool("debug") {
+		log.Println("Error writing no backend page:", err)
+	}
+
+	return true
+}
@@ -0,0 +1,104 @@
+package utils
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/vulcand/oxy/roundrobin"
+)
+
+// TestServeNoBackend validates that per-host pages take precedence over the
+// default page, which takes precedence over the redirect.
+func TestServeNoBackend(t *testing.T) {
+	directory := t.TempDir()
+
+	err := os.WriteFile(filepath.Join(directory, "app.example.com.html"), []byte("app is down"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaultPage := filepath.Join(t.TempDir(), "default.html")
+
+	err = os.WriteFile(defaultPage, []byte("tunnel is down"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		viper.Set("no-backend-page", nil)
+		viper.Set("no-backend-pages-directory", nil)
+		viper.Set("no-backend-redirect", nil)
+		viper.Set("no-backend-status", nil)
+	}()
+
+	serve := func(host string) (bool, *httptest.ResponseRecorder) {
+		recorder := httptest.NewRecorder()
+		served := ServeNoBackend(recorder, httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil), host)
+		return served, recorder
+	}
+
+	if served, _ := serve("app.example.com"); served {
+		t.Error("Nothing should have been served without a page or redirect")
+	}
+
+	viper.Set("no-backend-redirect", "https://status.example.com")
+
+	if served, recorder := serve("app.example.com"); !served || recorder.Code != http.StatusFound || recorder.Header().Get("Location") != "https://status.example.com" {
+		t.Errorf("Request should have been redirected, got %d to %q", recorder.Code, recorder.Header().Get("Location"))
+	}
+
+	viper.Set("no-backend-page", defaultPage)
+	viper.Set("no-backend-pages-directory", directory)
+	viper.Set("no-backend-status", http.StatusBadGateway)
+
+	for host, body := range map[string]string{
+		"APP.example.com":   "app is down",
+		"other.example.com": "tunnel is down",
+		"..":                "tunnel is down",
+	} {
+		served, recorder := serve(host)
+		if !served || recorder.Code != http.StatusBadGateway || recorder.Body.String() != body {
+			t.Errorf("Served %d %q for %s when should have been 502 %q", recorder.Code, recorder.Body.String(), host, body)
+		}
+	}
+}
+
+// TestHasBackend validates that a holder whose forwards all have a weight of
+// 0 has no backend.
+func TestHasBackend(t *testing.T) {
+	balancer, err := roundrobin.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holder := &HTTPHolder{Balancer: balancer}
+
+	if holder.HasBackend() {
+		t.Error("Holder without forwards should not have a backend")
+	}
+
+	serverURL := &url.URL{Host: "backend"}
+
+	err = balancer.UpsertServer(serverURL, roundrobin.Weight(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !holder.HasBackend() {
+		t.Error("Holder with a healthy forward should have a backend")
+	}
+
+	err = balancer.UpsertServer(serverURL, roundrobin.Weight(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if holder.HasBackend() {
+		t.Error("Holder with only unhealthy forwards should not have a backend")
+	}
+}
@@ -0,0 +1,63 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ACMEChallengePath is the path prefix of ACME HTTP-01 challenge requests.
+// These have to be answered over http, so they are never redirected.
+const ACMEChallengePath = "/.well-known/acme-challenge/"
+
+// HTTPSRedirectURL returns the URL on the https server that r should be
+// redirected to, keeping the path and query of the request. hostname is the
+// host the forward is bound to, and httpsPort is only added if it isn't 443.
+// It returns false if r shouldn't be redirected.
+func HTTPSRedirectURL(r *http.Request, hostname string, httpsPort int) (string, bool) {
+	if r.TLS != nil || strings.HasPrefix(r.URL.Path, ACMEChallengePath) {
+		return "", false
+	}
+
+	redirectURL := *r.URL
+	redirectURL.Scheme = "https"
+	redirectURL.Host = hostname
+
+	if httpsPort != 443 {
+		redirectURL.Host = net.JoinHostPort(hostname, strconv.Itoa(httpsPort))
+	}
+
+	return redirectURL.String(), true
+}
+
+// HTTPSRedirectStatus returns the status code from force-https-redirect-status
+// used for https redirects. Codes that aren't redirects use 302, so browsers
+// don't cache the redirect unless a permanent code is set.
+func HTTPSRedirectStatus() int {
+	switch status := viper.GetInt("force-https-redirect-status"); status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return status
+	default:
+		return http.StatusFound
+	}
+}
+
+// HSTSHeader returns the value of the Strict-Transport-Security header sent
+// for forwards that enforce https, or an empty string if it is disabled.
+func HSTSHeader() string {
+	maxAge := viper.GetDuration("force-https-hsts-max-age")
+	if maxAge <= 0 {
+		return ""
+	}
+
+	header := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	if viper.GetBool("force-https-hsts-include-subdomains") {
+		header += "; includeSubDomains"
+	}
+
+	return header
+}
@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TestHTTPSRedirectURL validates that redirects keep the path and query, only
+// add non default ports and skip ACME challenges and https requests.
+func TestHTTPSRedirectURL(t *testing.T) {
+	for name, test := range map[string]struct {
+		target   string
+		port     int
+		tls      bool
+		redirect string
+	}{
+		"path":      {target: "/a/b?c=d&e=f", port: 443, redirect: "https://app.example.com/a/b?c=d&e=f"},
+		"port":      {target: "/", port: 8443, redirect: "https://app.example.com:8443/"},
+		"escaped":   {target: "/a%2Fb", port: 443, redirect: "https://app.example.com/a%2Fb"},
+		"acme":      {target: ACMEChallengePath + "token", port: 443},
+		"https":     {target: "/", port: 443, tls: true},
+		"acme-like": {target: "/.well-known/acme-challenge", port: 443, redirect: "https://app.example.com/.well-known/acme-challenge"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.target, nil)
+		if test.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		redirect, ok := HTTPSRedirectURL(req, "app.example.com", test.port)
+		if ok != (test.redirect != "") || redirect != test.redirect {
+			t.Errorf("Redirected %s to %q (%t) when should have been %q", name, redirect, ok, test.redirect)
+		}
+	}
+}
+
+// TestHTTPSRedirectStatus validates that only redirect codes are used.
+func TestHTTPSRedirectStatus(t *testing.T) {
+	defer viper.Set("force-https-redirect-status", nil)
+
+	for status, expected := range map[int]int{
+		0:   http.StatusFound,
+		200: http.StatusFound,
+		301: http.StatusMovedPermanently,
+		302: http.StatusFound,
+		307: http.StatusTemporaryRedirect,
+		308: http.StatusPermanentRedirect,
+	} {
+		viper.Set("force-https-redirect-status", status)
+
+		if got := HTTPSRedirectStatus(); got != expected {
+			t.Errorf("Redirect status for %d was %d when should have been %d", status, got, expected)
+		}
+	}
+}
+
+// TestHSTSHeader validates the Strict-Transport-Security header value.
+func TestHSTSHeader(t *testing.T) {
+	defer viper.Set("force-https-hsts-max-age", nil)
+	defer viper.Set("force-https-hsts-include-subdomains", nil)
+
+	viper.Set("force-https-hsts-max-age", 0)
+	if header := HSTSHeader(); header != "" {
+		t.Errorf("HSTS header was %q when should have been disabled", header)
+	}
+
+	viper.Set("force-https-hsts-max-age", 24*time.Hour)
+	if header := HSTSHeader(); header != "max-age=86400" {
+		t.Errorf("HSTS header was %q when should have been max-age=86400", header)
+	}
+
+	viper.Set("force-https-hsts-include-subdomains", true)
+	if header := HSTSHeader(); header != "max-age=86400; includeSubDomains" {
+		t.Errorf("HSTS header was %q when should have included subdomains", header)
+	}
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// forwardedHeaders are the headers sent by clients that SetForwardedHeaders
+// overwrites if forwarded-headers-trust is disabled.
+var forwardedHeaders = []string{
+	"X-Forwarded-For",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Host",
+	"X-Forwarded-Port",
+	"X-Real-Ip",
+}
+
+// forwardedServer is the value of the X-Forwarded-Server header, which is the
+// hostname of the sish server.
+var forwardedServer = func() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+
+	return hostname
+}()
+
+// SetForwardedHeaders sets the X-Forwarded-For, X-Forwarded-Proto,
+// X-Forwarded-Host, X-Forwarded-Port, X-Forwarded-Server and X-Real-IP headers
+// of a request sent to a HTTP forward, if forwarded-headers is enabled. It
+// must be called before the Host header is rewritten. The client IP is taken
+// from the request's remote address, which is the accepted connection or the
+// PROXY header it started with. If forwarded-headers-trust is enabled, the client IP is
+// appended to the X-Forwarded-For header sent by the client and the other
+// headers are only set if the client didn't send them. Otherwise, headers
+// sent by the client are overwritten.
+func SetForwardedHeaders(req *http.Request) {
+	if !viper.GetBool("forwarded-headers") {
+		return
+	}
+
+	trust := viper.GetBool("forwarded-headers-trust")
+	if !trust {
+		for _, header := range forwardedHeaders {
+			req.Header.Del(header)
+		}
+	}
+
+	setHeader := func(header string, value string) {
+		if req.Header.Get(header) == "" && value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+
+	clientIP, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err == nil {
+		clientIP = strings.Split(clientIP, "%")[0]
+
+		if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			req.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+clientIP)
+		} else {
+			req.Header.Set("X-Forwarded-For", clientIP)
+		}
+
+		setHeader("X-Real-Ip", clientIP)
+	}
+
+	setHeader("X-Forwarded-Proto", forwardedProto(req))
+	setHeader("X-Forwarded-Host", req.Host)
+	setHeader("X-Forwarded-Port", forwardedPort(req))
+
+	req.Header.Set("X-Forwarded-Server", forwardedServer)
+}
+
+// forwardedProto returns the protocol the client used to reach sish. Requests
+// are https if they were received over TLS or sish runs behind a SSL
+// terminating proxy. Websocket requests use ws and wss instead.
+func forwardedProto(req *http.Request) string {
+	secure := req.TLS != nil || viper.GetBool("proxy-ssl-termination")
+	websocket := strings.EqualFold(req.Header.Get("Upgrade"), "websocket")
+
+	switch {
+	case websocket && secure:
+		return "wss"
+	case websocket:
+		return "ws"
+	case secure:
+		return "https"
+	}
+
+	return "http"
+}
+
+// forwardedPort returns the port the client used to reach sish, which is the
+// port of the Host header or the default port of the protocol.
+func forwardedPort(req *http.Request) string {
+	if _, port, err := net.SplitHostPort(req.Host); err == nil && port != "" {
+		return port
+	}
+
+	if req.TLS != nil || viper.GetBool("proxy-ssl-termination") {
+		return "443"
+	}
+
+	return "80"
+}
+
+// ForwardedHeaderRewriter is the request rewriter of the HTTP forwarder. It
+// leaves the headers set by SetForwardedHeaders as they are.
+type ForwardedHeaderRewriter struct{}
+
+// Rewrite implements the forwarder's request rewriter.
+func (ForwardedHeaderRewriter) Rewrite(req *http.Request) {}
+
+// ForwardedHeadersHandler passes requests to next without their remote
+// address, so the client IP that SetForwardedHeaders already added isn't
+// appended to X-Forwarded-For a second time by the forwarder.
+func ForwardedHeadersHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		outReq := req.WithContext(req.Context())
+		outReq.RemoteAddr = ""
+
+		next.ServeHTTP(w, outReq)
+	})
+}
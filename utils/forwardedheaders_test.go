@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/vulcand/oxy/forward"
+)
+
+// TestSetForwardedHeaders validates that the client IP is appended to the
+// X-Forwarded-For sent by the client when it is trusted, and that headers sent
+// by the client are overwritten when it isn't.
+func TestSetForwardedHeaders(t *testing.T) {
+	viper.Set("forwarded-headers", true)
+	defer viper.Set("forwarded-headers", nil)
+	defer viper.Set("forwarded-headers-trust", nil)
+
+	tests := map[bool]map[string]string{
+		true: {
+			"X-Forwarded-For":   "198.51.100.10, 203.0.113.12",
+			"X-Forwarded-Proto": "https",
+			"X-Forwarded-Host":  "spoofed.example.com",
+			"X-Forwarded-Port":  "8080",
+			"X-Real-Ip":         "198.51.100.10",
+		},
+		false: {
+			"X-Forwarded-For":   "203.0.113.12",
+			"X-Forwarded-Proto": "http",
+			"X-Forwarded-Host":  "app.example.com:8080",
+			"X-Forwarded-Port":  "8080",
+			"X-Real-Ip":         "203.0.113.12",
+		},
+	}
+
+	for trust, want := range tests {
+		viper.Set("forwarded-headers-trust", trust)
+
+		req := httptest.NewRequest(http.MethodGet, "http://app.example.com:8080/", nil)
+		req.RemoteAddr = "203.0.113.12:51234"
+		req.Header.Set("X-Forwarded-For", "198.51.100.10")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "spoofed.example.com")
+		req.Header.Set("X-Real-Ip", "198.51.100.10")
+
+		SetForwardedHeaders(req)
+
+		for header, value := range want {
+			if got := req.Header.Get(header); got != value {
+				t.Errorf("Trust %t set %s to %q when should have been %q", trust, header, got, value)
+			}
+		}
+
+		if req.Header.Get("X-Forwarded-Server") != forwardedServer {
+			t.Errorf("Trust %t set X-Forwarded-Server to %q", trust, req.Header.Get("X-Forwarded-Server"))
+		}
+	}
+
+	viper.Set("forwarded-headers", false)
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	SetForwardedHeaders(req)
+
+	if len(req.Header) != 0 {
+		t.Errorf("Disabled forwarded headers set %v", req.Header)
+	}
+}
+
+// TestForwardedProto validates that requests received over TLS or through a
+// SSL terminating proxy are https, and that websockets use ws and wss.
+func TestForwardedProto(t *testing.T) {
+	defer viper.Set("proxy-ssl-termination", nil)
+
+	tests := []struct {
+		tls            bool
+		sslTermination bool
+		websocket      bool
+		proto          string
+		port           string
+	}{
+		{proto: "http", port: "80"},
+		{tls: true, proto: "https", port: "443"},
+		{sslTermination: true, proto: "https", port: "443"},
+		{websocket: true, proto: "ws", port: "80"},
+		{tls: true, websocket: true, proto: "wss", port: "443"},
+	}
+
+	for _, test := range tests {
+		viper.Set("proxy-ssl-termination", test.sslTermination)
+
+		req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		if test.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		if test.websocket {
+			req.Header.Set("Upgrade", "websocket")
+		}
+
+		if proto, port := forwardedProto(req), forwardedPort(req); proto != test.proto || port != test.port {
+			t.Errorf("%+v got proto %s and port %s", test, proto, port)
+		}
+	}
+}
+
+// TestForwardedHeadersHandler validates that the forwarder sends the headers
+// set by SetForwardedHeaders without appending the client IP again.
+func TestForwardedHeadersHandler(t *testing.T) {
+	viper.Set("forwarded-headers", true)
+	viper.Set("forwarded-headers-trust", true)
+	defer viper.Set("forwarded-headers", nil)
+	defer viper.Set("forwarded-headers-trust", nil)
+
+	received := make(chan http.Header, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+	}))
+	defer backend.Close()
+
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fwd, err := forward.New(forward.PassHostHeader(true), forward.Rewriter(ForwardedHeaderRewriter{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	req.RemoteAddr = "203.0.113.12:51234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.10")
+	req.URL = backendURL
+
+	SetForwardedHeaders(req)
+	ForwardedHeadersHandler(fwd).ServeHTTP(httptest.NewRecorder(), req)
+
+	headers := <-received
+
+	if xff := headers.Values("X-Forwarded-For"); len(xff) != 1 || xff[0] != "198.51.100.10, 203.0.113.12" {
+		t.Errorf("Backend received X-Forwarded-For %q", xff)
+	}
+
+	if req.RemoteAddr != "203.0.113.12:51234" {
+		t.Errorf("Handler changed the remote address of the request to %q", req.RemoteAddr)
+	}
+}
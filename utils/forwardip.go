@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ParseIPNets parses a comma separated list of IPs and CIDRs. IPs are
+// converted to single address networks.
+func ParseIPNets(list string) ([]*net.IPNet, error) {
+	ipNets := []*net.IPNet{}
+
+	for _, item := range strings.FieldsFunc(list, CommaSplitFields) {
+		item = strings.TrimSpace(item)
+
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", item)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %q", item)
+		}
+
+		ipNets = append(ipNets, ipNet)
+	}
+
+	if len(ipNets) == 0 {
+		return nil, fmt.Errorf("no ips provided")
+	}
+
+	return ipNets, nil
+}
+
+// ForwardBlocked returns whether or not connections from ip to the
+// connection's forwards are blocked by its allow-ips and deny-ips. Denied IPs
+// take precedence over allowed IPs. If allow-ips is set, only those IPs are
+// allowed.
+func (s *SSHConnection) ForwardBlocked(ip string) bool {
+	if len(s.AllowedIPs) == 0 && len(s.DeniedIPs) == 0 {
+		return false
+	}
+
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return true
+	}
+
+	for _, ipNet := range s.DeniedIPs {
+		if ipNet.Contains(parsedIP) {
+			return true
+		}
+	}
+
+	if len(s.AllowedIPs) == 0 {
+		return false
+	}
+
+	for _, ipNet := range s.AllowedIPs {
+		if ipNet.Contains(parsedIP) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,51 @@
+package utils
+
+import "testing"
+
+// TestForwardBlocked validates that denied IPs take precedence over allowed
+// IPs, and that only allowed IPs pass when an allow list is set.
+func TestForwardBlocked(t *testing.T) {
+	allowed, err := ParseIPNets("10.0.0.0/8, 192.168.1.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	denied, err := ParseIPNets("10.1.0.0/16,2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshConn := &SSHConnection{}
+	if sshConn.ForwardBlocked("203.0.113.1") {
+		t.Error("Connections without lists should not block any IP")
+	}
+
+	sshConn.DeniedIPs = denied
+	if !sshConn.ForwardBlocked("2001:db8::1") || sshConn.ForwardBlocked("203.0.113.1") {
+		t.Error("Deny list without an allow list should only block denied IPs")
+	}
+
+	sshConn.AllowedIPs = allowed
+
+	tests := map[string]bool{
+		"10.2.3.4":    false,
+		"192.168.1.5": false,
+		"10.1.2.3":    true,
+		"192.168.1.6": true,
+		"203.0.113.1": true,
+		"not-an-ip":   true,
+	}
+
+	for ip, want := range tests {
+		if sshConn.ForwardBlocked(ip) != want {
+			t.Errorf("IP %s blocked %t when should have been %t", ip, !want, want)
+		}
+	}
+
+	for _, list := range []string{"", "10.0.0.0/33", "not-an-ip"} {
+		_, err := ParseIPNets(list)
+		if err == nil {
+			t.Errorf("List %q should have been rejected", list)
+		}
+	}
+}
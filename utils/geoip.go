@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// geoIPCacheSize is the number of lookups kept before the cache is reset.
+const geoIPCacheSize = 10000
+
+// GeoIPFilter blocks forwarded connections based on the country of the
+// remote address, as resolved by a MaxMind database.
+type GeoIPFilter struct {
+	AllowedCountries []string
+	BlockedCountries []string
+	FailOpen         bool
+
+	reader    *maxminddb.Reader
+	cacheLock sync.Mutex
+	cache     map[string]string
+}
+
+// geoIPRecord is the part of a MaxMind country record that is used for filtering.
+type geoIPRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// NewGeoIPFilter returns a new GeoIPFilter using the MaxMind database at
+// databasePath. If the database can't be opened, every connection is
+// allowed or blocked depending on failOpen.
+func NewGeoIPFilter(databasePath string, allowedCountries []string, blockedCountries []string, failOpen bool) *GeoIPFilter {
+	filter := &GeoIPFilter{
+		AllowedCountries: allowedCountries,
+		BlockedCountries: blockedCountries,
+		FailOpen:         failOpen,
+		cache:            map[string]string{},
+	}
+
+	if databasePath == "" {
+		log.Println("No geoip database provided for filtering forwarded connections")
+		return filter
+	}
+
+	reader, err := maxminddb.Open(databasePath)
+	if err != nil {
+		log.Println("Unable to open geoip database:", err)
+		return filter
+	}
+
+	filter.reader = reader
+
+	return filter
+}
+
+// Country returns the ISO country code of ip. Lookups are cached.
+func (g *GeoIPFilter) Country(ip string) (string, error) {
+	g.cacheLock.Lock()
+	country, ok := g.cache[ip]
+	g.cacheLock.Unlock()
+
+	if ok {
+		return country, nil
+	}
+
+	if g.reader == nil {
+		return "", fmt.Errorf("geoip database is unavailable")
+	}
+
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return "", fmt.Errorf("unable to parse ip %s", ip)
+	}
+
+	record := &geoIPRecord{}
+
+	err := g.reader.Lookup(parsedIP, record)
+	if err != nil {
+		return "", err
+	}
+
+	g.cacheLock.Lock()
+	if len(g.cache) >= geoIPCacheSize {
+		g.cache = map[string]string{}
+	}
+	g.cache[ip] = record.Country.ISOCode
+	g.cacheLock.Unlock()
+
+	return record.Country.ISOCode, nil
+}
+
+// Blocked returns whether or not a forwarded connection from ip should be dropped.
+// A nil GeoIPFilter does not block anything.
+func (g *GeoIPFilter) Blocked(ip string) bool {
+	if g == nil {
+		return false
+	}
+
+	country, err := g.Country(ip)
+	if err != nil {
+		return !g.FailOpen
+	}
+
+	if slices.Contains(g.BlockedCountries, country) {
+		return true
+	}
+
+	return len(g.AllowedCountries) > 0 && !slices.Contains(g.AllowedCountries, country)
+}
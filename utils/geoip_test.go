@@ -0,0 +1,33 @@
+package utils
+
+import "testing"
+
+// TestGeoIPFilterBlocked validates the allowed and blocked country lists and
+// the fail policy when the database is unavailable.
+func TestGeoIPFilterBlocked(t *testing.T) {
+	var nilFilter *GeoIPFilter
+	if nilFilter.Blocked("192.0.2.1") {
+		t.Error("Expected a nil filter to allow all connections")
+	}
+
+	filter := NewGeoIPFilter("", []string{"US", "CA"}, []string{"CA"}, true)
+	filter.cache["192.0.2.1"] = "US"
+	filter.cache["192.0.2.2"] = "CA"
+	filter.cache["192.0.2.3"] = "DE"
+
+	for ip, blocked := range map[string]bool{
+		"192.0.2.1": false,
+		"192.0.2.2": true,
+		"192.0.2.3": true,
+		"192.0.2.4": false,
+	} {
+		if filter.Blocked(ip) != blocked {
+			t.Errorf("Blocked(%s) %t when should have been %t", ip, !blocked, blocked)
+		}
+	}
+
+	filter.FailOpen = false
+	if !filter.Blocked("192.0.2.4") {
+		t.Error("Expected a failed lookup to be blocked when failing closed")
+	}
+}
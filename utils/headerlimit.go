@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"log"
+	"math"
+	"net/http"
+
+	"github.com/spf13/viper"
+)
+
+// RequestHeaderSize returns the size in bytes of the request line and headers
+// of req as they were sent by the client.
+func RequestHeaderSize(req *http.Request) int64 {
+	size := len(req.Method) + len(req.RequestURI) + len(req.Proto) + len(" \r\n ")
+
+	if req.Host != "" {
+		size += len("Host: \r\n") + len(req.Host)
+	}
+
+	for name, values := range req.Header {
+		for _, value := range values {
+			size += len(name) + len(value) + len(": \r\n")
+		}
+	}
+
+	return int64(size)
+}
+
+// MaxHeaderBytes returns the MaxHeaderBytes of the HTTP(S) servers. Requests
+// with larger headers are rejected with 431 by the server, before the limits
+// of their forward are checked.
+func MaxHeaderBytes() int {
+	limit := viper.GetInt("max-request-header-size")
+	if limit <= 0 {
+		return math.MaxInt32
+	}
+
+	return limit
+}
+
+// LimitRequestHeaders responds with 431 and returns false if the headers of
+// req are larger than limit bytes. 0 means unlimited.
+func LimitRequestHeaders(w http.ResponseWriter, req *http.Request, limit int64) bool {
+	if limit <= 0 || RequestHeaderSize(req) <= limit {
+		return true
+	}
+
+	status := http.StatusRequestHeaderFieldsTooLarge
+
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(status)
+	if viper.GetBool("debug") {
+		log.Println("Aborting with status", status)
+	}
+
+	return false
+}
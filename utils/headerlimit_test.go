@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/antoniomika/syncmap"
+	"github.com/spf13/viper"
+)
+
+// TestLimitRequestHeaders validates that requests with oversized headers are
+// rejected with 431 without being forwarded, and that connections can lower
+// the limit of their forward.
+func TestLimitRequestHeaders(t *testing.T) {
+	viper.Set("max-request-header-size", 1024)
+	defer viper.Set("max-request-header-size", nil)
+
+	holder := &HTTPHolder{SSHConnections: syncmap.New[string, *SSHConnection]()}
+
+	forwarded := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !LimitRequestHeaders(w, r, holder.RequestHeaderLimit()) {
+			return
+		}
+
+		forwarded++
+		w.WriteHeader(http.StatusOK)
+	})
+
+	send := func(headerSize int) int {
+		req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+		req.Header.Set("X-Large", strings.Repeat("a", headerSize))
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		return recorder.Code
+	}
+
+	if code := send(2048); code != http.StatusRequestHeaderFieldsTooLarge || forwarded != 0 {
+		t.Errorf("Oversized headers got %d and were forwarded %d times", code, forwarded)
+	}
+
+	if code := send(512); code != http.StatusOK || forwarded != 1 {
+		t.Errorf("Headers under the limit got %d and were forwarded %d times", code, forwarded)
+	}
+
+	holder.SSHConnections.Store("lowered", &SSHConnection{MaxRequestHeaderSize: 256})
+	holder.SSHConnections.Store("raised", &SSHConnection{MaxRequestHeaderSize: 4096})
+
+	if holder.RequestHeaderLimit() != 256 {
+		t.Fatalf("Holder limit %d when should have been 256", holder.RequestHeaderLimit())
+	}
+
+	if code := send(512); code != http.StatusRequestHeaderFieldsTooLarge || forwarded != 1 {
+		t.Errorf("Headers over the lowered limit got %d and were forwarded %d times", code, forwarded)
+	}
+}
+
+// TestMaxHeaderBytes validates that a server configured like the HTTP(S)
+// servers rejects headers over max-request-header-size itself, and that
+// forwards with a lower limit reject smaller headers.
+func TestMaxHeaderBytes(t *testing.T) {
+	viper.Set("max-request-header-size", 1024)
+	defer viper.Set("max-request-header-size", nil)
+
+	if MaxHeaderBytes() != 1024 {
+		t.Errorf("MaxHeaderBytes returned %d when should have been 1024", MaxHeaderBytes())
+	}
+
+	holder := &HTTPHolder{SSHConnections: syncmap.New[string, *SSHConnection]()}
+	holder.SSHConnections.Store("lowered", &SSHConnection{MaxRequestHeaderSize: 256})
+
+	var handled, forwarded atomic.Int64
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled.Add(1)
+
+		if !LimitRequestHeaders(w, r, holder.RequestHeaderLimit()) {
+			return
+		}
+
+		forwarded.Add(1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	server.Config.MaxHeaderBytes = MaxHeaderBytes()
+	server.Start()
+	defer server.Close()
+
+	send := func(headerSize int) int {
+		req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("X-Large", strings.Repeat("a", headerSize))
+
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	tests := map[string]struct {
+		headerSize int
+		want       int
+	}{
+		"small headers":                 {64, http.StatusOK},
+		"headers over the forward":      {512, http.StatusRequestHeaderFieldsTooLarge},
+		"headers far over the max size": {64 * 1024, http.StatusRequestHeaderFieldsTooLarge},
+	}
+
+	for name, test := range tests {
+		if code := send(test.headerSize); code != test.want {
+			t.Errorf("Request with %s got %d when should have been %d", name, code, test.want)
+		}
+	}
+
+	if handled.Load() != 2 || forwarded.Load() != 1 {
+		t.Errorf("Handled %d and forwarded %d requests when should have been 2 and 1", handled.Load(), forwarded.Load())
+	}
+
+	viper.Set("max-request-header-size", 0)
+
+	if MaxHeaderBytes() != math.MaxInt32 {
+		t.Errorf("Unlimited MaxHeaderBytes returned %d when should have been %d", MaxHeaderBytes(), math.MaxInt32)
+	}
+}
@@ -0,0 +1,124 @@
+package utils
+
+import (
+	"log"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/vulcand/oxy/roundrobin"
+)
+
+// HealthCheck actively probes a forwarded listener. The listener is skipped
+// by its balancer while it is unhealthy until it recovers. Other forwards of
+// the same connection are checked on their own.
+type HealthCheck struct {
+	Listener           *ListenerHolder
+	Balancer           *roundrobin.RoundRobin
+	ServerURL          *url.URL
+	Probe              func() error
+	Interval           time.Duration
+	UnhealthyThreshold int
+	HealthyThreshold   int
+
+	lock      sync.Mutex
+	stopped   bool
+	done      chan struct{}
+	unhealthy bool
+}
+
+// NewHealthCheck returns a HealthCheck configured from the health check settings.
+func NewHealthCheck(listener *ListenerHolder, balancer *roundrobin.RoundRobin, serverURL *url.URL, probe func() error) *HealthCheck {
+	return &HealthCheck{
+		Listener:           listener,
+		Balancer:           balancer,
+		ServerURL:          serverURL,
+		Probe:              probe,
+		Interval:           viper.GetDuration("health-check-interval"),
+		UnhealthyThreshold: viper.GetInt("health-check-unhealthy-threshold"),
+		HealthyThreshold:   viper.GetInt("health-check-healthy-threshold"),
+		done:               make(chan struct{}),
+	}
+}
+
+// Run probes the listener until Stop is called or the connection closes.
+func (h *HealthCheck) Run() {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+
+	failures := 0
+	successes := 0
+
+	for {
+		select {
+		case <-ticker.C:
+			err := h.Probe()
+			if err != nil {
+				successes = 0
+				failures++
+
+				if viper.GetBool("debug") {
+					log.Printf("Health check failed for %s: %s", LogAddr(h.Listener.SSHConn.SSHConn.RemoteAddr()), err)
+				}
+
+				if failures >= h.UnhealthyThreshold {
+					h.setHealthy(false)
+				}
+
+				continue
+			}
+
+			failures = 0
+			successes++
+
+			if successes >= h.HealthyThreshold {
+				h.setHealthy(true)
+			}
+		case <-h.done:
+			return
+		case <-h.Listener.SSHConn.Close:
+			return
+		}
+	}
+}
+
+// Stop stops the health check. The balancer will not be modified after Stop returns.
+func (h *HealthCheck) Stop() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.stopped {
+		return
+	}
+
+	h.stopped = true
+	close(h.done)
+}
+
+// setHealthy updates the balancer and listener state when health changes.
+// Unhealthy listeners are kept in the balancer with a weight of 0 so they are
+// skipped without affecting cleanup of the balancer.
+func (h *HealthCheck) setHealthy(healthy bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.stopped || h.unhealthy == !healthy {
+		return
+	}
+
+	h.unhealthy = !healthy
+	h.Listener.SetHealthy(healthy)
+
+	weight := h.Listener.SSHConn.routingWeight(h.Listener.ListenAddr)
+	if healthy {
+		log.Println("Health check recovered for:", LogAddr(h.Listener.SSHConn.SSHConn.RemoteAddr()))
+	} else {
+		log.Println("Health check failed, skipping in balancer:", LogAddr(h.Listener.SSHConn.SSHConn.RemoteAddr()))
+	}
+
+	err := h.Balancer.UpsertServer(h.ServerURL, roundrobin.Weight(weight))
+	if err != nil {
+		log.Println("Unable to update server in balancer:", err)
+	}
+}
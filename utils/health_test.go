@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/antoniomika/syncmap"
+	"github.com/vulcand/oxy/roundrobin"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestHealthCheckListener validates that a failing health check only skips
+// its own forward, and not the other forwards of the connection.
+func TestHealthCheckListener(t *testing.T) {
+	sshConn := &SSHConnection{
+		SSHConn:   &ssh.ServerConn{Conn: &closeTestConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}}},
+		Listeners: syncmap.New[string, net.Listener](),
+	}
+
+	failing := &ListenerHolder{ListenAddr: "failing", SSHConn: sshConn}
+	passing := &ListenerHolder{ListenAddr: "passing", SSHConn: sshConn}
+
+	sshConn.Listeners.Store(failing.ListenAddr, failing)
+	sshConn.Listeners.Store(passing.ListenAddr, passing)
+
+	balancer, err := roundrobin.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverURL := &url.URL{Host: "failing"}
+
+	err = balancer.UpsertServer(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	healthCheck := NewHealthCheck(failing, balancer, serverURL, func() error { return errors.New("refused") })
+	healthCheck.setHealthy(false)
+
+	if weight, _ := balancer.ServerWeight(serverURL); weight != 0 {
+		t.Errorf("Weight is %d when should have been 0 for the failing forward", weight)
+	}
+
+	if sshConn.routingWeight(failing.ListenAddr) != 0 || sshConn.routingWeight(passing.ListenAddr) != 1 {
+		t.Error("Only the failing forward should have been skipped")
+	}
+
+	if sshConn.Healthy() {
+		t.Error("The connection should not have been healthy with a failing forward")
+	}
+
+	healthCheck.setHealthy(true)
+
+	if weight, _ := balancer.ServerWeight(serverURL); weight != 1 || !sshConn.Healthy() {
+		t.Errorf("Weight is %d when should have been 1 once the forward recovered", weight)
+	}
+}
@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// maxHostRegexLength is the longest host regex a client can register.
+const maxHostRegexLength = 256
+
+// ParseHostRegex compiles a host regex for routing HTTP requests. The regex
+// has to match the whole host, and is case insensitive like hosts. It is
+// rejected if it is too long, matches an
+// empty host, or matches the sish domain itself.
+func ParseHostRegex(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" || len(pattern) > maxHostRegexLength {
+		return nil, fmt.Errorf("regex must be between 1 and %d characters", maxHostRegexLength)
+	}
+
+	hostRegex, err := regexp.Compile(fmt.Sprintf("(?i)^(?:%s)$", pattern))
+	if err != nil {
+		return nil, fmt.Errorf("invalid regex %q: %w", pattern, err)
+	}
+
+	if hostRegex.MatchString("") {
+		return nil, fmt.Errorf("regex %q matches an empty host", pattern)
+	}
+
+	if domain := viper.GetString("domain"); domain != "" && hostRegex.MatchString(domain) {
+		return nil, fmt.Errorf("regex %q matches the root domain %s", pattern, domain)
+	}
+
+	return hostRegex, nil
+}
+
+// matchesHostRegex returns whether host matches one of the host regexes of
+// the holder's connections. A connection's regexes don't match hosts it
+// couldn't bind itself: banned subdomains, hosts reserved for a reconnecting
+// client, and hosts in the wildcard scope of another key. Reservations change
+// over time, so they are checked on every match.
+func (s *State) matchesHostRegex(holder *HTTPHolder, host string) bool {
+	if holder.SSHConnections == nil {
+		return false
+	}
+
+	host = strings.ToLower(host)
+	if inList(host, bannedSubdomainList) {
+		return false
+	}
+
+	matched := false
+
+	holder.SSHConnections.Range(func(key string, sshConn *SSHConnection) bool {
+		for _, hostRegex := range sshConn.HostRegexes {
+			if !hostRegex.MatchString(host) {
+				continue
+			}
+
+			if s.reservedByOther(sshConn, ReservedHTTP, host) || wildcardReservedByOther(sshConn, host) {
+				break
+			}
+
+			matched = true
+			return false
+		}
+
+		return true
+	})
+
+	return matched
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antoniomika/syncmap"
+	"github.com/spf13/viper"
+)
+
+// TestParseHostRegex validates that host regexes match whole hosts, and that
+// unsafe regexes are rejected.
+func TestParseHostRegex(t *testing.T) {
+	viper.Set("domain", "example.com")
+	defer viper.Set("domain", "")
+
+	hostRegex, err := ParseHostRegex(`test-\d+\.example\.com`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for host, want := range map[string]bool{"test-1.example.com": true, "TEST-2.Example.com": true, "test-a.example.com": false, "xtest-1.example.com.evil": false} {
+		if hostRegex.MatchString(host) != want {
+			t.Errorf("Regex matched %s when should have been %t", host, want)
+		}
+	}
+
+	for _, pattern := range []string{"", "(", ".*", "(example.com)?", strings.Repeat("a", maxHostRegexLength+1)} {
+		_, err := ParseHostRegex(pattern)
+		if err == nil {
+			t.Errorf("Regex %q should have been rejected", pattern)
+		}
+	}
+}
+
+// TestFindHTTPHolderHostRegex validates that host regexes are only used when
+// no exact or wildcard host matches.
+func TestFindHTTPHolderHostRegex(t *testing.T) {
+	state := NewState()
+
+	holders := map[string]*HTTPHolder{}
+	for _, rawURL := range []string{"http://app.example.com", "http://*.example.com", "http://regex.example.org"} {
+		parsedURL, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		holders[rawURL] = &HTTPHolder{HTTPUrl: parsedURL, SSHConnections: syncmap.New[string, *SSHConnection]()}
+		state.HTTPListeners.Store(rawURL, holders[rawURL])
+	}
+
+	holders["http://regex.example.org"].SSHConnections.Store("conn", &SSHConnection{
+		HostRegexes: []*regexp.Regexp{regexp.MustCompile(`^.*\.example\.(com|net)$`)},
+	})
+
+	testCases := []struct {
+		hostname string
+		holder   string
+	}{
+		{"app.example.com", "http://app.example.com"},
+		{"other.example.com", "http://*.example.com"},
+		{"other.example.net", "http://regex.example.org"},
+		{"other.example.io", ""},
+	}
+
+	for _, testCase := range testCases {
+		holder, _ := state.FindHTTPHolder(testCase.hostname, "/", "", "")
+		if holder != holders[testCase.holder] {
+			t.Errorf("Unexpected holder for %s", testCase.hostname)
+		}
+	}
+}
+
+// TestHostRegexExclusions validates that host regexes don't route banned
+// hosts, hosts reserved for another client, or hosts in the wildcard scope of
+// another key.
+func TestHostRegexExclusions(t *testing.T) {
+	viper.Set("domain", "example.com")
+	viper.Set("reconnect-token-ttl", time.Hour)
+	defer viper.Set("domain", "")
+	defer viper.Set("reconnect-token-ttl", nil)
+
+	previousBanned := bannedSubdomainList
+	bannedSubdomainList = []string{"banned.example.com"}
+	defer func() { bannedSubdomainList = previousBanned }()
+
+	holderLock.Lock()
+	previousPermissions := keyPermissionsHolder
+	keyPermissionsHolder = map[string]*KeyPermissions{"owner": {WildcardSubdomains: []string{"scoped"}}}
+	holderLock.Unlock()
+
+	defer func() {
+		holderLock.Lock()
+		keyPermissionsHolder = previousPermissions
+		holderLock.Unlock()
+	}()
+
+	state := NewState()
+
+	reconnecting := reservationTestConn("alice")
+	state.NewReservation(reconnecting)
+	state.AddReservedForward(reconnecting, ReservedHTTP, "app", "reserved.example.com")
+
+	parsedURL, err := url.Parse("http://regex.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holder := &HTTPHolder{HTTPUrl: parsedURL, SSHConnections: syncmap.New[string, *SSHConnection]()}
+	state.HTTPListeners.Store(parsedURL.String(), holder)
+
+	regexConn := reservationTestConn("bob")
+	regexConn.HostRegexes = []*regexp.Regexp{regexp.MustCompile(`^.*\.example\.com$`)}
+	holder.SSHConnections.Store("conn", regexConn)
+
+	for host, want := range map[string]*HTTPHolder{
+		"free.example.com":       holder,
+		"banned.example.com":     nil,
+		"reserved.example.com":   nil,
+		"app.scoped.example.com": nil,
+	} {
+		found, _ := state.FindHTTPHolder(host, "/", "", "")
+		if found != want {
+			t.Errorf("Unexpected holder for %s", host)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// HostRewrite rewrites the Host header of HTTP requests that match a regex.
+type HostRewrite struct {
+	Match       *regexp.Regexp
+	Replacement string
+}
+
+// ParseHostRewrite parses a host rewrite rule in the form regex:replacement.
+// The replacement can reference capture groups of the regex, like $1.
+func ParseHostRewrite(rule string) (HostRewrite, error) {
+	match, replacement, ok := strings.Cut(rule, ":")
+	if !ok || match == "" || replacement == "" {
+		return HostRewrite{}, fmt.Errorf("rule %q is not in the form regex:replacement", rule)
+	}
+
+	matchRegex, err := regexp.Compile(match)
+	if err != nil {
+		return HostRewrite{}, fmt.Errorf("invalid regex %q: %w", match, err)
+	}
+
+	return HostRewrite{
+		Match:       matchRegex,
+		Replacement: replacement,
+	}, nil
+}
+
+// RewriteHost applies the first rewrite that matches host, and returns the
+// rewritten host and whether or not a rewrite matched.
+func RewriteHost(host string, rewrites []HostRewrite) (string, bool) {
+	for _, rewrite := range rewrites {
+		if rewrite.Match.MatchString(host) {
+			return rewrite.Match.ReplaceAllString(host, rewrite.Replacement), true
+		}
+	}
+
+	return host, false
+}
@@ -0,0 +1,41 @@
+package utils
+
+import "testing"
+
+// TestRewriteHost validates that the first matching rule rewrites the host.
+func TestRewriteHost(t *testing.T) {
+	rewrites := []HostRewrite{}
+
+	for _, rule := range []string{`^(\w+)\.tenants\.example\.com$:$1.internal`, `^.*\.example\.com$:default.internal`} {
+		rewrite, err := ParseHostRewrite(rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rewrites = append(rewrites, rewrite)
+	}
+
+	testCases := []struct {
+		host    string
+		want    string
+		matched bool
+	}{
+		{"acme.tenants.example.com", "acme.internal", true},
+		{"www.example.com", "default.internal", true},
+		{"example.org", "example.org", false},
+	}
+
+	for _, testCase := range testCases {
+		host, matched := RewriteHost(testCase.host, rewrites)
+		if host != testCase.want || matched != testCase.matched {
+			t.Errorf("Rewrote %s to %s (%t) when should have been %s (%t)", testCase.host, host, matched, testCase.want, testCase.matched)
+		}
+	}
+
+	for _, rule := range []string{"no-replacement", ":replacement", "(:replacement"} {
+		_, err := ParseHostRewrite(rule)
+		if err == nil {
+			t.Errorf("Rule %q should have been rejected", rule)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// httpAuthBearer is the username of a credential that is a bearer token.
+const httpAuthBearer = "bearer"
+
+// httpAuthSHA256Prefix starts a secret that is the hex encoded SHA-256 hash
+// of the password or token.
+const httpAuthSHA256Prefix = "sha256:"
+
+// HTTPCredential is a credential accepted by an authenticated HTTP forward.
+// Username is empty for bearer tokens. Secret is either the plaintext
+// password or token, a bcrypt hash, or a SHA-256 hash starting with sha256:.
+type HTTPCredential struct {
+	Username string
+	Secret   string
+}
+
+// ParseHTTPCredential parses a credential in the form username:secret, or
+// bearer:secret for a bearer token.
+func ParseHTTPCredential(credential string) (HTTPCredential, error) {
+	username, secret, ok := strings.Cut(strings.TrimSpace(credential), ":")
+	if !ok || username == "" || secret == "" {
+		return HTTPCredential{}, fmt.Errorf("credential must be in the form username:secret or bearer:secret")
+	}
+
+	if strings.EqualFold(username, httpAuthBearer) {
+		username = ""
+	}
+
+	if strings.HasPrefix(secret, httpAuthSHA256Prefix) {
+		hash, err := hex.DecodeString(strings.TrimPrefix(secret, httpAuthSHA256Prefix))
+		if err != nil || len(hash) != sha256.Size {
+			return HTTPCredential{}, fmt.Errorf("invalid sha256 hash")
+		}
+	}
+
+	return HTTPCredential{
+		Username: username,
+		Secret:   secret,
+	}, nil
+}
+
+// matches returns whether secret is the password or token of the credential.
+func (c HTTPCredential) matches(secret string) bool {
+	if strings.HasPrefix(c.Secret, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(c.Secret), []byte(secret)) == nil
+	}
+
+	if hash, ok := strings.CutPrefix(c.Secret, httpAuthSHA256Prefix); ok {
+		sum := sha256.Sum256([]byte(secret))
+		return subtle.ConstantTimeCompare([]byte(strings.ToLower(hash)), []byte(hex.EncodeToString(sum[:]))) == 1
+	}
+
+	return subtle.ConstantTimeCompare([]byte(c.Secret), []byte(secret)) == 1
+}
+
+// HTTPAuth is the credentials required to access a HTTP forward.
+type HTTPAuth struct {
+	Credentials []HTTPCredential
+}
+
+// Add adds a credential to the accepted credentials.
+func (a *HTTPAuth) Add(credential HTTPCredential) {
+	a.Credentials = append(a.Credentials, credential)
+}
+
+// Authorized returns whether r has the Basic or Bearer authorization of one of
+// the credentials. Every request is authorized if a is nil.
+func (a *HTTPAuth) Authorized(r *http.Request) bool {
+	if a == nil {
+		return true
+	}
+
+	username, password, basic := r.BasicAuth()
+
+	token, bearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !basic && !bearer {
+		return false
+	}
+
+	for _, credential := range a.Credentials {
+		if basic && credential.Username != "" && credential.Username == username && credential.matches(password) {
+			return true
+		}
+
+		if bearer && credential.Username == "" && credential.matches(token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Challenges returns the WWW-Authenticate challenges for the schemes of the
+// credentials.
+func (a *HTTPAuth) Challenges() []string {
+	basic := false
+	bearer := false
+
+	for _, credential := range a.Credentials {
+		basic = basic || credential.Username != ""
+		bearer = bearer || credential.Username == ""
+	}
+
+	challenges := []string{}
+
+	if basic {
+		challenges = append(challenges, `Basic realm="sish"`)
+	}
+
+	if bearer {
+		challenges = append(challenges, `Bearer realm="sish"`)
+	}
+
+	return challenges
+}
+
+// LoadHTTPAuthFile loads the credentials of HTTP forwards from a file. Each
+// line contains a host and a credential separated by whitespace. Empty lines
+// and lines starting with # are ignored.
+func LoadHTTPAuthFile(path string) (map[string]*HTTPAuth, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	auths := map[string]*HTTPAuth{}
+	scanner := bufio.NewScanner(file)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected a host and a credential", line)
+		}
+
+		credential, err := ParseHTTPCredential(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		host := strings.ToLower(fields[0])
+
+		if auths[host] == nil {
+			auths[host] = &HTTPAuth{}
+		}
+
+		auths[host].Add(credential)
+	}
+
+	return auths, scanner.Err()
+}
+
+// HTTPAuthFor returns the credentials required to access a HTTP holder: the
+// ones loaded from http-auth-file for its host and the ones set by its SSH
+// connections. It returns nil if the holder doesn't require credentials.
+func (s *State) HTTPAuthFor(holder *HTTPHolder) *HTTPAuth {
+	auth := &HTTPAuth{}
+
+	if fileAuth, ok := s.HTTPAuth[strings.ToLower(holder.HTTPUrl.Host)]; ok {
+		auth.Credentials = append(auth.Credentials, fileAuth.Credentials...)
+	}
+
+	holder.SSHConnections.Range(func(key string, sshConn *SSHConnection) bool {
+		if sshConn.HTTPAuth != nil {
+			auth.Credentials = append(auth.Credentials, sshConn.HTTPAuth.Credentials...)
+		}
+
+		return true
+	})
+
+	if len(auth.Credentials) == 0 {
+		return nil
+	}
+
+	return auth
+}
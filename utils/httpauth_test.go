@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/antoniomika/syncmap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestHTTPAuth validates Basic and Bearer credentials with plaintext, bcrypt
+// and SHA-256 secrets.
+func TestHTTPAuth(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenHash := sha256.Sum256([]byte("s3cret-token"))
+
+	auth := &HTTPAuth{}
+	for _, credential := range []string{"alice:plain", "bob:" + string(bcryptHash), "bearer:sha256:" + hex.EncodeToString(tokenHash[:])} {
+		parsed, err := ParseHTTPCredential(credential)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		auth.Add(parsed)
+	}
+
+	tests := []struct {
+		name          string
+		authorization string
+		authorized    bool
+	}{
+		{"plaintext", "Basic " + basicAuth("alice", "plain"), true},
+		{"bcrypt", "Basic " + basicAuth("bob", "hunter2"), true},
+		{"bearer", "Bearer s3cret-token", true},
+		{"wrong password", "Basic " + basicAuth("alice", "wrong"), false},
+		{"wrong user", "Basic " + basicAuth("bob", "plain"), false},
+		{"bearer as basic", "Basic " + basicAuth("bearer", "s3cret-token"), false},
+		{"wrong token", "Bearer plain", false},
+		{"missing", "", false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+
+		if auth.Authorized(req) != test.authorized {
+			t.Errorf("%s: authorized should have been %t", test.name, test.authorized)
+		}
+	}
+
+	if challenges := auth.Challenges(); len(challenges) != 2 {
+		t.Errorf("Got challenges %v when should have had Basic and Bearer", challenges)
+	}
+
+	var noAuth *HTTPAuth
+	if !noAuth.Authorized(httptest.NewRequest("GET", "/", nil)) {
+		t.Error("Requests should have been authorized without credentials")
+	}
+
+	for _, invalid := range []string{"alice", "alice:", ":secret", "bearer:sha256:abc"} {
+		_, err := ParseHTTPCredential(invalid)
+		if err == nil {
+			t.Errorf("Expected an error for credential %q", invalid)
+		}
+	}
+}
+
+// basicAuth returns the encoded credentials of a Basic authorization header.
+func basicAuth(username string, password string) string {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth(username, password)
+
+	return req.Header.Get("Authorization")[len("Basic "):]
+}
+
+// TestHTTPAuthFor validates combining the credentials from a file with the
+// ones set by the SSH connections of a HTTP holder.
+func TestHTTPAuthFor(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth")
+
+	err := os.WriteFile(path, []byte("# credentials\n\nApp.example.com alice:plain\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := NewState()
+	state.HTTPAuth, err = LoadHTTPAuthFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holder := &HTTPHolder{
+		HTTPUrl:        &url.URL{Host: "app.example.com"},
+		SSHConnections: syncmap.New[string, *SSHConnection](),
+	}
+
+	bearer, _ := ParseHTTPCredential("bearer:token")
+	holder.SSHConnections.Store("/tmp/forward", &SSHConnection{HTTPAuth: &HTTPAuth{Credentials: []HTTPCredential{bearer}}})
+
+	auth := state.HTTPAuthFor(holder)
+	if auth == nil || len(auth.Credentials) != 2 {
+		t.Fatalf("Got credentials %+v when should have had 2", auth)
+	}
+
+	other := &HTTPHolder{
+		HTTPUrl:        &url.URL{Host: "other.example.com"},
+		SSHConnections: syncmap.New[string, *SSHConnection](),
+	}
+
+	if state.HTTPAuthFor(other) != nil {
+		t.Error("Holder without credentials should not have required auth")
+	}
+
+	err = os.WriteFile(path, []byte("app.example.com\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadHTTPAuthFile(path)
+	if err == nil {
+		t.Error("Expected an error for a line without a credential")
+	}
+}
@@ -0,0 +1,158 @@
+package utils
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// TLS extensions used to build JA3 fingerprints.
+const (
+	ja3SupportedGroups = 10
+	ja3PointFormats    = 11
+)
+
+// ErrJA3Blocked is returned by PeekTLSHello when the JA3 fingerprint of the
+// hello is banned or not whitelisted.
+var ErrJA3Blocked = errors.New("tls fingerprint is not allowed")
+
+// JA3 returns the JA3 fingerprint of a TLS record holding a ClientHello: the
+// md5 of the hello's version, cipher suites, extensions, supported groups and
+// point formats in the order the client sent them, without GREASE values.
+func JA3(record []byte) (string, error) {
+	ja3, err := ja3String(record)
+	if err != nil {
+		return "", err
+	}
+
+	sum := md5.Sum([]byte(ja3))
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ja3String returns the JA3 string of a TLS record holding a ClientHello,
+// before it is hashed.
+func ja3String(record []byte) (string, error) {
+	errMalformed := fmt.Errorf("malformed tls client hello")
+
+	if len(record) < 5 {
+		return "", errMalformed
+	}
+
+	hello := cryptobyte.String(record[5:])
+
+	var messageType uint8
+	var message cryptobyte.String
+	var version uint16
+	var sessionID, suites, compression cryptobyte.String
+
+	if !hello.ReadUint8(&messageType) || messageType != 1 || !hello.ReadUint24LengthPrefixed(&message) ||
+		!message.ReadUint16(&version) || !message.Skip(32) || !message.ReadUint8LengthPrefixed(&sessionID) ||
+		!message.ReadUint16LengthPrefixed(&suites) || !message.ReadUint8LengthPrefixed(&compression) {
+		return "", errMalformed
+	}
+
+	var ciphers, extensions, groups, pointFormats []string
+
+	for !suites.Empty() {
+		var suite uint16
+		if !suites.ReadUint16(&suite) {
+			return "", errMalformed
+		}
+
+		if !isGREASE(suite) {
+			ciphers = append(ciphers, strconv.Itoa(int(suite)))
+		}
+	}
+
+	var extensionsData cryptobyte.String
+	if !message.Empty() && !message.ReadUint16LengthPrefixed(&extensionsData) {
+		return "", errMalformed
+	}
+
+	for !extensionsData.Empty() {
+		var extension uint16
+		var data cryptobyte.String
+
+		if !extensionsData.ReadUint16(&extension) || !extensionsData.ReadUint16LengthPrefixed(&data) {
+			return "", errMalformed
+		}
+
+		if isGREASE(extension) {
+			continue
+		}
+
+		extensions = append(extensions, strconv.Itoa(int(extension)))
+
+		switch extension {
+		case ja3SupportedGroups:
+			var list cryptobyte.String
+			if !data.ReadUint16LengthPrefixed(&list) {
+				return "", errMalformed
+			}
+
+			for !list.Empty() {
+				var group uint16
+				if !list.ReadUint16(&group) {
+					return "", errMalformed
+				}
+
+				if !isGREASE(group) {
+					groups = append(groups, strconv.Itoa(int(group)))
+				}
+			}
+		case ja3PointFormats:
+			var list cryptobyte.String
+			if !data.ReadUint8LengthPrefixed(&list) {
+				return "", errMalformed
+			}
+
+			for _, format := range list {
+				pointFormats = append(pointFormats, strconv.Itoa(int(format)))
+			}
+		}
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(version)),
+		strings.Join(ciphers, "-"),
+		strings.Join(extensions, "-"),
+		strings.Join(groups, "-"),
+		strings.Join(pointFormats, "-"),
+	}, ","), nil
+}
+
+// isGREASE returns whether v is a GREASE value (RFC 8701), which clients send
+// randomly and are left out of JA3 fingerprints.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// JA3Blocked returns whether TLS connections with the JA3 fingerprint are
+// dropped. Fingerprints in banned-ja3-fingerprints are blocked, and if
+// whitelisted-ja3-fingerprints is set, only those fingerprints are allowed.
+func JA3Blocked(fingerprint string) bool {
+	fingerprint = strings.ToLower(fingerprint)
+
+	if banned := viper.GetString("banned-ja3-fingerprints"); banned != "" && inList(fingerprint, strings.FieldsFunc(strings.ToLower(banned), CommaSplitFields)) {
+		return true
+	}
+
+	if whitelisted := viper.GetString("whitelisted-ja3-fingerprints"); whitelisted != "" && !inList(fingerprint, strings.FieldsFunc(strings.ToLower(whitelisted), CommaSplitFields)) {
+		return true
+	}
+
+	return false
+}
+
+// JA3FilterEnabled returns whether TLS connections are filtered by their JA3
+// fingerprint.
+func JA3FilterEnabled() bool {
+	return viper.GetString("banned-ja3-fingerprints") != "" || viper.GetString("whitelisted-ja3-fingerprints") != ""
+}
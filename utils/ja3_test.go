@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// ja3TestHello returns a TLS record holding a ClientHello with GREASE values
+// mixed into its cipher suites, extensions and groups.
+func ja3TestHello() []byte {
+	var message cryptobyte.Builder
+
+	message.AddUint16(0x0303)
+	message.AddBytes(make([]byte, 32))
+	message.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {})
+	message.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, suite := range []uint16{0x0a0a, 4865, 4866, 49195} {
+			b.AddUint16(suite)
+		}
+	})
+	message.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(0)
+	})
+	message.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint16(0x1a1a)
+		b.AddUint16(0)
+
+		b.AddUint16(0)
+		b.AddUint16(0)
+
+		b.AddUint16(ja3SupportedGroups)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+				for _, group := range []uint16{0x2a2a, 29, 23} {
+					b.AddUint16(group)
+				}
+			})
+		})
+
+		b.AddUint16(ja3PointFormats)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddUint8LengthPrefixed(func(b *cryptobyte.Builder) {
+				b.AddUint8(0)
+			})
+		})
+	})
+
+	var record cryptobyte.Builder
+
+	record.AddUint8(0x16)
+	record.AddUint16(0x0301)
+	record.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		b.AddUint8(1)
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) {
+			b.AddBytes(message.BytesOrPanic())
+		})
+	})
+
+	return record.BytesOrPanic()
+}
+
+// TestJA3 validates that JA3 strings keep the order of the hello and leave
+// out GREASE values.
+func TestJA3(t *testing.T) {
+	ja3, err := ja3String(ja3TestHello())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "771,4865-4866-49195,0-10-11,29-23,0"; ja3 != expected {
+		t.Errorf("JA3 string was %q when should have been %q", ja3, expected)
+	}
+
+	fingerprint, err := JA3(ja3TestHello())
+	if err != nil || fingerprint != "526cfb56edaf1183f21ff3c5deef718f" {
+		t.Errorf("JA3 fingerprint was %q with error %v when should have been the md5 of the JA3 string", fingerprint, err)
+	}
+
+	if _, err := JA3([]byte{0x16, 0x03, 0x01, 0x00, 0x04, 1, 0, 0, 10}); err == nil {
+		t.Error("Truncated hello should not have been fingerprinted")
+	}
+}
+
+// TestJA3Blocked validates the banned and whitelisted fingerprint lists.
+func TestJA3Blocked(t *testing.T) {
+	defer viper.Set("banned-ja3-fingerprints", nil)
+	defer viper.Set("whitelisted-ja3-fingerprints", nil)
+
+	if JA3Blocked("aaaa") || JA3FilterEnabled() {
+		t.Error("Fingerprints should not be blocked without lists")
+	}
+
+	viper.Set("banned-ja3-fingerprints", "AAAA, bbbb")
+
+	if !JA3Blocked("aaaa") || !JA3Blocked("bbbb") || JA3Blocked("cccc") {
+		t.Error("Only banned fingerprints should have been blocked")
+	}
+
+	viper.Set("banned-ja3-fingerprints", "")
+	viper.Set("whitelisted-ja3-fingerprints", "cccc")
+
+	if JA3Blocked("cccc") || !JA3Blocked("aaaa") || !JA3Blocked("") {
+		t.Error("Only whitelisted fingerprints should have been allowed")
+	}
+}
+
+// TestPeekTLSHelloJA3 validates that peeked hellos are fingerprinted and that
+// blocked fingerprints are rejected.
+func TestPeekTLSHelloJA3(t *testing.T) {
+	defer viper.Set("banned-ja3-fingerprints", nil)
+
+	peek := func() (*tls.ClientHelloInfo, *TeeConn, error) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		go func() {
+			_ = tls.Client(client, &tls.Config{ServerName: "app.example.com"}).Handshake()
+		}()
+
+		return PeekTLSHello(server)
+	}
+
+	tlsHello, teeConn, err := peek()
+	if tlsHello == nil || len(teeConn.JA3) != 32 {
+		t.Fatalf("Peeked hello %v with ja3 %q and error %v when should have been fingerprinted", tlsHello, teeConn.JA3, err)
+	}
+
+	viper.Set("banned-ja3-fingerprints", teeConn.JA3)
+
+	tlsHello, _, err = peek()
+	if tlsHello != nil || !errors.Is(err, ErrJA3Blocked) {
+		t.Errorf("Peeked hello %v with error %v when should have been blocked", tlsHello, err)
+	}
+}
@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+)
+
+const (
+	// maxLabels is the maximum number of labels a connection can have.
+	maxLabels = 16
+
+	// maxLabelKeyLength is the maximum length of a label key.
+	maxLabelKeyLength = 64
+
+	// maxLabelValueLength is the maximum length of a label value.
+	maxLabelValueLength = 256
+)
+
+// labelKeyRegex matches the characters allowed in a label key.
+var labelKeyRegex = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// ParseLabel parses a label in the form key:value.
+func ParseLabel(label string) (string, string, error) {
+	key, value, ok := strings.Cut(label, ":")
+	if !ok || key == "" {
+		return "", "", fmt.Errorf("label %q is not in the form key:value", label)
+	}
+
+	if len(key) > maxLabelKeyLength || !labelKeyRegex.MatchString(key) {
+		return "", "", fmt.Errorf("label key %q must be at most %d letters, digits, '_', '.' or '-'", key, maxLabelKeyLength)
+	}
+
+	if len(value) > maxLabelValueLength {
+		return "", "", fmt.Errorf("label value for %q is longer than %d characters", key, maxLabelValueLength)
+	}
+
+	return key, value, nil
+}
+
+// SetLabel sets a label on the connection. Labels over the limit are rejected.
+func (s *SSHConnection) SetLabel(key string, value string) error {
+	s.labelsLock.Lock()
+	defer s.labelsLock.Unlock()
+
+	if s.labels == nil {
+		s.labels = map[string]string{}
+	}
+
+	if _, ok := s.labels[key]; !ok && len(s.labels) >= maxLabels {
+		return fmt.Errorf("a connection can have at most %d labels", maxLabels)
+	}
+
+	s.labels[key] = value
+
+	return nil
+}
+
+// GetLabels returns a copy of the connection's labels.
+func (s *SSHConnection) GetLabels() map[string]string {
+	s.labelsLock.Lock()
+	defer s.labelsLock.Unlock()
+
+	return maps.Clone(s.labels)
+}
+
+// SnapshotFilter selects the connections returned by State.Snapshot.
+type SnapshotFilter func(ConnectionSnapshot) bool
+
+// LabelFilter selects connections with the label key set to value.
+func LabelFilter(key string, value string) SnapshotFilter {
+	return func(snapshot ConnectionSnapshot) bool {
+		labelValue, ok := snapshot.Labels[key]
+		return ok && labelValue == value
+	}
+}
+
+// UserFilter selects connections of the user.
+func UserFilter(user string) SnapshotFilter {
+	return func(snapshot ConnectionSnapshot) bool {
+		return snapshot.User == user
+	}
+}
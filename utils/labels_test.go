@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestParseLabel validates that labels are parsed and size-limited.
+func TestParseLabel(t *testing.T) {
+	key, value, err := ParseLabel("customer:acme:prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key != "customer" || value != "acme:prod" {
+		t.Errorf("Parsed %q: %q when should have been \"customer\": \"acme:prod\"", key, value)
+	}
+
+	for _, label := range []string{"novalue", ":value", "bad key:value", strings.Repeat("k", maxLabelKeyLength+1) + ":value", "key:" + strings.Repeat("v", maxLabelValueLength+1)} {
+		_, _, err := ParseLabel(label)
+		if err == nil {
+			t.Errorf("Label %q should have been rejected", label)
+		}
+	}
+}
+
+// TestSetLabel validates that a connection can't have more than maxLabels labels.
+func TestSetLabel(t *testing.T) {
+	sshConn := &SSHConnection{}
+
+	for i := 0; i < maxLabels; i++ {
+		err := sshConn.SetLabel(fmt.Sprintf("key%d", i), "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := sshConn.SetLabel("extra", "value")
+	if err == nil {
+		t.Error("Label over the limit should have been rejected")
+	}
+
+	err = sshConn.SetLabel("key0", "updated")
+	if err != nil {
+		t.Errorf("Existing label should have been updated: %s", err)
+	}
+
+	labels := sshConn.GetLabels()
+	labels["key1"] = "changed"
+
+	if sshConn.GetLabels()["key0"] != "updated" || sshConn.GetLabels()["key1"] != "value" {
+		t.Error("GetLabels returned the internal map")
+	}
+}
+
+// TestSnapshotFilters validates that label and user filters select matching snapshots.
+func TestSnapshotFilters(t *testing.T) {
+	snapshot := ConnectionSnapshot{
+		User:   "alice",
+		Labels: map[string]string{"customer": "acme"},
+	}
+
+	if !LabelFilter("customer", "acme")(snapshot) || LabelFilter("customer", "other")(snapshot) || LabelFilter("region", "")(snapshot) {
+		t.Error("LabelFilter selected the wrong snapshots")
+	}
+
+	if !UserFilter("alice")(snapshot) || UserFilter("bob")(snapshot) {
+		t.Error("UserFilter selected the wrong snapshots")
+	}
+}
@@ -1,7 +1,9 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"net"
 	"strings"
 
@@ -40,13 +42,55 @@ func Listen(addresses string) (net.Listener, error) {
 	return multilistener.Listen(listeners)
 }
 
-// ParseAddress parse a list of addresses into a host, port, err split.
+// ListenEach listens on each address in addresses with its own listener, so a
+// service can bind to several addresses, like an IPv4 and an IPv6 address.
+// An address that fails to bind is logged and skipped. An error is only
+// returned if none of the addresses could be bound.
+func ListenEach(addresses string) ([]net.Listener, error) {
+	listeners := []net.Listener{}
+	errs := []error{}
+
+	for _, address := range strings.Split(addresses, AddressSeparator) {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+
+		l, err := Listen(address)
+		if err != nil {
+			log.Printf("Unable to listen on %q: %s", address, err)
+			errs = append(errs, fmt.Errorf("%s: %w", address, err))
+			continue
+		}
+
+		listeners = append(listeners, l)
+	}
+
+	if len(listeners) == 0 {
+		if len(errs) == 0 {
+			return nil, fmt.Errorf("no addresses to listen on in %q", addresses)
+		}
+
+		return nil, errors.Join(errs...)
+	}
+
+	return listeners, nil
+}
+
+// ListenerClosed returns whether err was returned because the listener was
+// closed.
+func ListenerClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, multilistener.ErrClosed)
+}
+
+// ParseAddress parse a list of addresses into a host, port, err split. Only
+// the first address in the list is used.
 func ParseAddress(addresses string) (string, string, error) {
 	addressList := strings.Split(addresses, AddressSeparator)
-	addressSplit := strings.Split(addressList[0], NetworkSeparator)
+	addressSplit := strings.Split(strings.TrimSpace(addressList[0]), NetworkSeparator)
 
 	address := addressSplit[0]
-	if len(addressList) == 2 {
+	if len(addressSplit) == 2 {
 		address = addressSplit[1]
 	}
 	return net.SplitHostPort(address)
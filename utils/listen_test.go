@@ -0,0 +1,79 @@
+package utils
+
+import (
+	"net"
+	"testing"
+
+	"github.com/antoniomika/multilistener"
+)
+
+// TestListenEach validates that each address gets its own listener and that
+// an address that fails to bind doesn't stop the others.
+func TestListenEach(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+
+	listeners, err := ListenEach("127.0.0.1:0, " + taken.Addr().String() + ",127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(listeners) != 2 {
+		t.Fatalf("Got %d listeners when should have been 2", len(listeners))
+	}
+
+	for _, l := range listeners {
+		conn, err := net.Dial("tcp", l.Addr().(*multilistener.MultiListener).Addresses()[0].String())
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		accepted, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+		} else {
+			accepted.Close()
+		}
+
+		conn.Close()
+
+		err = l.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, err = l.Accept()
+		if !ListenerClosed(err) {
+			t.Errorf("Accept on a closed listener returned %v", err)
+		}
+	}
+
+	_, err = ListenEach(taken.Addr().String())
+	if err == nil {
+		t.Error("Listening only on a bound address should fail")
+	}
+}
+
+// TestParseAddress validates that the port is taken from the first address
+// in a list.
+func TestParseAddress(t *testing.T) {
+	tests := map[string]string{
+		"localhost:80":                "80",
+		"0.0.0.0:443,[::]:443":        "443",
+		"tcp://0.0.0.0:2222,[::]:22":  "2222",
+		" tcp6://[::1]:8080 ,[::]:80": "8080",
+	}
+
+	for addresses, want := range tests {
+		_, port, err := ParseAddress(addresses)
+		if err != nil {
+			t.Errorf("Error parsing %q: %s", addresses, err)
+		} else if port != want {
+			t.Errorf("Parsed port %s from %q when should have been %s", port, addresses, want)
+		}
+	}
+}
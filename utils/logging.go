@@ -0,0 +1,65 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// LogFormatText writes logs as plain text lines.
+	LogFormatText = "text"
+
+	// LogFormatJSON writes each log line as a JSON object.
+	LogFormatJSON = "json"
+)
+
+// LogFields represents structured fields attached to a log event.
+type LogFields map[string]interface{}
+
+// jsonLogLine builds a JSON log line from an event, message, and fields.
+// The ts, event, and msg fields are always set and take precedence over fields.
+func jsonLogLine(event string, message string, fields LogFields) []byte {
+	line := LogFields{}
+
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+
+		line[k] = v
+	}
+
+	line["ts"] = time.Now().Format(time.RFC3339Nano)
+	line["event"] = event
+	line["msg"] = message
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		data, _ = json.Marshal(LogFields{
+			"ts":    line["ts"],
+			"event": event,
+			"msg":   message,
+		})
+	}
+
+	return append(data, '\n')
+}
+
+// LogEvent logs a structured event. When log-format is json, the event is
+// written as a JSON object containing the fields. Otherwise, v is logged the
+// same way as log.Println.
+func LogEvent(event string, fields LogFields, v ...interface{}) {
+	if viper.GetString("log-format") != LogFormatJSON {
+		log.Println(v...)
+		return
+	}
+
+	message := strings.TrimSuffix(fmt.Sprintln(v...), "\n")
+
+	log.Print(string(jsonLogLine(event, message, fields)))
+}
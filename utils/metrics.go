@@ -0,0 +1,160 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// metricsListenerTypes are the tunnel types reported with a type label.
+var metricsListenerTypes = []ListenerType{HTTPListener, TCPListener, AliasListener, UDPListener}
+
+// String returns the name of the listener type used in logs and metrics.
+func (l ListenerType) String() string {
+	switch l {
+	case AliasListener:
+		return "alias"
+	case HTTPListener:
+		return "http"
+	case TCPListener:
+		return "tcp"
+	case UDPListener:
+		return "udp"
+	case ProcessListener:
+		return "process"
+	}
+
+	return "unknown"
+}
+
+// Metrics holds the counters exposed on the metrics endpoint. Gauges are
+// computed from the State when the metrics are requested.
+type Metrics struct {
+	connectionsOpened atomic.Uint64
+	connectionsClosed atomic.Uint64
+	forwardsCreated   [ProcessListener + 1]atomic.Uint64
+	forwardErrors     [ProcessListener + 1]atomic.Uint64
+}
+
+// ConnectionOpened counts a new SSH connection.
+func (m *Metrics) ConnectionOpened() {
+	m.connectionsOpened.Add(1)
+}
+
+// ConnectionClosed counts a closed SSH connection.
+func (m *Metrics) ConnectionClosed() {
+	m.connectionsClosed.Add(1)
+}
+
+// ForwardCreated counts a forward of listenerType that was set up.
+func (m *Metrics) ForwardCreated(listenerType ListenerType) {
+	m.forwardsCreated[listenerType].Add(1)
+}
+
+// ForwardError counts a forward of listenerType that could not be set up.
+func (m *Metrics) ForwardError(listenerType ListenerType) {
+	m.forwardErrors[listenerType].Add(1)
+}
+
+// WriteMetrics writes the current metrics in the Prometheus text format.
+func (s *State) WriteMetrics(w io.Writer) error {
+	var bytesIn, bytesOut uint64
+	listeners := map[ListenerType]int{}
+
+	snapshot := s.Snapshot()
+	for _, conn := range snapshot {
+		bytesIn += conn.BytesIn
+		bytesOut += conn.BytesOut
+	}
+
+	s.SSHConnections.Range(func(key string, sshConn *SSHConnection) bool {
+		sshConn.Listeners.Range(func(name string, listener net.Listener) bool {
+			if holder, ok := listener.(*ListenerHolder); ok {
+				listeners[holder.Type]++
+			}
+			return true
+		})
+		return true
+	})
+
+	stalls := map[string]StallInfo{}
+
+	s.SSHConnections.Range(func(key string, sshConn *SSHConnection) bool {
+		for direction, info := range sshConn.Stalls() {
+			total := stalls[direction]
+			total.Read += info.Read
+			total.Write += info.Write
+			stalls[direction] = total
+		}
+		return true
+	})
+
+	metrics := []struct {
+		name       string
+		help       string
+		metricType string
+		value      func(ListenerType) uint64
+		byType     bool
+	}{
+		{"sish_connections", "Number of active SSH connections.", "gauge", func(ListenerType) uint64 { return uint64(len(snapshot)) }, false},
+		{"sish_connection_bytes_in", "Bytes received from SSH clients by active connections.", "gauge", func(ListenerType) uint64 { return bytesIn }, false},
+		{"sish_connection_bytes_out", "Bytes sent to SSH clients by active connections.", "gauge", func(ListenerType) uint64 { return bytesOut }, false},
+		{"sish_listeners", "Number of active forwards.", "gauge", func(l ListenerType) uint64 { return uint64(listeners[l]) }, true},
+		{"sish_connections_opened_total", "Total number of SSH connections opened.", "counter", func(ListenerType) uint64 { return s.Metrics.connectionsOpened.Load() }, false},
+		{"sish_connections_closed_total", "Total number of SSH connections closed.", "counter", func(ListenerType) uint64 { return s.Metrics.connectionsClosed.Load() }, false},
+		{"sish_forwards_created_total", "Total number of forwards created.", "counter", func(l ListenerType) uint64 { return s.Metrics.forwardsCreated[l].Load() }, true},
+		{"sish_forward_errors_total", "Total number of forwards that could not be created.", "counter", func(l ListenerType) uint64 { return s.Metrics.forwardErrors[l].Load() }, true},
+	}
+
+	for _, metric := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.metricType)
+		if err != nil {
+			return err
+		}
+
+		if !metric.byType {
+			_, err = fmt.Fprintf(w, "%s %d\n", metric.name, metric.value(0))
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		for _, listenerType := range metricsListenerTypes {
+			_, err = fmt.Fprintf(w, "%s{type=%q} %d\n", metric.name, listenerType, metric.value(listenerType))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(w, "# HELP sish_connection_stall_seconds Estimated time the forwards of active connections spent blocked reading and writing.\n# TYPE sish_connection_stall_seconds gauge\n")
+	if err != nil {
+		return err
+	}
+
+	for _, direction := range []string{StallFromClient, StallToClient} {
+		_, err = fmt.Fprintf(w, "sish_connection_stall_seconds{direction=%q,op=\"read\"} %g\nsish_connection_stall_seconds{direction=%q,op=\"write\"} %g\n", direction, stalls[direction].Read.Seconds(), direction, stalls[direction].Write.Seconds())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MetricsHandler returns a http.Handler that serves the metrics of the State.
+func (s *State) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		err := s.WriteMetrics(w)
+		if err != nil {
+			log.Println("Error writing metrics:", err)
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// TestWriteMetrics validates that counters are written with their type labels.
+func TestWriteMetrics(t *testing.T) {
+	state := NewState()
+	state.Metrics.ConnectionOpened()
+	state.Metrics.ForwardCreated(TCPListener)
+	state.Metrics.ForwardError(HTTPListener)
+
+	buf := &bytes.Buffer{}
+
+	err := state.WriteMetrics(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		"# TYPE sish_connections gauge",
+		"sish_connections 0",
+		"sish_connections_opened_total 1",
+		`sish_forwards_created_total{type="tcp"} 1`,
+		`sish_forwards_created_total{type="http"} 0`,
+		`sish_forward_errors_total{type="http"} 1`,
+		`sish_listeners{type="alias"} 0`,
+		`sish_connection_stall_seconds{direction="to_client",op="write"} 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Metrics are missing %q:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,363 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/spf13/viper"
+)
+
+// Protocol is the protocol of a connection detected by SniffProtocol.
+type Protocol int
+
+const (
+	// ProtocolTCP is a connection that is neither HTTP nor TLS, or that sent
+	// nothing before the sniff timeout.
+	ProtocolTCP Protocol = iota
+
+	// ProtocolHTTP is a connection that starts with a HTTP request line.
+	ProtocolHTTP
+
+	// ProtocolTLS is a connection that starts with a TLS ClientHello.
+	ProtocolTLS
+)
+
+// String returns the name of the protocol.
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolHTTP:
+		return "http"
+	case ProtocolTLS:
+		return "tls"
+	default:
+		return "tcp"
+	}
+}
+
+// httpMethods are the methods SniffProtocol recognizes at the start of a HTTP
+// request line. PRI starts the HTTP/2 connection preface.
+var httpMethods = [][]byte{
+	[]byte("GET "),
+	[]byte("HEAD "),
+	[]byte("POST "),
+	[]byte("PUT "),
+	[]byte("DELETE "),
+	[]byte("CONNECT "),
+	[]byte("OPTIONS "),
+	[]byte("TRACE "),
+	[]byte("PATCH "),
+	[]byte("PRI "),
+}
+
+// matchHTTPMethod returns whether data could be the start of a HTTP request
+// line, and whether it contains a whole method followed by a space.
+func matchHTTPMethod(data []byte) (bool, bool) {
+	partial := false
+
+	for _, method := range httpMethods {
+		if bytes.HasPrefix(data, method) {
+			return true, true
+		}
+
+		if len(data) < len(method) && bytes.HasPrefix(method, data) {
+			partial = true
+		}
+	}
+
+	return partial, false
+}
+
+// SniffProtocol peeks the first bytes sent on conn to detect whether it is a
+// TLS, HTTP or raw TCP connection. The returned connection replays the peeked
+// bytes. Connections that send nothing within timeout are treated as raw TCP,
+// for protocols where the server speaks first. TLS hellos must also be sent
+// within timeout, unless tls-peek-timeout is set. A timeout of 0 waits
+// indefinitely.
+func SniffProtocol(conn net.Conn, timeout time.Duration) (Protocol, net.Conn, error) {
+	teeConn := NewTeeConn(conn)
+
+	if timeout > 0 {
+		err := conn.SetReadDeadline(time.Now().Add(timeout))
+		if err != nil && viper.GetBool("debug") {
+			log.Println("Unable to set protocol sniff read deadline:", err)
+		}
+
+		defer func() {
+			err := conn.SetReadDeadline(time.Time{})
+			if err != nil && viper.GetBool("debug") {
+				log.Println("Unable to clear protocol sniff read deadline:", err)
+			}
+		}()
+	}
+
+	protocol, err := sniffProtocol(teeConn)
+
+	teeConn.Unbuffer = true
+
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return ProtocolTCP, teeConn, nil
+	}
+
+	if err != nil {
+		return protocol, teeConn, err
+	}
+
+	if protocol != ProtocolTLS {
+		return protocol, teeConn, nil
+	}
+
+	tlsHello, tlsConn, err := PeekTLSHello(teeConn)
+	if errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, ErrJA3Blocked) {
+		return ProtocolTLS, tlsConn, err
+	}
+
+	if tlsHello == nil {
+		return ProtocolTCP, tlsConn, nil
+	}
+
+	return ProtocolTLS, tlsConn, nil
+}
+
+// sniffProtocol detects the protocol from the bytes buffered by teeConn,
+// reading more until the protocol is known.
+func sniffProtocol(teeConn *TeeConn) (Protocol, error) {
+	for n := 1; ; n++ {
+		data, err := teeConn.Buffer.Peek(n)
+		if err != nil {
+			return ProtocolTCP, err
+		}
+
+		if data[0] == 0x16 {
+			return ProtocolTLS, nil
+		}
+
+		partial, complete := matchHTTPMethod(data)
+		if complete {
+			return ProtocolHTTP, nil
+		}
+
+		if !partial {
+			return ProtocolTCP, nil
+		}
+	}
+}
+
+// ConnListener is a net.Listener that accepts the connections handed to it
+// with Deliver.
+type ConnListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewConnListener returns a new ConnListener with the address addr.
+func NewConnListener(addr net.Addr) *ConnListener {
+	return &ConnListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept waits for a connection to be delivered.
+func (l *ConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the listener. Connections that are being delivered are
+// rejected.
+func (l *ConnListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+	})
+
+	return nil
+}
+
+// Addr returns the address of the listener.
+func (l *ConnListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Deliver waits for conn to be accepted. It returns false if the listener
+// is closed first.
+func (l *ConnListener) Deliver(conn net.Conn) bool {
+	select {
+	case l.conns <- conn:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+// Closed returns whether the listener has been closed.
+func (l *ConnListener) Closed() bool {
+	select {
+	case <-l.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// MultiProtocolMux listens on multiprotocol-port and routes each connection
+// by its protocol. HTTP connections are accepted by HTTP, TLS connections by
+// HTTPS and other connections by the TCP forward bound to the port.
+type MultiProtocolMux struct {
+	Listener net.Listener
+	Port     uint32
+	HTTP     *ConnListener
+
+	// HTTPS is nil if https is disabled, in which case TLS connections
+	// are routed as raw TCP.
+	HTTPS *ConnListener
+
+	tcp atomic.Pointer[ConnListener]
+}
+
+// NewMultiProtocolMux listens on port of each address in addresses. If
+// https is false, TLS connections are routed as raw TCP.
+func NewMultiProtocolMux(addresses string, port uint32, https bool) (*MultiProtocolMux, error) {
+	lis, err := Listen(GenerateAddress(addresses, port))
+	if err != nil {
+		return nil, err
+	}
+
+	var l net.Listener = lis
+
+	if viper.GetBool("proxy-protocol-listener") {
+		ln := &proxyproto.Listener{
+			Listener: lis,
+		}
+
+		LoadProxyProtoConfig(ln)
+		l = ln
+	}
+
+	m := &MultiProtocolMux{
+		Listener: l,
+		Port:     port,
+		HTTP:     NewConnListener(l.Addr()),
+	}
+
+	if https {
+		m.HTTPS = NewConnListener(l.Addr())
+	}
+
+	return m, nil
+}
+
+// TCPListener returns the listener for raw TCP connections if port is the
+// multiprotocol port, or nil otherwise. A new listener is returned once the
+// previous one has been closed.
+func (m *MultiProtocolMux) TCPListener(port uint32) *ConnListener {
+	if m == nil || port != m.Port {
+		return nil
+	}
+
+	for {
+		current := m.tcp.Load()
+		if current != nil && !current.Closed() {
+			return current
+		}
+
+		l := NewConnListener(m.Listener.Addr())
+		if m.tcp.CompareAndSwap(current, l) {
+			return l
+		}
+	}
+}
+
+// ServesPort returns whether port is the multiprotocol port.
+func (m *MultiProtocolMux) ServesPort(port uint32) bool {
+	return m != nil && port == m.Port
+}
+
+// Serve accepts connections until the listener is closed.
+func (m *MultiProtocolMux) Serve(state *State) {
+	for {
+		cl, err := m.Listener.Accept()
+		if err != nil {
+			if !ListenerClosed(err) {
+				log.Println("Error accepting multiprotocol connection:", err)
+			}
+			break
+		}
+
+		go m.handle(cl, state)
+	}
+}
+
+// handle detects the protocol of a connection and hands it to its listener.
+func (m *MultiProtocolMux) handle(cl net.Conn, state *State) {
+	clientRemote, _, err := net.SplitHostPort(cl.RemoteAddr().String())
+	if err != nil || state.IPFilter.Blocked(clientRemote) || state.GeoIPFilter.Blocked(clientRemote) {
+		err := cl.Close()
+		if err != nil {
+			log.Printf("Unable to close connection: %s", err)
+		}
+
+		if viper.GetBool("debug") {
+			log.Printf("Blocked connection from %s to %s", LogAddr(cl.RemoteAddr()), cl.LocalAddr().String())
+		}
+
+		return
+	}
+
+	protocol, conn, err := SniffProtocol(cl, viper.GetDuration("multiprotocol-sniff-timeout"))
+	if err != nil {
+		err := cl.Close()
+		if err != nil {
+			log.Printf("Unable to close connection: %s", err)
+		}
+
+		if viper.GetBool("debug") {
+			log.Printf("Unable to detect protocol of connection from %s: %s", LogAddr(cl.RemoteAddr()), err)
+		}
+
+		return
+	}
+
+	var target *ConnListener
+
+	switch protocol {
+	case ProtocolHTTP:
+		target = m.HTTP
+	case ProtocolTLS:
+		target = m.HTTPS
+	}
+
+	if target == nil {
+		target = m.tcp.Load()
+	}
+
+	if target == nil || !target.Deliver(conn) {
+		err := conn.Close()
+		if err != nil {
+			log.Printf("Unable to close connection: %s", err)
+		}
+
+		if viper.GetBool("debug") {
+			log.Printf("No forward for %s connection from %s", protocol, LogAddr(cl.RemoteAddr()))
+		}
+
+		return
+	}
+
+	if viper.GetBool("debug") {
+		log.Printf("Routed %s connection from %s", protocol, LogAddr(cl.RemoteAddr()))
+	}
+}
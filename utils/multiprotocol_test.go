@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// sniff writes data to a connection, or starts a TLS handshake if
+// tlsHandshake is true, and returns the protocol SniffProtocol detected with
+// the bytes it replays. Only the record header of TLS hellos is returned.
+func sniff(t *testing.T, data []byte, tlsHandshake bool) (Protocol, []byte) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	go func() {
+		if tlsHandshake {
+			_ = tls.Client(client, &tls.Config{ServerName: "app.example.com"}).Handshake()
+			return
+		}
+
+		_, _ = client.Write(data)
+	}()
+
+	protocol, conn, err := SniffProtocol(server, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tlsHandshake {
+		header := make([]byte, 5)
+
+		_, err := io.ReadFull(conn, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return protocol, header
+	}
+
+	replayed := make([]byte, len(data))
+
+	_, err = io.ReadFull(conn, replayed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return protocol, replayed
+}
+
+// TestSniffProtocol validates that TLS, HTTP and raw TCP connections are
+// detected, and that the peeked bytes are replayed.
+func TestSniffProtocol(t *testing.T) {
+	for name, test := range map[string]struct {
+		data     string
+		protocol Protocol
+	}{
+		"http":        {data: "GET / HTTP/1.1\r\nHost: app.example.com\r\n\r\n", protocol: ProtocolHTTP},
+		"http2":       {data: "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n", protocol: ProtocolHTTP},
+		"lowercase":   {data: "get / HTTP/1.1\r\n\r\n", protocol: ProtocolTCP},
+		"method-like": {data: "GETX\r\n", protocol: ProtocolTCP},
+		"raw":         {data: "\x00\x01binary", protocol: ProtocolTCP},
+		"partial":     {data: "POS", protocol: ProtocolTCP},
+		"not-tls":     {data: "\x16\x03\x01\x00\x04abcd", protocol: ProtocolTCP},
+	} {
+		protocol, replayed := sniff(t, []byte(test.data), false)
+		if protocol != test.protocol || string(replayed) != test.data {
+			t.Errorf("Sniffed %s as %s replaying %q when should have been %s replaying %q", name, protocol, replayed, test.protocol, test.data)
+		}
+	}
+
+	protocol, header := sniff(t, nil, true)
+	if protocol != ProtocolTLS || header[0] != 0x16 {
+		t.Errorf("Sniffed TLS hello as %s replaying %x when should have been tls replaying the hello", protocol, header)
+	}
+}
+
+// TestSniffProtocolSilent validates that connections that send nothing are
+// treated as raw TCP once the sniff timeout passes.
+func TestSniffProtocolSilent(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	protocol, conn, err := SniffProtocol(server, 50*time.Millisecond)
+	if err != nil || protocol != ProtocolTCP {
+		t.Fatalf("Sniffed silent connection as %s with error %v when should have been tcp", protocol, err)
+	}
+
+	go func() {
+		_, _ = client.Write([]byte("hello"))
+	}()
+
+	data := make([]byte, 5)
+
+	_, err = io.ReadFull(conn, data)
+	if err != nil || string(data) != "hello" {
+		t.Errorf("Read %q with error %v after the sniff timeout when should have been \"hello\"", data, err)
+	}
+}
+
+// TestConnListener validates that delivered connections are accepted and
+// that closed listeners reject them.
+func TestConnListener(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	l := NewConnListener(nil)
+
+	go func() {
+		if !l.Deliver(server) {
+			t.Error("Connection should have been delivered")
+		}
+	}()
+
+	conn, err := l.Accept()
+	if err != nil || conn != server {
+		t.Fatalf("Accepted %v with error %v when should have been the delivered connection", conn, err)
+	}
+
+	l.Close()
+
+	if l.Deliver(server) || !l.Closed() {
+		t.Error("Closed listener should have rejected the connection")
+	}
+
+	if _, err := l.Accept(); !ListenerClosed(err) {
+		t.Errorf("Accept returned %v when should have been closed", err)
+	}
+
+	m := &MultiProtocolMux{Listener: l, Port: 7000}
+
+	tcp := m.TCPListener(7000)
+	if tcp == nil || m.TCPListener(7000) != tcp || m.TCPListener(7001) != nil {
+		t.Fatal("Only the multiprotocol port should have a TCP listener, and it should be reused")
+	}
+
+	tcp.Close()
+
+	if next := m.TCPListener(7000); next == tcp || next.Closed() {
+		t.Error("A new TCP listener should have replaced the closed one")
+	}
+}
+
+// TestSniffProtocolJA3Blocked validates that TLS hellos with a blocked JA3
+// fingerprint are reported instead of being treated as raw TCP.
+func TestSniffProtocolJA3Blocked(t *testing.T) {
+	defer viper.Set("banned-ja3-fingerprints", nil)
+
+	sniffHello := func() (Protocol, net.Conn, error) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		go func() {
+			_ = tls.Client(client, &tls.Config{ServerName: "app.example.com"}).Handshake()
+		}()
+
+		return SniffProtocol(server, 100*time.Millisecond)
+	}
+
+	_, conn, err := sniffHello()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	viper.Set("banned-ja3-fingerprints", conn.(*TeeConn).JA3)
+
+	protocol, _, err := sniffHello()
+	if !errors.Is(err, ErrJA3Blocked) {
+		t.Errorf("Sniffed blocked hello as %s with error %v when should have been blocked", protocol, err)
+	}
+}
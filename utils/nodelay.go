@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"log"
+	"net"
+
+	"github.com/spf13/viper"
+)
+
+// TCPNoDelay returns whether or not Nagle's algorithm is disabled on the
+// connection's forwarded TCP connections. A value set by the connection takes
+// precedence over tcp-nodelay. It returns tcp-nodelay if s is nil.
+func (s *SSHConnection) TCPNoDelay() bool {
+	if s != nil && s.NoDelay != nil {
+		return *s.NoDelay
+	}
+
+	return viper.GetBool("tcp-nodelay")
+}
+
+// SetNoDelay disables Nagle's algorithm on conn if noDelay is true and
+// enables it otherwise, unwrapping conn until the underlying TCP connection
+// is found. Connections that aren't TCP, like unix sockets, are left as is.
+func SetNoDelay(conn net.Conn, noDelay bool) error {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c.SetNoDelay(noDelay)
+		case *TeeConn:
+			conn = c.Conn
+		case interface{ Raw() net.Conn }:
+			conn = c.Raw()
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// ApplyNoDelay sets Nagle's algorithm on a forwarded TCP connection for
+// sshConn and logs if it can't be set.
+func ApplyNoDelay(conn net.Conn, sshConn *SSHConnection) {
+	err := SetNoDelay(conn, sshConn.TCPNoDelay())
+	if err != nil && viper.GetBool("debug") {
+		log.Println("Unable to set tcp nodelay on forwarded connection:", err)
+	}
+}
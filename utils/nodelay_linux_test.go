@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/spf13/viper"
+)
+
+// socketNoDelay returns whether or not TCP_NODELAY is set on conn.
+func socketNoDelay(t *testing.T, conn *net.TCPConn) bool {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	noDelay := 0
+	var sockErr error
+
+	err = rawConn.Control(func(fd uintptr) {
+		noDelay, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+
+	return noDelay != 0
+}
+
+// TestSetNoDelay validates that Nagle's algorithm is set on the socket of
+// wrapped connections, that non-TCP connections are left as is, and that a
+// connection's setting overrides tcp-nodelay.
+func TestSetNoDelay(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	wrapped := &TeeConn{Conn: proxyproto.NewConn(server)}
+
+	for _, noDelay := range []bool{false, true} {
+		err = SetNoDelay(wrapped, noDelay)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if socketNoDelay(t, server.(*net.TCPConn)) != noDelay {
+			t.Errorf("Socket nodelay should have been %t", noDelay)
+		}
+	}
+
+	pipeServer, pipeClient := net.Pipe()
+	defer pipeServer.Close()
+	defer pipeClient.Close()
+
+	if err := SetNoDelay(pipeServer, true); err != nil {
+		t.Errorf("Non-TCP connection returned %v", err)
+	}
+
+	viper.Set("tcp-nodelay", true)
+	defer viper.Set("tcp-nodelay", nil)
+
+	disabled := false
+
+	var nilConn *SSHConnection
+	if !nilConn.TCPNoDelay() || !(&SSHConnection{}).TCPNoDelay() || (&SSHConnection{NoDelay: &disabled}).TCPNoDelay() {
+		t.Error("Connection nodelay setting should override tcp-nodelay")
+	}
+}
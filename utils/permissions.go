@@ -0,0 +1,242 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// keyPermissionsExtension is the ssh.Permissions extension that holds a
+// key's permissions after authentication.
+const keyPermissionsExtension = "keyPermissions"
+
+// KeyPermissions represents the limits attached to a public key. They are
+// loaded from authorized_keys style options in authentication-keys-directory:
+//
+//	allowed-ports="8000-8100",allowed-subdomains="app,api",allowed-server-names="*.example.com",max-bandwidth="1048576" ssh-ed25519 AAAA...
+//
+// Limits that are not set use the global settings. wildcard-subdomains
+// reserves wildcard hosts for the key, see WildcardScopes. priority sets the
+// class of the key's connections when max-bandwidth-total is shared, see
+// PriorityBucket.
+type KeyPermissions struct {
+	AllowedPorts       string   `json:"allowed_ports,omitempty"`
+	AllowedSubdomains  []string `json:"allowed_subdomains,omitempty"`
+	AllowedServerNames []string `json:"allowed_server_names,omitempty"`
+	WildcardSubdomains []string `json:"wildcard_subdomains,omitempty"`
+	MaxBandwidth       int64    `json:"max_bandwidth,omitempty"`
+	Priority           int      `json:"priority,omitempty"`
+}
+
+// ParseKeyPermissions parses the options of an authorized key. It returns nil
+// if none of the options set a permission.
+func ParseKeyPermissions(options []string) (*KeyPermissions, error) {
+	permissions := &KeyPermissions{}
+	found := false
+
+	for _, option := range options {
+		name, value, ok := strings.Cut(option, "=")
+		if !ok {
+			continue
+		}
+
+		value = strings.Trim(value, "\"")
+
+		switch strings.ToLower(name) {
+		case "allowed-ports":
+			for _, r := range strings.FieldsFunc(value, CommaSplitFields) {
+				for _, end := range strings.Split(strings.TrimSpace(r), "-") {
+					_, err := strconv.ParseUint(end, 0, 16)
+					if err != nil {
+						return nil, fmt.Errorf("invalid allowed-ports %q: %w", value, err)
+					}
+				}
+			}
+
+			permissions.AllowedPorts = value
+			found = true
+		case "allowed-subdomains":
+			for _, subdomain := range strings.FieldsFunc(value, CommaSplitFields) {
+				permissions.AllowedSubdomains = append(permissions.AllowedSubdomains, strings.ToLower(strings.TrimSpace(subdomain)))
+			}
+
+			found = true
+		case "allowed-server-names":
+			for _, serverName := range strings.FieldsFunc(value, CommaSplitFields) {
+				permissions.AllowedServerNames = append(permissions.AllowedServerNames, strings.ToLower(strings.TrimSpace(serverName)))
+			}
+
+			found = true
+		case "wildcard-subdomains":
+			for _, wildcard := range strings.FieldsFunc(value, CommaSplitFields) {
+				wildcard = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(wildcard)), wildcardPrefix)
+				if wildcard == "" || strings.ContainsAny(wildcard, "*/:") {
+					return nil, fmt.Errorf("invalid wildcard-subdomains %q", value)
+				}
+
+				permissions.WildcardSubdomains = append(permissions.WildcardSubdomains, wildcard)
+			}
+
+			found = true
+		case "max-bandwidth":
+			bandwidth, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || bandwidth < 1 {
+				return nil, fmt.Errorf("invalid max-bandwidth %q", value)
+			}
+
+			permissions.MaxBandwidth = bandwidth
+			found = true
+		case "priority":
+			priority, err := strconv.Atoi(value)
+			if err != nil || priority < 0 {
+				return nil, fmt.Errorf("invalid priority %q", value)
+			}
+
+			permissions.Priority = priority
+			found = true
+		}
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	return permissions, nil
+}
+
+// SubdomainAllowed returns whether a HTTP host can be bound. Allowed subdomains
+// can be full hosts, subdomains of the sish domain, or wildcards. Hosts in the
+// key's wildcard scopes are always allowed.
+func (p *KeyPermissions) SubdomainAllowed(host string) bool {
+	if p == nil {
+		return true
+	}
+
+	return hostAllowed(host, p.AllowedSubdomains) || p.HoldsWildcard(host)
+}
+
+// WildcardScopes returns the wildcard hosts reserved for the key, like
+// *.myapp.example.com. Only the key can bind them or any host they match, and
+// it can bind them even if bind-wildcards is disabled. Wildcard subdomains
+// without a dot are subdomains of the sish domain.
+func (p *KeyPermissions) WildcardScopes() []string {
+	if p == nil {
+		return nil
+	}
+
+	scopes := make([]string, 0, len(p.WildcardSubdomains))
+
+	for _, wildcard := range p.WildcardSubdomains {
+		if !strings.Contains(wildcard, ".") {
+			wildcard = fmt.Sprintf("%s.%s", wildcard, viper.GetString("domain"))
+		}
+
+		scopes = append(scopes, wildcardPrefix+wildcard)
+	}
+
+	return scopes
+}
+
+// HoldsWildcard returns whether host is one of the key's wildcard scopes, or a
+// host that one of them matches.
+func (p *KeyPermissions) HoldsWildcard(host string) bool {
+	host = strings.ToLower(host)
+
+	for _, scope := range p.WildcardScopes() {
+		if host == scope || MatchesWildcardHost(host, scope) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// wildcardReservedByOther returns whether host is reserved by the wildcard
+// scope of a key other than the connection's.
+func wildcardReservedByOther(sshConn *SSHConnection, host string) bool {
+	if sshConn.KeyPermissions.HoldsWildcard(host) {
+		return false
+	}
+
+	holderLock.Lock()
+	defer holderLock.Unlock()
+
+	for _, permissions := range keyPermissionsHolder {
+		if permissions.HoldsWildcard(host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ServerNameAllowed returns whether a TLS server name can be claimed by a SNI
+// proxy, or routed to one. Allowed server names are matched the same way as
+// allowed subdomains.
+func (p *KeyPermissions) ServerNameAllowed(serverName string) bool {
+	if p == nil {
+		return true
+	}
+
+	return hostAllowed(serverName, p.AllowedServerNames)
+}
+
+// hostAllowed returns whether host matches one of the allowed hosts. Allowed
+// hosts can be full hosts, subdomains of the sish domain, or wildcards. Any
+// host is allowed if the list is empty.
+func hostAllowed(host string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(host)
+
+	for _, allowedHost := range allowed {
+		if host == allowedHost || host == fmt.Sprintf("%s.%s", allowedHost, viper.GetString("domain")) || MatchesWildcardHost(host, allowedHost) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addPermissionsExtension stores key permissions on the permissions returned
+// from the public key callback.
+func addPermissionsExtension(sshPermissions *ssh.Permissions, permissions *KeyPermissions) {
+	if permissions == nil {
+		return
+	}
+
+	data, err := json.Marshal(permissions)
+	if err != nil {
+		return
+	}
+
+	sshPermissions.Extensions[keyPermissionsExtension] = string(data)
+}
+
+// KeyPermissionsFromSSH returns the key permissions stored by the public key
+// callback, or nil if the key has none.
+func KeyPermissionsFromSSH(sshPermissions *ssh.Permissions) *KeyPermissions {
+	if sshPermissions == nil {
+		return nil
+	}
+
+	data, ok := sshPermissions.Extensions[keyPermissionsExtension]
+	if !ok {
+		return nil
+	}
+
+	permissions := &KeyPermissions{}
+
+	err := json.Unmarshal([]byte(data), permissions)
+	if err != nil {
+		return nil
+	}
+
+	return permissions
+}
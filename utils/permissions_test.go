@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/antoniomika/syncmap"
+	"github.com/spf13/viper"
+)
+
+// TestParseKeyPermissions validates parsing permissions from authorized key options.
+func TestParseKeyPermissions(t *testing.T) {
+	permissions, err := ParseKeyPermissions([]string{`allowed-ports="8000-8100,9000"`, `allowed-subdomains="App,api"`, `max-bandwidth="1024"`, "no-pty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if permissions.AllowedPorts != "8000-8100,9000" || permissions.MaxBandwidth != 1024 || len(permissions.AllowedSubdomains) != 2 {
+		t.Errorf("Unexpected permissions: %+v", permissions)
+	}
+
+	viper.Set("domain", "example.com")
+	defer viper.Set("domain", "")
+
+	for host, allowed := range map[string]bool{
+		"app.example.com":   true,
+		"api.example.com":   true,
+		"other.example.com": false,
+	} {
+		if permissions.SubdomainAllowed(host) != allowed {
+			t.Errorf("SubdomainAllowed(%s) should have been %t", host, allowed)
+		}
+	}
+
+	permissions, err = ParseKeyPermissions([]string{"no-pty"})
+	if err != nil || permissions != nil {
+		t.Errorf("Expected no permissions, got %+v and error %v", permissions, err)
+	}
+
+	if !permissions.SubdomainAllowed("any.example.com") {
+		t.Error("Expected any subdomain to be allowed without permissions")
+	}
+
+	_, err = ParseKeyPermissions([]string{`allowed-ports="http"`})
+	if err == nil {
+		t.Error("Expected an error for invalid allowed-ports")
+	}
+
+	permissions, err = ParseKeyPermissions([]string{`priority="2"`})
+	if err != nil || permissions.Priority != 2 {
+		t.Errorf("Expected priority 2, got %+v and error %v", permissions, err)
+	}
+
+	_, err = ParseKeyPermissions([]string{`priority="-1"`})
+	if err == nil {
+		t.Error("Expected an error for invalid priority")
+	}
+}
+
+// TestServerNameAllowed validates matching TLS server names against the
+// allowed server names of a key.
+func TestServerNameAllowed(t *testing.T) {
+	permissions, err := ParseKeyPermissions([]string{`allowed-server-names="db.example.org,*.Tenant.example.org"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for serverName, allowed := range map[string]bool{
+		"db.example.org":         true,
+		"a.tenant.example.org":   true,
+		"*.tenant.example.org":   true,
+		"a.b.tenant.example.org": true,
+		"tenant.example.org":     false,
+		"other.example.org":      false,
+	} {
+		if permissions.ServerNameAllowed(serverName) != allowed {
+			t.Errorf("ServerNameAllowed(%s) should have been %t", serverName, allowed)
+		}
+	}
+
+	if !permissions.SubdomainAllowed("any.example.org") {
+		t.Error("Expected any subdomain to be allowed without allowed subdomains")
+	}
+
+	tH := &TCPHolder{SSHConnections: syncmap.New[string, *SSHConnection]()}
+	tH.SSHConnections.Store("/tmp/forward", &SSHConnection{KeyPermissions: permissions})
+
+	if !tH.ServerNameAllowed("/tmp/forward", "a.tenant.example.org") || tH.ServerNameAllowed("/tmp/forward", "other.example.org") {
+		t.Error("Server names should have been checked against the key of the forward")
+	}
+
+	if tH.ServerNameAllowed("/tmp/missing", "db.example.org") {
+		t.Error("Server names should not have been allowed for a missing forward")
+	}
+}
+
+// TestWildcardSubdomains validates that a key's wildcard scopes can only be
+// bound by the key, even when wildcards can't otherwise be bound.
+func TestWildcardSubdomains(t *testing.T) {
+	viper.Set("domain", "example.com")
+	viper.Set("bind-random-subdomains", false)
+	defer viper.Set("domain", "")
+	defer viper.Set("bind-random-subdomains", nil)
+
+	permissions, err := ParseKeyPermissions([]string{`allowed-subdomains="app"`, `wildcard-subdomains="*.MyApp,tenants.example.org"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scopes := permissions.WildcardScopes()
+	if len(scopes) != 2 || scopes[0] != "*.myapp.example.com" || scopes[1] != "*.tenants.example.org" {
+		t.Errorf("Wildcard scopes %v when should have been *.myapp.example.com and *.tenants.example.org", scopes)
+	}
+
+	for host, allowed := range map[string]bool{
+		"app.example.com":       true,
+		"*.myapp.example.com":   true,
+		"a.myapp.example.com":   true,
+		"a.tenants.example.org": true,
+		"myapp.example.com":     false,
+		"other.example.com":     false,
+	} {
+		if permissions.SubdomainAllowed(host) != allowed {
+			t.Errorf("SubdomainAllowed(%s) should have been %t", host, allowed)
+		}
+	}
+
+	if _, err := ParseKeyPermissions([]string{`wildcard-subdomains="*.a.*.b"`}); err == nil {
+		t.Error("Expected an error for a nested wildcard")
+	}
+
+	holderLock.Lock()
+	previousPermissions := keyPermissionsHolder
+	keyPermissionsHolder = map[string]*KeyPermissions{"owner": permissions}
+	holderLock.Unlock()
+
+	defer func() {
+		holderLock.Lock()
+		keyPermissionsHolder = previousPermissions
+		holderLock.Unlock()
+	}()
+
+	state := NewState()
+
+	owner := reservationTestConn("owner")
+	owner.KeyPermissions = permissions
+	owner.Messages = make(chan string, 10)
+
+	if hostURL, _ := GetOpenHost("*.myapp", state, owner); hostURL == nil || hostURL.Host != "*.myapp.example.com" {
+		t.Errorf("Owner allocated %v when should have been its wildcard", hostURL)
+	}
+
+	if hostURL, _ := GetOpenHost("*.tenants.example.org", state, owner); hostURL == nil || hostURL.Host != "*.tenants.example.org" {
+		t.Errorf("Owner allocated %v when should have been its wildcard outside of the domain", hostURL)
+	}
+
+	other := reservationTestConn("other")
+	other.Messages = make(chan string, 10)
+
+	for _, requested := range []string{"*.myapp", "a.myapp"} {
+		if hostURL, _ := GetOpenHost(requested, state, other); hostURL == nil || strings.HasSuffix(hostURL.Host, ".myapp.example.com") {
+			t.Errorf("Other key allocated %v for %s when it is reserved", hostURL, requested)
+		}
+	}
+
+	if hostURL, _ := GetOpenHost("free", state, other); hostURL == nil || hostURL.Host != "free.example.com" {
+		t.Errorf("Other key allocated %v when should have been free.example.com", hostURL)
+	}
+}
@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// priorityPollInterval is how often a reader that yields to readers of a
+// higher priority class checks whether it can take tokens.
+const priorityPollInterval = 10 * time.Millisecond
+
+// totalBandwidth is the bucket shared by every forwarded connection when
+// max-bandwidth-total is set.
+var totalBandwidth = &PriorityBucket{}
+
+// PriorityBucket is a token bucket shared by many readers. Readers waiting
+// for tokens are served by priority class, so readers of lower classes yield
+// while readers of a higher class are waiting. Readers of the same class take
+// tokens as they become available. The rate is read from max-bandwidth-total
+// and the burst from max-bandwidth-burst.
+type PriorityBucket struct {
+	lock    sync.Mutex
+	tokens  float64
+	last    time.Time
+	waiting map[int]int
+}
+
+// limits returns the rate and burst of the bucket. A rate of 0 means
+// unlimited.
+func (b *PriorityBucket) limits() (int64, int64) {
+	rate := viper.GetInt64("max-bandwidth-total")
+
+	burst := viper.GetInt64("max-bandwidth-burst")
+	if burst < 1 {
+		burst = rate
+	}
+
+	return rate, burst
+}
+
+// Burst returns the most tokens a reader can take at once. 0 means
+// unlimited.
+func (b *PriorityBucket) Burst() int64 {
+	_, burst := b.limits()
+	return burst
+}
+
+// Wait blocks until n tokens are available and no reader of a higher
+// priority class is waiting. It returns early with an error if done is
+// closed while waiting.
+func (b *PriorityBucket) Wait(n int, priority int, done <-chan struct{}) error {
+	registered := false
+
+	defer func() {
+		if registered {
+			b.lock.Lock()
+			b.waiting[priority]--
+			b.lock.Unlock()
+		}
+	}()
+
+	for {
+		wait, ok := b.take(n, priority, !registered)
+		if ok {
+			return nil
+		}
+
+		registered = true
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return fmt.Errorf("rate limited copy closed")
+		}
+	}
+}
+
+// take takes n tokens if they are available and no reader of a higher
+// priority class is waiting. Otherwise it returns how long to wait before
+// trying again, and registers the reader as waiting if register is set.
+func (b *PriorityBucket) take(n int, priority int, register bool) (time.Duration, bool) {
+	rate, burst := b.limits()
+	if rate <= 0 {
+		return 0, true
+	}
+
+	if int64(n) > burst {
+		n = int(burst)
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * float64(rate)
+	}
+
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+
+	b.last = now
+
+	if b.waiting == nil {
+		b.waiting = map[int]int{}
+	}
+
+	yielding := false
+	for class, count := range b.waiting {
+		if class > priority && count > 0 {
+			yielding = true
+			break
+		}
+	}
+
+	if !yielding && b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		return 0, true
+	}
+
+	if register {
+		b.waiting[priority]++
+	}
+
+	if yielding {
+		return priorityPollInterval, false
+	}
+
+	return time.Duration((float64(n) - b.tokens) / float64(rate) * float64(time.Second)), false
+}
@@ -0,0 +1,58 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TestPriorityBucket validates that readers of a lower priority class yield
+// tokens while a reader of a higher class is waiting for them.
+func TestPriorityBucket(t *testing.T) {
+	viper.Set("max-bandwidth-total", 1000)
+	defer viper.Set("max-bandwidth-total", nil)
+
+	bucket := &PriorityBucket{}
+	done := make(chan struct{})
+	defer close(done)
+
+	err := bucket.Wait(1000, 0, done)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan int, 2)
+
+	go func() {
+		if bucket.Wait(500, 1, done) == nil {
+			order <- 1
+		}
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+
+	go func() {
+		if bucket.Wait(100, 0, done) == nil {
+			order <- 0
+		}
+	}()
+
+	for _, expected := range []int{1, 0} {
+		select {
+		case class := <-order:
+			if class != expected {
+				t.Errorf("Class %d was served when class %d should have been", class, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for tokens")
+		}
+	}
+
+	viper.Set("max-bandwidth-total", 0)
+
+	err = bucket.Wait(1<<20, 0, done)
+	if err != nil {
+		t.Error("Bucket without a rate should not limit readers")
+	}
+}
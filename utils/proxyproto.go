@@ -0,0 +1,334 @@
+package utils
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// ProxyProtoV1 represents the human readable PROXY protocol header.
+	ProxyProtoV1 byte = 1
+
+	// ProxyProtoV2 represents the binary PROXY protocol header.
+	ProxyProtoV2 byte = 2
+
+	// ja3TLVType is the custom TLV type that carries the JA3 fingerprint of a
+	// client connection to the forwarded listener's unix socket.
+	ja3TLVType = proxyproto.PP2_TYPE_MIN_CUSTOM
+)
+
+// ParseProxyProtoVersion parses a user provided PROXY protocol version.
+func ParseProxyProtoVersion(version string) (byte, error) {
+	switch version {
+	case "1":
+		return ProxyProtoV1, nil
+	case "2":
+		return ProxyProtoV2, nil
+	}
+
+	return 0, fmt.Errorf("unsupported proxy protocol version: %s", version)
+}
+
+// NewProxyProtoHeader builds a PROXY protocol header for a TCP connection. The
+// address family is selected based on the source and destination addresses.
+func NewProxyProtoHeader(version byte, sourceAddr *net.TCPAddr, destAddr *net.TCPAddr) *proxyproto.Header {
+	transportProtocol := proxyproto.TCPv4
+	if sourceAddr.IP.To4() == nil || destAddr.IP.To4() == nil {
+		transportProtocol = proxyproto.TCPv6
+	}
+
+	return &proxyproto.Header{
+		Version:           version,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: transportProtocol,
+		SourceAddr:        sourceAddr,
+		DestinationAddr:   destAddr,
+	}
+}
+
+// WriteProxyProtoHeader writes a PROXY protocol header to the writer. Version 1
+// writes the text header and version 2 writes the binary header, which includes
+// the 12 byte signature, address family, and address length. TLVs are only
+// included in version 2 headers.
+func WriteProxyProtoHeader(w io.Writer, version byte, sourceAddr *net.TCPAddr, destAddr *net.TCPAddr, tlvs ...proxyproto.TLV) error {
+	if version != ProxyProtoV1 && version != ProxyProtoV2 {
+		return fmt.Errorf("unsupported proxy protocol version: %d", version)
+	}
+
+	header := NewProxyProtoHeader(version, sourceAddr, destAddr)
+
+	if version == ProxyProtoV2 && len(tlvs) > 0 {
+		err := header.SetTLVs(tlvs)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := header.WriteTo(w)
+	return err
+}
+
+// ProxyProtoTLVs returns the PROXY protocol v2 TLVs describing a peeked TLS
+// ClientHello: the SNI server name (PP2_TYPE_AUTHORITY), the client's preferred
+// ALPN protocol (PP2_TYPE_ALPN), and the highest offered TLS version
+// (PP2_TYPE_SSL). sish does not terminate the TLS session, so a client
+// certificate is never reported as verified.
+func ProxyProtoTLVs(hello *tls.ClientHelloInfo) []proxyproto.TLV {
+	if hello == nil {
+		return nil
+	}
+
+	tlvs := []proxyproto.TLV{}
+
+	if hello.ServerName != "" {
+		tlvs = append(tlvs, proxyproto.TLV{
+			Type:  proxyproto.PP2_TYPE_AUTHORITY,
+			Value: []byte(hello.ServerName),
+		})
+	}
+
+	if len(hello.SupportedProtos) > 0 {
+		tlvs = append(tlvs, proxyproto.TLV{
+			Type:  proxyproto.PP2_TYPE_ALPN,
+			Value: []byte(hello.SupportedProtos[0]),
+		})
+	}
+
+	ssl := tlvparse.PP2SSL{
+		Client: tlvparse.PP2_BITFIELD_CLIENT_SSL,
+		Verify: 1,
+	}
+
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if v > version {
+			version = v
+		}
+	}
+
+	if version != 0 {
+		ssl.TLV = append(ssl.TLV, proxyproto.TLV{
+			Type:  proxyproto.PP2_SUBTYPE_SSL_VERSION,
+			Value: []byte(tls.VersionName(version)),
+		})
+	}
+
+	sslTLV, err := ssl.Marshal()
+	if err == nil {
+		tlvs = append(tlvs, sslTLV)
+	}
+
+	return tlvs
+}
+
+// PP2TypeClientSubject is the custom PROXY protocol v2 TLV type used to send
+// the distinguished name of a verified client certificate.
+const PP2TypeClientSubject = proxyproto.PP2_TYPE_MIN_CUSTOM
+
+// TerminatedTLSTLVs returns the PROXY protocol v2 TLVs describing a TLS session
+// terminated by sish: the SNI server name (PP2_TYPE_AUTHORITY), the negotiated
+// ALPN protocol (PP2_TYPE_ALPN) and the negotiated TLS version (PP2_TYPE_SSL).
+// If the client presented a verified certificate, its common name is included
+// in PP2_TYPE_SSL and its subject in PP2TypeClientSubject.
+func TerminatedTLSTLVs(state tls.ConnectionState) []proxyproto.TLV {
+	tlvs := []proxyproto.TLV{}
+
+	if state.ServerName != "" {
+		tlvs = append(tlvs, proxyproto.TLV{
+			Type:  proxyproto.PP2_TYPE_AUTHORITY,
+			Value: []byte(state.ServerName),
+		})
+	}
+
+	if state.NegotiatedProtocol != "" {
+		tlvs = append(tlvs, proxyproto.TLV{
+			Type:  proxyproto.PP2_TYPE_ALPN,
+			Value: []byte(state.NegotiatedProtocol),
+		})
+	}
+
+	ssl := tlvparse.PP2SSL{
+		Client: tlvparse.PP2_BITFIELD_CLIENT_SSL,
+		Verify: 1,
+		TLV: []proxyproto.TLV{
+			{
+				Type:  proxyproto.PP2_SUBTYPE_SSL_VERSION,
+				Value: []byte(tls.VersionName(state.Version)),
+			},
+		},
+	}
+
+	if len(state.VerifiedChains) > 0 {
+		clientCert := state.VerifiedChains[0][0]
+
+		ssl.Client |= tlvparse.PP2_BITFIELD_CLIENT_CERT_CONN
+		ssl.Verify = 0
+
+		if clientCert.Subject.CommonName != "" {
+			ssl.TLV = append(ssl.TLV, proxyproto.TLV{
+				Type:  proxyproto.PP2_SUBTYPE_SSL_CN,
+				Value: []byte(clientCert.Subject.CommonName),
+			})
+		}
+
+		tlvs = append(tlvs, proxyproto.TLV{
+			Type:  PP2TypeClientSubject,
+			Value: []byte(clientCert.Subject.String()),
+		})
+	}
+
+	sslTLV, err := ssl.Marshal()
+	if err == nil {
+		tlvs = append(tlvs, sslTLV)
+	}
+
+	return tlvs
+}
+
+// WriteForwardedHeader writes a PROXY protocol v2 header describing the original
+// client connection to a forwarded listener's unix socket. This allows the real
+// addresses and TLVs to be used when the connection is accepted from the socket.
+// If the addresses are not TCP addresses, a LOCAL header is written instead.
+func WriteForwardedHeader(w io.Writer, conn net.Conn, tlvs []proxyproto.TLV) error {
+	return WriteForwardedAddrs(w, conn.RemoteAddr(), conn.LocalAddr(), tlvs)
+}
+
+// WriteForwardedAddrs writes the PROXY protocol v2 header of WriteForwardedHeader
+// for a client connection from source to dest.
+func WriteForwardedAddrs(w io.Writer, source net.Addr, dest net.Addr, tlvs []proxyproto.TLV) error {
+	sourceAddr, sourceOk := source.(*net.TCPAddr)
+	destAddr, destOk := dest.(*net.TCPAddr)
+
+	if !sourceOk || !destOk {
+		header := &proxyproto.Header{
+			Version:           ProxyProtoV2,
+			Command:           proxyproto.LOCAL,
+			TransportProtocol: proxyproto.UNSPEC,
+		}
+
+		_, err := header.WriteTo(w)
+		return err
+	}
+
+	return WriteProxyProtoHeader(w, ProxyProtoV2, sourceAddr, destAddr, tlvs...)
+}
+
+// forwardedAddrsKey is the context key of the client addresses of a HTTP
+// request.
+type forwardedAddrsKey struct{}
+
+// forwardedAddrs are the addresses of the client connection a HTTP request
+// was received on.
+type forwardedAddrs struct {
+	source *net.TCPAddr
+	dest   *net.TCPAddr
+}
+
+// WithForwardedAddrs returns the context of req holding the addresses of the
+// client connection it was received on. When the request is forwarded, they
+// are written to the HTTP listener's unix socket with WriteForwardedAddrs, so
+// HTTP forwards can send them in a PROXY protocol header.
+func WithForwardedAddrs(req *http.Request) context.Context {
+	source, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return req.Context()
+	}
+
+	dest, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+	if !ok {
+		return req.Context()
+	}
+
+	return context.WithValue(req.Context(), forwardedAddrsKey{}, forwardedAddrs{
+		source: net.TCPAddrFromAddrPort(source),
+		dest:   dest,
+	})
+}
+
+// ForwardedAddrs returns the client addresses stored in ctx by
+// WithForwardedAddrs, and whether they were found.
+func ForwardedAddrs(ctx context.Context) (*net.TCPAddr, *net.TCPAddr, bool) {
+	addrs, ok := ctx.Value(forwardedAddrsKey{}).(forwardedAddrs)
+	if !ok {
+		return nil, nil, false
+	}
+
+	return addrs.source, addrs.dest, true
+}
+
+// ProxyProtoAddrs returns the source and destination addresses to send in the
+// PROXY protocol header for a connection accepted from a forwarded listener's
+// unix socket. These are the addresses of the original client connection, as
+// written by WriteForwardedHeader, so the client's real source port is kept.
+// If the original addresses are unknown, the addresses of the SSH connection
+// are used instead.
+func ProxyProtoAddrs(conn net.Conn, sshConn ssh.Conn) (*net.TCPAddr, *net.TCPAddr) {
+	sourceAddr, sourceOk := conn.RemoteAddr().(*net.TCPAddr)
+	destAddr, destOk := conn.LocalAddr().(*net.TCPAddr)
+
+	if !sourceOk || !destOk {
+		sourceAddr, _ = sshConn.RemoteAddr().(*net.TCPAddr)
+		destAddr, _ = sshConn.LocalAddr().(*net.TCPAddr)
+	}
+
+	return sourceAddr, destAddr
+}
+
+// ForwardedTLVs returns the TLVs sent with WriteForwardedHeader for a
+// connection accepted from a forwarded listener's unix socket. The JA3 TLV is
+// only used by sish, so it is not included.
+func ForwardedTLVs(conn net.Conn) []proxyproto.TLV {
+	tlvs := forwardedTLVs(conn)
+
+	return slices.DeleteFunc(tlvs, func(tlv proxyproto.TLV) bool {
+		return tlv.Type == ja3TLVType
+	})
+}
+
+// ForwardedJA3 returns the JA3 fingerprint sent with WriteForwardedHeader for
+// a connection accepted from a forwarded listener's unix socket, if there is
+// one.
+func ForwardedJA3(conn net.Conn) string {
+	for _, tlv := range forwardedTLVs(conn) {
+		if tlv.Type == ja3TLVType {
+			return string(tlv.Value)
+		}
+	}
+
+	return ""
+}
+
+// JA3TLVs returns the TLV that carries a JA3 fingerprint to the forwarded
+// listener with WriteForwardedHeader, or nil if there is no fingerprint.
+func JA3TLVs(ja3 string) []proxyproto.TLV {
+	if ja3 == "" {
+		return nil
+	}
+
+	return []proxyproto.TLV{{Type: ja3TLVType, Value: []byte(ja3)}}
+}
+
+// forwardedTLVs returns all of the TLVs of the forwarded header of conn.
+func forwardedTLVs(conn net.Conn) []proxyproto.TLV {
+	proxyConn, ok := conn.(*proxyproto.Conn)
+	if !ok || proxyConn.ProxyHeader() == nil {
+		return nil
+	}
+
+	tlvs, err := proxyConn.ProxyHeader().TLVs()
+	if err != nil {
+		return nil
+	}
+
+	return tlvs
+}
@@ -0,0 +1,431 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/pires/go-proxyproto/tlvparse"
+	"github.com/spf13/viper"
+)
+
+// TestProxyProtoTLVs validates that TLVs built from a ClientHello are written
+// in v2 headers and can be parsed by a backend.
+func TestProxyProtoTLVs(t *testing.T) {
+	hello := &tls.ClientHelloInfo{
+		ServerName:        "app.example.com",
+		SupportedProtos:   []string{"h2", "http/1.1"},
+		SupportedVersions: []uint16{tls.VersionTLS12, tls.VersionTLS13},
+	}
+
+	sourceAddr := &net.TCPAddr{IP: net.ParseIP("203.0.113.10"), Port: 51234}
+	destAddr := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443}
+
+	buf := &bytes.Buffer{}
+
+	err := WriteProxyProtoHeader(buf, ProxyProtoV2, sourceAddr, destAddr, ProxyProtoTLVs(hello)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := proxyproto.Read(bufio.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlvs, err := header.TLVs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[proxyproto.PP2Type]proxyproto.TLV{}
+	for _, tlv := range tlvs {
+		values[tlv.Type] = tlv
+	}
+
+	if authority := string(values[proxyproto.PP2_TYPE_AUTHORITY].Value); authority != hello.ServerName {
+		t.Errorf("Authority %q when should have been %q", authority, hello.ServerName)
+	}
+
+	if alpn := string(values[proxyproto.PP2_TYPE_ALPN].Value); alpn != "h2" {
+		t.Errorf("ALPN %q when should have been %q", alpn, "h2")
+	}
+
+	ssl, err := tlvparse.SSL(values[proxyproto.PP2_TYPE_SSL])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if version, _ := ssl.SSLVersion(); !ssl.ClientSSL() || version != "TLS 1.3" {
+		t.Errorf("Unexpected SSL TLV: client ssl %t, version %q", ssl.ClientSSL(), version)
+	}
+
+	v1Buf := &bytes.Buffer{}
+
+	err = WriteProxyProtoHeader(v1Buf, ProxyProtoV1, sourceAddr, destAddr, ProxyProtoTLVs(hello)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "PROXY TCP4 203.0.113.10 198.51.100.1 51234 443\r\n"; v1Buf.String() != expected {
+		t.Errorf("Wrote %q when should have been %q", v1Buf.String(), expected)
+	}
+}
+
+// TestTerminatedTLSTLVs validates that a verified client certificate is
+// reported in the SSL TLV and its subject is sent in PP2TypeClientSubject.
+func TestTerminatedTLSTLVs(t *testing.T) {
+	clientCert := &x509.Certificate{
+		Subject: pkix.Name{
+			CommonName:   "alice",
+			Organization: []string{"Example"},
+		},
+	}
+
+	state := tls.ConnectionState{
+		Version:        tls.VersionTLS13,
+		ServerName:     "app.example.com",
+		VerifiedChains: [][]*x509.Certificate{{clientCert}},
+	}
+
+	values := map[proxyproto.PP2Type]proxyproto.TLV{}
+	for _, tlv := range TerminatedTLSTLVs(state) {
+		values[tlv.Type] = tlv
+	}
+
+	if subject := string(values[PP2TypeClientSubject].Value); subject != "CN=alice,O=Example" {
+		t.Errorf("Subject %q when should have been %q", subject, "CN=alice,O=Example")
+	}
+
+	ssl, err := tlvparse.SSL(values[proxyproto.PP2_TYPE_SSL])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cn, _ := ssl.ClientCN(); !ssl.Verified() || !ssl.ClientCertConn() || cn != "alice" {
+		t.Errorf("Unexpected SSL TLV: verified %t, client cert %t, cn %q", ssl.Verified(), ssl.ClientCertConn(), cn)
+	}
+
+	state.VerifiedChains = nil
+
+	ssl, err = tlvparse.SSL(TerminatedTLSTLVs(state)[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ssl.Verified() || ssl.ClientCertConn() {
+		t.Error("Expected a connection without a client certificate to not be verified")
+	}
+}
+
+// TestProxyProtoAddrsSourcePort validates that the PROXY header sent to a
+// client carries the real peer's address and source port after the connection
+// passes through a forwarded listener's unix socket, for both versions.
+func TestProxyProtoAddrsSourcePort(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+
+	peer, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	accepted, err := tcpListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	unixListener, err := net.Listen("unix", filepath.Join(t.TempDir(), "forward.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwardListener := &proxyproto.Listener{Listener: unixListener}
+	defer forwardListener.Close()
+
+	unixConn, err := net.Dial("unix", unixListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixConn.Close()
+
+	err = WriteForwardedHeader(unixConn, accepted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl, err := forwardListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	sourceAddr, destAddr := ProxyProtoAddrs(cl, nil)
+
+	peerAddr := peer.LocalAddr().(*net.TCPAddr)
+	listenerAddr := tcpListener.Addr().(*net.TCPAddr)
+
+	for _, version := range []byte{ProxyProtoV1, ProxyProtoV2} {
+		buf := &bytes.Buffer{}
+
+		err = WriteProxyProtoHeader(buf, version, sourceAddr, destAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header, err := proxyproto.Read(bufio.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		source := header.SourceAddr.(*net.TCPAddr)
+		if !source.IP.Equal(peerAddr.IP) || source.Port != peerAddr.Port {
+			t.Errorf("Version %d source %s when should have been %s", version, source, peerAddr)
+		}
+
+		dest := header.DestinationAddr.(*net.TCPAddr)
+		if !dest.IP.Equal(listenerAddr.IP) || dest.Port != listenerAddr.Port {
+			t.Errorf("Version %d destination %s when should have been %s", version, dest, listenerAddr)
+		}
+	}
+}
+
+// TestWithForwardedAddrs validates that the client addresses of a HTTP
+// request are kept in its context, and are missing if they are unknown.
+func TestWithForwardedAddrs(t *testing.T) {
+	listenerAddr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "198.51.100.10:51234"
+	req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, listenerAddr))
+
+	source, dest, ok := ForwardedAddrs(WithForwardedAddrs(req))
+	if !ok {
+		t.Fatal("Addresses should have been found")
+	}
+
+	if source.String() != "198.51.100.10:51234" || dest != listenerAddr {
+		t.Errorf("Addresses %s -> %s when should have been 198.51.100.10:51234 -> %s", source, dest, listenerAddr)
+	}
+
+	req.RemoteAddr = "pipe"
+	if _, _, ok := ForwardedAddrs(WithForwardedAddrs(req)); ok {
+		t.Error("Unknown remote address should not have been stored")
+	}
+}
+
+// proxyProtoTestConn sends header and data to ln and returns the address,
+// data and read error of the accepted connection.
+func proxyProtoTestConn(t *testing.T, ln *proxyproto.Listener, header string) (net.Addr, string, error) {
+	go func() {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer client.Close()
+
+		_, err = client.Write([]byte(header + "data"))
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	data, err := io.ReadAll(conn)
+
+	return conn.RemoteAddr(), string(data), err
+}
+
+// TestLoadProxyProtoConfigTrustedCIDRs validates that PROXY headers are only
+// used when they come from a trusted upstream, and that connections from other
+// upstreams are rejected if they send one.
+func TestLoadProxyProtoConfigTrustedCIDRs(t *testing.T) {
+	defer viper.Set("proxy-protocol-listener-trusted-cidrs", nil)
+	defer trustedUpstreams.Store(nil)
+
+	header := "PROXY TCP4 203.0.113.10 198.51.100.1 51234 443\r\n"
+
+	tests := map[string]string{
+		"127.0.0.0/8, 10.0.0.1": "203.0.113.10:51234",
+		"10.0.0.0/8":            "127.0.0.1",
+		"invalid":               "127.0.0.1",
+	}
+
+	for cidrs, wantAddr := range tests {
+		viper.Set("proxy-protocol-listener-trusted-cidrs", cidrs)
+		trustedUpstreams.Store(nil)
+
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ln := &proxyproto.Listener{Listener: lis}
+		LoadProxyProtoConfig(ln)
+
+		addr, data, err := proxyProtoTestConn(t, ln, header)
+
+		trusted := wantAddr != "127.0.0.1"
+		if trusted && (addr.String() != wantAddr || data != "data" || err != nil) {
+			t.Errorf("Trusted %q read %q from %s with error %v", cidrs, data, addr, err)
+		}
+
+		if !trusted && (!strings.HasPrefix(addr.String(), wantAddr+":") || data != "" || !errors.Is(err, proxyproto.ErrSuperfluousProxyHeader)) {
+			t.Errorf("Untrusted %q read %q from %s with error %v when should have been rejected", cidrs, data, addr, err)
+		}
+
+		if addr, data, err := proxyProtoTestConn(t, ln, ""); !strings.HasPrefix(addr.String(), "127.0.0.1:") || data != "data" || err != nil {
+			t.Errorf("%q without a header read %q from %s with error %v", cidrs, data, addr, err)
+		}
+
+		_ = ln.Close()
+	}
+}
+
+// TestReloadProxyProtoTrustedCIDRs validates that reloading the trusted cidrs
+// file applies to new connections of a listener, and that cidrs that can't be
+// parsed keep the previous ones.
+func TestReloadProxyProtoTrustedCIDRs(t *testing.T) {
+	defer viper.Set("proxy-protocol-listener-trusted-cidrs-file", nil)
+	defer trustedUpstreams.Store(nil)
+
+	file := filepath.Join(t.TempDir(), "trusted")
+	viper.Set("proxy-protocol-listener-trusted-cidrs-file", file)
+
+	writeCIDRs := func(cidrs string) {
+		err := os.WriteFile(file, []byte(cidrs), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeCIDRs("# load balancers\n127.0.0.1\n")
+
+	count, err := ReloadProxyProtoTrustedCIDRs()
+	if err != nil || count != 1 {
+		t.Fatalf("Reload trusted %d cidrs: %v", count, err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln := &proxyproto.Listener{Listener: lis}
+	LoadProxyProtoConfig(ln)
+	defer ln.Close()
+
+	header := "PROXY TCP4 203.0.113.10 198.51.100.1 51234 443\r\n"
+
+	if addr, _, _ := proxyProtoTestConn(t, ln, header); addr.String() != "203.0.113.10:51234" {
+		t.Errorf("Trusted upstream read from %s", addr)
+	}
+
+	writeCIDRs("10.0.0.0/8\n192.168.1.5\n")
+
+	count, err = ReloadProxyProtoTrustedCIDRs()
+	if err != nil || count != 2 {
+		t.Fatalf("Reload trusted %d cidrs: %v", count, err)
+	}
+
+	if addr, _, err := proxyProtoTestConn(t, ln, header); !strings.HasPrefix(addr.String(), "127.0.0.1:") || !errors.Is(err, proxyproto.ErrSuperfluousProxyHeader) {
+		t.Errorf("Upstream removed on reload read from %s with error %v when should have been rejected", addr, err)
+	}
+
+	writeCIDRs("invalid\n")
+
+	if _, err = ReloadProxyProtoTrustedCIDRs(); err == nil {
+		t.Error("Reloading invalid cidrs should have failed")
+	}
+
+	if trust := trustedUpstreams.Load(); len(trust.trusted) != 2 {
+		t.Errorf("Invalid reload replaced the trusted cidrs with %v", trust.trusted)
+	}
+}
+
+// TestForwardedJA3 validates that a JA3 fingerprint written in the forwarded
+// header is read back, and is not passed on with the other TLVs.
+func TestForwardedJA3(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpListener.Close()
+
+	peer, err := net.Dial("tcp", tcpListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	accepted, err := tcpListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	unixListener, err := net.Listen("unix", filepath.Join(t.TempDir(), "forward.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forwardListener := &proxyproto.Listener{Listener: unixListener}
+	defer forwardListener.Close()
+
+	unixConn, err := net.Dial("unix", unixListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unixConn.Close()
+
+	tlvs := append(ProxyProtoTLVs(&tls.ClientHelloInfo{ServerName: "app.example.com"}), JA3TLVs("e7d705a3286e19ea42f587b344ee6865")...)
+
+	err = WriteForwardedHeader(unixConn, accepted, tlvs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cl, err := forwardListener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	if ja3 := ForwardedJA3(cl); ja3 != "e7d705a3286e19ea42f587b344ee6865" {
+		t.Errorf("Read ja3 %q when should have been the written fingerprint", ja3)
+	}
+
+	for _, tlv := range ForwardedTLVs(cl) {
+		if tlv.Type == ja3TLVType {
+			t.Error("Forwarded TLVs should not include the ja3 fingerprint")
+		}
+	}
+
+	if len(ForwardedTLVs(cl)) != len(tlvs)-1 {
+		t.Errorf("Forwarded %d TLVs when should have been %d", len(ForwardedTLVs(cl)), len(tlvs)-1)
+	}
+}
@@ -0,0 +1,213 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/spf13/viper"
+)
+
+// proxyProtoTrust is the set of upstreams PROXY protocol headers are used
+// from. If restricted is false, every upstream is trusted.
+type proxyProtoTrust struct {
+	restricted bool
+	trusted    []*net.IPNet
+}
+
+// trustedUpstreams holds the current proxyProtoTrust. It is swapped when the
+// trusted cidrs are reloaded, and checked for every accepted connection.
+var trustedUpstreams atomic.Pointer[proxyProtoTrust]
+
+// ReloadProxyProtoTrustedCIDRs loads the trusted upstreams from
+// proxy-protocol-listener-trusted-cidrs and
+// proxy-protocol-listener-trusted-cidrs-file again and logs how many were
+// loaded. New connections are checked against the reloaded upstreams. If they
+// can't be parsed, the upstreams that were loaded before are kept.
+func ReloadProxyProtoTrustedCIDRs() (int, error) {
+	trust, err := loadProxyProtoTrust()
+	if err != nil {
+		return 0, err
+	}
+
+	trustedUpstreams.Store(trust)
+
+	log.Printf("Reloaded proxy protocol trusted cidrs: %d trusted\n", len(trust.trusted))
+
+	return len(trust.trusted), nil
+}
+
+// loadProxyProtoTrust parses the trusted upstreams from the cidrs flag and the
+// cidrs file.
+func loadProxyProtoTrust() (*proxyProtoTrust, error) {
+	cidrs := viper.GetString("proxy-protocol-listener-trusted-cidrs")
+
+	if file := viper.GetString("proxy-protocol-listener-trusted-cidrs-file"); file != "" {
+		fileCIDRs, err := readTrustedCIDRsFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		cidrs = strings.Join(append([]string{cidrs}, fileCIDRs...), ",")
+	}
+
+	if strings.Trim(cidrs, ", ") == "" {
+		return &proxyProtoTrust{}, nil
+	}
+
+	trusted, err := ParseIPNets(cidrs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyProtoTrust{restricted: true, trusted: trusted}, nil
+}
+
+// readTrustedCIDRsFile reads the upstream IPs and CIDRs from file. They can be
+// comma or newline separated, and lines starting with # are ignored.
+func readTrustedCIDRsFile(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read proxy protocol trusted cidrs file: %w", err)
+	}
+
+	cidrs := []string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		cidrs = append(cidrs, line)
+	}
+
+	return cidrs, scanner.Err()
+}
+
+// currentProxyProtoTrust returns the trusted upstreams, loading them the first
+// time they are used. If they can't be parsed then, no upstreams are trusted.
+func currentProxyProtoTrust() *proxyProtoTrust {
+	if trust := trustedUpstreams.Load(); trust != nil {
+		return trust
+	}
+
+	trust, err := loadProxyProtoTrust()
+	if err != nil {
+		log.Println("Error parsing proxy protocol trusted cidrs, no upstreams will be trusted:", err)
+		trust = &proxyProtoTrust{restricted: true}
+	}
+
+	trustedUpstreams.CompareAndSwap(nil, trust)
+
+	return trustedUpstreams.Load()
+}
+
+// ProxyProtoUpstreamTrusted returns whether or not PROXY protocol headers
+// are used from upstream.
+func ProxyProtoUpstreamTrusted(upstream net.Addr) bool {
+	trust := currentProxyProtoTrust()
+
+	return !trust.restricted || upstreamTrusted(upstream, trust.trusted)
+}
+
+// trustedUpstreamListener applies the PROXY protocol policy to the
+// connections of trusted upstreams. Other upstreams keep their socket
+// addresses, and their connections are rejected if they send a header.
+type trustedUpstreamListener struct {
+	net.Listener
+	policy  proxyproto.ConnPolicyFunc
+	timeout time.Duration
+}
+
+// Accept waits for the next connection and wraps it depending on whether or
+// not its upstream is trusted.
+func (l *trustedUpstreamListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if !ProxyProtoUpstreamTrusted(conn.RemoteAddr()) {
+		return &untrustedProxyConn{
+			Conn: proxyproto.NewConn(conn, proxyproto.WithPolicy(proxyproto.REJECT), proxyproto.SetReadHeaderTimeout(l.timeout)),
+			raw:  conn,
+		}, nil
+	}
+
+	policy := proxyproto.USE
+	if l.policy != nil {
+		policy, err = l.policy(proxyproto.ConnPolicyOptions{Upstream: conn.RemoteAddr(), Downstream: conn.LocalAddr()})
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+
+	if policy == proxyproto.SKIP {
+		return conn, nil
+	}
+
+	return proxyproto.NewConn(conn, proxyproto.WithPolicy(policy), proxyproto.SetReadHeaderTimeout(l.timeout)), nil
+}
+
+// untrustedProxyConn is a connection from an untrusted upstream. If it starts
+// with a PROXY header, which may be an attempt to spoof the client address,
+// reading from it fails and the header is logged.
+type untrustedProxyConn struct {
+	*proxyproto.Conn
+	raw  net.Conn
+	once sync.Once
+}
+
+// checkHeader logs that the connection was rejected if err is caused by a
+// PROXY header.
+func (c *untrustedProxyConn) checkHeader(err error) {
+	if !errors.Is(err, proxyproto.ErrSuperfluousProxyHeader) {
+		return
+	}
+
+	c.once.Do(func() {
+		LogEvent("proxy_header_untrusted", LogFields{
+			"upstream": LogAddr(c.raw.RemoteAddr()),
+		}, "Rejecting proxy protocol header from untrusted upstream", LogAddr(c.raw.RemoteAddr()))
+	})
+}
+
+// Read reads data from the connection, failing if it sent a PROXY header.
+func (c *untrustedProxyConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.checkHeader(err)
+
+	return n, err
+}
+
+// WriteTo writes the data of the connection to w, failing if it sent a PROXY
+// header.
+func (c *untrustedProxyConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := c.Conn.WriteTo(w)
+	c.checkHeader(err)
+
+	return n, err
+}
+
+// RemoteAddr returns the socket address of the upstream.
+func (c *untrustedProxyConn) RemoteAddr() net.Addr {
+	return c.raw.RemoteAddr()
+}
+
+// LocalAddr returns the socket address the connection was accepted on.
+func (c *untrustedProxyConn) LocalAddr() net.Addr {
+	return c.raw.LocalAddr()
+}
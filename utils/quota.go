@@ -0,0 +1,286 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// QuotaUsage is the bandwidth a user has used in a quota period.
+type QuotaUsage struct {
+	PeriodStart time.Time `json:"period_start"`
+	Bytes       uint64    `json:"bytes"`
+}
+
+// QuotaStore persists the bandwidth used by each user so it survives
+// restarts.
+type QuotaStore interface {
+	Load() (map[string]QuotaUsage, error)
+	Save(usage map[string]QuotaUsage) error
+}
+
+// FileQuotaStore is a QuotaStore that keeps the usage of every user in a
+// JSON file.
+type FileQuotaStore struct {
+	Path string
+}
+
+// Load reads the usage from the file. A missing file has no usage.
+func (f *FileQuotaStore) Load() (map[string]QuotaUsage, error) {
+	usage := map[string]QuotaUsage{}
+
+	data, err := os.ReadFile(f.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return usage, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &usage)
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// Save writes the usage to a temporary file and moves it over the file, so
+// the file is never left partially written.
+func (f *FileQuotaStore) Save(usage map[string]QuotaUsage) error {
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(f.Path), filepath.Base(f.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmpFile.Write(data)
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return err
+	}
+
+	return os.Rename(tmpFile.Name(), f.Path)
+}
+
+// QuotaInfo is the bandwidth quota of a user.
+type QuotaInfo struct {
+	Limit     uint64    `json:"limit"`
+	Used      uint64    `json:"used"`
+	Remaining uint64    `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// Quotas tracks the bandwidth used by each user across all of their
+// connections. Usage is reset every bandwidth-quota-reset-interval, or at the
+// start of every month if it is 0.
+type Quotas struct {
+	Store QuotaStore
+
+	lock  sync.Mutex
+	usage map[string]QuotaUsage
+}
+
+// NewQuotas returns Quotas with the usage loaded from store. If store is nil,
+// usage is only kept in memory.
+func NewQuotas(store QuotaStore) (*Quotas, error) {
+	usage := map[string]QuotaUsage{}
+
+	if store != nil {
+		var err error
+
+		usage, err = store.Load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Quotas{
+		Store: store,
+		usage: usage,
+	}, nil
+}
+
+// QuotaPeriodStart returns the start of the quota period that contains now.
+// Periods are interval long, or calendar months in UTC if interval is 0.
+func QuotaPeriodStart(now time.Time, interval time.Duration) time.Time {
+	now = now.UTC()
+
+	if interval <= 0 {
+		year, month, _ := now.Date()
+		return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	return now.Truncate(interval)
+}
+
+// quotaPeriodEnd returns the end of the quota period that starts at start.
+func quotaPeriodEnd(start time.Time, interval time.Duration) time.Time {
+	if interval <= 0 {
+		return start.AddDate(0, 1, 0)
+	}
+
+	return start.Add(interval)
+}
+
+// add adds bytes to the usage of user in the period that contains now.
+func (q *Quotas) add(user string, bytes uint64, now time.Time) QuotaUsage {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return q.addLocked(user, bytes, now)
+}
+
+// addLocked adds bytes to the usage of user in the period that contains now.
+// Bytes of a period that has already been replaced by a later one are
+// dropped. The lock must be held.
+func (q *Quotas) addLocked(user string, bytes uint64, now time.Time) QuotaUsage {
+	periodStart := QuotaPeriodStart(now, viper.GetDuration("bandwidth-quota-reset-interval"))
+
+	usage := q.usage[user]
+	if usage.PeriodStart.After(periodStart) {
+		return usage
+	}
+
+	if usage.PeriodStart.Before(periodStart) {
+		usage = QuotaUsage{PeriodStart: periodStart}
+	}
+
+	usage.Bytes += bytes
+	q.usage[user] = usage
+
+	return usage
+}
+
+// account adds the bytes sshConn copied since it was last accounted to the
+// usage of its user. If a new period started since then, the bytes are split
+// between the periods by how long the connection was open in each, so bytes
+// copied before the reset aren't charged to the new period.
+func (q *Quotas) account(sshConn *SSHConnection, now time.Time) QuotaUsage {
+	user := sshConn.UserKey()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	total := sshConn.BytesIn() + sshConn.BytesOut()
+	bytes := total - sshConn.quotaAccounted
+
+	since := sshConn.quotaAccountedAt
+	if since.IsZero() {
+		since = sshConn.Created
+	}
+
+	sshConn.quotaAccounted = total
+	sshConn.quotaAccountedAt = now
+
+	periodStart := QuotaPeriodStart(now, viper.GetDuration("bandwidth-quota-reset-interval"))
+	if !since.IsZero() && since.Before(periodStart) && now.After(since) {
+		earlier := uint64(float64(bytes) * float64(periodStart.Sub(since)) / float64(now.Sub(since)))
+
+		q.addLocked(user, earlier, since)
+		bytes -= earlier
+	}
+
+	return q.addLocked(user, bytes, now)
+}
+
+// Save persists the usage of the current period to the store. Usage from
+// earlier periods is dropped.
+func (q *Quotas) Save() error {
+	if q.Store == nil {
+		return nil
+	}
+
+	periodStart := QuotaPeriodStart(time.Now(), viper.GetDuration("bandwidth-quota-reset-interval"))
+
+	q.lock.Lock()
+	usage := map[string]QuotaUsage{}
+
+	for user, userUsage := range q.usage {
+		if userUsage.PeriodStart.Before(periodStart) {
+			delete(q.usage, user)
+			continue
+		}
+
+		usage[user] = userUsage
+	}
+	q.lock.Unlock()
+
+	return q.Store.Save(usage)
+}
+
+// AccountQuotas adds the bytes copied by every SSH connection to the usage of
+// its user and saves it.
+func (s *State) AccountQuotas() error {
+	if s.Quotas == nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	s.SSHConnections.Range(func(key string, sshConn *SSHConnection) bool {
+		s.Quotas.account(sshConn, now)
+		return true
+	})
+
+	return s.Quotas.Save()
+}
+
+// QuotaInfo returns the bandwidth quota of the user of sshConn, including
+// the bytes copied by all of their connections so far. It is nil if
+// bandwidth quotas are disabled.
+func (s *State) QuotaInfo(sshConn *SSHConnection) *QuotaInfo {
+	limit := viper.GetInt64("bandwidth-quota")
+	if s.Quotas == nil || limit <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	user := sshConn.UserKey()
+	usage := s.Quotas.add(user, 0, now)
+
+	s.SSHConnections.Range(func(key string, userConn *SSHConnection) bool {
+		if userConn.UserKey() == user {
+			usage = s.Quotas.account(userConn, now)
+		}
+		return true
+	})
+
+	info := &QuotaInfo{
+		Limit:    uint64(limit),
+		Used:     usage.Bytes,
+		ResetsAt: quotaPeriodEnd(usage.PeriodStart, viper.GetDuration("bandwidth-quota-reset-interval")),
+	}
+
+	if info.Used < info.Limit {
+		info.Remaining = info.Limit - info.Used
+	}
+
+	return info
+}
+
+// releaseQuota accounts the last bytes copied by a closed SSH connection.
+func (s *State) releaseQuota(sshConn *SSHConnection) {
+	if s.Quotas == nil {
+		return
+	}
+
+	usage := s.Quotas.account(sshConn, time.Now())
+
+	if viper.GetBool("debug") {
+		log.Printf("Bandwidth used by %s in the current quota period: %d bytes", sshConn.UserKey(), usage.Bytes)
+	}
+}
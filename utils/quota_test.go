@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TestQuotaPeriodStart validates that quota periods are calendar months by
+// default and intervals otherwise.
+func TestQuotaPeriodStart(t *testing.T) {
+	now := time.Date(2024, time.February, 29, 13, 45, 0, 0, time.UTC)
+
+	monthly := QuotaPeriodStart(now, 0)
+	if !monthly.Equal(time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Monthly period started at %s", monthly)
+	}
+
+	if end := quotaPeriodEnd(monthly, 0); !end.Equal(time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Monthly period ended at %s", end)
+	}
+
+	hourly := QuotaPeriodStart(now, time.Hour)
+	if !hourly.Equal(time.Date(2024, time.February, 29, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("Hourly period started at %s", hourly)
+	}
+}
+
+// TestQuotas validates that usage is summed across a user's connections,
+// survives a restart through the store and resets in a new period.
+func TestQuotas(t *testing.T) {
+	viper.Set("bandwidth-quota", 1000)
+	defer viper.Set("bandwidth-quota", nil)
+
+	store := &FileQuotaStore{Path: filepath.Join(t.TempDir(), "quotas.json")}
+
+	quotas, err := NewQuotas(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := NewState()
+	state.Quotas = quotas
+
+	first := reservationTestConn("alice")
+	second := reservationTestConn("alice")
+	other := reservationTestConn("bob")
+	state.SSHConnections.Store("first", first)
+	state.SSHConnections.Store("second", second)
+	state.SSHConnections.Store("other", other)
+
+	first.bytesIn.Add(300)
+	second.bytesOut.Add(200)
+	other.bytesIn.Add(5000)
+
+	info := state.QuotaInfo(first)
+	if info.Used != 500 || info.Remaining != 500 {
+		t.Errorf("Used %d and remaining %d when should have been 500 and 500", info.Used, info.Remaining)
+	}
+
+	first.bytesIn.Add(100)
+	state.SSHConnections.Delete("first")
+	state.releaseQuota(first)
+
+	if info := state.QuotaInfo(second); info.Used != 600 {
+		t.Errorf("Used %d after closing a connection when should have been 600", info.Used)
+	}
+
+	if info := state.QuotaInfo(other); info.Used != 5000 || info.Remaining != 0 {
+		t.Errorf("Used %d and remaining %d when should have been 5000 and 0", info.Used, info.Remaining)
+	}
+
+	err = state.AccountQuotas()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewQuotas(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if usage := restarted.add("alice", 0, time.Now()); usage.Bytes != 600 {
+		t.Errorf("Loaded usage %d when should have been 600", usage.Bytes)
+	}
+
+	if usage := restarted.add("alice", 10, time.Now().AddDate(0, 1, 0)); usage.Bytes != 10 {
+		t.Errorf("Usage %d in the next period when should have been 10", usage.Bytes)
+	}
+
+	viper.Set("bandwidth-quota", 0)
+	if state.QuotaInfo(second) != nil {
+		t.Error("Quota info should be nil when quotas are disabled")
+	}
+}
+
+// TestQuotasPeriodBoundary validates that bytes copied before a period
+// started aren't charged to it when they are accounted after it started.
+func TestQuotasPeriodBoundary(t *testing.T) {
+	viper.Set("bandwidth-quota-reset-interval", time.Hour)
+	defer viper.Set("bandwidth-quota-reset-interval", nil)
+
+	quotas, err := NewQuotas(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	periodStart := time.Date(2024, time.February, 29, 13, 0, 0, 0, time.UTC)
+
+	sshConn := reservationTestConn("alice")
+	sshConn.Created = periodStart.Add(-30 * time.Minute)
+	sshConn.bytesIn.Add(1000)
+
+	usage := quotas.account(sshConn, periodStart.Add(10*time.Minute))
+	if !usage.PeriodStart.Equal(periodStart) || usage.Bytes != 250 {
+		t.Errorf("Usage %d in the period starting at %s when should have been 250 in the period starting at %s", usage.Bytes, usage.PeriodStart, periodStart)
+	}
+
+	sshConn.bytesOut.Add(100)
+
+	if usage := quotas.account(sshConn, periodStart.Add(20*time.Minute)); usage.Bytes != 350 {
+		t.Errorf("Usage %d within the period when should have been 350", usage.Bytes)
+	}
+
+	if usage := quotas.add("alice", 10, periodStart.Add(-time.Minute)); usage.Bytes != 350 || !usage.PeriodStart.Equal(periodStart) {
+		t.Errorf("Bytes of an ended period changed the usage to %d in the period starting at %s", usage.Bytes, usage.PeriodStart)
+	}
+}
@@ -0,0 +1,230 @@
+package utils
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TokenBucket implements a simple token bucket used to throttle bandwidth.
+type TokenBucket struct {
+	Rate   int64
+	Burst  int64
+	tokens float64
+	last   time.Time
+	lock   sync.Mutex
+}
+
+// NewTokenBucket returns a new TokenBucket that refills at rate tokens per second
+// and holds at most burst tokens. If burst is less than 1, rate is used.
+func NewTokenBucket(rate int64, burst int64) *TokenBucket {
+	if burst < 1 {
+		burst = rate
+	}
+
+	return &TokenBucket{
+		Rate:   rate,
+		Burst:  burst,
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller
+// needs to wait for the bucket to be back in balance.
+func (t *TokenBucket) reserve(n int) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+
+	t.tokens += now.Sub(t.last).Seconds() * float64(t.Rate)
+	if t.tokens > float64(t.Burst) {
+		t.tokens = float64(t.Burst)
+	}
+
+	t.last = now
+	t.tokens -= float64(n)
+
+	if t.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-t.tokens / float64(t.Rate) * float64(time.Second))
+}
+
+// Take takes n tokens from the bucket if they are available, without
+// waiting, and returns 0. Otherwise no tokens are taken and it returns how
+// long until n tokens will be available.
+func (t *TokenBucket) Take(n int) time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := time.Now()
+
+	t.tokens += now.Sub(t.last).Seconds() * float64(t.Rate)
+	if t.tokens > float64(t.Burst) {
+		t.tokens = float64(t.Burst)
+	}
+
+	t.last = now
+
+	if t.tokens < float64(n) {
+		wait := time.Duration((float64(n) - t.tokens) / float64(t.Rate) * float64(time.Second))
+		if wait <= 0 {
+			wait = time.Nanosecond
+		}
+
+		return wait
+	}
+
+	t.tokens -= float64(n)
+
+	return 0
+}
+
+// Allow takes n tokens from the bucket if they are available, without
+// waiting. It returns whether the tokens were taken.
+func (t *TokenBucket) Allow(n int) bool {
+	return t.Take(n) == 0
+}
+
+// Wait blocks until n tokens are available. It returns early with an error
+// if done is closed while waiting.
+func (t *TokenBucket) Wait(n int, done <-chan struct{}) error {
+	wait := t.reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		return fmt.Errorf("rate limited copy closed")
+	}
+}
+
+// RateLimitedReader throttles reads from the underlying reader using a
+// TokenBucket, a PriorityBucket shared with other readers, or both. Either
+// bucket can be nil.
+type RateLimitedReader struct {
+	Reader   io.Reader
+	Bucket   *TokenBucket
+	Shared   *PriorityBucket
+	Priority int
+	Done     <-chan struct{}
+}
+
+// Read reads at most Burst bytes from the underlying reader and waits for
+// the buckets to allow the bytes that were read.
+func (r *RateLimitedReader) Read(p []byte) (int, error) {
+	if r.Bucket != nil && int64(len(p)) > r.Bucket.Burst {
+		p = p[:r.Bucket.Burst]
+	}
+
+	if r.Shared != nil {
+		if burst := r.Shared.Burst(); burst > 0 && int64(len(p)) > burst {
+			p = p[:burst]
+		}
+	}
+
+	n, err := r.Reader.Read(p)
+	if n > 0 && r.Bucket != nil {
+		waitErr := r.Bucket.Wait(n, r.Done)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	if n > 0 && r.Shared != nil {
+		waitErr := r.Shared.Wait(n, r.Priority, r.Done)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+
+	return n, err
+}
+
+// ForwardLimiter bounds the number of connections a forward handles at once.
+// Connections over the limit wait for a slot and are counted as queued.
+type ForwardLimiter struct {
+	slots  chan struct{}
+	active atomic.Int64
+	queued atomic.Int64
+}
+
+// NewForwardLimiter returns a new ForwardLimiter that allows max concurrent
+// connections. If max is less than 1, the number of connections is unbounded.
+func NewForwardLimiter(max int) *ForwardLimiter {
+	limiter := &ForwardLimiter{}
+
+	if max > 0 {
+		limiter.slots = make(chan struct{}, max)
+	}
+
+	return limiter
+}
+
+// Acquire waits for a free slot. It returns false if no slot became available
+// within timeout or if done is closed while waiting. A timeout of 0 waits
+// until a slot is available. Every successful Acquire must be followed by Release.
+func (f *ForwardLimiter) Acquire(timeout time.Duration, done <-chan bool) bool {
+	if f.slots == nil {
+		f.active.Add(1)
+		return true
+	}
+
+	select {
+	case f.slots <- struct{}{}:
+		f.active.Add(1)
+		return true
+	default:
+	}
+
+	f.queued.Add(1)
+	defer f.queued.Add(-1)
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		expired = timer.C
+	}
+
+	select {
+	case f.slots <- struct{}{}:
+		f.active.Add(1)
+		return true
+	case <-expired:
+		return false
+	case <-done:
+		return false
+	}
+}
+
+// Release frees a slot taken by Acquire.
+func (f *ForwardLimiter) Release() {
+	f.active.Add(-1)
+
+	if f.slots != nil {
+		<-f.slots
+	}
+}
+
+// Active returns the number of connections currently being handled.
+func (f *ForwardLimiter) Active() int64 {
+	return f.active.Load()
+}
+
+// Queued returns the number of connections currently waiting for a slot.
+func (f *ForwardLimiter) Queued() int64 {
+	return f.queued.Load()
+}
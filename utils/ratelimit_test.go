@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// TestForwardLimiter validates that connections over the limit are queued
+// and are rejected once the timeout expires.
+func TestForwardLimiter(t *testing.T) {
+	limiter := NewForwardLimiter(1)
+	done := make(chan bool)
+
+	if !limiter.Acquire(0, done) {
+		t.Fatal("Expected the first connection to acquire a slot")
+	}
+
+	acquired := make(chan bool)
+	go func() {
+		acquired <- limiter.Acquire(time.Second, done)
+	}()
+
+	for limiter.Queued() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if limiter.Active() != 1 {
+		t.Errorf("Active %d when should have been 1", limiter.Active())
+	}
+
+	limiter.Release()
+
+	if !<-acquired {
+		t.Fatal("Expected the queued connection to acquire the released slot")
+	}
+
+	if limiter.Queued() != 0 {
+		t.Errorf("Queued %d when should have been 0", limiter.Queued())
+	}
+
+	if limiter.Acquire(10*time.Millisecond, done) {
+		t.Error("Expected the connection to time out waiting for a slot")
+	}
+
+	unbounded := NewForwardLimiter(0)
+	for i := 0; i < 10; i++ {
+		if !unbounded.Acquire(time.Millisecond, done) {
+			t.Fatal("Expected an unbounded limiter to always acquire")
+		}
+	}
+
+	if unbounded.Active() != 10 {
+		t.Errorf("Active %d when should have been 10", unbounded.Active())
+	}
+}
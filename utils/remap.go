@@ -0,0 +1,216 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	// errRemapNotFound is returned when a connection has no HTTP forward
+	// bound to the host being remapped.
+	errRemapNotFound = errors.New("no HTTP forward of the connection is bound to the host")
+
+	// errRemapShared is returned when the host being remapped is load
+	// balanced with forwards of other connections.
+	errRemapShared = errors.New("the host is shared with other connections")
+
+	// errRemapTaken is returned when the host being remapped to is already
+	// bound or reserved.
+	errRemapTaken = errors.New("the new host is already in use")
+
+	// errRemapInvalid is returned when the host being remapped to can't be
+	// bound.
+	errRemapInvalid = errors.New("the new host is not valid")
+)
+
+// RemapHTTPHost moves the HTTP forwards of sshConn that are bound to oldHost
+// to newHost without the client reconnecting. newHost is a subdomain of
+// domain unless it contains a dot. Requests that are already being proxied
+// finish on the forward, and new requests to oldHost are no longer routed.
+// The client is told about the move, and the new addresses are returned.
+func (s *State) RemapHTTPHost(sshConn *SSHConnection, oldHost string, newHost string) ([]string, error) {
+	oldHost = strings.ToLower(strings.TrimSpace(oldHost))
+	newHost = strings.ToLower(strings.TrimSpace(newHost))
+
+	if newHost != "" && !strings.Contains(newHost, ".") {
+		newHost = fmt.Sprintf("%s.%s", newHost, viper.GetString("domain"))
+	}
+
+	if newHost == "" || strings.ContainsAny(newHost, "/:@?#* ") || inList(newHost, bannedSubdomainList) {
+		return nil, errRemapInvalid
+	}
+
+	addresses, err := s.moveHTTPHolders(sshConn, oldHost, newHost)
+	if err != nil {
+		return nil, err
+	}
+
+	s.remapReservedForwards(sshConn, ReservedHTTP, oldHost, newHost)
+
+	LogEvent("http_host_remapped", sshConn.logFields(LogFields{"old_host": oldHost, "new_host": newHost}), "Remapped HTTP host", oldHost, "to", newHost, "for:", LogAddr(sshConn.SSHConn.RemoteAddr()))
+
+	sshConn.SendMessage(fmt.Sprintf("The server administrator moved %s to %s. Forwarded connections can now be accessed via: %s", oldHost, newHost, strings.Join(addresses, ", ")), false)
+
+	return addresses, nil
+}
+
+// moveHTTPHolders moves the HTTP holders of sshConn bound to oldHost to
+// newHost and returns the new addresses of their forwards.
+func (s *State) moveHTTPHolders(sshConn *SSHConnection, oldHost string, newHost string) ([]string, error) {
+	s.httpRemapLock.Lock()
+	defer s.httpRemapLock.Unlock()
+
+	var holders []*HTTPHolder
+	shared := false
+	taken := s.reservedByOther(sshConn, ReservedHTTP, newHost) || wildcardReservedByOther(sshConn, newHost)
+
+	s.HTTPListeners.Range(func(key string, holder *HTTPHolder) bool {
+		if holder.HTTPUrl.Host == newHost {
+			taken = true
+		}
+
+		if holder.HTTPUrl.Host != oldHost {
+			return true
+		}
+
+		owned, other := false, false
+
+		holder.SSHConnections.Range(func(addr string, holderConn *SSHConnection) bool {
+			if holderConn == sshConn {
+				owned = true
+			} else {
+				other = true
+			}
+
+			return true
+		})
+
+		if owned {
+			holders = append(holders, holder)
+			shared = shared || other
+		}
+
+		return true
+	})
+
+	if len(holders) == 0 {
+		return nil, errRemapNotFound
+	}
+
+	if shared {
+		return nil, errRemapShared
+	}
+
+	if taken {
+		return nil, errRemapTaken
+	}
+
+	var addresses []string
+
+	for _, holder := range holders {
+		oldURL := holder.HTTPUrl.String()
+
+		newURL := *holder.HTTPUrl
+		newURL.Host = newHost
+
+		s.HTTPListeners.Store(newURL.String(), &HTTPHolder{
+			HTTPUrl:        &newURL,
+			SSHConnections: holder.SSHConnections,
+			Forward:        holder.Forward,
+			Balancer:       holder.Balancer,
+		})
+		s.HTTPListeners.Delete(oldURL)
+
+		if routeToken, ok := s.Console.RouteToken(oldURL); ok {
+			s.Console.RemoveRoute(oldURL)
+			s.Console.AddRoute(newURL.String(), routeToken)
+		}
+
+		holder.SSHConnections.Range(func(addr string, _ *SSHConnection) bool {
+			listener, ok := sshConn.Listeners.Load(addr)
+			if !ok {
+				return true
+			}
+
+			if listenerHolder, ok := listener.(*ListenerHolder); ok {
+				addresses = append(addresses, listenerHolder.remapHost(oldHost, newHost)...)
+			}
+
+			return true
+		})
+	}
+
+	return addresses, nil
+}
+
+// AddHTTPHolder stores holder in HTTPListeners unless a holder for the same
+// URL was stored first, such as by a concurrent forward or remap. It returns
+// the stored holder and whether or not it is holder. It takes the remap lock,
+// so holders aren't created on a host while it is being remapped to.
+func (s *State) AddHTTPHolder(holder *HTTPHolder) (*HTTPHolder, bool) {
+	s.httpRemapLock.Lock()
+	defer s.httpRemapLock.Unlock()
+
+	current, loaded := s.HTTPListeners.LoadOrStore(holder.HTTPUrl.String(), holder)
+
+	return current, !loaded
+}
+
+// RemoveHTTPHolder removes holder from HTTPListeners once its balancer has no
+// servers left. Holders that were moved by RemapHTTPHost are removed from the
+// host they were moved to.
+func (s *State) RemoveHTTPHolder(holder *HTTPHolder) {
+	s.httpRemapLock.Lock()
+	defer s.httpRemapLock.Unlock()
+
+	if len(holder.Balancer.Servers()) > 0 {
+		return
+	}
+
+	s.HTTPListeners.Range(func(key string, current *HTTPHolder) bool {
+		if current.Balancer != holder.Balancer {
+			return true
+		}
+
+		s.HTTPListeners.Delete(key)
+		s.RequestRateLimiter.Evict(current)
+
+		if viper.GetBool("admin-console") || viper.GetBool("service-console") {
+			s.Console.RemoveRoute(key)
+		}
+
+		return false
+	})
+}
+
+// remapHost replaces oldHost with newHost in the addresses of the listener and
+// returns the addresses that were replaced.
+func (l *ListenerHolder) remapHost(oldHost string, newHost string) []string {
+	l.addressesLock.Lock()
+	defer l.addressesLock.Unlock()
+
+	var remapped []string
+
+	for i, address := range l.addresses {
+		addressURL, err := url.Parse(address)
+		if err != nil || addressURL.Hostname() != oldHost {
+			continue
+		}
+
+		if port := addressURL.Port(); port != "" {
+			addressURL.Host = net.JoinHostPort(newHost, port)
+		} else {
+			addressURL.Host = newHost
+		}
+
+		l.addresses[i] = addressURL.String()
+		remapped = append(remapped, l.addresses[i])
+	}
+
+	return remapped
+}
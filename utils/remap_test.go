@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/antoniomika/syncmap"
+	"github.com/spf13/viper"
+	"github.com/vulcand/oxy/roundrobin"
+	"golang.org/x/crypto/ssh"
+)
+
+// remapTestHolder binds a HTTP holder for host to a forward of each of the
+// connections.
+func remapTestHolder(t *testing.T, state *State, host string, sshConns ...*SSHConnection) *HTTPHolder {
+	balancer, err := roundrobin.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	holder := &HTTPHolder{
+		HTTPUrl:        &url.URL{Scheme: "http", Host: host, Path: "/", User: url.UserPassword("", "")},
+		SSHConnections: syncmap.New[string, *SSHConnection](),
+		Balancer:       balancer,
+	}
+
+	for _, sshConn := range sshConns {
+		listenAddr := "/tmp/" + host + "_" + sshConn.SSHConn.RemoteAddr().String()
+
+		listenerHolder := &ListenerHolder{ListenAddr: listenAddr, SSHConn: sshConn}
+		listenerHolder.AddAddress("http://" + host + ":8080/")
+		sshConn.Listeners.Store(listenAddr, listenerHolder)
+
+		holder.SSHConnections.Store(listenAddr, sshConn)
+
+		err := balancer.UpsertServer(&url.URL{Host: listenAddr})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state.HTTPListeners.Store(holder.HTTPUrl.String(), holder)
+
+	return holder
+}
+
+// TestRemapHTTPHost validates that a connection's HTTP forwards are moved to
+// a new host, and that collisions and hosts shared with other connections are
+// rejected.
+func TestRemapHTTPHost(t *testing.T) {
+	viper.Set("domain", "example.com")
+	viper.Set("message-retry-count", 1)
+	defer viper.Set("domain", nil)
+	defer viper.Set("message-retry-count", nil)
+
+	state := NewState()
+
+	newConn := func(port int) *SSHConnection {
+		return &SSHConnection{
+			SSHConn:   &ssh.ServerConn{Conn: &closeTestConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}},
+			Listeners: syncmap.New[string, net.Listener](),
+			Messages:  make(chan string, 1),
+		}
+	}
+
+	alice, bob := newConn(1), newConn(2)
+
+	holder := remapTestHolder(t, state, "app.example.com", alice)
+	remapTestHolder(t, state, "taken.example.com", bob)
+	remapTestHolder(t, state, "shared.example.com", alice, bob)
+
+	for name, test := range map[string]struct {
+		oldHost string
+		newHost string
+		err     error
+	}{
+		"taken":     {oldHost: "app.example.com", newHost: "taken", err: errRemapTaken},
+		"not-owned": {oldHost: "taken.example.com", newHost: "moved", err: errRemapNotFound},
+		"shared":    {oldHost: "shared.example.com", newHost: "moved", err: errRemapShared},
+		"invalid":   {oldHost: "app.example.com", newHost: "moved/path", err: errRemapInvalid},
+	} {
+		_, err := state.RemapHTTPHost(alice, test.oldHost, test.newHost)
+		if !errors.Is(err, test.err) {
+			t.Errorf("Remapping %s returned %v when should have been %v", name, err, test.err)
+		}
+	}
+
+	addresses, err := state.RemapHTTPHost(alice, "app.example.com", "moved")
+	if err != nil || len(addresses) != 1 || addresses[0] != "http://moved.example.com:8080/" {
+		t.Fatalf("Remapping returned %v with error %v when should have been the moved address", addresses, err)
+	}
+
+	if _, ok := state.HTTPListeners.Load(holder.HTTPUrl.String()); ok {
+		t.Error("The old host should no longer be routed")
+	}
+
+	if moved := state.httpHolderFor("moved.example.com", hostRequest{Path: "/"}); moved == nil || moved.Balancer != holder.Balancer {
+		t.Fatal("The new host should be routed to the connection's balancer")
+	}
+
+	if message := <-alice.Messages; message == "" {
+		t.Error("The client should have been told about the new host")
+	}
+
+	for _, server := range holder.Balancer.Servers() {
+		err := holder.Balancer.RemoveServer(server)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state.RemoveHTTPHolder(holder)
+
+	if moved := state.httpHolderFor("moved.example.com", hostRequest{Path: "/"}); moved != nil {
+		t.Error("Removing the original holder should have removed the host it was moved to")
+	}
+}
+
+// TestAddHTTPHolder validates that a new holder doesn't replace the holder a
+// remap moved to the same URL.
+func TestAddHTTPHolder(t *testing.T) {
+	viper.Set("domain", "example.com")
+	viper.Set("message-retry-count", 1)
+	defer viper.Set("domain", nil)
+	defer viper.Set("message-retry-count", nil)
+
+	state := NewState()
+
+	alice := &SSHConnection{
+		SSHConn:   &ssh.ServerConn{Conn: &closeTestConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}}},
+		Listeners: syncmap.New[string, net.Listener](),
+		Messages:  make(chan string, 1),
+	}
+
+	holder := remapTestHolder(t, state, "app.example.com", alice)
+
+	_, err := state.RemapHTTPHost(alice, "app.example.com", "moved")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balancer, err := roundrobin.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newHolder := &HTTPHolder{
+		HTTPUrl:        &url.URL{Scheme: "http", Host: "moved.example.com", Path: "/", User: url.UserPassword("", "")},
+		SSHConnections: syncmap.New[string, *SSHConnection](),
+		Balancer:       balancer,
+	}
+
+	current, added := state.AddHTTPHolder(newHolder)
+	if added || current.Balancer != holder.Balancer {
+		t.Error("The moved holder should have been kept")
+	}
+
+	newHolder.HTTPUrl.Host = "other.example.com"
+
+	current, added = state.AddHTTPHolder(newHolder)
+	if !added || current != newHolder {
+		t.Error("A holder for a free URL should have been added")
+	}
+}
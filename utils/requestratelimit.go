@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/vulcand/oxy/roundrobin"
+)
+
+// RequestRateLimiter limits how many requests per second each HTTP forward
+// receives. Each forward has its own token bucket, keyed by its balancer so it
+// follows the forward when its host is remapped, and so one busy forward
+// doesn't use up the requests of another.
+type RequestRateLimiter struct {
+	lock    sync.Mutex
+	buckets map[*roundrobin.RoundRobin]*TokenBucket
+}
+
+// NewRequestRateLimiter returns a new RequestRateLimiter.
+func NewRequestRateLimiter() *RequestRateLimiter {
+	return &RequestRateLimiter{
+		buckets: map[*roundrobin.RoundRobin]*TokenBucket{},
+	}
+}
+
+// Allow takes a token from the bucket of holder and returns whether the
+// request should be forwarded. If it shouldn't, it also returns how long
+// until the forward accepts another request. Holders without a request rate
+// limit are always allowed. A nil limiter allows every request.
+func (r *RequestRateLimiter) Allow(holder *HTTPHolder) (bool, time.Duration) {
+	if r == nil {
+		return true, 0
+	}
+
+	rate := holder.RequestRateLimit()
+	if rate <= 0 {
+		return true, 0
+	}
+
+	r.lock.Lock()
+
+	bucket, ok := r.buckets[holder.Balancer]
+	if !ok || bucket.Rate != rate {
+		bucket = NewTokenBucket(rate, viper.GetInt64("http-request-rate-limit-burst"))
+		r.buckets[holder.Balancer] = bucket
+	}
+
+	r.lock.Unlock()
+
+	wait := bucket.Take(1)
+
+	return wait == 0, wait
+}
+
+// Evict removes the bucket of holder. It is called when the forward is
+// removed.
+func (r *RequestRateLimiter) Evict(holder *HTTPHolder) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.buckets, holder.Balancer)
+}
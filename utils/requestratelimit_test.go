@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"testing"
+	"time"
+
+	"github.com/antoniomika/syncmap"
+	"github.com/spf13/viper"
+	"github.com/vulcand/oxy/roundrobin"
+)
+
+// requestRateTestHolder returns a HTTP holder with its own balancer.
+func requestRateTestHolder(t *testing.T) *HTTPHolder {
+	balancer, err := roundrobin.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &HTTPHolder{
+		SSHConnections: syncmap.New[string, *SSHConnection](),
+		Balancer:       balancer,
+	}
+}
+
+// allowed returns whether the limiter allows a request to holder.
+func allowed(limiter *RequestRateLimiter, holder *HTTPHolder) bool {
+	ok, _ := limiter.Allow(holder)
+	return ok
+}
+
+// TestRequestRateLimiter validates that each forward has its own bucket, that
+// connections can lower the limit, and that buckets are evicted.
+func TestRequestRateLimiter(t *testing.T) {
+	viper.Set("http-request-rate-limit", 2)
+	defer viper.Set("http-request-rate-limit", nil)
+
+	limiter := NewRequestRateLimiter()
+
+	noisy := requestRateTestHolder(t)
+	quiet := requestRateTestHolder(t)
+
+	for i := 0; i < 2; i++ {
+		if !allowed(limiter, noisy) {
+			t.Fatalf("Request %d should have been allowed", i)
+		}
+	}
+
+	if ok, wait := limiter.Allow(noisy); ok || wait <= 0 || wait > 500*time.Millisecond {
+		t.Errorf("Request over the limit returned %t and wait %s when should have been rejected with a wait up to 500ms", ok, wait)
+	}
+
+	if !allowed(limiter, quiet) {
+		t.Error("Another forward should not share the bucket")
+	}
+
+	quiet.SSHConnections.Store("lowered", &SSHConnection{MaxRequestRate: 1})
+	if quiet.RequestRateLimit() != 1 {
+		t.Fatalf("Holder limit %d when should have been 1", quiet.RequestRateLimit())
+	}
+
+	if !allowed(limiter, quiet) || allowed(limiter, quiet) {
+		t.Error("Lowered limit should allow a single request")
+	}
+
+	limiter.Evict(noisy)
+	if _, ok := limiter.buckets[noisy.Balancer]; ok {
+		t.Error("Bucket should have been evicted")
+	}
+
+	if !allowed(limiter, noisy) {
+		t.Error("Evicted forward should start with a full bucket")
+	}
+
+	viper.Set("http-request-rate-limit", 0)
+	unlimited := requestRateTestHolder(t)
+
+	for i := 0; i < 10; i++ {
+		if !allowed(limiter, unlimited) {
+			t.Fatal("Forward without a limit should not be limited")
+		}
+	}
+
+	if _, ok := limiter.buckets[unlimited.Balancer]; ok {
+		t.Error("Forward without a limit should not have a bucket")
+	}
+}
@@ -0,0 +1,211 @@
+package utils
+
+import (
+	"crypto/rand"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Kinds of forwards that can be reserved with a reconnect token.
+const (
+	ReservedHTTP  = "http"
+	ReservedAlias = "alias"
+	ReservedTCP   = "tcp"
+)
+
+// reservedForward identifies a forward request of a reservation.
+type reservedForward struct {
+	kind    string
+	request string
+}
+
+// reservation keeps the addresses assigned to a connection's forwards so the
+// client can reclaim them when it reconnects with the reservation's token.
+// Reservations loaded from the StateStore have no owner until they are
+// claimed.
+type reservation struct {
+	userKey  string
+	owner    *SSHConnection
+	expires  time.Time
+	forwards map[reservedForward][]string
+}
+
+// active returns whether or not the reservation is owned by a connection or
+// still within reconnect-token-ttl.
+func (r *reservation) active(now time.Time) bool {
+	return r.owner != nil || now.Before(r.expires)
+}
+
+// NewReservation creates a reservation owned by the connection and returns
+// its reconnect token.
+func (s *State) NewReservation(sshConn *SSHConnection) string {
+	token := rand.Text()
+
+	s.reservationsLock.Lock()
+	defer s.reservationsLock.Unlock()
+
+	s.reservations[token] = &reservation{
+		userKey:  sshConn.UserKey(),
+		owner:    sshConn,
+		forwards: map[reservedForward][]string{},
+	}
+	s.persistReservation(token, s.reservations[token], true)
+
+	sshConn.ReconnectToken = token
+
+	return token
+}
+
+// ClaimReservation gives the reservation for token to the connection, so its
+// forwards can reclaim the reserved addresses. The connection must belong to
+// the same user that created the reservation. If the previous owner of the
+// reservation is still connected, it is cleaned up. Reservations made on
+// another instance are loaded from the StateStore.
+func (s *State) ClaimReservation(token string, sshConn *SSHConnection) error {
+	s.loadStoredReservation(token)
+
+	s.reservationsLock.Lock()
+
+	r, ok := s.reservations[token]
+	if !ok || !r.active(time.Now()) || r.userKey != sshConn.UserKey() {
+		s.reservationsLock.Unlock()
+		return fmt.Errorf("reconnect token is invalid or expired")
+	}
+
+	previousOwner := r.owner
+	r.owner = sshConn
+	sshConn.ReconnectToken = token
+	s.persistReservation(token, r, true)
+
+	s.reservationsLock.Unlock()
+
+	if previousOwner != nil && previousOwner != sshConn {
+		previousOwner.CleanUp(s, CloseReasonReconnected)
+	}
+
+	return nil
+}
+
+// AddReservedForward records the address assigned to a forward request of the
+// connection, so it can be reclaimed with the connection's reconnect token.
+func (s *State) AddReservedForward(sshConn *SSHConnection, kind string, request string, address string) {
+	if sshConn.ReconnectToken == "" {
+		return
+	}
+
+	s.reservationsLock.Lock()
+	defer s.reservationsLock.Unlock()
+
+	r, ok := s.reservations[sshConn.ReconnectToken]
+	key := reservedForward{kind: kind, request: request}
+	if !ok || r.owner != sshConn || slices.Contains(r.forwards[key], address) {
+		return
+	}
+
+	r.forwards[key] = append(r.forwards[key], address)
+	s.persistReservation(sshConn.ReconnectToken, r, false)
+}
+
+// remapReservedForwards replaces oldAddress with newAddress in the reserved
+// forwards of the connection, so the client reclaims the new address when it
+// reconnects.
+func (s *State) remapReservedForwards(sshConn *SSHConnection, kind string, oldAddress string, newAddress string) {
+	if sshConn.ReconnectToken == "" {
+		return
+	}
+
+	s.reservationsLock.Lock()
+	defer s.reservationsLock.Unlock()
+
+	r, ok := s.reservations[sshConn.ReconnectToken]
+	if !ok || r.owner != sshConn {
+		return
+	}
+
+	for key, addresses := range r.forwards {
+		if key.kind != kind {
+			continue
+		}
+
+		for i, address := range addresses {
+			if address == oldAddress {
+				addresses[i] = newAddress
+			}
+		}
+	}
+
+	s.persistReservation(sshConn.ReconnectToken, r, false)
+}
+
+// reservedForwards returns the addresses reserved for a forward request of
+// the connection.
+func (s *State) reservedForwards(sshConn *SSHConnection, kind string, request string) []string {
+	if sshConn.ReconnectToken == "" {
+		return nil
+	}
+
+	s.reservationsLock.Lock()
+	defer s.reservationsLock.Unlock()
+
+	r, ok := s.reservations[sshConn.ReconnectToken]
+	if !ok || r.owner != sshConn {
+		return nil
+	}
+
+	return slices.Clone(r.forwards[reservedForward{kind: kind, request: request}])
+}
+
+// reservedByOther returns whether or not address is reserved for a client
+// other than the connection. Expired reservations are removed from memory.
+// They are left in the StateStore, which expires them itself, as another
+// instance may have claimed them since.
+func (s *State) reservedByOther(sshConn *SSHConnection, kind string, address string) bool {
+	now := time.Now()
+
+	s.reservationsLock.Lock()
+	defer s.reservationsLock.Unlock()
+
+	reserved := false
+
+	for token, r := range s.reservations {
+		if !r.active(now) {
+			delete(s.reservations, token)
+			continue
+		}
+
+		if token == sshConn.ReconnectToken {
+			continue
+		}
+
+		for key, addresses := range r.forwards {
+			if key.kind == kind && slices.Contains(addresses, address) {
+				reserved = true
+			}
+		}
+	}
+
+	return reserved
+}
+
+// releaseReservation keeps the reservation of a closed connection for
+// reconnect-token-ttl.
+func (s *State) releaseReservation(sshConn *SSHConnection) {
+	if sshConn.ReconnectToken == "" {
+		return
+	}
+
+	s.reservationsLock.Lock()
+	defer s.reservationsLock.Unlock()
+
+	r, ok := s.reservations[sshConn.ReconnectToken]
+	if !ok || r.owner != sshConn {
+		return
+	}
+
+	r.owner = nil
+	r.expires = time.Now().Add(viper.GetDuration("reconnect-token-ttl"))
+	s.persistReservation(sshConn.ReconnectToken, r, false)
+}
@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// reservationTestConn returns a connection authenticated with fingerprint.
+func reservationTestConn(fingerprint string) *SSHConnection {
+	return &SSHConnection{
+		SSHConn: &ssh.ServerConn{
+			Permissions: &ssh.Permissions{
+				Extensions: map[string]string{"pubKeyFingerprint": fingerprint},
+			},
+		},
+	}
+}
+
+// TestReservations validates that a reconnecting client reclaims its reserved
+// addresses, and that they are held from other clients until they expire.
+func TestReservations(t *testing.T) {
+	viper.Set("reconnect-token-ttl", time.Hour)
+	defer viper.Set("reconnect-token-ttl", nil)
+
+	state := NewState()
+
+	first := reservationTestConn("alice")
+	token := state.NewReservation(first)
+
+	state.AddReservedForward(first, ReservedHTTP, "app", "abc.example.com")
+	state.AddReservedForward(first, ReservedHTTP, "app", "abc.example.com")
+
+	other := reservationTestConn("bob")
+	if !state.reservedByOther(other, ReservedHTTP, "abc.example.com") {
+		t.Error("Host should have been reserved for another client")
+	}
+
+	if state.reservedByOther(other, ReservedAlias, "abc.example.com") {
+		t.Error("Reservations of one kind should not reserve another")
+	}
+
+	err := state.ClaimReservation(token, other)
+	if err == nil {
+		t.Error("Token should not be claimable by another user")
+	}
+
+	state.releaseReservation(first)
+
+	second := reservationTestConn("alice")
+	err = state.ClaimReservation(token, second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reserved := state.reservedForwards(second, ReservedHTTP, "app")
+	if !slices.Equal(reserved, []string{"abc.example.com"}) {
+		t.Errorf("Reserved hosts %v when should have been [abc.example.com]", reserved)
+	}
+
+	if state.reservedByOther(second, ReservedHTTP, "abc.example.com") {
+		t.Error("Host should be available to the reservation's owner")
+	}
+
+	if state.reservedForwards(first, ReservedHTTP, "app") != nil {
+		t.Error("Previous owner should no longer see the reservation")
+	}
+
+	viper.Set("reconnect-token-ttl", -time.Second)
+	state.releaseReservation(second)
+
+	if state.reservedByOther(other, ReservedHTTP, "abc.example.com") {
+		t.Error("Expired reservation should not reserve the host")
+	}
+
+	err = state.ClaimReservation(token, reservationTestConn("alice"))
+	if err == nil {
+		t.Error("Expired token should not be claimable")
+	}
+}
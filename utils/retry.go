@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+
+	"github.com/spf13/viper"
+)
+
+// idempotentMethods are the HTTP methods that can safely be sent to another
+// backend if the first one fails.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// RetryTransport is a http.RoundTripper that retries idempotent requests on
+// the other healthy backends of Holder when a backend fails before sending
+// response headers. A round trip only returns once the response headers are
+// read, so nothing has been written to the client when a request is retried.
+// Requests are retried at most max-retries times.
+type RetryTransport struct {
+	Transport http.RoundTripper
+	Holder    *HTTPHolder
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	response, err := t.roundTrip(req)
+
+	maxRetries := viper.GetInt("max-retries")
+	if err == nil || maxRetries <= 0 || t.Holder == nil || !retryable(req) {
+		return response, err
+	}
+
+	tried := map[string]bool{req.URL.Host: true}
+
+	for retry := 1; retry <= maxRetries && req.Context().Err() == nil; retry++ {
+		backend := t.nextBackend(tried)
+		if backend == "" {
+			break
+		}
+
+		tried[backend] = true
+
+		retryReq := req.Clone(req.Context())
+		retryReq.URL.Host = backend
+
+		if req.GetBody != nil {
+			retryReq.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if viper.GetBool("debug") {
+			log.Printf("Retrying %s request to %s on another backend (%d of %d): %s", req.Method, req.Host, retry, maxRetries, err)
+		}
+
+		response, err = t.roundTrip(retryReq)
+		if err == nil {
+			return response, nil
+		}
+	}
+
+	return response, err
+}
+
+// roundTrip sends req to its backend. Requests to backends that are sent a
+// PROXY protocol header close their connection afterwards, so a connection
+// is never reused for another client.
+func (t *RetryTransport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.Holder != nil && !req.Close && t.Holder.BackendProxyProto(req.URL.Host) != 0 {
+		req = req.Clone(req.Context())
+		req.Close = true
+	}
+
+	return t.Transport.RoundTrip(req)
+}
+
+// nextBackend returns the host of a healthy backend of the holder whose
+// circuit breaker isn't open and that has not been tried yet, or an empty
+// string if there are none.
+func (t *RetryTransport) nextBackend(tried map[string]bool) string {
+	backend := ""
+
+	t.Holder.SSHConnections.Range(func(listenerAddr string, sshConn *SSHConnection) bool {
+		host := base64.StdEncoding.EncodeToString([]byte(listenerAddr))
+		if tried[host] || !sshConn.listenerHealthy(listenerAddr) || sshConn.Breaker.Open() || sshConn.Paused() {
+			return true
+		}
+
+		backend = host
+		return false
+	})
+
+	return backend
+}
+
+// retryable returns whether req can be sent again. Only idempotent requests
+// whose body is empty or can be read again are retried.
+func retryable(req *http.Request) bool {
+	if !idempotentMethods[req.Method] {
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/antoniomika/syncmap"
+	"github.com/spf13/viper"
+)
+
+// retryTestTransport fails requests to the failing backends and records the
+// backend and body of every request.
+type retryTestTransport struct {
+	failing map[string]bool
+	hosts   []string
+	bodies  []string
+}
+
+func (r *retryTestTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	backend, _ := base64.StdEncoding.DecodeString(req.URL.Host)
+	r.hosts = append(r.hosts, string(backend))
+
+	if req.Body != nil {
+		body, _ := io.ReadAll(req.Body)
+		r.bodies = append(r.bodies, string(body))
+	}
+
+	if r.failing[string(backend)] {
+		return nil, errors.New("connection reset by peer")
+	}
+
+	return &http.Response{StatusCode: http.StatusOK, Request: req}, nil
+}
+
+// TestRetryTransport validates that idempotent requests are retried on other
+// healthy backends and that other requests are not.
+func TestRetryTransport(t *testing.T) {
+	viper.Set("max-retries", 2)
+	defer viper.Set("max-retries", nil)
+
+	holder := &HTTPHolder{
+		SSHConnections: syncmap.New[string, *SSHConnection](),
+	}
+
+	// The unhealthy forward shares its connection with a healthy one, which
+	// is still retried.
+	shared := &SSHConnection{Listeners: syncmap.New[string, net.Listener]()}
+
+	unhealthy := &ListenerHolder{ListenAddr: "unhealthy", SSHConn: shared}
+	unhealthy.SetHealthy(false)
+
+	shared.Listeners.Store("unhealthy", unhealthy)
+	shared.Listeners.Store("second", &ListenerHolder{ListenAddr: "second", SSHConn: shared})
+
+	holder.SSHConnections.Store("first", &SSHConnection{})
+	holder.SSHConnections.Store("unhealthy", shared)
+	holder.SSHConnections.Store("second", shared)
+
+	newRequest := func(method string, body string) *http.Request {
+		req, err := http.NewRequest(method, "http://"+base64.StdEncoding.EncodeToString([]byte("first"))+"/", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return req
+	}
+
+	backends := &retryTestTransport{failing: map[string]bool{"first": true}}
+	transport := &RetryTransport{Transport: backends, Holder: holder}
+
+	response, err := transport.RoundTrip(newRequest(http.MethodPut, "data"))
+	if err != nil {
+		t.Fatalf("Retried request failed: %s", err)
+	}
+
+	served, _ := base64.StdEncoding.DecodeString(response.Request.URL.Host)
+	if string(served) != "second" {
+		t.Errorf("Request was served by %s when should have been second", served)
+	}
+
+	if strings.Join(backends.hosts, ",") != "first,second" || strings.Join(backends.bodies, ",") != "data,data" {
+		t.Errorf("Requests were sent to %v with bodies %v", backends.hosts, backends.bodies)
+	}
+
+	backends.hosts = nil
+
+	_, err = transport.RoundTrip(newRequest(http.MethodPost, "data"))
+	if err == nil || len(backends.hosts) != 1 {
+		t.Errorf("POST request was sent to %v when should not have been retried", backends.hosts)
+	}
+
+	backends.hosts = nil
+	backends.failing["second"] = true
+
+	_, err = transport.RoundTrip(newRequest(http.MethodGet, ""))
+	if err == nil || len(backends.hosts) != 2 {
+		t.Errorf("Request was sent to %v when every healthy backend fails", backends.hosts)
+	}
+}
+
+// TestRetryTransportProxyProto validates that requests to backends that are
+// sent a PROXY protocol header don't reuse their connection.
+func TestRetryTransportProxyProto(t *testing.T) {
+	holder := &HTTPHolder{
+		SSHConnections: syncmap.New[string, *SSHConnection](),
+	}
+
+	for addr, proxyProto := range map[string]byte{"plain": 0, "proxied": ProxyProtoV2} {
+		sshConn := &SSHConnection{Listeners: syncmap.New[string, net.Listener]()}
+		sshConn.Listeners.Store(addr, &ListenerHolder{Type: HTTPListener, ProxyProto: proxyProto})
+		holder.SSHConnections.Store(addr, sshConn)
+	}
+
+	transport := &RetryTransport{Transport: &retryTestTransport{}, Holder: holder}
+
+	for addr, closed := range map[string]bool{"plain": false, "proxied": true} {
+		req, err := http.NewRequest(http.MethodGet, "http://"+base64.StdEncoding.EncodeToString([]byte(addr))+"/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.Request.Close != closed {
+			t.Errorf("Request to %s closed its connection: %t when should have been %t", addr, response.Request.Close, closed)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package utils
+
+import (
+	"sort"
+)
+
+// RouteBackend is a SSH connection that serves a HTTP route.
+type RouteBackend struct {
+	RemoteAddr string `json:"remote_addr"`
+	User       string `json:"user"`
+	Healthy    bool   `json:"healthy"`
+	Circuit    string `json:"circuit"`
+}
+
+// RouteSnapshot is a view of a HTTP route and the connections serving it.
+type RouteSnapshot struct {
+	Host            string         `json:"host"`
+	Auth            bool           `json:"auth"`
+	Users           []string       `json:"users"`
+	BackendCount    int            `json:"backend_count"`
+	HealthyBackends int            `json:"healthy_backends"`
+	Backends        []RouteBackend `json:"backends"`
+}
+
+// HTTPRoutes returns a view of the HTTP routes the muxer routes requests by,
+// sorted by host. Auth is set for routes that require credentials, which are
+// never included. A backend is healthy if it is passing health checks and its
+// circuit breaker isn't open, so requests can be balanced to it.
+func (s *State) HTTPRoutes() []RouteSnapshot {
+	type keyedRoute struct {
+		key   string
+		route RouteSnapshot
+	}
+
+	keyed := []keyedRoute{}
+
+	s.HTTPListeners.Range(func(key string, holder *HTTPHolder) bool {
+		password, _ := holder.HTTPUrl.User.Password()
+
+		route := RouteSnapshot{
+			Host:     holder.HTTPUrl.Host + holder.HTTPUrl.Path,
+			Auth:     holder.HTTPUrl.User.Username() != "" || password != "",
+			Users:    []string{},
+			Backends: []RouteBackend{},
+		}
+
+		users := map[string]struct{}{}
+
+		holder.SSHConnections.Range(func(addr string, sshConn *SSHConnection) bool {
+			backend := RouteBackend{
+				RemoteAddr: sshConn.SSHConn.RemoteAddr().String(),
+				User:       sshConn.SSHConn.User(),
+				Healthy:    sshConn.routingWeight(addr) > 0,
+				Circuit:    sshConn.Breaker.State().String(),
+			}
+
+			if backend.Healthy {
+				route.HealthyBackends++
+			}
+
+			if _, ok := users[backend.User]; !ok {
+				users[backend.User] = struct{}{}
+				route.Users = append(route.Users, backend.User)
+			}
+
+			route.Backends = append(route.Backends, backend)
+			return true
+		})
+
+		sort.Strings(route.Users)
+		sort.Slice(route.Backends, func(i, j int) bool {
+			return route.Backends[i].RemoteAddr < route.Backends[j].RemoteAddr
+		})
+
+		route.BackendCount = len(route.Backends)
+
+		keyed = append(keyed, keyedRoute{key: key, route: route})
+		return true
+	})
+
+	sort.Slice(keyed, func(i, j int) bool {
+		if keyed[i].route.Host != keyed[j].route.Host {
+			return keyed[i].route.Host < keyed[j].route.Host
+		}
+
+		return keyed[i].key < keyed[j].key
+	})
+
+	routes := make([]RouteSnapshot, len(keyed))
+	for i, k := range keyed {
+		routes[i] = k.route
+	}
+
+	return routes
+}
+
+// PageRoutes returns at most limit of routes starting at offset. A limit of
+// zero or less returns every route after offset.
+func PageRoutes(routes []RouteSnapshot, offset int, limit int) []RouteSnapshot {
+	if offset < 0 {
+		offset = 0
+	}
+
+	if offset > len(routes) {
+		offset = len(routes)
+	}
+
+	routes = routes[offset:]
+
+	if limit > 0 && len(routes) > limit {
+		routes = routes[:limit]
+	}
+
+	return routes
+}
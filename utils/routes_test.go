@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"net"
+	"net/url"
+	"testing"
+
+	"github.com/antoniomika/syncmap"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestHTTPRoutes validates that the route table lists every HTTP holder sorted
+// by host with its users and backend health, without exposing credentials.
+func TestHTTPRoutes(t *testing.T) {
+	state := NewState()
+
+	newConn := func(port int) *SSHConnection {
+		return &SSHConnection{
+			SSHConn: &ssh.ServerConn{Conn: &closeTestConn{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}},
+		}
+	}
+
+	addHolder := func(host string, user *url.Userinfo, sshConns ...*SSHConnection) {
+		holder := &HTTPHolder{
+			HTTPUrl:        &url.URL{Host: host, Path: "/", User: user},
+			SSHConnections: syncmap.New[string, *SSHConnection](),
+		}
+
+		for _, sshConn := range sshConns {
+			holder.SSHConnections.Store(sshConn.SSHConn.RemoteAddr().String(), sshConn)
+		}
+
+		state.HTTPListeners.Store(holder.HTTPUrl.String(), holder)
+	}
+
+	unhealthy := newConn(2)
+	unhealthy.Listeners = syncmap.New[string, net.Listener]()
+
+	unhealthyListener := &ListenerHolder{SSHConn: unhealthy}
+	unhealthyListener.SetHealthy(false)
+	unhealthy.Listeners.Store(unhealthy.SSHConn.RemoteAddr().String(), unhealthyListener)
+
+	addHolder("b.example.com", url.UserPassword("", ""), newConn(1), unhealthy)
+	addHolder("a.example.com", url.UserPassword("", ""), newConn(3))
+	addHolder("a.example.com", url.UserPassword("admin", "secret"), newConn(4))
+
+	routes := state.HTTPRoutes()
+	if len(routes) != 3 {
+		t.Fatalf("Listed %d routes when should have been 3", len(routes))
+	}
+
+	for i, want := range []struct {
+		host    string
+		auth    bool
+		count   int
+		healthy int
+	}{
+		{host: "a.example.com/", count: 1, healthy: 1},
+		{host: "a.example.com/", auth: true, count: 1, healthy: 1},
+		{host: "b.example.com/", count: 2, healthy: 1},
+	} {
+		route := routes[i]
+		if route.Host != want.host || route.Auth != want.auth || route.BackendCount != want.count || route.HealthyBackends != want.healthy {
+			t.Errorf("Route %d is %+v when should have been %+v", i, route, want)
+		}
+
+		if len(route.Users) != 1 || route.Users[0] != "alice" {
+			t.Errorf("Route %d has users %v when should have been alice", i, route.Users)
+		}
+	}
+
+	if backend := routes[2].Backends[1]; backend.RemoteAddr != "127.0.0.1:2" || backend.Healthy || backend.Circuit != "closed" {
+		t.Errorf("Unhealthy backend is %+v", backend)
+	}
+}
+
+// TestPageRoutes validates that routes are paginated by offset and limit.
+func TestPageRoutes(t *testing.T) {
+	routes := []RouteSnapshot{{Host: "a"}, {Host: "b"}, {Host: "c"}}
+
+	for _, test := range []struct {
+		offset int
+		limit  int
+		hosts  string
+	}{
+		{offset: 0, limit: 2, hosts: "ab"},
+		{offset: 2, limit: 2, hosts: "c"},
+		{offset: 1, limit: 0, hosts: "bc"},
+		{offset: 5, limit: 2, hosts: ""},
+	} {
+		hosts := ""
+		for _, route := range PageRoutes(routes, test.offset, test.limit) {
+			hosts += route.Host
+		}
+
+		if hosts != test.hosts {
+			t.Errorf("Page at %d of %d is %q when should have been %q", test.offset, test.limit, hosts, test.hosts)
+		}
+	}
+}
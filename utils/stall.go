@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Directions of the data copied for a SSH connection's forwards, used to
+// report stall times.
+const (
+	// StallFromClient is data read from the SSH client and written to the
+	// remote end of the forwarded connection.
+	StallFromClient = "from_client"
+
+	// StallToClient is data read from the remote end of the forwarded
+	// connection and written to the SSH client.
+	StallToClient = "to_client"
+)
+
+// stallAverageWeight is the inverse of the weight each sample has in the
+// moving average of stall times.
+const stallAverageWeight = 8
+
+// stallMeter estimates the time spent blocked on reads and writes in one
+// direction of a SSH connection's copies. Only one in every sample rate reads
+// and writes is timed, and totals are scaled by the rate.
+type stallMeter struct {
+	read  atomic.Int64
+	write atomic.Int64
+
+	// recentRead and recentWrite are moving averages of the sampled
+	// durations, in nanoseconds.
+	recentRead  atomic.Int64
+	recentWrite atomic.Int64
+}
+
+// add records a sampled duration of a read or write, scaled by rate.
+func (m *stallMeter) add(write bool, d time.Duration, rate int) {
+	total, recent := &m.read, &m.recentRead
+	if write {
+		total, recent = &m.write, &m.recentWrite
+	}
+
+	total.Add(int64(d) * int64(rate))
+
+	average := recent.Load()
+	recent.Store(average + (int64(d)-average)/stallAverageWeight)
+}
+
+// info returns the StallInfo of the meter.
+func (m *stallMeter) info() StallInfo {
+	info := StallInfo{
+		Read:  time.Duration(m.read.Load()),
+		Write: time.Duration(m.write.Load()),
+	}
+
+	recentRead, recentWrite := m.recentRead.Load(), m.recentWrite.Load()
+	if recentRead+recentWrite > 0 {
+		info.WriteFraction = float64(recentWrite) / float64(recentRead+recentWrite)
+	}
+
+	return info
+}
+
+// StallInfo is the estimated time the copies in one direction of a SSH
+// connection's forwards spent blocked.
+type StallInfo struct {
+	// Read is the time spent waiting for data to read. It includes the time
+	// connections are idle.
+	Read time.Duration `json:"read"`
+
+	// Write is the time spent waiting for a slow peer to accept data.
+	Write time.Duration `json:"write"`
+
+	// WriteFraction is the share of recent blocked time spent writing.
+	// Values close to 1 mean the peer being written to is the bottleneck.
+	WriteFraction float64 `json:"write_fraction"`
+}
+
+// Stalls returns the estimated stall times of the connection's forwards by
+// direction, StallFromClient and StallToClient.
+func (s *SSHConnection) Stalls() map[string]StallInfo {
+	return map[string]StallInfo{
+		StallFromClient: s.fromClientStalls.info(),
+		StallToClient:   s.toClientStalls.info(),
+	}
+}
+
+// stallReader times one in every Rate reads from Reader.
+type stallReader struct {
+	Reader io.Reader
+	Meter  *stallMeter
+	Rate   int
+
+	calls int
+}
+
+// Read implements the reader and samples how long the read blocked.
+func (r *stallReader) Read(p []byte) (int, error) {
+	r.calls++
+	if r.calls%r.Rate != 0 {
+		return r.Reader.Read(p)
+	}
+
+	start := time.Now()
+	n, err := r.Reader.Read(p)
+	r.Meter.add(false, time.Since(start), r.Rate)
+
+	return n, err
+}
+
+// stallWriter times one in every Rate writes to Writer.
+type stallWriter struct {
+	Writer io.Writer
+	Meter  *stallMeter
+	Rate   int
+
+	calls int
+}
+
+// Write implements the writer and samples how long the write blocked.
+func (w *stallWriter) Write(p []byte) (int, error) {
+	w.calls++
+	if w.calls%w.Rate != 0 {
+		return w.Writer.Write(p)
+	}
+
+	start := time.Now()
+	n, err := w.Writer.Write(p)
+	w.Meter.add(true, time.Since(start), w.Rate)
+
+	return n, err
+}
@@ -0,0 +1,92 @@
+package utils
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// slowWriter is a writer that blocks for delay on each write.
+type slowWriter struct {
+	delay time.Duration
+}
+
+func (w slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	return len(p), nil
+}
+
+// TestStallMeter validates that sampled reads and writes are scaled by the
+// sample rate, and that a slow writer is reported as the bottleneck.
+func TestStallMeter(t *testing.T) {
+	meter := &stallMeter{}
+
+	reader := &stallReader{Reader: strings.NewReader(strings.Repeat("a", 8)), Meter: meter, Rate: 2}
+	writer := &stallWriter{Writer: slowWriter{delay: 5 * time.Millisecond}, Meter: meter, Rate: 2}
+
+	n, err := io.CopyBuffer(writer, reader, make([]byte, 1))
+	if err != nil || n != 8 {
+		t.Fatalf("Copied %d bytes with error %v when should have been 8", n, err)
+	}
+
+	info := meter.info()
+
+	if info.Write < 40*time.Millisecond || info.Write > time.Second {
+		t.Errorf("Estimated write stall of %s when should have been about 40ms", info.Write)
+	}
+
+	if info.Read > info.Write || info.WriteFraction < 0.9 {
+		t.Errorf("Slow writer should have been the bottleneck: %+v", info)
+	}
+
+	if (&stallMeter{}).info().WriteFraction != 0 {
+		t.Error("A meter without samples should have no write fraction")
+	}
+}
+
+// TestCopyBothStalls validates that copies of a SSH connection's forwards
+// record their stall times by direction.
+func TestCopyBothStalls(t *testing.T) {
+	viper.Set("stall-sample-rate", 1)
+	defer viper.Set("stall-sample-rate", nil)
+
+	sshConn := &SSHConnection{Close: make(chan bool)}
+
+	client, writer := net.Pipe()
+	reader, backend := net.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		CopyBothResult(writer, reader, sshConn)
+		close(done)
+	}()
+
+	go func() {
+		_, err := client.Write([]byte("hello"))
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+
+	buf := make([]byte, 5)
+
+	_, err := io.ReadFull(backend, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = client.Close()
+	_ = backend.Close()
+	<-done
+
+	stalls := sshConn.Stalls()
+	if stalls[StallToClient].Write < 10*time.Millisecond || stalls[StallFromClient].Write != 0 {
+		t.Errorf("Writes to the slow client should have stalled: %+v", stalls)
+	}
+}
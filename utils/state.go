@@ -1,21 +1,32 @@
 package utils
 
 import (
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/antoniomika/syncmap"
 	"github.com/jpillora/ipfilter"
+	"github.com/pires/go-proxyproto"
 	"github.com/spf13/viper"
 	"github.com/vulcand/oxy/forward"
 	"github.com/vulcand/oxy/roundrobin"
+	"golang.org/x/crypto/ssh"
 )
 
+// draining is set when the server stops accepting new forwards.
+var draining atomic.Bool
+
 // ListenerType represents any listener sish supports.
 type ListenerType int
 
@@ -29,6 +40,9 @@ const (
 	// TCPListener represents a generic tcp listener.
 	TCPListener
 
+	// UDPListener represents a udp listener.
+	UDPListener
+
 	// ProcessListener represents a process specific listener.
 	ProcessListener
 )
@@ -36,12 +50,23 @@ const (
 // LogWriter represents a writer that is used for writing logs in multiple locations.
 type LogWriter struct {
 	TimeFmt     string
+	Format      string
 	MultiWriter io.Writer
 }
 
 // Write implements the write function for the LogWriter. It will add a time in a
-// specific format to logs.
+// specific format to logs. If the json format is used, lines that are not already
+// JSON objects are wrapped in one.
 func (w LogWriter) Write(bytes []byte) (int, error) {
+	if w.Format == LogFormatJSON {
+		if len(bytes) > 0 && bytes[0] == '{' {
+			return w.MultiWriter.Write(bytes)
+		}
+
+		_, err := w.MultiWriter.Write(jsonLogLine("log", strings.TrimSuffix(string(bytes), "\n"), nil))
+		return len(bytes), err
+	}
+
 	return fmt.Fprintf(w.MultiWriter, "%v | %s", time.Now().Format(w.TimeFmt), string(bytes))
 }
 
@@ -53,6 +78,39 @@ type ListenerHolder struct {
 	SSHConn      *SSHConnection
 	OriginalAddr string
 	OriginalPort uint32
+	Limiter      *ForwardLimiter
+	ProxyProto   byte
+
+	addressesLock sync.Mutex
+	addresses     []string
+	unhealthy     atomic.Bool
+}
+
+// Healthy returns whether or not the listener is passing health checks. A nil
+// listener is always healthy.
+func (l *ListenerHolder) Healthy() bool {
+	return l == nil || !l.unhealthy.Load()
+}
+
+// SetHealthy sets the health check status of the listener.
+func (l *ListenerHolder) SetHealthy(healthy bool) {
+	l.unhealthy.Store(!healthy)
+}
+
+// AddAddress records a public address that the listener can be accessed from.
+func (l *ListenerHolder) AddAddress(address string) {
+	l.addressesLock.Lock()
+	defer l.addressesLock.Unlock()
+
+	l.addresses = append(l.addresses, address)
+}
+
+// Addresses returns the public addresses that the listener can be accessed from.
+func (l *ListenerHolder) Addresses() []string {
+	l.addressesLock.Lock()
+	defer l.addressesLock.Unlock()
+
+	return append([]string{}, l.addresses...)
 }
 
 // HTTPHolder holds proxy and connection info.
@@ -63,11 +121,118 @@ type HTTPHolder struct {
 	Balancer       *roundrobin.RoundRobin
 }
 
+// RequestBodyLimit returns the smallest request body limit of the holder's
+// connections, as requests can be sent to any of them. 0 means unlimited.
+func (h *HTTPHolder) RequestBodyLimit() int64 {
+	limit := viper.GetInt64("max-request-body-size")
+
+	h.SSHConnections.Range(func(key string, sshConn *SSHConnection) bool {
+		connLimit := sshConn.RequestBodyLimit()
+		if connLimit > 0 && (limit <= 0 || connLimit < limit) {
+			limit = connLimit
+		}
+
+		return true
+	})
+
+	return limit
+}
+
+// RequestHeaderLimit returns the smallest request header limit of the
+// holder's connections, as requests can be sent to any of them. 0 means
+// unlimited.
+func (h *HTTPHolder) RequestHeaderLimit() int64 {
+	limit := viper.GetInt64("max-request-header-size")
+
+	h.SSHConnections.Range(func(key string, sshConn *SSHConnection) bool {
+		connLimit := sshConn.RequestHeaderLimit()
+		if connLimit > 0 && (limit <= 0 || connLimit < limit) {
+			limit = connLimit
+		}
+
+		return true
+	})
+
+	return limit
+}
+
+// RequestRateLimit returns the smallest request rate limit of the holder's
+// connections, as requests can be sent to any of them. 0 means unlimited.
+func (h *HTTPHolder) RequestRateLimit() int64 {
+	limit := viper.GetInt64("http-request-rate-limit")
+
+	h.SSHConnections.Range(func(key string, sshConn *SSHConnection) bool {
+		connLimit := sshConn.RequestRateLimit()
+		if connLimit > 0 && (limit <= 0 || connLimit < limit) {
+			limit = connLimit
+		}
+
+		return true
+	})
+
+	return limit
+}
+
+// BackendProxyProto returns the PROXY protocol version sent to the backend
+// with the balancer host, the base64 encoded address of its listener. 0 means
+// no header is sent.
+func (h *HTTPHolder) BackendProxyProto(host string) byte {
+	listenerAddr, err := base64.StdEncoding.DecodeString(host)
+	if err != nil {
+		return 0
+	}
+
+	sshConn, ok := h.SSHConnections.Load(string(listenerAddr))
+	if !ok || sshConn.Listeners == nil {
+		return 0
+	}
+
+	listener, ok := sshConn.Listeners.Load(string(listenerAddr))
+	if !ok {
+		return 0
+	}
+
+	listenerHolder, ok := listener.(*ListenerHolder)
+	if !ok || listenerHolder.Type != HTTPListener {
+		return 0
+	}
+
+	return listenerHolder.ProxyProto
+}
+
 // AliasHolder holds alias and connection info.
 type AliasHolder struct {
 	AliasHost      string
 	SSHConnections *syncmap.Map[string, *SSHConnection]
 	Balancer       *roundrobin.RoundRobin
+	TLS            bool
+	Mux            bool
+}
+
+// UserAllowed returns whether a client with the public key fingerprint can
+// connect to the alias. With tcp-aliases-allowed-users, one of the alias's
+// connections has to allow the fingerprint or any. Clients without a
+// fingerprint, like connections to the TCP alias multiplexer, are only
+// allowed by any.
+func (a *AliasHolder) UserAllowed(fingerprint string) bool {
+	if !viper.GetBool("tcp-aliases-allowed-users") {
+		return true
+	}
+
+	allowed := false
+
+	a.SSHConnections.Range(func(name string, conn *SSHConnection) bool {
+		for _, allowedFingerprint := range conn.TCPAliasesAllowedUsers {
+			if allowedFingerprint == "any" || (allowedFingerprint != "" && fingerprint != "" && allowedFingerprint == fingerprint) {
+				allowed = true
+				return false
+			}
+		}
+
+		return true
+	})
+
+	return allowed
 }
 
 // TCPHolder holds proxy and connection info.
@@ -80,6 +245,83 @@ type TCPHolder struct {
 	NoHandle       bool
 }
 
+// sniALPNSeparator separates the server name and ALPN protocol in a SNI route key.
+const sniALPNSeparator = "|"
+
+// SNIRouteKey returns the balancer key used for a server name and an optional
+// ALPN protocol.
+func SNIRouteKey(serverName string, alpn string) string {
+	if alpn == "" {
+		return serverName
+	}
+
+	return serverName + sniALPNSeparator + alpn
+}
+
+// splitSNIRouteKey returns the server name and ALPN protocol of a SNI route key.
+func splitSNIRouteKey(key string) (string, string) {
+	serverName, alpn, _ := strings.Cut(key, sniALPNSeparator)
+	return serverName, alpn
+}
+
+// SNIRoute returns the balancer for a TLS server name and the ALPN protocols
+// offered by the client. The server name is matched first, preferring an exact
+// match followed by the most specific wildcard (*.example.com) match. For the
+// matched name, a route for one of the protocols is used in the client's order
+// of preference before falling back to the route without an ALPN protocol.
+func (tH *TCPHolder) SNIRoute(serverName string, protos ...string) (*roundrobin.RoundRobin, bool) {
+	serverName = strings.ToLower(serverName)
+
+	routes := map[string]map[string]*roundrobin.RoundRobin{}
+	names := []string{}
+
+	tH.Balancers.Range(func(key string, b *roundrobin.RoundRobin) bool {
+		name, alpn := splitSNIRouteKey(key)
+		if name != serverName && !MatchesWildcardHost(serverName, name) {
+			return true
+		}
+
+		if _, ok := routes[name]; !ok {
+			routes[name] = map[string]*roundrobin.RoundRobin{}
+			names = append(names, name)
+		}
+
+		routes[name][alpn] = b
+		return true
+	})
+
+	sort.Slice(names, func(i, j int) bool {
+		if names[i] == serverName || names[j] == serverName {
+			return names[i] == serverName
+		}
+
+		return len(names[i]) > len(names[j])
+	})
+
+	for _, name := range names {
+		for _, proto := range protos {
+			if balancer, ok := routes[name][proto]; ok {
+				return balancer, true
+			}
+		}
+
+		if balancer, ok := routes[name][""]; ok {
+			return balancer, true
+		}
+	}
+
+	return nil, false
+}
+
+// ServerNameAllowed returns whether the key of the SSH connection that owns
+// the forward at listenerAddr allows it to receive TLS connections for
+// serverName.
+func (tH *TCPHolder) ServerNameAllowed(listenerAddr string, serverName string) bool {
+	sshConn, ok := tH.SSHConnections.Load(listenerAddr)
+
+	return ok && sshConn.KeyPermissions.ServerNameAllowed(serverName)
+}
+
 // Handle will copy connections from one handler to a roundrobin server.
 func (tH *TCPHolder) Handle(state *State) {
 	for {
@@ -91,22 +333,25 @@ func (tH *TCPHolder) Handle(state *State) {
 		go func() {
 			clientRemote, _, err := net.SplitHostPort(cl.RemoteAddr().String())
 
-			if err != nil || state.IPFilter.Blocked(clientRemote) {
+			if err != nil || state.IPFilter.Blocked(clientRemote) || state.GeoIPFilter.Blocked(clientRemote) {
 				err := cl.Close()
 				if err != nil {
 					log.Printf("Unable to close connection: %s", err)
 				}
 
 				if viper.GetBool("debug") {
-					log.Printf("Blocked connection from %s to %s", cl.RemoteAddr().String(), cl.LocalAddr().String())
+					log.Printf("Blocked connection from %s to %s", LogAddr(cl.RemoteAddr()), cl.LocalAddr().String())
 				}
 
 				return
 			}
 
-			var bufBytes []byte
+			var clientConn net.Conn = cl
+			var tlvs []proxyproto.TLV
 
 			balancerName := ""
+			ja3 := ""
+			var protos []string
 			if tH.SNIProxy {
 				tlsHello, teeConn, err := PeekTLSHello(cl)
 				if tlsHello == nil {
@@ -120,46 +365,24 @@ func (tH *TCPHolder) Handle(state *State) {
 					return
 				}
 
-				bufBytes = make([]byte, teeConn.Buffer.Buffered())
-
-				_, err = io.ReadFull(teeConn, bufBytes)
-				if err != nil {
-					log.Printf("Unable to read buffered data: %s", err)
-
-					err := cl.Close()
-					if err != nil {
-						log.Printf("Unable to close connection: %s", err)
-					}
-
-					return
-				}
-
+				clientConn = teeConn.ReplayConn()
 				balancerName = tlsHello.ServerName
+				protos = tlsHello.SupportedProtos
+				tlvs = append(ProxyProtoTLVs(tlsHello), JA3TLVs(teeConn.JA3)...)
+				ja3 = teeConn.JA3
 			}
 
-			pB, ok := tH.Balancers.Load(balancerName)
+			balancer, ok := tH.SNIRoute(balancerName, protos...)
 			if !ok {
-				tH.Balancers.Range(func(n string, b *roundrobin.RoundRobin) bool {
-					if MatchesWildcardHost(balancerName, n) {
-						pB = b
-						return false
-					}
-					return true
-				})
-
-				if pB == nil {
-					log.Printf("Unable to load connection location: %s not found on TCP listener %s", balancerName, tH.TCPHost)
-
-					err := cl.Close()
-					if err != nil {
-						log.Printf("Unable to close connection: %s", err)
-					}
+				log.Printf("Unable to load connection location: %s not found on TCP listener %s", balancerName, tH.TCPHost)
 
-					return
+				err := cl.Close()
+				if err != nil {
+					log.Printf("Unable to close connection: %s", err)
 				}
-			}
 
-			balancer := pB
+				return
+			}
 
 			connectionLocation, err := balancer.NextServer()
 			if err != nil {
@@ -187,7 +410,21 @@ func (tH *TCPHolder) Handle(state *State) {
 
 			hostAddr := string(host)
 
-			logLine := fmt.Sprintf("Accepted connection from %s -> %s", cl.RemoteAddr().String(), cl.LocalAddr().String())
+			if tH.SNIProxy && !tH.ServerNameAllowed(hostAddr, balancerName) {
+				log.Printf("Rejected connection from %s: server name %s is not allowed for %s", LogAddr(cl.RemoteAddr()), balancerName, hostAddr)
+
+				err := cl.Close()
+				if err != nil {
+					log.Printf("Unable to close connection: %s", err)
+				}
+
+				return
+			}
+
+			logLine := fmt.Sprintf("Accepted connection from %s -> %s", LogAddr(cl.RemoteAddr()), cl.LocalAddr().String())
+			if ja3 != "" {
+				logLine = fmt.Sprintf("%s with ja3 %s", logLine, ja3)
+			}
 			log.Println(logLine)
 
 			if viper.GetBool("log-to-client") {
@@ -206,6 +443,10 @@ func (tH *TCPHolder) Handle(state *State) {
 				})
 			}
 
+			forwardConn, _ := tH.SSHConnections.Load(hostAddr)
+			MarkDSCP(cl, forwardConn)
+			ApplyNoDelay(cl, forwardConn)
+
 			conn, err := net.Dial("unix", hostAddr)
 			if err != nil {
 				log.Println("Error connecting to tcp balancer:", err)
@@ -218,21 +459,19 @@ func (tH *TCPHolder) Handle(state *State) {
 				return
 			}
 
-			if bufBytes != nil {
-				_, err := conn.Write(bufBytes)
-				if err != nil {
-					log.Println("Unable to write to conn:", err)
-
-					err := cl.Close()
-					if err != nil {
-						log.Printf("Unable to close connection: %s", err)
-					}
+			err = WriteForwardedHeader(conn, cl, tlvs)
+			if err != nil {
+				log.Println("Unable to write forwarded header:", err)
 
-					return
+				err := cl.Close()
+				if err != nil {
+					log.Printf("Unable to close connection: %s", err)
 				}
+
+				return
 			}
 
-			CopyBoth(conn, cl)
+			CopyBoth(conn, clientConn, nil)
 		}()
 	}
 }
@@ -257,11 +496,61 @@ type State struct {
 	HTTPListeners  *syncmap.Map[string, *HTTPHolder]
 	AliasListeners *syncmap.Map[string, *AliasHolder]
 	TCPListeners   *syncmap.Map[string, *TCPHolder]
+	UDPListeners   *syncmap.Map[string, *UDPHolder]
 	IPFilter       *ipfilter.IPFilter
+	GeoIPFilter    *GeoIPFilter
 	LogWriter      io.Writer
 	Ports          *Ports
+	Metrics        *Metrics
+	Quotas         *Quotas
+	AccessLogger   AccessLogger
+	HostAllocator  HostAllocator
+
+	// StateStore persists reservations so they can be shared with other
+	// instances. It is a MemoryStateStore unless state-store is set.
+	StateStore StateStore
+
+	// AdminClientCerts verifies the client certificates of admin console
+	// requests. It is nil if admin-console-client-ca is not set.
+	AdminClientCerts *ClientCertVerifier
+
+	// HTTPAuth holds the credentials loaded from http-auth-file by host.
+	HTTPAuth map[string]*HTTPAuth
+
+	// ConnectionRateLimiter limits new SSH connections by source IP. It is
+	// nil if ssh-connection-rate-limit is not set.
+	ConnectionRateLimiter *ConnectionRateLimiter
+
+	// RequestRateLimiter limits the requests per second of each HTTP forward.
+	RequestRateLimiter *RequestRateLimiter
+
+	// MultiProtocol routes connections to multiprotocol-port by protocol. It
+	// is nil if multiprotocol-port is not set.
+	MultiProtocol *MultiProtocolMux
+
+	tlsConfig      atomic.Pointer[tls.Config]
+	totalListeners atomic.Int64
+
+	teardownHooksLock sync.RWMutex
+	teardownHooks     []TeardownHook
+
+	userConnectionsLock sync.Mutex
+	userConnections     map[string]int
+
+	reservationsLock sync.Mutex
+	reservations     map[string]*reservation
+	storeWrites      chan storeWrite
+	instanceID       string
+
+	// httpRemapLock serializes moving HTTP holders between hosts with
+	// removing them.
+	httpRemapLock sync.Mutex
 }
 
+// TeardownHook is called after a SSH connection has been cleaned up. The
+// environment variables set by the client are available from GetEnv.
+type TeardownHook func(*SSHConnection, *State)
+
 // NewState returns a new State struct.
 func NewState() *State {
 	return &State{
@@ -270,9 +559,510 @@ func NewState() *State {
 		HTTPListeners:  syncmap.New[string, *HTTPHolder](),
 		AliasListeners: syncmap.New[string, *AliasHolder](),
 		TCPListeners:   syncmap.New[string, *TCPHolder](),
+		UDPListeners:   syncmap.New[string, *UDPHolder](),
 		IPFilter:       Filter,
+		GeoIPFilter:    GeoIP,
 		Console:        NewWebConsole(),
 		LogWriter:      multiWriter,
 		Ports:          &Ports{},
+		Metrics:        &Metrics{},
+		StateStore:     NewMemoryStateStore(),
+
+		RequestRateLimiter: NewRequestRateLimiter(),
+
+		userConnections: map[string]int{},
+		reservations:    map[string]*reservation{},
 	}
 }
+
+// AddTeardownHook registers a hook to run after each SSH connection is cleaned
+// up. Hooks should be registered at startup, before connections are accepted.
+func (s *State) AddTeardownHook(hook TeardownHook) {
+	s.teardownHooksLock.Lock()
+	defer s.teardownHooksLock.Unlock()
+
+	s.teardownHooks = append(s.teardownHooks, hook)
+}
+
+// runTeardownHooks runs the registered teardown hooks in order. Hooks that are
+// still running after teardown-hook-timeout are abandoned.
+func (s *State) runTeardownHooks(sshConn *SSHConnection) {
+	s.teardownHooksLock.RLock()
+	hooks := s.teardownHooks
+	s.teardownHooksLock.RUnlock()
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	timeout := time.NewTimer(viper.GetDuration("teardown-hook-timeout"))
+	defer timeout.Stop()
+
+	for _, hook := range hooks {
+		done := make(chan struct{})
+
+		go func() {
+			defer close(done)
+			hook(sshConn, s)
+		}()
+
+		select {
+		case <-done:
+		case <-timeout.C:
+			log.Println("Timed out running teardown hooks for:", LogAddr(sshConn.SSHConn.RemoteAddr()))
+			return
+		}
+	}
+}
+
+// ReapIdleConnections cleans up SSH connections that haven't copied any data
+// over their forwards for longer than idleAfter, and returns how many were
+// cleaned up.
+func (s *State) ReapIdleConnections(idleAfter time.Duration) int {
+	reaped := 0
+
+	s.SSHConnections.Range(func(key string, sshConn *SSHConnection) bool {
+		idle := time.Since(sshConn.LastActivity())
+		if idle <= idleAfter || sshConn.Paused() {
+			return true
+		}
+
+		LogEvent("connection_reaped", sshConn.logFields(LogFields{"idle": idle.String()}), "Reaping idle SSH connection for:", LogAddr(sshConn.SSHConn.RemoteAddr()), "idle for:", idle)
+
+		sshConn.CleanUp(s, CloseReasonIdleTimeout)
+		reaped++
+
+		return true
+	})
+
+	return reaped
+}
+
+// FindHTTPHolder returns the HTTPHolder that should handle a request for
+// hostname and path, and whether or not the request still needs to provide
+// credentials. Holders for the exact hostname are preferred over wildcard
+// holders, which are preferred over holders with a connection whose host regex
+// matches, followed by the holder with the longest matching path prefix.
+// Holders for the same host and path prefix that require credentials are
+// preferred over ones that don't.
+func (s *State) FindHTTPHolder(hostname string, path string, username string, password string) (*HTTPHolder, bool) {
+	var currentHolder *HTTPHolder
+	var currentRank [3]int
+
+	s.HTTPListeners.Range(func(key string, holder *HTTPHolder) bool {
+		rank := [3]int{}
+
+		if hostname == holder.HTTPUrl.Host {
+			rank[0] = 3
+		} else if MatchesWildcardHost(hostname, holder.HTTPUrl.Host) {
+			rank[0] = 2
+		} else if s.matchesHostRegex(holder, hostname) {
+			rank[0] = 1
+		} else {
+			return true
+		}
+
+		if !MatchesPathPrefix(path, holder.HTTPUrl.Path) {
+			return true
+		}
+
+		rank[1] = len(holder.HTTPUrl.Path)
+
+		holderPassword, _ := holder.HTTPUrl.User.Password()
+		if holder.HTTPUrl.User.Username() != "" && holderPassword != "" {
+			rank[2] = 1
+
+			if username == holder.HTTPUrl.User.Username() && password == holderPassword {
+				rank[2] = 2
+			}
+		}
+
+		if currentHolder == nil || slices.Compare(rank[:], currentRank[:]) > 0 {
+			currentHolder = holder
+			currentRank = rank
+		}
+
+		return true
+	})
+
+	return currentHolder, currentRank[2] == 1
+}
+
+// SetTLSConfig sets the TLS config used to terminate TLS for TCP aliases.
+func (s *State) SetTLSConfig(tlsConfig *tls.Config) {
+	s.tlsConfig.Store(tlsConfig)
+}
+
+// TLSConfig returns the TLS config used to terminate TLS for TCP aliases.
+// It is nil if HTTPS is not enabled.
+func (s *State) TLSConfig() *tls.Config {
+	return s.tlsConfig.Load()
+}
+
+// RegisterUserConnection counts a new SSH connection for its user. It returns
+// false if the user has already reached max-connections-per-user, in which case
+// the connection is not counted.
+func (s *State) RegisterUserConnection(sshConn *SSHConnection) bool {
+	limit := viper.GetInt("max-connections-per-user")
+	if limit <= 0 {
+		return true
+	}
+
+	key := sshConn.UserKey()
+
+	s.userConnectionsLock.Lock()
+	defer s.userConnectionsLock.Unlock()
+
+	if s.userConnections[key] >= limit {
+		return false
+	}
+
+	s.userConnections[key]++
+	sshConn.userKey = key
+
+	return true
+}
+
+// UserConnectionLimitReached returns whether or not the user identified by key,
+// as returned by SSHConnection.UserKey, has reached max-connections-per-user.
+func (s *State) UserConnectionLimitReached(key string) bool {
+	limit := viper.GetInt("max-connections-per-user")
+	if limit <= 0 {
+		return false
+	}
+
+	s.userConnectionsLock.Lock()
+	defer s.userConnectionsLock.Unlock()
+
+	return s.userConnections[key] >= limit
+}
+
+// LimitUserConnections wraps the authentication callbacks of sshConfig so a
+// user that has reached max-connections-per-user is rejected during the
+// handshake, before it can open a session. Connections that authenticate at
+// the same time are still counted by RegisterUserConnection once their
+// handshake completes.
+func (s *State) LimitUserConnections(sshConfig *ssh.ServerConfig) {
+	limited := func(c ssh.ConnMetadata, permissions *ssh.Permissions, err error) (*ssh.Permissions, error) {
+		if err != nil {
+			return permissions, err
+		}
+
+		key := c.User()
+		if permissions != nil && permissions.Extensions["pubKeyFingerprint"] != "" {
+			key = permissions.Extensions["pubKeyFingerprint"]
+		}
+
+		if s.UserConnectionLimitReached(key) {
+			LogEvent("connection_limit_reached", LogFields{"remote_addr": LogAddr(c.RemoteAddr()), "user": c.User()}, "Connection limit reached for user:", key)
+			return nil, fmt.Errorf("connection limit reached for user %s", key)
+		}
+
+		return permissions, nil
+	}
+
+	if passwordCallback := sshConfig.PasswordCallback; passwordCallback != nil {
+		sshConfig.PasswordCallback = func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			permissions, err := passwordCallback(c, password)
+			return limited(c, permissions, err)
+		}
+	}
+
+	if publicKeyCallback := sshConfig.PublicKeyCallback; publicKeyCallback != nil {
+		sshConfig.PublicKeyCallback = func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			permissions, err := publicKeyCallback(c, key)
+			return limited(c, permissions, err)
+		}
+	}
+}
+
+// releaseUserConnection removes a SSH connection from its user's count.
+func (s *State) releaseUserConnection(sshConn *SSHConnection) {
+	s.userConnectionsLock.Lock()
+	defer s.userConnectionsLock.Unlock()
+
+	if sshConn.userKey == "" {
+		return
+	}
+
+	s.userConnections[sshConn.userKey]--
+	if s.userConnections[sshConn.userKey] <= 0 {
+		delete(s.userConnections, sshConn.userKey)
+	}
+
+	sshConn.userKey = ""
+}
+
+// ReserveListener counts a new forward listener. It returns false if
+// max-total-listeners has already been reached, in which case the listener
+// is not counted.
+func (s *State) ReserveListener() bool {
+	limit := viper.GetInt64("max-total-listeners")
+
+	for {
+		current := s.totalListeners.Load()
+		if limit > 0 && current >= limit {
+			return false
+		}
+
+		if s.totalListeners.CompareAndSwap(current, current+1) {
+			return true
+		}
+	}
+}
+
+// ReleaseListener removes a closed forward listener from the count.
+func (s *State) ReleaseListener() {
+	s.totalListeners.Add(-1)
+}
+
+// TotalListeners returns the number of forward listeners that are open.
+func (s *State) TotalListeners() int64 {
+	return s.totalListeners.Load()
+}
+
+// BeginDrain stops the server from accepting new SSH sessions and forwards.
+// Existing connections are kept until they close on their own.
+func (s *State) BeginDrain() {
+	if draining.CompareAndSwap(false, true) {
+		log.Println("Draining connections. New sessions and forwards will be rejected.")
+	}
+}
+
+// Draining returns whether or not the server is in drain mode.
+func (s *State) Draining() bool {
+	return draining.Load()
+}
+
+// DrainStatus returns the number of SSH connections that are still active.
+func (s *State) DrainStatus() int {
+	count := 0
+
+	s.SSHConnections.Range(func(key string, value *SSHConnection) bool {
+		count++
+		return true
+	})
+
+	return count
+}
+
+// CloseAll sends a message to every SSH connection and cleans it up. Connections
+// are closed concurrently and will be waited on for at most shutdown-timeout, so
+// a stuck connection can't block shutdown. It returns the number of connections
+// that were closed within the timeout.
+func (s *State) CloseAll(message string) int {
+	closed := make(chan struct{})
+	connections := 0
+
+	// done is closed when CloseAll returns, so connections that are cleaned
+	// up after the timeout don't block on reporting it.
+	done := make(chan struct{})
+	defer close(done)
+
+	s.SSHConnections.Range(func(key string, sshConn *SSHConnection) bool {
+		connections++
+
+		go func() {
+			if message != "" {
+				sshConn.SendMessage(message, false)
+			}
+
+			sshConn.CleanUp(s, CloseReasonShutdown)
+
+			select {
+			case closed <- struct{}{}:
+			case <-done:
+			}
+		}()
+
+		return true
+	})
+
+	count := 0
+	timeout := time.NewTimer(viper.GetDuration("shutdown-timeout"))
+	defer timeout.Stop()
+
+	for count < connections {
+		select {
+		case <-closed:
+			count++
+		case <-timeout.C:
+			log.Printf("Timed out closing SSH connections, %d of %d closed", count, connections)
+			return count
+		}
+	}
+
+	return count
+}
+
+// CloseConnection sends message to the SSH connection with remoteAddr, if it
+// is not empty, and cleans it up. It returns a snapshot of the connection from
+// before it was closed, and whether it was found. If it is called
+// concurrently for the same connection, only one call finds it.
+func (s *State) CloseConnection(remoteAddr string, message string) (ConnectionSnapshot, bool) {
+	sshConn, ok := s.SSHConnections.LoadAndDelete(remoteAddr)
+	if !ok {
+		return ConnectionSnapshot{}, false
+	}
+
+	snapshot := sshConn.snapshot(time.Now())
+
+	if message != "" && sshConn.SendMessage(message, false) {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	sshConn.CleanUp(s, CloseReasonAdminKill)
+
+	return snapshot, true
+}
+
+// CloseListeners closes and removes every listener in the state, like the
+// SSH, HTTP and HTTPS listeners on each of their addresses. It returns the
+// number of listeners that were closed.
+func (s *State) CloseListeners() int {
+	closed := 0
+
+	s.Listeners.Range(func(key string, listener net.Listener) bool {
+		err := listener.Close()
+		if err != nil && !ListenerClosed(err) {
+			log.Printf("Error closing listener %s: %s", key, err)
+		}
+
+		s.Listeners.Delete(key)
+		closed++
+
+		return true
+	})
+
+	return closed
+}
+
+// Broadcast sends message to the console of every SSH connection and returns
+// how many received it. Messages are sent concurrently and without blocking,
+// so a slow connection doesn't hold up the others.
+func (s *State) Broadcast(message string) int {
+	var wg sync.WaitGroup
+	var received atomic.Int64
+
+	s.SSHConnections.Range(func(key string, sshConn *SSHConnection) bool {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if sshConn.SendMessage(message, false) {
+				received.Add(1)
+			}
+		}()
+
+		return true
+	})
+
+	wg.Wait()
+
+	return int(received.Load())
+}
+
+// ConnectionSnapshot is a point in time view of a SSH connection.
+type ConnectionSnapshot struct {
+	RemoteAddr     string            `json:"remote_addr"`
+	User           string            `json:"user"`
+	ListenerCount  int               `json:"listener_count"`
+	BytesIn        uint64            `json:"bytes_in"`
+	BytesOut       uint64            `json:"bytes_out"`
+	Uptime         time.Duration     `json:"uptime"`
+	ActiveForwards int64             `json:"active_forwards"`
+	QueuedForwards int64             `json:"queued_forwards"`
+	Paused         bool              `json:"paused"`
+	Capturing      bool              `json:"capturing"`
+	Labels         map[string]string `json:"labels,omitempty"`
+}
+
+// snapshot returns a ConnectionSnapshot of the connection.
+func (s *SSHConnection) snapshot(now time.Time) ConnectionSnapshot {
+	snapshot := ConnectionSnapshot{
+		RemoteAddr:    s.SSHConn.RemoteAddr().String(),
+		User:          s.SSHConn.User(),
+		ListenerCount: s.ListenerCount(),
+		BytesIn:       s.BytesIn(),
+		BytesOut:      s.BytesOut(),
+		Uptime:        now.Sub(s.Created),
+		Paused:        s.Paused(),
+		Capturing:     s.Capturing(),
+		Labels:        s.GetLabels(),
+	}
+
+	s.Listeners.Range(func(key string, value net.Listener) bool {
+		if holder, ok := value.(*ListenerHolder); ok && holder.Limiter != nil {
+			snapshot.ActiveForwards += holder.Limiter.Active()
+			snapshot.QueuedForwards += holder.Limiter.Queued()
+		}
+		return true
+	})
+
+	return snapshot
+}
+
+// ConnectionInfo is the information a client can request about its own connection.
+type ConnectionInfo struct {
+	ConnectionSnapshot
+	Forwards []string             `json:"forwards"`
+	Streams  []StreamInfo         `json:"streams"`
+	Stalls   map[string]StallInfo `json:"stalls"`
+	Healthy  bool                 `json:"healthy"`
+	Circuit  string               `json:"circuit"`
+	Env      map[string]string    `json:"env,omitempty"`
+	Quota    *QuotaInfo           `json:"quota,omitempty"`
+}
+
+// Info returns the ConnectionInfo of the connection, containing the public
+// addresses of each of its forwards.
+func (s *SSHConnection) Info() ConnectionInfo {
+	info := ConnectionInfo{
+		ConnectionSnapshot: s.snapshot(time.Now()),
+		Forwards:           []string{},
+		Streams:            s.Streams(),
+		Stalls:             s.Stalls(),
+		Healthy:            s.Healthy(),
+		Circuit:            s.Breaker.State().String(),
+		Env:                s.GetEnv(),
+	}
+
+	s.Listeners.Range(func(key string, value net.Listener) bool {
+		if holder, ok := value.(*ListenerHolder); ok {
+			info.Forwards = append(info.Forwards, holder.Addresses()...)
+		}
+		return true
+	})
+
+	sort.Strings(info.Forwards)
+
+	return info
+}
+
+// Snapshot returns a view of all current SSH connections that is safe to use
+// while connections are being cleaned up. It is sorted by remote address.
+// Only connections that match all of the filters are returned.
+func (s *State) Snapshot(filters ...SnapshotFilter) []ConnectionSnapshot {
+	now := time.Now()
+	snapshot := []ConnectionSnapshot{}
+
+	s.SSHConnections.Range(func(key string, value *SSHConnection) bool {
+		connSnapshot := value.snapshot(now)
+
+		for _, filter := range filters {
+			if !filter(connSnapshot) {
+				return true
+			}
+		}
+
+		snapshot = append(snapshot, connSnapshot)
+		return true
+	})
+
+	sort.Slice(snapshot, func(i, j int) bool {
+		return snapshot[i].RemoteAddr < snapshot[j].RemoteAddr
+	})
+
+	return snapshot
+}
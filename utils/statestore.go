@@ -0,0 +1,430 @@
+package utils
+
+import (
+	"crypto/rand"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// stateStoreQueueSize is the number of reservation writes that can wait to be
+// persisted. Writes over it are dropped and persisted on the next sync.
+const stateStoreQueueSize = 1024
+
+// StateStore persists the reservations of reconnect tokens, including the
+// addresses assigned to their forwards, so sish instances sharing a store can
+// take over the addresses of clients that fail over to them. Live connections
+// are never stored. Reservations are kept in memory and persisted in the
+// background, so a slow store doesn't slow down forwards.
+type StateStore interface {
+	// GetReservation returns the reservation for token, or nil if there is
+	// no active reservation for it.
+	GetReservation(token string) (*StoredReservation, error)
+
+	// PutReservation stores the reservation for token until it expires,
+	// regardless of the instance owning it. Its hosts are stored as well.
+	PutReservation(token string, reservation StoredReservation) error
+
+	// RefreshReservation stores the reservation for token like
+	// PutReservation, but only if the stored reservation is missing or owned
+	// by owner. It returns false without storing anything otherwise, such as
+	// after the client claimed it on another instance.
+	RefreshReservation(token string, owner string, reservation StoredReservation) (bool, error)
+
+	// DeleteReservation removes the reservation for token.
+	DeleteReservation(token string) error
+
+	// Reservations returns the active reservations by token.
+	Reservations() (map[string]StoredReservation, error)
+
+	// Hosts returns the active hosts of reservations.
+	Hosts() ([]StoredHost, error)
+}
+
+// StoredReservation is a reservation as it is persisted in a StateStore.
+// Owner is the ID of the instance the client holding the reservation is
+// connected to, and is empty once the client disconnects.
+type StoredReservation struct {
+	UserKey  string          `json:"user_key"`
+	Owner    string          `json:"owner,omitempty"`
+	Expires  time.Time       `json:"expires"`
+	Forwards []StoredForward `json:"forwards"`
+}
+
+// StoredHost maps an address reserved for a forward to the reservation it
+// was assigned to first. A host is only assigned to another reservation once
+// it expires, so two instances don't reserve the same host for different
+// clients.
+type StoredHost struct {
+	Kind    string    `json:"kind"`
+	Address string    `json:"address"`
+	Token   string    `json:"token"`
+	Owner   string    `json:"owner,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+// hosts returns the hosts of the reservation for token.
+func (r StoredReservation) hosts(token string) []StoredHost {
+	var hosts []StoredHost
+
+	for _, forward := range r.Forwards {
+		for _, address := range forward.Addresses {
+			hosts = append(hosts, StoredHost{
+				Kind:    forward.Kind,
+				Address: address,
+				Token:   token,
+				Owner:   r.Owner,
+				Expires: r.Expires,
+			})
+		}
+	}
+
+	return hosts
+}
+
+// StoredForward holds the addresses reserved for a forward request.
+type StoredForward struct {
+	Kind      string   `json:"kind"`
+	Request   string   `json:"request"`
+	Addresses []string `json:"addresses"`
+}
+
+// MemoryStateStore is a StateStore that keeps reservations in memory. It is
+// the default store, and doesn't share reservations between instances.
+type MemoryStateStore struct {
+	lock         sync.Mutex
+	reservations map[string]StoredReservation
+	hosts        map[string]StoredHost
+}
+
+// NewMemoryStateStore returns a new MemoryStateStore.
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{
+		reservations: map[string]StoredReservation{},
+		hosts:        map[string]StoredHost{},
+	}
+}
+
+// GetReservation implements StateStore.
+func (m *MemoryStateStore) GetReservation(token string) (*StoredReservation, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	reservation, ok := m.reservations[token]
+	if !ok || !time.Now().Before(reservation.Expires) {
+		return nil, nil
+	}
+
+	return &reservation, nil
+}
+
+// PutReservation implements StateStore.
+func (m *MemoryStateStore) PutReservation(token string, reservation StoredReservation) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.put(token, reservation)
+	return nil
+}
+
+// RefreshReservation implements StateStore.
+func (m *MemoryStateStore) RefreshReservation(token string, owner string, reservation StoredReservation) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	current, ok := m.reservations[token]
+	if ok && time.Now().Before(current.Expires) && current.Owner != owner {
+		return false, nil
+	}
+
+	m.put(token, reservation)
+	return true, nil
+}
+
+// put stores the reservation and the hosts that aren't assigned to another
+// active reservation. The caller must hold lock.
+func (m *MemoryStateStore) put(token string, reservation StoredReservation) {
+	now := time.Now()
+
+	m.reservations[token] = reservation
+
+	for _, host := range reservation.hosts(token) {
+		key := host.Kind + ":" + host.Address
+
+		if current, ok := m.hosts[key]; ok && current.Token != token && now.Before(current.Expires) {
+			continue
+		}
+
+		m.hosts[key] = host
+	}
+}
+
+// DeleteReservation implements StateStore.
+func (m *MemoryStateStore) DeleteReservation(token string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.reservations, token)
+	return nil
+}
+
+// Reservations implements StateStore. Expired reservations are removed.
+func (m *MemoryStateStore) Reservations() (map[string]StoredReservation, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	reservations := map[string]StoredReservation{}
+
+	for token, reservation := range m.reservations {
+		if !now.Before(reservation.Expires) {
+			delete(m.reservations, token)
+			continue
+		}
+
+		reservations[token] = reservation
+	}
+
+	return reservations, nil
+}
+
+// Hosts implements StateStore. Expired hosts are removed.
+func (m *MemoryStateStore) Hosts() ([]StoredHost, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := time.Now()
+	var hosts []StoredHost
+
+	for key, host := range m.hosts {
+		if !now.Before(host.Expires) {
+			delete(m.hosts, key)
+			continue
+		}
+
+		hosts = append(hosts, host)
+	}
+
+	return hosts, nil
+}
+
+// storeWrite is a reservation waiting to be persisted. Claims are stored
+// regardless of the instance owning the reservation, other writes are
+// refreshes that fail once another instance has claimed it.
+type storeWrite struct {
+	token       string
+	reservation StoredReservation
+	claim       bool
+}
+
+// StartStateStore loads the reservations of the state's StateStore and starts
+// persisting reservations to it. Every state-store-sync-interval, the
+// reservations of connected clients are refreshed in the store and the
+// reservations of other instances are loaded.
+func (s *State) StartStateStore() {
+	s.instanceID = rand.Text()
+	s.storeWrites = make(chan storeWrite, stateStoreQueueSize)
+
+	s.syncStateStore()
+
+	go func() {
+		for write := range s.storeWrites {
+			if write.claim {
+				err := s.StateStore.PutReservation(write.token, write.reservation)
+				if err != nil {
+					log.Println("Error persisting reservation:", err)
+				}
+
+				continue
+			}
+
+			refreshed, err := s.StateStore.RefreshReservation(write.token, s.instanceID, write.reservation)
+			if err != nil {
+				log.Println("Error persisting reservation:", err)
+				continue
+			}
+
+			if !refreshed {
+				s.dropReservation(write.token)
+			}
+		}
+	}()
+
+	interval := viper.GetDuration("state-store-sync-interval")
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			s.syncStateStore()
+		}
+	}()
+}
+
+// syncStateStore refreshes the reservations owned by connections in the
+// store, and loads the reservations of other instances that aren't owned by
+// a connection of this one. Hosts the store assigned to another reservation
+// are removed from the reservations owned by connections.
+func (s *State) syncStateStore() {
+	stored, err := s.StateStore.Reservations()
+	if err != nil {
+		log.Println("Error loading reservations:", err)
+		return
+	}
+
+	hosts, err := s.StateStore.Hosts()
+	if err != nil {
+		log.Println("Error loading reserved hosts:", err)
+		return
+	}
+
+	s.reservationsLock.Lock()
+	defer s.reservationsLock.Unlock()
+
+	for _, host := range hosts {
+		for token, r := range s.reservations {
+			if token == host.Token || r.owner == nil {
+				continue
+			}
+
+			for key, addresses := range r.forwards {
+				if key.kind == host.Kind && slices.Contains(addresses, host.Address) {
+					log.Printf("Host %s is reserved by another instance, removing it from the reservation", host.Address)
+					r.forwards[key] = slices.DeleteFunc(addresses, func(address string) bool { return address == host.Address })
+				}
+			}
+		}
+	}
+
+	for token, r := range s.reservations {
+		if r.owner != nil {
+			s.persistReservation(token, r, false)
+		}
+	}
+
+	for token, reservation := range stored {
+		if r, ok := s.reservations[token]; ok && r.owner != nil {
+			continue
+		}
+
+		s.reservations[token] = reservationFromStore(reservation)
+	}
+}
+
+// dropReservation gives up the reservation for token after a client claimed
+// it on another instance, so this instance stops refreshing it. The
+// connection that owned it keeps its forwards, but can't reclaim them with
+// the token. The reservation is replaced with the stored one.
+func (s *State) dropReservation(token string) {
+	stored, err := s.StateStore.GetReservation(token)
+	if err != nil {
+		log.Println("Error loading reservation:", err)
+	}
+
+	s.reservationsLock.Lock()
+	defer s.reservationsLock.Unlock()
+
+	r, ok := s.reservations[token]
+	if !ok || r.owner == nil {
+		return
+	}
+
+	log.Println("Reservation was claimed on another instance, releasing it")
+
+	if stored == nil {
+		delete(s.reservations, token)
+		return
+	}
+
+	s.reservations[token] = reservationFromStore(*stored)
+}
+
+// loadStoredReservation loads the reservation for token from the state's
+// StateStore if it isn't in memory, so a client that failed over from another
+// instance can claim it.
+func (s *State) loadStoredReservation(token string) {
+	if s.storeWrites == nil {
+		return
+	}
+
+	s.reservationsLock.Lock()
+	_, ok := s.reservations[token]
+	s.reservationsLock.Unlock()
+
+	if ok {
+		return
+	}
+
+	stored, err := s.StateStore.GetReservation(token)
+	if err != nil {
+		log.Println("Error loading reservation:", err)
+		return
+	}
+
+	if stored == nil {
+		return
+	}
+
+	s.reservationsLock.Lock()
+	defer s.reservationsLock.Unlock()
+
+	if _, ok := s.reservations[token]; !ok {
+		s.reservations[token] = reservationFromStore(*stored)
+	}
+}
+
+// persistReservation queues r to be written to the state's StateStore. A
+// claim is stored even if another instance owns the reservation, other
+// writes are dropped with the reservation if it does. Reservations owned by
+// a connection are stored as owned by this instance and expiring
+// reconnect-token-ttl from now, and are refreshed by the sync. The caller
+// must hold reservationsLock.
+func (s *State) persistReservation(token string, r *reservation, claim bool) {
+	if s.storeWrites == nil {
+		return
+	}
+
+	stored := StoredReservation{
+		UserKey: r.userKey,
+		Expires: r.expires,
+	}
+
+	if r.owner != nil {
+		stored.Owner = s.instanceID
+		stored.Expires = time.Now().Add(viper.GetDuration("reconnect-token-ttl"))
+	}
+
+	for key, addresses := range r.forwards {
+		stored.Forwards = append(stored.Forwards, StoredForward{
+			Kind:      key.kind,
+			Request:   key.request,
+			Addresses: append([]string{}, addresses...),
+		})
+	}
+
+	select {
+	case s.storeWrites <- storeWrite{token: token, reservation: stored, claim: claim}:
+	default:
+		log.Println("Reservation store queue is full, persisting on the next sync")
+	}
+}
+
+// reservationFromStore returns a reservation not owned by a connection of
+// this instance from a stored reservation.
+func reservationFromStore(stored StoredReservation) *reservation {
+	r := &reservation{
+		userKey:  stored.UserKey,
+		expires:  stored.Expires,
+		forwards: map[reservedForward][]string{},
+	}
+
+	for _, forward := range stored.Forwards {
+		r.forwards[reservedForward{kind: forward.Kind, request: forward.Request}] = append([]string{}, forward.Addresses...)
+	}
+
+	return r
+}
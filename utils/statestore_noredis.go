@@ -0,0 +1,11 @@
+//go:build !redis
+
+package utils
+
+import "fmt"
+
+// NewRedisStateStore returns an error, as sish was built without the redis
+// build tag.
+func NewRedisStateStore(rawURL string, prefix string) (StateStore, error) {
+	return nil, fmt.Errorf("sish was built without redis support, rebuild it with -tags redis")
+}
@@ -0,0 +1,180 @@
+package utils
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TestStateStoreFailover validates that a client failing over to another
+// instance sharing a StateStore reclaims its reserved addresses, that they
+// are held from other clients of that instance, and that the first instance
+// stops refreshing the reservation.
+func TestStateStoreFailover(t *testing.T) {
+	viper.Set("reconnect-token-ttl", time.Hour)
+	defer viper.Set("reconnect-token-ttl", nil)
+
+	store := NewMemoryStateStore()
+
+	first := NewState()
+	first.StateStore = store
+	first.StartStateStore()
+
+	conn := reservationTestConn("alice")
+	token := first.NewReservation(conn)
+	first.AddReservedForward(conn, ReservedHTTP, "app", "abc.example.com")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stored, err := store.GetReservation(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored != nil && len(stored.Forwards) == 1 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Reservation was not persisted")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second := NewState()
+	second.StateStore = store
+	second.StartStateStore()
+
+	if !second.reservedByOther(reservationTestConn("bob"), ReservedHTTP, "abc.example.com") {
+		t.Error("Host should have been reserved for the client of the other instance")
+	}
+
+	reconnected := reservationTestConn("alice")
+	err := second.ClaimReservation(token, reconnected)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reserved := second.reservedForwards(reconnected, ReservedHTTP, "app")
+	if !slices.Equal(reserved, []string{"abc.example.com"}) {
+		t.Errorf("Reserved hosts %v when should have been [abc.example.com]", reserved)
+	}
+
+	err = second.ClaimReservation(token, reservationTestConn("bob"))
+	if err == nil {
+		t.Error("Token should not be claimable by another user")
+	}
+
+	for {
+		stored, err := store.GetReservation(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if stored != nil && stored.Owner == second.instanceID {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("Claimed reservation was not persisted")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	first.syncStateStore()
+
+	for first.reservedForwards(conn, ReservedHTTP, "app") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("The first instance should have released the claimed reservation")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stored, err := store.GetReservation(token)
+	if err != nil || stored == nil || stored.Owner != second.instanceID {
+		t.Errorf("Reservation %v with error %v when should have been owned by the second instance", stored, err)
+	}
+}
+
+// TestMemoryStateStoreRefresh validates that a reservation is only refreshed
+// by the instance owning it, and that a host stays assigned to the first
+// reservation it was stored with.
+func TestMemoryStateStoreRefresh(t *testing.T) {
+	store := NewMemoryStateStore()
+
+	forwards := []StoredForward{{Kind: ReservedHTTP, Request: "app", Addresses: []string{"abc.example.com"}}}
+
+	err := store.PutReservation("first", StoredReservation{UserKey: "alice", Owner: "a", Expires: time.Now().Add(time.Hour), Forwards: forwards})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := store.RefreshReservation("first", "b", StoredReservation{UserKey: "alice", Owner: "b", Expires: time.Now().Add(time.Hour)})
+	if err != nil || refreshed {
+		t.Errorf("Refresh by another instance returned %t, %v when should have failed", refreshed, err)
+	}
+
+	refreshed, err = store.RefreshReservation("first", "a", StoredReservation{UserKey: "alice", Owner: "a", Expires: time.Now().Add(time.Hour), Forwards: forwards})
+	if err != nil || !refreshed {
+		t.Errorf("Refresh by the owner returned %t, %v when should have succeeded", refreshed, err)
+	}
+
+	err = store.PutReservation("second", StoredReservation{UserKey: "bob", Owner: "b", Expires: time.Now().Add(time.Hour), Forwards: forwards})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts, err := store.Hosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hosts) != 1 || hosts[0].Token != "first" || hosts[0].Owner != "a" {
+		t.Errorf("Hosts %v when should have only been assigned to first", hosts)
+	}
+}
+
+// TestMemoryStateStoreExpiry validates that expired reservations are not
+// returned by the MemoryStateStore.
+func TestMemoryStateStoreExpiry(t *testing.T) {
+	store := NewMemoryStateStore()
+
+	err := store.PutReservation("expired", StoredReservation{UserKey: "alice", Expires: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.PutReservation("active", StoredReservation{UserKey: "alice", Expires: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := store.GetReservation("expired")
+	if err != nil || stored != nil {
+		t.Errorf("Expired reservation returned %v, %v", stored, err)
+	}
+
+	reservations, err := store.Reservations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := reservations["active"]; !ok || len(reservations) != 1 {
+		t.Errorf("Reservations %v when should have only been active", reservations)
+	}
+
+	err = store.DeleteReservation("active")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err = store.GetReservation("active")
+	if err != nil || stored != nil {
+		t.Errorf("Deleted reservation returned %v, %v", stored, err)
+	}
+}
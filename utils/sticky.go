@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"crypto/rand"
+	"net/http"
+	"net/url"
+
+	"github.com/spf13/viper"
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/roundrobin/stickycookie"
+)
+
+// stickySessionSalt anonymizes sticky session cookies so they don't expose
+// the socket address of a forward.
+var stickySessionSalt = rand.Text()
+
+// HealthyCookieValue is a sticky session cookie value that only matches
+// servers that are still enabled in Balancer. Servers that are failing
+// health checks have a weight of 0 and fall back to normal balancing.
+type HealthyCookieValue struct {
+	stickycookie.CookieValue
+	Balancer *roundrobin.RoundRobin
+}
+
+// FindURL returns the server matching the cookie value if it is enabled.
+func (v *HealthyCookieValue) FindURL(raw string, urls []*url.URL) (*url.URL, error) {
+	u, err := v.CookieValue.FindURL(raw, urls)
+	if u == nil || err != nil || v.Balancer == nil {
+		return u, err
+	}
+
+	if weight, ok := v.Balancer.ServerWeight(u); !ok || weight < 1 {
+		return nil, nil
+	}
+
+	return u, nil
+}
+
+// NewStickySession returns a cookie based sticky session configured by the
+// sticky-sessions-cookie-name and sticky-sessions-cookie-ttl settings. The
+// balancer using the session must be set on the returned HealthyCookieValue.
+func NewStickySession() (*roundrobin.StickySession, *HealthyCookieValue) {
+	cookieValue := &HealthyCookieValue{
+		CookieValue: &stickycookie.HashValue{Salt: stickySessionSalt},
+	}
+
+	stickySession := roundrobin.NewStickySessionWithOptions(viper.GetString("sticky-sessions-cookie-name"), roundrobin.CookieOptions{
+		HTTPOnly: true,
+		MaxAge:   int(viper.GetDuration("sticky-sessions-cookie-ttl").Seconds()),
+		SameSite: http.SameSiteLaxMode,
+	}).SetCookieValue(cookieValue)
+
+	return stickySession, cookieValue
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/vulcand/oxy/roundrobin"
+	"github.com/vulcand/oxy/roundrobin/stickycookie"
+)
+
+// TestHealthyCookieValue validates that sticky cookies stop matching servers
+// that have been disabled by a health check.
+func TestHealthyCookieValue(t *testing.T) {
+	balancer, err := roundrobin.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &url.URL{Host: "c2VydmVy"}
+
+	err = balancer.UpsertServer(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookieValue := &HealthyCookieValue{
+		CookieValue: &stickycookie.HashValue{Salt: "salt"},
+		Balancer:    balancer,
+	}
+
+	raw := cookieValue.Get(server)
+
+	found, err := cookieValue.FindURL(raw, balancer.Servers())
+	if err != nil || found == nil || found.Host != server.Host {
+		t.Fatalf("Expected cookie to match %s, got %v (%v)", server, found, err)
+	}
+
+	err = balancer.UpsertServer(server, roundrobin.Weight(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found, err = cookieValue.FindURL(raw, balancer.Servers())
+	if err != nil || found != nil {
+		t.Errorf("Expected cookie to not match an unhealthy server, got %v (%v)", found, err)
+	}
+}
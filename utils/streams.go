@@ -0,0 +1,147 @@
+package utils
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Stream is a forwarded connection that is being copied for a SSH connection.
+type Stream struct {
+	LocalAddr  string
+	RemoteAddr string
+	JA3        string
+	Created    time.Time
+
+	bytesIn      atomic.Uint64
+	bytesOut     atomic.Uint64
+	lastActivity atomic.Int64
+	idle         *IdleTimeoutConn
+	webhookSent  bool
+}
+
+// StreamInfo is a point in time view of a Stream.
+type StreamInfo struct {
+	LocalAddr  string        `json:"local_addr"`
+	RemoteAddr string        `json:"remote_addr"`
+	JA3        string        `json:"ja3,omitempty"`
+	BytesIn    uint64        `json:"bytes_in"`
+	BytesOut   uint64        `json:"bytes_out"`
+	Age        time.Duration `json:"age"`
+	Idle       time.Duration `json:"idle"`
+}
+
+// openStream starts tracking a forwarded connection copied with conn, and
+// sends it to the connection's webhook. idle is the idle timeout of conn, if
+// it has one, so it can be suspended while the connection is paused.
+func (s *SSHConnection) openStream(conn net.Conn, idle *IdleTimeoutConn) *Stream {
+	stream := &Stream{
+		JA3:     ForwardedJA3(conn),
+		Created: time.Now(),
+		idle:    idle,
+	}
+
+	if conn.LocalAddr() != nil {
+		stream.LocalAddr = conn.LocalAddr().String()
+	}
+
+	if conn.RemoteAddr() != nil {
+		stream.RemoteAddr = conn.RemoteAddr().String()
+	}
+
+	stream.lastActivity.Store(stream.Created.UnixNano())
+
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+
+	if s.streams == nil {
+		s.streams = map[*Stream]struct{}{}
+	}
+
+	s.streams[stream] = struct{}{}
+
+	stream.webhookSent = s.Webhook.Send(ClientWebhookEvent{
+		Event:      "connection_opened",
+		Time:       stream.Created,
+		RemoteAddr: stream.RemoteAddr,
+		LocalAddr:  stream.LocalAddr,
+	})
+
+	return stream
+}
+
+// closeStream stops tracking a forwarded connection once it is done copying,
+// and sends the bytes it copied to the connection's webhook if its opened
+// event was sent.
+func (s *SSHConnection) closeStream(stream *Stream) {
+	s.streamsLock.Lock()
+	delete(s.streams, stream)
+	s.streamsLock.Unlock()
+
+	if !stream.webhookSent {
+		return
+	}
+
+	now := time.Now()
+
+	s.Webhook.Send(ClientWebhookEvent{
+		Event:      "connection_closed",
+		Time:       now,
+		RemoteAddr: stream.RemoteAddr,
+		LocalAddr:  stream.LocalAddr,
+		BytesIn:    stream.bytesIn.Load(),
+		BytesOut:   stream.bytesOut.Load(),
+		DurationMS: float64(now.Sub(stream.Created).Microseconds()) / 1000,
+	})
+}
+
+// idleConns returns the idle timeouts of the connection's open streams.
+func (s *SSHConnection) idleConns() []*IdleTimeoutConn {
+	s.streamsLock.Lock()
+	defer s.streamsLock.Unlock()
+
+	var idleConns []*IdleTimeoutConn
+
+	for stream := range s.streams {
+		if stream.idle != nil {
+			idleConns = append(idleConns, stream.idle)
+		}
+	}
+
+	return idleConns
+}
+
+// Streams returns the forwarded connections that are being copied for the
+// connection, ordered by most recent activity first. At most
+// info-max-streams are returned.
+func (s *SSHConnection) Streams() []StreamInfo {
+	now := time.Now()
+	streams := []StreamInfo{}
+
+	s.streamsLock.Lock()
+	for stream := range s.streams {
+		streams = append(streams, StreamInfo{
+			LocalAddr:  stream.LocalAddr,
+			RemoteAddr: stream.RemoteAddr,
+			JA3:        stream.JA3,
+			BytesIn:    stream.bytesIn.Load(),
+			BytesOut:   stream.bytesOut.Load(),
+			Age:        now.Sub(stream.Created),
+			Idle:       now.Sub(time.Unix(0, stream.lastActivity.Load())),
+		})
+	}
+	s.streamsLock.Unlock()
+
+	sort.SliceStable(streams, func(i, j int) bool {
+		return streams[i].Idle < streams[j].Idle
+	})
+
+	if limit := viper.GetInt("info-max-streams"); limit > 0 && len(streams) > limit {
+		streams = streams[:limit]
+	}
+
+	return streams
+}
@@ -0,0 +1,361 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/antoniomika/syncmap"
+	"github.com/logrusorgru/aurora"
+	"github.com/spf13/viper"
+	"github.com/vulcand/oxy/roundrobin"
+)
+
+// maxUDPDatagramSize is the largest datagram that can be relayed, which is
+// also the largest length that fits in a frame's length prefix.
+const maxUDPDatagramSize = 65535
+
+// maxUDPPortAttempts is how many random ports are tried for a UDP forward.
+const maxUDPPortAttempts = 10
+
+// udpFlowQueueSize is how many datagrams can wait to be written to a flow.
+// Datagrams are dropped while its queue is full, so a slow flow doesn't hold
+// up the datagrams of other clients.
+const udpFlowQueueSize = 64
+
+// UDPHolder holds a UDP listener and connection info. Datagrams from each
+// source address are relayed over their own forwarded connection, framed
+// with WriteUDPFrame.
+type UDPHolder struct {
+	UDPHost        string
+	Conn           net.PacketConn
+	SSHConnections *syncmap.Map[string, *SSHConnection]
+	Balancer       *roundrobin.RoundRobin
+	SessionTimeout time.Duration
+
+	flowsLock sync.Mutex
+	flows     map[string]*udpFlow
+	running   sync.WaitGroup
+}
+
+// udpFlow is the forwarded connection of a source address, and the queue of
+// datagrams waiting to be written to it.
+type udpFlow struct {
+	conn      net.Conn
+	datagrams chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewUDPHolder returns a UDPHolder for conn that closes flows after
+// udp-session-timeout.
+func NewUDPHolder(udpHost string, conn net.PacketConn, balancer *roundrobin.RoundRobin) *UDPHolder {
+	return &UDPHolder{
+		UDPHost:        udpHost,
+		Conn:           conn,
+		SSHConnections: syncmap.New[string, *SSHConnection](),
+		Balancer:       balancer,
+		SessionTimeout: viper.GetDuration("udp-session-timeout"),
+		flows:          map[string]*udpFlow{},
+	}
+}
+
+// Start handles the UDP listener in a goroutine that Close waits for.
+func (uH *UDPHolder) Start(state *State) {
+	uH.running.Add(1)
+
+	go func() {
+		defer uH.running.Done()
+		uH.handle(state)
+	}()
+}
+
+// handle reads datagrams from the UDP listener and queues them on the flow of
+// their source address, opening a new flow if needed. Flows are closed after
+// SessionTimeout without a datagram in either direction.
+func (uH *UDPHolder) handle(state *State) {
+	buf := make([]byte, maxUDPDatagramSize)
+
+	for {
+		n, addr, err := uH.Conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+
+		clientRemote, _, err := net.SplitHostPort(addr.String())
+		if err != nil || state.IPFilter.Blocked(clientRemote) || state.GeoIPFilter.Blocked(clientRemote) {
+			if viper.GetBool("debug") {
+				log.Printf("Blocked datagram from %s to %s", LogAddr(addr), uH.Conn.LocalAddr().String())
+			}
+
+			continue
+		}
+
+		flow, err := uH.flow(addr)
+		if err != nil {
+			log.Println("Unable to open UDP flow:", err)
+			continue
+		}
+
+		select {
+		case flow.datagrams <- bytes.Clone(buf[:n]):
+		case <-flow.done:
+		default:
+			if viper.GetBool("debug") {
+				log.Printf("Dropped datagram from %s as its UDP flow is busy", LogAddr(addr))
+			}
+		}
+	}
+
+	uH.closeFlows()
+}
+
+// Close closes the UDP listener and its flows, and waits for the goroutines
+// relaying them to return.
+func (uH *UDPHolder) Close() error {
+	err := uH.Conn.Close()
+
+	uH.closeFlows()
+	uH.running.Wait()
+
+	return err
+}
+
+// closeFlows closes every flow of the holder.
+func (uH *UDPHolder) closeFlows() {
+	uH.flowsLock.Lock()
+	flows := uH.flows
+	uH.flows = map[string]*udpFlow{}
+	uH.flowsLock.Unlock()
+
+	for _, flow := range flows {
+		flow.close()
+	}
+}
+
+// flow returns the flow for addr, opening a connection to the next server of
+// the balancer if there isn't one.
+func (uH *UDPHolder) flow(addr net.Addr) (*udpFlow, error) {
+	uH.flowsLock.Lock()
+	defer uH.flowsLock.Unlock()
+
+	if flow, ok := uH.flows[addr.String()]; ok {
+		return flow, nil
+	}
+
+	connectionLocation, err := uH.Balancer.NextServer()
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := base64.StdEncoding.DecodeString(connectionLocation.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("unix", string(host))
+	if err != nil {
+		return nil, err
+	}
+
+	flow := &udpFlow{
+		conn:      conn,
+		datagrams: make(chan []byte, udpFlowQueueSize),
+		done:      make(chan struct{}),
+	}
+
+	uH.flows[addr.String()] = flow
+
+	uH.running.Add(2)
+	go uH.writeFlow(addr, flow)
+	go uH.relayFlow(addr, flow)
+
+	return flow, nil
+}
+
+// writeFlow writes the datagrams queued for flow until it is closed.
+func (uH *UDPHolder) writeFlow(addr net.Addr, flow *udpFlow) {
+	defer uH.running.Done()
+
+	for {
+		select {
+		case datagram := <-flow.datagrams:
+			err := WriteUDPFrame(flow.conn, datagram)
+			if err != nil {
+				if viper.GetBool("debug") {
+					log.Println("Unable to write datagram to UDP flow:", err)
+				}
+
+				uH.closeFlow(addr.String(), flow)
+				return
+			}
+
+			err = flow.conn.SetReadDeadline(time.Now().Add(uH.SessionTimeout))
+			if err != nil && viper.GetBool("debug") {
+				log.Println("Unable to extend UDP flow deadline:", err)
+			}
+		case <-flow.done:
+			return
+		}
+	}
+}
+
+// relayFlow sends the datagrams read from flow back to addr until the flow
+// times out or is closed.
+func (uH *UDPHolder) relayFlow(addr net.Addr, flow *udpFlow) {
+	defer uH.running.Done()
+	defer uH.closeFlow(addr.String(), flow)
+
+	err := flow.conn.SetReadDeadline(time.Now().Add(uH.SessionTimeout))
+	if err != nil && viper.GetBool("debug") {
+		log.Println("Unable to set UDP flow deadline:", err)
+	}
+
+	for {
+		datagram, err := ReadUDPFrame(flow.conn)
+		if err != nil {
+			return
+		}
+
+		_, err = uH.Conn.WriteTo(datagram, addr)
+		if err != nil {
+			if viper.GetBool("debug") {
+				log.Println("Unable to write datagram to UDP client:", err)
+			}
+
+			return
+		}
+
+		err = flow.conn.SetReadDeadline(time.Now().Add(uH.SessionTimeout))
+		if err != nil && viper.GetBool("debug") {
+			log.Println("Unable to extend UDP flow deadline:", err)
+		}
+	}
+}
+
+// closeFlow closes flow and removes it if it is still the flow for key.
+func (uH *UDPHolder) closeFlow(key string, flow *udpFlow) {
+	uH.flowsLock.Lock()
+	if uH.flows[key] == flow {
+		delete(uH.flows, key)
+	}
+	uH.flowsLock.Unlock()
+
+	flow.close()
+}
+
+// close closes the flow's connection and stops its writer. It is safe to call
+// more than once.
+func (f *udpFlow) close() {
+	f.closeOnce.Do(func() {
+		close(f.done)
+
+		err := f.conn.Close()
+		if err != nil && viper.GetBool("debug") {
+			log.Println("Unable to close UDP flow:", err)
+		}
+	})
+}
+
+// WriteUDPFrame writes datagram to w prefixed with its length as a 2 byte
+// big endian integer. This is the same framing DNS uses over TCP.
+func WriteUDPFrame(w io.Writer, datagram []byte) error {
+	if len(datagram) > maxUDPDatagramSize {
+		return fmt.Errorf("datagram of %d bytes is too large", len(datagram))
+	}
+
+	frame := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[2:], datagram)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadUDPFrame reads a datagram written with WriteUDPFrame from r.
+func ReadUDPFrame(r io.Reader) ([]byte, error) {
+	length := make([]byte, 2)
+
+	_, err := io.ReadFull(r, length)
+	if err != nil {
+		return nil, err
+	}
+
+	datagram := make([]byte, binary.BigEndian.Uint16(length))
+
+	_, err = io.ReadFull(r, datagram)
+	if err != nil {
+		return nil, err
+	}
+
+	return datagram, nil
+}
+
+// GetOpenUDPPort returns a UDP address that can be bound for a forward. If
+// the requested port is unavailable, a random port in the connection's port
+// bind range is used. If load balancing is enabled, it will return the
+// holder of the requested port if it is used.
+func GetOpenUDPPort(addr string, port uint32, state *State, sshConn *SSHConnection) (string, uint32, *UDPHolder, error) {
+	portBindRange := sshConn.PortBindRange()
+	bindAddr := addr
+
+	if bindAddr == "" {
+		bindAddr = sshConn.TCPAddress
+	}
+
+	if (bindAddr == "localhost" && viper.GetBool("localhost-as-all")) || viper.GetBool("force-tcp-address") {
+		bindAddr = viper.GetString("tcp-address")
+	}
+
+	available := func(checkPort uint32) (*UDPHolder, bool) {
+		listenAddr := GenerateAddress(bindAddr, checkPort)
+
+		if holder, ok := state.UDPListeners.Load(listenAddr); ok {
+			return holder, viper.GetBool("tcp-load-balancer")
+		}
+
+		conn, err := net.ListenPacket("udp", listenAddr)
+		if err != nil {
+			return nil, false
+		}
+
+		err = conn.Close()
+		if err != nil {
+			log.Println("Error closing listener:", err)
+		}
+
+		return nil, true
+	}
+
+	_, err := CheckPort(port, portBindRange)
+	if err == nil && !viper.GetBool("bind-random-ports") {
+		if holder, ok := available(port); ok {
+			return GenerateAddress(bindAddr, port), port, holder, nil
+		}
+	}
+
+	if viper.GetBool("force-requested-ports") {
+		sshConn.SendMessage(aurora.Sprintf("The UDP port %d is unavailable.", aurora.Red(port)), true)
+		return "", 0, nil, fmt.Errorf("unable to bind requested port")
+	}
+
+	if port != 0 {
+		sshConn.SendMessage(aurora.Sprintf("The UDP port %d is unavailable. Assigning a random port.", aurora.Red(port)), true)
+	}
+
+	for range maxUDPPortAttempts {
+		randomPort := randomPortInRange(portBindRange)
+
+		if holder, ok := available(randomPort); ok && holder == nil {
+			return GenerateAddress(bindAddr, randomPort), randomPort, nil, nil
+		}
+	}
+
+	return "", 0, nil, fmt.Errorf("unable to find an open udp port")
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jpillora/ipfilter"
+	"github.com/vulcand/oxy/roundrobin"
+)
+
+// TestUDPFrame validates that datagrams are read back as they were written.
+func TestUDPFrame(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	for _, datagram := range [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("x"), maxUDPDatagramSize)} {
+		err := WriteUDPFrame(buf, datagram)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		read, err := ReadUDPFrame(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(read, datagram) {
+			t.Errorf("Read %d bytes when should have been %d", len(read), len(datagram))
+		}
+	}
+
+	err := WriteUDPFrame(buf, make([]byte, maxUDPDatagramSize+1))
+	if err == nil {
+		t.Error("Datagram over the frame size should have been rejected")
+	}
+}
+
+// TestUDPHolder validates that datagrams are relayed through a forwarded
+// connection and that replies are sent back to the client.
+func TestUDPHolder(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "forward.sock")
+
+	forward, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forward.Close()
+
+	go func() {
+		conn, err := forward.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			datagram, err := ReadUDPFrame(conn)
+			if err != nil {
+				return
+			}
+
+			err = WriteUDPFrame(conn, append([]byte("ECHO:"), datagram...))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	balancer, err := roundrobin.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = balancer.UpsertServer(&url.URL{Host: base64.StdEncoding.EncodeToString([]byte(socket))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state := NewState()
+	state.IPFilter = ipfilter.NewNoDB(ipfilter.Options{})
+
+	holder := NewUDPHolder(conn.LocalAddr().String(), conn, balancer)
+	holder.SessionTimeout = time.Second
+	holder.Start(state)
+	defer func() {
+		err := holder.Close()
+		if err != nil {
+			t.Error(err)
+		}
+
+		holder.flowsLock.Lock()
+		flows := len(holder.flows)
+		holder.flowsLock.Unlock()
+
+		if flows != 0 {
+			t.Errorf("Holder has %d flows after closing when should have had 0", flows)
+		}
+	}()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	err = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, message := range []string{"one", "two"} {
+		_, err = client.Write([]byte(message))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply := make([]byte, 64)
+		n, err := client.Read(reply)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(reply[:n]) != "ECHO:"+message {
+			t.Errorf("Received %q when should have been %q", reply[:n], "ECHO:"+message)
+		}
+	}
+
+	holder.flowsLock.Lock()
+	flows := len(holder.flows)
+	holder.flowsLock.Unlock()
+
+	if flows != 1 {
+		t.Errorf("Holder has %d flows when should have had 1", flows)
+	}
+}
@@ -8,6 +8,8 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
@@ -21,6 +23,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
@@ -48,9 +51,15 @@ var (
 	// Filter is the IPFilter used to block connections.
 	Filter *ipfilter.IPFilter
 
+	// GeoIP is the GeoIPFilter used to block forwarded connections by country.
+	GeoIP *GeoIPFilter
+
 	// certHolder is a slice of publickeys for auth.
 	certHolder = make([]ssh.PublicKey, 0)
 
+	// keyPermissionsHolder maps public key fingerprints to their permissions.
+	keyPermissionsHolder = map[string]*KeyPermissions{}
+
 	// holderLock is the mutex used to update the certHolder slice.
 	holderLock = sync.Mutex{}
 
@@ -95,6 +104,13 @@ func Setup(logWriter io.Writer) {
 		Filter = ipfilter.NewNoDB(ipfilterOpts)
 	}
 
+	allowedCountriesList := upperList(viper.GetString("allowed-countries"))
+	blockedCountriesList := upperList(viper.GetString("blocked-countries"))
+
+	if len(allowedCountriesList) > 0 || len(blockedCountriesList) > 0 {
+		GeoIP = NewGeoIPFilter(viper.GetString("geoip-database"), allowedCountriesList, blockedCountriesList, viper.GetBool("geoip-fail-open"))
+	}
+
 	bannedSubdomainList = append(bannedSubdomainList, strings.FieldsFunc(viper.GetString("banned-subdomains"), CommaSplitFields)...)
 	for k, v := range bannedSubdomainList {
 		bannedSubdomainList[k] = strings.ToLower(strings.TrimSpace(v) + "." + viper.GetString("domain"))
@@ -112,6 +128,8 @@ func CommaSplitFields(c rune) bool {
 }
 
 // LoadProxyProtoConfig will load the timeouts and policies for the proxy protocol.
+// Headers are only used from trusted upstreams, which are checked when each
+// connection is accepted so reloading them applies to new connections.
 func LoadProxyProtoConfig(l *proxyproto.Listener) {
 	if viper.GetBool("proxy-protocol-use-timeout") {
 		l.ReadHeaderTimeout = viper.GetDuration("proxy-protocol-timeout")
@@ -129,11 +147,70 @@ func LoadProxyProtoConfig(l *proxyproto.Listener) {
 			return proxyproto.USE, nil
 		}
 	}
+
+	timeout := l.ReadHeaderTimeout
+	if timeout == 0 {
+		timeout = proxyproto.DefaultReadHeaderTimeout
+	}
+
+	l.Listener = &trustedUpstreamListener{
+		Listener: l.Listener,
+		policy:   l.ConnPolicy,
+		timeout:  timeout,
+	}
+
+	l.ConnPolicy = func(connPolicyOptions proxyproto.ConnPolicyOptions) (proxyproto.Policy, error) {
+		return proxyproto.SKIP, nil
+	}
+}
+
+// upstreamTrusted returns whether or not upstream is in one of the trusted
+// networks.
+func upstreamTrusted(upstream net.Addr, trusted []*net.IPNet) bool {
+	if upstream == nil {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(upstream.String())
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
 }
 
 // GetRandomPortInRange returns a random port in the provided range.
 // The port range is a comma separated list of ranges or ports.
 func GetRandomPortInRange(listenAddr string, portRange string) uint32 {
+	bindPort := randomPortInRange(portRange)
+
+	ln, err := Listen(GenerateAddress(listenAddr, bindPort))
+	if err != nil {
+		return GetRandomPortInRange(listenAddr, portRange)
+	}
+
+	err = ln.Close()
+	if err != nil {
+		log.Println("Error closing listener:", err)
+	}
+
+	return bindPort
+}
+
+// randomPortInRange returns a random port from portRange. It returns 0 if the
+// range can't be parsed.
+func randomPortInRange(portRange string) uint32 {
 	var bindPort uint32
 
 	ranges := strings.Split(strings.TrimSpace(portRange), ",")
@@ -171,16 +248,6 @@ func GetRandomPortInRange(listenAddr string, portRange string) uint32 {
 		bindPort = uint32(mathrand.Intn(int(possible[locHolder][1]-possible[locHolder][0])) + int(possible[locHolder][0]))
 	}
 
-	ln, err := Listen(GenerateAddress(listenAddr, bindPort))
-	if err != nil {
-		return GetRandomPortInRange(listenAddr, portRange)
-	}
-
-	err = ln.Close()
-	if err != nil {
-		log.Println("Error closing listener:", err)
-	}
-
 	return bindPort
 }
 
@@ -228,6 +295,191 @@ func CheckPort(port uint32, portRanges string) (uint32, error) {
 	return 0, fmt.Errorf("not a safe port")
 }
 
+// ParseTLSMinVersion parses a minimum TLS version. Versions older than
+// TLS 1.2 are rejected.
+func ParseTLSMinVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	case "1.0", "1.1":
+		return 0, fmt.Errorf("tls version %s is insecure, use 1.2 or 1.3", version)
+	}
+
+	return 0, fmt.Errorf("unsupported tls version: %s", version)
+}
+
+// ParseTLSCipherSuites parses a comma separated list of TLS 1.2 cipher suite
+// names. Insecure cipher suites are rejected. TLS 1.3 cipher suites are not
+// configurable.
+func ParseTLSCipherSuites(cipherSuites string) ([]uint16, error) {
+	names := strings.FieldsFunc(cipherSuites, CommaSplitFields)
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	available := map[string]*tls.CipherSuite{}
+	for _, suite := range tls.CipherSuites() {
+		available[suite.Name] = suite
+	}
+
+	for _, suite := range tls.InsecureCipherSuites() {
+		available[suite.Name] = suite
+	}
+
+	suites := []uint16{}
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+
+		suite, ok := available[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls cipher suite: %s", name)
+		}
+
+		if suite.Insecure {
+			return nil, fmt.Errorf("tls cipher suite %s is insecure", name)
+		}
+
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return nil, fmt.Errorf("tls cipher suite %s can't be configured, only TLS 1.2 cipher suites can be set", name)
+		}
+
+		suites = append(suites, suite.ID)
+	}
+
+	return suites, nil
+}
+
+// ConfigureTLSBaseline applies tls-min-version and tls-cipher-suites to a
+// TLS config used to terminate TLS connections.
+func ConfigureTLSBaseline(tlsConfig *tls.Config) error {
+	minVersion, err := ParseTLSMinVersion(viper.GetString("tls-min-version"))
+	if err != nil {
+		return err
+	}
+
+	cipherSuites, err := ParseTLSCipherSuites(viper.GetString("tls-cipher-suites"))
+	if err != nil {
+		return err
+	}
+
+	tlsConfig.MinVersion = minVersion
+	tlsConfig.CipherSuites = cipherSuites
+
+	return nil
+}
+
+// ConfigureClientAuth requires and verifies client certificates against the CA
+// bundle in tls-client-ca, if it is set.
+func ConfigureClientAuth(tlsConfig *tls.Config) error {
+	caFile := viper.GetString("tls-client-ca")
+	if caFile == "" {
+		return nil
+	}
+
+	clientCAs, err := loadCertPool(caFile)
+	if err != nil {
+		return err
+	}
+
+	tlsConfig.ClientCAs = clientCAs
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return nil
+}
+
+// RootDomainTLSConfig returns the config used for TLS handshakes with the root
+// domain when admin console requests are verified. It keeps the client auth
+// settings of tlsConfig, but asks for a client certificate if tlsConfig
+// doesn't already.
+func RootDomainTLSConfig(tlsConfig *tls.Config) *tls.Config {
+	rootTLSConfig := tlsConfig.Clone()
+	rootTLSConfig.GetConfigForClient = nil
+
+	if rootTLSConfig.ClientAuth == tls.NoClientCert {
+		rootTLSConfig.ClientAuth = tls.RequestClientCert
+	}
+
+	return rootTLSConfig
+}
+
+// loadCertPool reads a PEM bundle of certificate authorities.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caData, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caData) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+
+	return pool, nil
+}
+
+// ClientCertVerifier verifies the client certificates of requests to
+// operational endpoints like the admin console and metrics. A nil
+// ClientCertVerifier accepts every request.
+type ClientCertVerifier struct {
+	Roots *x509.CertPool
+}
+
+// NewClientCertVerifier returns a ClientCertVerifier for the CA bundle in
+// caFile. It returns nil if caFile is empty.
+func NewClientCertVerifier(caFile string) (*ClientCertVerifier, error) {
+	if caFile == "" {
+		return nil, nil
+	}
+
+	roots, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ClientCertVerifier{Roots: roots}, nil
+}
+
+// Verified returns whether the connection presented a client certificate
+// signed by one of the verifier's certificate authorities.
+func (v *ClientCertVerifier) Verified(connState *tls.ConnectionState) bool {
+	if v == nil {
+		return true
+	}
+
+	if connState == nil || len(connState.PeerCertificates) == 0 {
+		return false
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range connState.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := connState.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         v.Roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	return err == nil
+}
+
+// Handler responds with 403 to requests without a verified client
+// certificate before they reach next.
+func (v *ClientCertVerifier) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !v.Verified(r.TLS) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func loadCerts(certManager *certmagic.Config) {
 	certFiles, err := filepath.Glob(filepath.Join(viper.GetString("https-certificate-directory"), "*.crt"))
 	if err != nil {
@@ -349,7 +601,7 @@ func WatchCerts(certManager *certmagic.Config) {
 
 // WatchKeys watches ssh keys for changes and will load them.
 func WatchKeys() {
-	loadKeys()
+	_, _, _ = loadKeys()
 
 	w := watcher.New()
 	w.SetMaxEvents(1)
@@ -376,7 +628,7 @@ func WatchKeys() {
 				if !ok {
 					return
 				}
-				loadKeys()
+				_, _, _ = ReloadKeys()
 			case _, ok := <-w.Error:
 				if !ok {
 					return
@@ -392,14 +644,30 @@ func WatchKeys() {
 	}()
 }
 
+// ReloadKeys loads public keys from the keys directory again and logs how many
+// keys were added and removed. Connections that are already authenticated keep
+// their permissions, new connections are authenticated with the new keys.
+func ReloadKeys() (int, int, error) {
+	added, removed, err := loadKeys()
+	if err != nil {
+		return added, removed, err
+	}
+
+	log.Printf("Reloaded authentication keys: %d added, %d removed\n", added, removed)
+
+	return added, removed, nil
+}
+
 // loadKeys loads public keys from the keys directory into a slice that is used
-// authenticating a user.
-func loadKeys() {
+// authenticating a user. It returns the number of keys that were added and
+// removed compared to the keys that were loaded before.
+func loadKeys() (int, int, error) {
 	tmpCertHolder := make([]ssh.PublicKey, 0)
+	tmpKeyPermissionsHolder := map[string]*KeyPermissions{}
 
 	parseKey := func(keyBytes []byte, d fs.DirEntry) {
 		keyHandle := func(keyBytes []byte, d fs.DirEntry) []byte {
-			key, _, _, rest, e := ssh.ParseAuthorizedKey(keyBytes)
+			key, _, options, rest, e := ssh.ParseAuthorizedKey(keyBytes)
 			if e != nil {
 				if e.Error() != "ssh: no key found" || (e.Error() == "ssh: no key found" && viper.GetBool("debug")) {
 					log.Printf("Can't load file %s:\"%s\" as public key: %s\n", d.Name(), string(keyBytes), e)
@@ -407,6 +675,16 @@ func loadKeys() {
 			}
 
 			if key != nil {
+				permissions, err := ParseKeyPermissions(options)
+				if err != nil {
+					log.Printf("Can't load permissions for public key in file %s: %s\n", d.Name(), err)
+					return rest
+				}
+
+				if permissions != nil {
+					tmpKeyPermissionsHolder[ssh.FingerprintSHA256(key)] = permissions
+				}
+
 				tmpCertHolder = append(tmpCertHolder, key)
 			}
 			return rest
@@ -442,12 +720,48 @@ func loadKeys() {
 
 	if err != nil {
 		log.Printf("Unable to walk authentication-keys-directory %s: %s\n", viper.GetString("authentication-keys-directory"), err)
-		return
+		return 0, 0, err
 	}
 
 	holderLock.Lock()
 	defer holderLock.Unlock()
+
+	added, removed := diffKeys(certHolder, tmpCertHolder)
+
 	certHolder = tmpCertHolder
+	keyPermissionsHolder = tmpKeyPermissionsHolder
+
+	return added, removed, nil
+}
+
+// diffKeys returns the number of keys in newKeys that aren't in oldKeys, and
+// the number of keys in oldKeys that aren't in newKeys.
+func diffKeys(oldKeys []ssh.PublicKey, newKeys []ssh.PublicKey) (int, int) {
+	oldSet := map[string]struct{}{}
+	for _, key := range oldKeys {
+		oldSet[string(key.Marshal())] = struct{}{}
+	}
+
+	newSet := map[string]struct{}{}
+	for _, key := range newKeys {
+		newSet[string(key.Marshal())] = struct{}{}
+	}
+
+	added := 0
+	for key := range newSet {
+		if _, ok := oldSet[key]; !ok {
+			added++
+		}
+	}
+
+	removed := 0
+	for key := range oldSet {
+		if _, ok := newSet[key]; !ok {
+			removed++
+		}
+	}
+
+	return added, removed
 }
 
 // GetSSHConfig Returns an SSH config for the ssh muxer.
@@ -457,7 +771,7 @@ func GetSSHConfig() *ssh.ServerConfig {
 		ServerVersion: "SSH-2.0-sish",
 		NoClientAuth:  !viper.GetBool("authentication"),
 		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
-			log.Printf("Login attempt: %s, user %s", c.RemoteAddr(), c.User())
+			log.Printf("Login attempt: %s, user %s", LogAddr(c.RemoteAddr()), c.User())
 
 			if string(password) == viper.GetString("authentication-password") && viper.GetString("authentication-password") != "" {
 				return nil, nil
@@ -481,7 +795,7 @@ func GetSSHConfig() *ssh.ServerConfig {
 			authKey := ssh.MarshalAuthorizedKey(key)
 			authKey = authKey[:len(authKey)-1]
 
-			log.Printf("Login attempt: %s, user %s key: %s", c.RemoteAddr(), c.User(), string(authKey))
+			log.Printf("Login attempt: %s, user %s key: %s", LogAddr(c.RemoteAddr()), c.User(), string(authKey))
 
 			holderLock.Lock()
 			defer holderLock.Unlock()
@@ -494,6 +808,8 @@ func GetSSHConfig() *ssh.ServerConfig {
 						},
 					}
 
+					addPermissionsExtension(permssionsData, keyPermissionsHolder[ssh.FingerprintSHA256(key)])
+
 					return permssionsData, nil
 				}
 			}
@@ -701,6 +1017,8 @@ func verifyDNS(addr string, sshConn *SSHConnection) (bool, string, error) {
 // bind the port to and attempts to listen to the port to ensure it is open.
 // If load balancing is enabled, it will return the port if used.
 func GetOpenPort(addr string, port uint32, state *State, sshConn *SSHConnection, sniProxyEnabled bool) (string, uint32, *TCPHolder) {
+	portBindRange := sshConn.PortBindRange()
+
 	getUnusedPort := func() (string, uint32, *TCPHolder) {
 		var tH *TCPHolder
 		var bindErr error
@@ -718,6 +1036,34 @@ func GetOpenPort(addr string, port uint32, state *State, sshConn *SSHConnection,
 			bindAddr = viper.GetString("tcp-address")
 		}
 
+		for _, reservedPort := range state.reservedForwards(sshConn, ReservedTCP, fmt.Sprintf("%s:%d", addr, port)) {
+			parsedPort, err := strconv.ParseUint(reservedPort, 10, 32)
+			if err != nil {
+				continue
+			}
+
+			reservedAddr := GenerateAddress(bindAddr, uint32(parsedPort))
+			if _, ok := state.TCPListeners.Load(reservedAddr); ok {
+				continue
+			}
+
+			if _, err := CheckPort(uint32(parsedPort), portBindRange); err != nil {
+				continue
+			}
+
+			ln, err := Listen(reservedAddr)
+			if err != nil {
+				continue
+			}
+
+			err = ln.Close()
+			if err != nil {
+				log.Println("Error closing listener:", err)
+			}
+
+			return reservedAddr, uint32(parsedPort), nil
+		}
+
 		reportUnavailable := func(unavailable bool) {
 			if first && unavailable {
 				extra := " Assigning a random port."
@@ -737,10 +1083,10 @@ func GetOpenPort(addr string, port uint32, state *State, sshConn *SSHConnection,
 			}
 
 			listenAddr = GenerateAddress(bindAddr, bindPort)
-			checkedPort, err := CheckPort(checkerPort, viper.GetString("port-bind-range"))
+			checkedPort, err := CheckPort(checkerPort, portBindRange)
 			_, ok := state.TCPListeners.Load(listenAddr)
 
-			if err == nil && !ok && (viper.GetBool("tcp-load-balancer") || viper.GetBool("sni-load-balancer")) {
+			if err == nil && !ok && (viper.GetBool("tcp-load-balancer") || viper.GetBool("sni-load-balancer")) && !state.MultiProtocol.ServesPort(bindPort) {
 				ln, listenErr := Listen(listenAddr)
 				if listenErr != nil {
 					err = listenErr
@@ -755,8 +1101,8 @@ func GetOpenPort(addr string, port uint32, state *State, sshConn *SSHConnection,
 			if viper.GetBool("bind-random-ports") || !first || err != nil {
 				reportUnavailable(true)
 
-				if viper.GetString("port-bind-range") != "" {
-					bindPort = GetRandomPortInRange(bindAddr, viper.GetString("port-bind-range"))
+				if portBindRange != "" {
+					bindPort = GetRandomPortInRange(bindAddr, portBindRange)
 				} else {
 					bindPort = 0
 				}
@@ -771,6 +1117,10 @@ func GetOpenPort(addr string, port uint32, state *State, sshConn *SSHConnection,
 				ok = false
 			}
 
+			if !ok && tH == nil && bindPort != 0 && state.reservedByOther(sshConn, ReservedTCP, strconv.FormatUint(uint64(bindPort), 10)) {
+				ok = true
+			}
+
 			reportUnavailable(ok)
 
 			first = false
@@ -854,7 +1204,7 @@ func GetOpenSNIHost(addr string, state *State, sshConn *SSHConnection, tH *TCPHo
 			ok := false
 
 			tH.Balancers.Range(func(strKey string, value *roundrobin.RoundRobin) bool {
-				if strKey == host {
+				if strKey == SNIRouteKey(host, sshConn.ALPN) {
 					ok = true
 					return false
 				}
@@ -881,149 +1231,38 @@ func GetOpenSNIHost(addr string, state *State, sshConn *SSHConnection, tH *TCPHo
 	return getUnusedHost()
 }
 
-// GetOpenHost returns an open host or a random host if that one is unavailable.
-// If load balancing is enabled, it will return the requested domain.
+// GetOpenHost returns the host chosen by the state's HostAllocator, or by
+// DefaultHostAllocator if it is not set, along with the holder to join if
+// load balancing is enabled and the host is in use. It returns a nil URL and
+// tells the client why if the host can't be used.
 func GetOpenHost(addr string, state *State, sshConn *SSHConnection) (*url.URL, *HTTPHolder) {
-	getUnusedHost := func() (*url.URL, *HTTPHolder) {
-		var pH *HTTPHolder
-
-		first := true
-		hostExtension := ""
-
-		if viper.GetBool("append-user-to-subdomain") {
-			hostExtension = viper.GetString("append-user-to-subdomain-separator") + sshConn.SSHConn.User()
-		}
-
-		var username string
-		var password string
-		var path string
-
-		var bindErr error
-
-		if strings.Contains(addr, "@") {
-			hostParts := strings.SplitN(addr, "@", 2)
-
-			addr = hostParts[1]
-
-			if viper.GetBool("bind-http-auth") && len(hostParts[0]) > 0 {
-				authParts := strings.Split(hostParts[0], ":")
-
-				if len(authParts) > 0 {
-					username = authParts[0]
-				}
-
-				if len(authParts) > 1 {
-					password = authParts[1]
-				}
-			}
-		}
-
-		if strings.Contains(addr, "/") {
-			pathParts := strings.SplitN(addr, "/", 2)
-
-			if viper.GetBool("bind-http-path") && len(pathParts[1]) > 0 {
-				path = fmt.Sprintf("/%s", pathParts[1])
-			}
-
-			addr = pathParts[0]
-		}
-
-		dnsMatch, _, err := verifyDNS(addr, sshConn)
-		if err != nil && viper.GetBool("debug") {
-			log.Println("Error looking up txt records for domain:", addr)
-		}
-
-		proposedHost := fmt.Sprintf("%s%s.%s", addr, hostExtension, viper.GetString("domain"))
-		domainParts := strings.Join(strings.Split(addr, ".")[1:], ".")
-
-		if dnsMatch || (viper.GetBool("bind-any-host") && strings.Contains(addr, ".")) || inList(domainParts, strings.FieldsFunc(viper.GetString("bind-hosts"), CommaSplitFields)) {
-			proposedHost = addr
-
-			if proposedHost == fmt.Sprintf(".%s", viper.GetString("domain")) {
-				proposedHost = viper.GetString("domain")
-			}
-		}
-
-		if viper.GetBool("bind-root-domain") && proposedHost == fmt.Sprintf(".%s", viper.GetString("domain")) {
-			proposedHost = viper.GetString("domain")
-		}
-
-		host := strings.ToLower(proposedHost)
-
-		getRandomHost := func() string {
-			return strings.ToLower(RandStringBytesMaskImprSrc(viper.GetInt("bind-random-subdomains-length")) + "." + viper.GetString("domain"))
-		}
-
-		reportUnavailable := func(unavailable bool) {
-			if first && unavailable {
-				extra := " Assigning a random subdomain."
-				if viper.GetBool("force-requested-subdomains") {
-					extra = ""
-					bindErr = fmt.Errorf("unable to bind requested subdomain")
-				}
-
-				sshConn.SendMessage(aurora.Sprintf("The subdomain %s is unavailable.%s", aurora.Red(host), extra), true)
-			}
-		}
-
-		checkHost := func() bool {
-			if bindErr != nil {
-				return false
-			}
-
-			if viper.GetBool("bind-random-subdomains") || !first || inList(host, bannedSubdomainList) {
-				reportUnavailable(true)
-				host = getRandomHost()
-			}
-
-			if !viper.GetBool("bind-wildcards") && strings.HasPrefix(host, wildcardPrefix) {
-				reportUnavailable(true)
-				host = getRandomHost()
-			}
-
-			var holder *HTTPHolder
-			ok := false
-
-			state.HTTPListeners.Range(func(key string, locationListener *HTTPHolder) bool {
-				parsedPassword, _ := locationListener.HTTPUrl.User.Password()
-
-				if host == locationListener.HTTPUrl.Host && strings.HasPrefix(path, locationListener.HTTPUrl.Path) && username == locationListener.HTTPUrl.User.Username() && password == parsedPassword {
-					ok = true
-					holder = locationListener
-					return false
-				}
-
-				return true
-			})
-
-			if ok && viper.GetBool("http-load-balancer") {
-				pH = holder
-				ok = false
-			}
-
-			reportUnavailable(ok)
-
-			first = false
-			return ok
-		}
+	var allocator HostAllocator = &DefaultHostAllocator{State: state}
+	if state.HostAllocator != nil {
+		allocator = state.HostAllocator
+	}
 
-		for checkHost() {
-		}
+	host, err := allocator.AllocateHost(sshConn, addr)
+	if err != nil {
+		sshConn.SendMessage(aurora.Sprintf("Unable to assign a subdomain for %s: %s.", aurora.Red(addr), err), true)
+		return nil, nil
+	}
 
-		if bindErr != nil {
-			return nil, nil
-		}
+	host = strings.ToLower(host)
+	request := parseHostRequest(addr)
 
-		hostUrl := &url.URL{
-			User: url.UserPassword(username, password),
-			Host: host,
-			Path: path,
-		}
+	pH := state.httpHolderFor(host, request)
+	if (pH != nil && !viper.GetBool("http-load-balancer")) || (pH == nil && state.reservedByOther(sshConn, ReservedHTTP, host)) {
+		sshConn.SendMessage(aurora.Sprintf("Unable to assign a subdomain for %s: the subdomain %s is unavailable.", aurora.Red(addr), aurora.Red(host)), true)
+		return nil, nil
+	}
 
-		return hostUrl, pH
+	hostUrl := &url.URL{
+		User: url.UserPassword(request.Username, request.Password),
+		Host: host,
+		Path: request.Path,
 	}
 
-	return getUnusedHost()
+	return hostUrl, pH
 }
 
 // GetOpenAlias returns open aliases or a random one if it is not enabled.
@@ -1065,8 +1304,18 @@ func GetOpenAlias(addr string, port string, state *State, sshConn *SSHConnection
 
 			holder, ok := state.AliasListeners.Load(alias)
 			if ok && viper.GetBool("alias-load-balancer") {
-				aH = holder
-				ok = false
+				// Connections to a holder all use its TLS mode, so a forward
+				// can't join one that terminates TLS differently.
+				if holder.TLS == sshConn.TCPAliasTLS {
+					aH = holder
+					ok = false
+				} else if first {
+					sshConn.SendMessage(aurora.Sprintf("The alias %s is load balanced with tcp-alias-tls=%t.", aurora.Red(alias), holder.TLS), true)
+				}
+			}
+
+			if !ok && holder == nil && state.reservedByOther(sshConn, ReservedAlias, alias) {
+				ok = true
 			}
 
 			reportUnavailable(ok)
@@ -1075,7 +1324,17 @@ func GetOpenAlias(addr string, port string, state *State, sshConn *SSHConnection
 			return ok
 		}
 
-		for checkAlias() {
+		reclaimed := false
+
+		for _, reservedAlias := range state.reservedForwards(sshConn, ReservedAlias, alias) {
+			if _, ok := state.AliasListeners.Load(reservedAlias); !ok {
+				alias = reservedAlias
+				reclaimed = true
+				break
+			}
+		}
+
+		for !reclaimed && checkAlias() {
 		}
 
 		if bindErr != nil {
@@ -1116,6 +1375,15 @@ func RandStringBytesMaskImprSrc(n int) string {
 	return string(b)
 }
 
+// MatchesPathPrefix checks if the path provided is within the path prefix. A
+// prefix only matches whole path segments, so /api matches /api/users but not
+// /apiary. An empty prefix matches every path.
+func MatchesPathPrefix(path string, prefix string) bool {
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
 // MatchesWildcardHost checks if the hostname provided would match the potential wildcard.
 func MatchesWildcardHost(hostname string, potentialWildcard string) bool {
 	if !strings.Contains(potentialWildcard, wildcardPrefix) {
@@ -0,0 +1,278 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ssh"
+)
+
+// TestParseTLSMinVersion validates that only TLS 1.2 and newer are accepted.
+func TestParseTLSMinVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		err     bool
+	}{
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.0", 0, true},
+		{"1.1", 0, true},
+		{"", 0, true},
+	}
+
+	for _, test := range tests {
+		version, err := ParseTLSMinVersion(test.version)
+		if (err != nil) != test.err {
+			t.Errorf("Version %q returned error %v", test.version, err)
+		}
+
+		if version != test.want {
+			t.Errorf("Version %q parsed as %d when should have been %d", test.version, version, test.want)
+		}
+	}
+}
+
+// TestParseTLSCipherSuites validates that weak and TLS 1.3 cipher suites are rejected.
+func TestParseTLSCipherSuites(t *testing.T) {
+	suites, err := ParseTLSCipherSuites("")
+	if err != nil || suites != nil {
+		t.Errorf("Empty cipher suites returned %v, %v", suites, err)
+	}
+
+	suites, err = ParseTLSCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}
+	if !slices.Equal(suites, want) {
+		t.Errorf("Cipher suites %v when should have been %v", suites, want)
+	}
+
+	for _, name := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_AES_128_GCM_SHA256", "TLS_NOT_A_SUITE"} {
+		_, err = ParseTLSCipherSuites(name)
+		if err == nil {
+			t.Errorf("Cipher suite %s should have been rejected", name)
+		}
+	}
+}
+
+// testCertificate returns a certificate for name signed by parent, or a self
+// signed CA if parent is nil.
+func testCertificate(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+// TestClientCertVerifier validates that only requests with a client
+// certificate signed by the configured CA reach the handler.
+func TestClientCertVerifier(t *testing.T) {
+	ca, caKey := testCertificate(t, "ca", nil, nil)
+	otherCA, otherCAKey := testCertificate(t, "other ca", nil, nil)
+	client, _ := testCertificate(t, "client", ca, caKey)
+	otherClient, _ := testCertificate(t, "other client", otherCA, otherCAKey)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+
+	err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier, err := NewClientCertVerifier(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := verifier.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := map[string]struct {
+		tls  *tls.ConnectionState
+		want int
+	}{
+		"plain http":    {nil, http.StatusForbidden},
+		"no cert":       {&tls.ConnectionState{}, http.StatusForbidden},
+		"other ca cert": {&tls.ConnectionState{PeerCertificates: []*x509.Certificate{otherClient}}, http.StatusForbidden},
+		"valid cert":    {&tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}}, http.StatusOK},
+	}
+
+	for name, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.TLS = test.tls
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+
+		if recorder.Code != test.want {
+			t.Errorf("Request with %s returned %d when should have been %d", name, recorder.Code, test.want)
+		}
+	}
+
+	var disabled *ClientCertVerifier
+	if !disabled.Verified(nil) {
+		t.Error("A nil verifier should accept every request")
+	}
+
+	if verifier, err := NewClientCertVerifier(""); verifier != nil || err != nil {
+		t.Errorf("An empty CA file returned %v and %v", verifier, err)
+	}
+}
+
+// TestRootDomainTLSConfig validates that the root domain config asks for a
+// client certificate without loosening the configured client auth.
+func TestRootDomainTLSConfig(t *testing.T) {
+	clientCAs := x509.NewCertPool()
+
+	tests := map[string]struct {
+		config *tls.Config
+		want   tls.ClientAuthType
+	}{
+		"no client auth":       {&tls.Config{}, tls.RequestClientCert},
+		"required client auth": {&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}, tls.RequireAndVerifyClientCert},
+	}
+
+	for name, test := range tests {
+		test.config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) { return nil, nil }
+
+		rootTLSConfig := RootDomainTLSConfig(test.config)
+
+		if rootTLSConfig.ClientAuth != test.want {
+			t.Errorf("Root domain config with %s has client auth %s when should have been %s", name, rootTLSConfig.ClientAuth, test.want)
+		}
+
+		if rootTLSConfig.ClientCAs != test.config.ClientCAs {
+			t.Errorf("Root domain config with %s didn't keep the client CAs", name)
+		}
+
+		if rootTLSConfig.GetConfigForClient != nil {
+			t.Errorf("Root domain config with %s kept GetConfigForClient", name)
+		}
+	}
+}
+
+// authorizedKey returns a new public key in authorized_keys format.
+func authorizedKey(t *testing.T) []byte {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ssh.MarshalAuthorizedKey(key)
+}
+
+// TestReloadKeys validates that reloading the keys directory reports the keys
+// that were added and removed.
+func TestReloadKeys(t *testing.T) {
+	dir := t.TempDir()
+
+	defer viper.Set("authentication-keys-directory", "")
+	viper.Set("authentication-keys-directory", dir)
+
+	err := os.WriteFile(filepath.Join(dir, "first.pub"), authorizedKey(t), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "first.pub"), append(authorizedKey(t), authorizedKey(t)...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added, removed, err := ReloadKeys()
+	if err != nil || added != 2 || removed != 1 {
+		t.Errorf("Reload added %d and removed %d keys with error %v when should have added 2 and removed 1", added, removed, err)
+	}
+
+	added, removed, err = ReloadKeys()
+	if err != nil || added != 0 || removed != 0 {
+		t.Errorf("Reload of unchanged keys added %d and removed %d keys with error %v", added, removed, err)
+	}
+}
+
+// TestGetOpenAliasTLSMode validates that a load balanced alias is only joined
+// by forwards with the same TLS termination mode.
+func TestGetOpenAliasTLSMode(t *testing.T) {
+	viper.Set("alias-load-balancer", true)
+	viper.Set("bind-random-aliases", false)
+	viper.Set("force-requested-aliases", true)
+	defer viper.Set("alias-load-balancer", nil)
+	defer viper.Set("bind-random-aliases", nil)
+	defer viper.Set("force-requested-aliases", nil)
+
+	state := NewState()
+
+	holder := &AliasHolder{AliasHost: "db:5432", TLS: true}
+	state.AliasListeners.Store(holder.AliasHost, holder)
+
+	plain := reservationTestConn("alice")
+	plain.Messages = make(chan string, 2)
+
+	alias, aH := GetOpenAlias("db", "5432", state, plain)
+	if alias != "" || aH != nil {
+		t.Errorf("Alias %q should not have been joined without TLS termination", alias)
+	}
+
+	tlsConn := reservationTestConn("bob")
+	tlsConn.TCPAliasTLS = true
+
+	alias, aH = GetOpenAlias("db", "5432", state, tlsConn)
+	if alias != holder.AliasHost || aH != holder {
+		t.Errorf("Alias %q should have been joined with TLS termination", alias)
+	}
+}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// maxWebhookURLLength is the maximum length of a client webhook URL.
+const maxWebhookURLLength = 2048
+
+// errWebhookDestination is returned when a client webhook would connect to an
+// address it isn't allowed to reach.
+var errWebhookDestination = errors.New("webhook destination is not allowed")
+
+// webhookDeniedNetworks are networks client webhooks can't reach unless they
+// are in client-webhook-allowed-networks, in addition to loopback, private,
+// link local, multicast and unspecified addresses.
+var webhookDeniedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+// ClientWebhookEvent is the JSON body posted to a client webhook.
+type ClientWebhookEvent struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	LocalAddr  string    `json:"local_addr"`
+	BytesIn    uint64    `json:"bytes_in,omitempty"`
+	BytesOut   uint64    `json:"bytes_out,omitempty"`
+	DurationMS float64   `json:"duration_ms,omitempty"`
+}
+
+// ClientWebhook posts an event to a URL chosen by the client of a SSH
+// connection for each connection to its forwards. Opened events over
+// client-webhook-rate-limit per second are dropped.
+type ClientWebhook struct {
+	URL *url.URL
+
+	allowed []*net.IPNet
+	bucket  *TokenBucket
+	client  *http.Client
+}
+
+// NewClientWebhook validates rawURL and returns a ClientWebhook posting to it.
+// URLs must be http or https, and hosts that are IPs must be an allowed
+// destination. The addresses of other hosts are checked when connecting.
+func NewClientWebhook(rawURL string) (*ClientWebhook, error) {
+	if len(rawURL) > maxWebhookURLLength {
+		return nil, fmt.Errorf("webhook url is longer than %d characters", maxWebhookURLLength)
+	}
+
+	webhookURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	if (webhookURL.Scheme != "http" && webhookURL.Scheme != "https") || webhookURL.Hostname() == "" {
+		return nil, fmt.Errorf("webhook url must be an absolute http or https url")
+	}
+
+	var allowed []*net.IPNet
+	if allowlist := viper.GetString("client-webhook-allowed-networks"); allowlist != "" {
+		allowed, err = ParseIPNets(allowlist)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse client-webhook-allowed-networks: %w", err)
+		}
+	}
+
+	if addr, err := netip.ParseAddr(webhookURL.Hostname()); err == nil && !WebhookDestinationAllowed(addr, allowed) {
+		return nil, errWebhookDestination
+	}
+
+	dialer := &net.Dialer{
+		Timeout: viper.GetDuration("client-webhook-timeout"),
+		Control: func(network string, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !WebhookDestinationAllowed(addrPort.Addr(), allowed) {
+				return errWebhookDestination
+			}
+
+			return nil
+		},
+	}
+
+	webhook := &ClientWebhook{
+		URL:     webhookURL,
+		allowed: allowed,
+		client: &http.Client{
+			Timeout: viper.GetDuration("client-webhook-timeout"),
+			Transport: &http.Transport{
+				DialContext:       dialer.DialContext,
+				DisableKeepAlives: true,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+
+	if rate := viper.GetInt64("client-webhook-rate-limit"); rate > 0 {
+		webhook.bucket = NewTokenBucket(rate, rate)
+	}
+
+	return webhook, nil
+}
+
+// WebhookDestinationAllowed returns whether client webhooks can connect to
+// addr. Addresses in allowed, the parsed client-webhook-allowed-networks, are
+// always allowed. Otherwise, loopback, private, link local, multicast,
+// unspecified and other special purpose addresses are denied.
+func WebhookDestinationAllowed(addr netip.Addr, allowed []*net.IPNet) bool {
+	addr = addr.Unmap()
+
+	for _, ipNet := range allowed {
+		if ipNet.Contains(addr.AsSlice()) {
+			return true
+		}
+	}
+
+	if !addr.IsValid() || addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return false
+	}
+
+	for _, prefix := range webhookDeniedNetworks {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Send posts event to the webhook in the background and returns whether it
+// was sent. Events over the rate limit are dropped, except for closed events
+// so every opened event that was sent is followed by one. A nil webhook sends
+// nothing.
+func (w *ClientWebhook) Send(event ClientWebhookEvent) bool {
+	if w == nil {
+		return false
+	}
+
+	if w.bucket != nil && event.Event != "connection_closed" && !w.bucket.Allow(1) {
+		return false
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Println("Error marshaling webhook event:", err)
+		return false
+	}
+
+	go func() {
+		req, err := http.NewRequest(http.MethodPost, w.URL.String(), bytes.NewReader(body))
+		if err != nil {
+			log.Println("Error creating webhook request:", err)
+			return
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "sish")
+
+		res, err := w.client.Do(req)
+		if err != nil {
+			if viper.GetBool("debug") {
+				log.Println("Error sending webhook event:", err)
+			}
+			return
+		}
+
+		err = res.Body.Close()
+		if err != nil && viper.GetBool("debug") {
+			log.Println("Error closing webhook response:", err)
+		}
+	}()
+
+	return true
+}
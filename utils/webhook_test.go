@@ -0,0 +1,153 @@
+package utils
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TestNewClientWebhook validates that only absolute http and https URLs to
+// allowed destinations are accepted.
+func TestNewClientWebhook(t *testing.T) {
+	for rawURL, valid := range map[string]bool{
+		"https://hooks.example.com/sish":          true,
+		"http://93.184.216.34:8080/events":        true,
+		"ftp://hooks.example.com/sish":            false,
+		"hooks.example.com/sish":                  false,
+		"https:///sish":                           false,
+		"http://127.0.0.1/events":                 false,
+		"http://10.0.0.1/events":                  false,
+		"http://169.254.169.254/latest/meta-data": false,
+		"http://[::1]/events":                     false,
+		"http://[::ffff:192.168.1.1]/events":      false,
+		"https://hooks.example.com/" + strings.Repeat("a", maxWebhookURLLength): false,
+	} {
+		_, err := NewClientWebhook(rawURL)
+		if (err == nil) != valid {
+			t.Errorf("Webhook %q returned error %v when valid should have been %t", rawURL, err, valid)
+		}
+	}
+}
+
+// TestWebhookDestinationAllowed validates that private and special purpose
+// addresses are denied unless they are in the allowed networks.
+func TestWebhookDestinationAllowed(t *testing.T) {
+	for addr, allowed := range map[string]bool{
+		"93.184.216.34":   true,
+		"2606:4700::1111": true,
+		"127.0.0.1":       false,
+		"192.168.1.1":     false,
+		"100.64.0.1":      false,
+		"0.0.0.0":         false,
+		"224.0.0.1":       false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+	} {
+		if WebhookDestinationAllowed(netip.MustParseAddr(addr), nil) != allowed {
+			t.Errorf("Destination %s should have been allowed %t", addr, allowed)
+		}
+	}
+
+	allowed, err := ParseIPNets("192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !WebhookDestinationAllowed(netip.MustParseAddr("192.168.1.1"), allowed) || WebhookDestinationAllowed(netip.MustParseAddr("192.168.2.1"), allowed) {
+		t.Error("Only destinations in the allowed networks should have been allowed")
+	}
+
+	viper.Set("client-webhook-allowed-networks", "not a network")
+	defer viper.Set("client-webhook-allowed-networks", "")
+
+	if _, err := NewClientWebhook("https://example.com/hook"); err == nil {
+		t.Error("Webhook with an invalid client-webhook-allowed-networks should have returned an error")
+	}
+}
+
+// TestClientWebhookSend validates that events are posted as JSON and that
+// opened events over the rate limit are dropped, while closed events aren't.
+func TestClientWebhookSend(t *testing.T) {
+	defer viper.Set("client-webhook-allowed-networks", "")
+	defer viper.Set("client-webhook-rate-limit", 0)
+	defer viper.Set("client-webhook-timeout", 0)
+
+	viper.Set("client-webhook-allowed-networks", "127.0.0.1")
+	viper.Set("client-webhook-rate-limit", 1)
+	viper.Set("client-webhook-timeout", time.Second)
+
+	events := make(chan ClientWebhookEvent, 3)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event ClientWebhookEvent
+
+		err := json.NewDecoder(r.Body).Decode(&event)
+		if err != nil || r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Received %s request with error %v when should have been a JSON post", r.Method, err)
+		}
+
+		events <- event
+	}))
+	defer server.Close()
+
+	webhook, err := NewClientWebhook(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !webhook.Send(ClientWebhookEvent{Event: "connection_opened", RemoteAddr: "203.0.113.7:51234"}) {
+		t.Fatal("Opened event should have been sent")
+	}
+
+	select {
+	case event := <-events:
+		if event.Event != "connection_opened" || event.RemoteAddr != "203.0.113.7:51234" {
+			t.Errorf("Received %+v when should have been the opened event", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Webhook should have received the opened event")
+	}
+
+	if webhook.Send(ClientWebhookEvent{Event: "connection_opened", RemoteAddr: "203.0.113.8:51234"}) {
+		t.Error("Opened event over the rate limit should have been dropped")
+	}
+
+	if !webhook.Send(ClientWebhookEvent{Event: "connection_closed", RemoteAddr: "203.0.113.7:51234"}) {
+		t.Error("Closed event should not have been rate limited")
+	}
+
+	select {
+	case event := <-events:
+		if event.Event != "connection_closed" {
+			t.Errorf("Received %+v when should have been the closed event", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Webhook should have received the closed event")
+	}
+
+	select {
+	case event := <-events:
+		t.Errorf("Received %+v when it should have been rate limited", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var nilWebhook *ClientWebhook
+	if nilWebhook.Send(ClientWebhookEvent{Event: "connection_opened"}) {
+		t.Error("A nil webhook should not send events")
+	}
+}
+
+// TestTokenBucketAllow validates that Allow takes tokens without waiting.
+func TestTokenBucketAllow(t *testing.T) {
+	bucket := NewTokenBucket(1, 2)
+
+	if !bucket.Allow(1) || !bucket.Allow(1) || bucket.Allow(1) {
+		t.Error("Bucket should have allowed its burst and nothing more")
+	}
+}
@@ -0,0 +1,261 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// wsSwitchingProtocols is the status line prefix of a WebSocket upgrade response.
+var wsSwitchingProtocols = []byte("HTTP/1.1 101")
+
+// wsMaxResponseHead is the most bytes of a response head that are buffered
+// while looking for the end of a WebSocket upgrade response.
+const wsMaxResponseHead = 16 << 10
+
+// wsVersion is the only WebSocket protocol version defined by RFC 6455.
+const wsVersion = "13"
+
+// headerHasToken returns whether the comma separated values of header name
+// contain token, ignoring case.
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// ValidateWebSocketUpgrade returns an error if r asks for a WebSocket upgrade
+// but does not follow the handshake of RFC 6455. Requests that ask for
+// another protocol with the Upgrade header, or no upgrade at all, are valid.
+func ValidateWebSocketUpgrade(r *http.Request) error {
+	connectionUpgrade := headerHasToken(r.Header, "Connection", "upgrade")
+
+	if !headerHasToken(r.Header, "Upgrade", "websocket") {
+		if connectionUpgrade && r.Header.Get("Upgrade") == "" {
+			return fmt.Errorf("connection header asks for an upgrade without an upgrade header")
+		}
+
+		return nil
+	}
+
+	if r.Method != http.MethodGet {
+		return fmt.Errorf("websocket upgrade must use GET, not %s", r.Method)
+	}
+
+	if !connectionUpgrade {
+		return fmt.Errorf("websocket upgrade without an upgrade connection header")
+	}
+
+	if version := r.Header.Get("Sec-WebSocket-Version"); version != wsVersion {
+		return fmt.Errorf("unsupported websocket version %q", version)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(r.Header.Get("Sec-WebSocket-Key"))
+	if err != nil || len(key) != 16 {
+		return fmt.Errorf("websocket key must be 16 base64 encoded bytes")
+	}
+
+	return nil
+}
+
+// wsFrameTracker parses just enough of the WebSocket framing to know when a
+// frame has been completely received.
+type wsFrameTracker struct {
+	header    []byte
+	remaining uint64
+	opcode    byte
+}
+
+// headerLength returns the length of the frame header being parsed, or 0 if
+// not enough bytes have been read to know it.
+func (w *wsFrameTracker) headerLength() int {
+	if len(w.header) < 2 {
+		return 0
+	}
+
+	length := 2
+
+	switch w.header[1] & 0x7f {
+	case 126:
+		length += 2
+	case 127:
+		length += 8
+	}
+
+	if w.header[1]&0x80 != 0 {
+		length += 4
+	}
+
+	return length
+}
+
+// payloadLength returns the payload length from a complete frame header.
+func (w *wsFrameTracker) payloadLength() uint64 {
+	switch length := w.header[1] & 0x7f; length {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(w.header[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(w.header[2:10])
+	default:
+		return uint64(length)
+	}
+}
+
+// feed consumes stream bytes and calls onFrame with the opcode of each frame
+// that is completed.
+func (w *wsFrameTracker) feed(p []byte, onFrame func(opcode byte)) {
+	for len(p) > 0 {
+		if w.remaining > 0 {
+			n := uint64(len(p))
+			if n > w.remaining {
+				n = w.remaining
+			}
+
+			p = p[n:]
+			w.remaining -= n
+
+			if w.remaining == 0 {
+				onFrame(w.opcode)
+			}
+
+			continue
+		}
+
+		w.header = append(w.header, p[0])
+		p = p[1:]
+
+		if headerLength := w.headerLength(); headerLength == 0 || len(w.header) < headerLength {
+			continue
+		}
+
+		w.opcode = w.header[0] & 0x0f
+		w.remaining = w.payloadLength()
+		w.header = w.header[:0]
+
+		if w.remaining == 0 {
+			onFrame(w.opcode)
+		}
+	}
+}
+
+// WebSocketIdleTimeoutConn is an IdleTimeoutConn that understands WebSocket
+// framing once a connection has been upgraded. Every completed frame,
+// including ping and pong control frames, resets both the read and write
+// deadlines so a tunnel that is only kept alive by pings is not closed.
+type WebSocketIdleTimeoutConn struct {
+	net.Conn
+	idle        IdleTimeoutConn
+	upgraded    atomic.Bool
+	readFrames  wsFrameTracker
+	writeFrames wsFrameTracker
+
+	// head holds the start of an upgrade response written so far, which can
+	// be split across writes.
+	head []byte
+}
+
+// NewWebSocketIdleTimeoutConn returns a new WebSocketIdleTimeoutConn wrapping
+// conn for a forward of sshConn. The connection's idle timeout overrides the
+// read and write idle timeouts if it is set. Frames don't extend the deadlines
+// past max-connection-duration-hard.
+func NewWebSocketIdleTimeoutConn(conn net.Conn, sshConn *SSHConnection) *WebSocketIdleTimeoutConn {
+	idle := IdleTimeoutConn{
+		Conn:     conn,
+		Deadline: HardDeadline(),
+		SSHConn:  sshConn,
+	}
+
+	if sshConn != nil {
+		idle.Timeout = sshConn.IdleTimeout
+	}
+
+	return &WebSocketIdleTimeoutConn{
+		Conn: conn,
+		idle: idle,
+	}
+}
+
+// resetDeadlines extends both deadlines when a WebSocket frame is completed.
+func (w *WebSocketIdleTimeoutConn) resetDeadlines(_ byte) {
+	readTimeout, writeTimeout := w.idle.timeouts()
+
+	_ = w.idle.setDeadline(w.Conn.SetReadDeadline, readTimeout)
+	_ = w.idle.setDeadline(w.Conn.SetWriteDeadline, writeTimeout)
+}
+
+// Read reads from the connection and tracks completed WebSocket frames.
+func (w *WebSocketIdleTimeoutConn) Read(buf []byte) (int, error) {
+	n, err := w.idle.Read(buf)
+	if n > 0 && w.upgraded.Load() {
+		w.readFrames.feed(buf[:n], w.resetDeadlines)
+	}
+
+	return n, err
+}
+
+// Write writes to the connection, detects the WebSocket upgrade response, and
+// tracks completed WebSocket frames.
+func (w *WebSocketIdleTimeoutConn) Write(buf []byte) (int, error) {
+	upgraded := w.upgraded.Load()
+
+	n, err := w.idle.Write(buf)
+	if n <= 0 {
+		return n, err
+	}
+
+	if upgraded {
+		w.writeFrames.feed(buf[:n], w.resetDeadlines)
+		return n, err
+	}
+
+	w.detectUpgrade(buf[:n])
+
+	return n, err
+}
+
+// detectUpgrade buffers written bytes that start an upgrade response until
+// its head is complete, then marks the connection as upgraded and tracks the
+// frames written after it. Writes that can't be part of an upgrade response
+// are not buffered.
+func (w *WebSocketIdleTimeoutConn) detectUpgrade(p []byte) {
+	if len(w.head) == 0 {
+		n := min(len(p), len(wsSwitchingProtocols))
+		if !bytes.Equal(p[:n], wsSwitchingProtocols[:n]) {
+			return
+		}
+	}
+
+	w.head = append(w.head, p...)
+
+	n := min(len(w.head), len(wsSwitchingProtocols))
+	if !bytes.Equal(w.head[:n], wsSwitchingProtocols[:n]) {
+		w.head = nil
+		return
+	}
+
+	end := bytes.Index(w.head, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(w.head) > wsMaxResponseHead {
+			w.head = nil
+		}
+
+		return
+	}
+
+	head := w.head
+	w.head = nil
+
+	w.upgraded.Store(true)
+	w.writeFrames.feed(head[end+4:], w.resetDeadlines)
+}
@@ -0,0 +1,123 @@
+package utils
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// TestWSFrameTracker validates that frames are detected across arbitrary
+// read boundaries, including masked and extended length frames.
+func TestWSFrameTracker(t *testing.T) {
+	stream := [][]byte{
+		{0x89, 0x00},
+		{0x8a, 0x82, 0x01, 0x02, 0x03, 0x04, 0xaa, 0xbb},
+		append([]byte{0x82, 0x7e, 0x01, 0x00}, bytes.Repeat([]byte{0xff}, 256)...),
+		{0x81, 0x03, 'a', 'b', 'c'},
+	}
+
+	expected := []byte{0x9, 0xa, 0x2, 0x1}
+
+	data := bytes.Join(stream, nil)
+
+	for _, chunkSize := range []int{1, 3, 7, len(data)} {
+		tracker := &wsFrameTracker{}
+		opcodes := []byte{}
+
+		for i := 0; i < len(data); i += chunkSize {
+			end := i + chunkSize
+			if end > len(data) {
+				end = len(data)
+			}
+
+			tracker.feed(data[i:end], func(opcode byte) {
+				opcodes = append(opcodes, opcode)
+			})
+		}
+
+		if !bytes.Equal(opcodes, expected) {
+			t.Errorf("Got opcodes %v when should have been %v with chunk size %d", opcodes, expected, chunkSize)
+		}
+	}
+}
+
+// TestValidateWebSocketUpgrade validates that malformed WebSocket handshakes
+// are rejected and that other requests are left alone.
+func TestValidateWebSocketUpgrade(t *testing.T) {
+	valid := http.Header{
+		"Connection":            {"keep-alive, Upgrade"},
+		"Upgrade":               {"websocket"},
+		"Sec-Websocket-Version": {"13"},
+		"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		modify func(http.Header)
+		valid  bool
+	}{
+		{"valid", http.MethodGet, func(h http.Header) {}, true},
+		{"no upgrade", http.MethodPost, func(h http.Header) { h.Del("Upgrade"); h.Del("Connection") }, true},
+		{"other protocol", http.MethodGet, func(h http.Header) { h.Set("Upgrade", "h2c") }, true},
+		{"missing upgrade header", http.MethodGet, func(h http.Header) { h.Del("Upgrade") }, false},
+		{"wrong method", http.MethodPost, func(h http.Header) {}, false},
+		{"missing connection header", http.MethodGet, func(h http.Header) { h.Set("Connection", "keep-alive") }, false},
+		{"wrong version", http.MethodGet, func(h http.Header) { h.Set("Sec-WebSocket-Version", "8") }, false},
+		{"missing key", http.MethodGet, func(h http.Header) { h.Del("Sec-WebSocket-Key") }, false},
+		{"short key", http.MethodGet, func(h http.Header) { h.Set("Sec-WebSocket-Key", "c2hvcnQ=") }, false},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/", nil)
+		req.Header = valid.Clone()
+		test.modify(req.Header)
+
+		err := ValidateWebSocketUpgrade(req)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: got error %v when should have been valid: %t", test.name, err, test.valid)
+		}
+	}
+}
+
+// TestWebSocketIdleTimeoutConnUpgrade validates that an upgrade response is
+// detected when its status line and headers are split across writes, and
+// that frames written with the end of its head are tracked.
+func TestWebSocketIdleTimeoutConnUpgrade(t *testing.T) {
+	viper.Set("idle-connection-timeout", time.Second)
+	defer viper.Set("idle-connection-timeout", nil)
+
+	for name, writes := range map[string][]string{
+		"split status": {"HTTP/1.", "1 101 Switching Protocols\r\nUpgrade: websocket\r\n", "\r\n\x89\x00"},
+		"one write":    {"HTTP/1.1 101 Switching Protocols\r\n\r\n\x89\x00"},
+		"not upgraded": {"HTTP/1.1 200 OK\r\n\r\n", "HTTP/1.1 101"},
+	} {
+		server, client := net.Pipe()
+		go func() { _, _ = io.Copy(io.Discard, client) }()
+
+		conn := NewWebSocketIdleTimeoutConn(server, nil)
+
+		for _, write := range writes {
+			_, err := conn.Write([]byte(write))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if upgraded := conn.upgraded.Load(); upgraded != (name != "not upgraded") {
+			t.Errorf("Upgraded was %t for %s", upgraded, name)
+		}
+
+		if name != "not upgraded" && len(conn.writeFrames.header) != 0 {
+			t.Errorf("The ping written with the %s upgrade should have been tracked", name)
+		}
+
+		_ = server.Close()
+	}
+}